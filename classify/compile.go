@@ -0,0 +1,362 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package classify
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strings"
+
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// ipv4ChecksumOffset is where the header checksum is, updated when the TOS byte is rewritten
+	ipv4ChecksumOffset = 10
+	// ipv4SourceOffset and the others are where addresses are in each header
+	ipv4SourceOffset      = 12
+	ipv4DestinationOffset = 16
+	ipv6SourceOffset      = 8
+	ipv6DestinationOffset = 24
+	// destinationPortOffset is where the destination port is in TCP and UDP headers
+	destinationPortOffset = 2
+)
+
+// families is every family a rule compiles for, with zero meaning either.
+var families = []byte{unix.NFPROTO_IPV4, unix.NFPROTO_IPV6} //nolint:gochecknoglobals
+
+// Compile returns the expressions of each nftables rule the rule expands to. A rule matching
+// any of several values becomes a rule per combination of values.
+func (r Rule) Compile() ([][]expr.Any, error) {
+	compiled := [][]expr.Any{}
+
+	common := append(append(append(
+		interfaceMatch(expr.MetaKeyIIFNAME, r.Match.InputInterface),
+		interfaceMatch(expr.MetaKeyOIFNAME, r.Match.OutputInterface)...),
+		markMatch(r.Match.Mark)...),
+		connStateMatch(r.Match.ConnStates)...)
+
+	for _, family := range r.families() {
+		sources := prefixesOf(family, r.Match.Sources)
+		destinations := prefixesOf(family, r.Match.Destinations)
+
+		if (len(r.Match.Sources) > 0 && len(sources) == 0) ||
+			(len(r.Match.Destinations) > 0 && len(destinations) == 0) {
+			continue
+		}
+
+		alternatives := [][]expr.Any{append(familyMatch(family), common...)}
+		alternatives = product(alternatives, addressMatches(family, sources, true))
+		alternatives = product(alternatives, addressMatches(family, destinations, false))
+		alternatives = product(alternatives, r.transportMatches())
+
+		action, err := r.action(family)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, alternative := range alternatives {
+			compiled = append(compiled, append(alternative, action...))
+		}
+	}
+
+	if len(compiled) == 0 {
+		return nil, fmt.Errorf("%w: rule %s can't match any packet", ErrInvalidRule, r.Name)
+	}
+
+	return compiled, nil
+}
+
+// families returns the IP versions the rule needs separate rules for. Setting DSCP and
+// matching addresses both depend on the header layout.
+func (r Rule) families() []byte {
+	if r.Action.DSCP == nil && len(r.Match.Sources) == 0 && len(r.Match.Destinations) == 0 {
+		return []byte{0}
+	}
+
+	return families
+}
+
+// Hash returns a digest of a compiled rule, for tagging it so a changed rule is replaced.
+func Hash(compiled [][]expr.Any) string {
+	digest := fnv.New32a()
+
+	for _, exprs := range compiled {
+		for _, e := range exprs {
+			fmt.Fprintf(digest, "%T%+v;", e, e)
+		}
+
+		fmt.Fprintln(digest)
+	}
+
+	return fmt.Sprintf("%08x", digest.Sum32())
+}
+
+// product returns every alternative of a followed by every alternative of b. An empty b
+// leaves a alone.
+func product(a [][]expr.Any, b [][]expr.Any) [][]expr.Any {
+	if len(b) == 0 {
+		return a
+	}
+
+	combined := make([][]expr.Any, 0, len(a)*len(b))
+
+	for _, first := range a {
+		for _, second := range b {
+			combined = append(combined, append(append([]expr.Any{}, first...), second...))
+		}
+	}
+
+	return combined
+}
+
+// familyMatch matches packets of an IP version, or every packet for zero.
+func familyMatch(family byte) []expr.Any {
+	if family == 0 {
+		return nil
+	}
+
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, SourceRegister: false, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family}},
+	}
+}
+
+// interfaceMatch matches a device name, comparing only the prefix of a name ending in *.
+func interfaceMatch(key expr.MetaKey, name string) []expr.Any {
+	if name == "" {
+		return nil
+	}
+
+	data := append([]byte(name), 0)
+	if prefix := strings.TrimSuffix(name, "*"); prefix != name {
+		data = []byte(prefix)
+	}
+
+	return []expr.Any{
+		&expr.Meta{Key: key, SourceRegister: false, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: data},
+	}
+}
+
+// markMatch matches the masked bits of the firewall mark.
+func markMatch(mark *Mark) []expr.Any {
+	if mark == nil {
+		return nil
+	}
+
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: false, Register: 1},
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            4, //nolint:gomnd
+			Mask:           binaryutil.NativeEndian.PutUint32(mark.Mask),
+			Xor:            binaryutil.NativeEndian.PutUint32(0),
+		},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(mark.Value)},
+	}
+}
+
+// connStateMatch matches connections in any of the given conntrack states.
+func connStateMatch(states uint32) []expr.Any {
+	if states == 0 {
+		return nil
+	}
+
+	return []expr.Any{
+		&expr.Ct{Register: 1, SourceRegister: false, Key: expr.CtKeySTATE},
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            4, //nolint:gomnd
+			Mask:           binaryutil.NativeEndian.PutUint32(states),
+			Xor:            binaryutil.NativeEndian.PutUint32(0),
+		},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0)},
+	}
+}
+
+// prefixesOf returns the prefixes belonging to an IP version.
+func prefixesOf(family byte, prefixes []*net.IPNet) []*net.IPNet {
+	matching := []*net.IPNet{}
+
+	for _, prefix := range prefixes {
+		if (prefix.IP.To4() != nil) == (family == unix.NFPROTO_IPV4) {
+			matching = append(matching, prefix)
+		}
+	}
+
+	return matching
+}
+
+// addressMatches returns a match for each prefix against the source or destination address.
+func addressMatches(family byte, prefixes []*net.IPNet, source bool) [][]expr.Any {
+	offset, length := uint32(ipv6DestinationOffset), uint32(net.IPv6len)
+
+	switch {
+	case family == unix.NFPROTO_IPV4 && source:
+		offset, length = ipv4SourceOffset, net.IPv4len
+	case family == unix.NFPROTO_IPV4:
+		offset, length = ipv4DestinationOffset, net.IPv4len
+	case source:
+		offset = ipv6SourceOffset
+	}
+
+	matches := [][]expr.Any{}
+
+	for _, prefix := range prefixes {
+		ip := prefix.IP.To16()
+		if length == net.IPv4len {
+			ip = prefix.IP.To4()
+		}
+
+		exprs := []expr.Any{&expr.Payload{ //nolint:exhaustruct
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       offset,
+			Len:          length,
+		}}
+
+		if ones, bits := prefix.Mask.Size(); ones != bits {
+			exprs = append(exprs, &expr.Bitwise{
+				SourceRegister: 1,
+				DestRegister:   1,
+				Len:            length,
+				Mask:           []byte(prefix.Mask),
+				Xor:            make([]byte, length),
+			})
+		}
+
+		matches = append(matches, append(exprs,
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte(ip.Mask(prefix.Mask))}))
+	}
+
+	return matches
+}
+
+// transportMatches returns a match for each combination of protocol and ports.
+func (r Rule) transportMatches() [][]expr.Any {
+	protocols := r.Match.Protocols
+	hasPorts := len(r.Match.Ports)+len(r.Match.SourcePorts)+len(r.Match.DestinationPorts) > 0
+
+	if len(protocols) == 0 && hasPorts {
+		protocols = []uint8{unix.IPPROTO_TCP, unix.IPPROTO_UDP}
+	}
+
+	eitherPorts := [][]expr.Any{}
+	for _, port := range r.Match.Ports {
+		eitherPorts = append(eitherPorts, portMatch(0, port), portMatch(destinationPortOffset, port))
+	}
+
+	sourcePorts := [][]expr.Any{}
+	for _, port := range r.Match.SourcePorts {
+		sourcePorts = append(sourcePorts, portMatch(0, port))
+	}
+
+	destinationPorts := [][]expr.Any{}
+	for _, port := range r.Match.DestinationPorts {
+		destinationPorts = append(destinationPorts, portMatch(destinationPortOffset, port))
+	}
+
+	matches := [][]expr.Any{}
+
+	for _, protocol := range protocols {
+		match := [][]expr.Any{{
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, SourceRegister: false, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{protocol}},
+		}}
+
+		match = product(match, eitherPorts)
+		match = product(match, sourcePorts)
+		match = product(match, destinationPorts)
+		matches = append(matches, match...)
+	}
+
+	return matches
+}
+
+// portMatch matches the TCP or UDP port at offset.
+func portMatch(offset uint32, port uint16) []expr.Any {
+	data := make([]byte, 2) //nolint:gomnd
+	binary.BigEndian.PutUint16(data, port)
+
+	return []expr.Any{
+		&expr.Payload{ //nolint:exhaustruct
+			DestRegister: 1,
+			Base:         expr.PayloadBaseTransportHeader,
+			Offset:       offset,
+			Len:          2, //nolint:gomnd
+		},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: data},
+	}
+}
+
+// action returns the expressions setting the DSCP and mark of a packet of the given family.
+func (r Rule) action(family byte) ([]expr.Any, error) {
+	exprs := []expr.Any{}
+
+	if r.Action.DSCP != nil {
+		dscp := *r.Action.DSCP
+
+		switch family {
+		case unix.NFPROTO_IPV4:
+			// DSCP is the top six bits of the TOS byte. The header checksum covers it, and is
+			// only updated correctly by writing whole 16 bit words.
+			exprs = append(exprs, rewrite(0, []byte{0xff, 0x03}, []byte{0, dscp << 2}, expr.CsumTypeInet, ipv4ChecksumOffset)...) //nolint:gomnd,lll
+		case unix.NFPROTO_IPV6:
+			// DSCP straddles the first two bytes, and there's no header checksum.
+			exprs = append(exprs, rewrite(0, []byte{0xf0, 0x3f}, []byte{dscp >> 2, dscp << 6}, expr.CsumTypeNone, 0)...) //nolint:gomnd,lll
+		default:
+			return nil, fmt.Errorf("%w: rule %s sets DSCP without an IP version", ErrInvalidRule, r.Name)
+		}
+	}
+
+	if r.Action.Mark != nil {
+		exprs = append(exprs,
+			&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: false, Register: 1},
+			&expr.Bitwise{
+				SourceRegister: 1,
+				DestRegister:   1,
+				Len:            4, //nolint:gomnd
+				Mask:           binaryutil.NativeEndian.PutUint32(^r.Action.Mark.Mask),
+				Xor:            binaryutil.NativeEndian.PutUint32(r.Action.Mark.Value),
+			},
+			&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: 1},
+		)
+	}
+
+	return exprs, nil
+}
+
+// rewrite returns the expressions keeping the masked bits of the network header at offset and
+// setting the rest to value.
+func rewrite(offset uint32, keep []byte, value []byte, csum expr.PayloadCsumType, csumOffset uint32) []expr.Any {
+	length := uint32(len(keep))
+
+	return []expr.Any{
+		&expr.Payload{ //nolint:exhaustruct
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       offset,
+			Len:          length,
+		},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: length, Mask: keep, Xor: value},
+		&expr.Payload{
+			OperationType:  expr.PayloadWrite,
+			DestRegister:   0,
+			SourceRegister: 1,
+			Base:           expr.PayloadBaseNetworkHeader,
+			Offset:         offset,
+			Len:            length,
+			CsumType:       csum,
+			CsumOffset:     csumOffset,
+			CsumFlags:      0,
+		},
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package classify
+
+import (
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/randomvariable/sqm/firewall"
+	"go.uber.org/zap"
+)
+
+// hooks is every hook, in the order chains are reconciled.
+var hooks = []Hook{Prerouting, Forward, Output, Postrouting} //nolint:gochecknoglobals
+
+// Chain returns the base chain holding the rules of a hook. It runs at the mangle priority,
+// ahead of sqm's other rules, so they see the markings. Marks set on output reroute packets.
+func Chain(hook Hook) *nftables.Chain {
+	chain := &nftables.Chain{ //nolint:exhaustruct
+		Name:     "classify-" + string(hook),
+		Table:    firewall.Table(),
+		Priority: nftables.ChainPriorityMangle,
+		Type:     nftables.ChainTypeFilter,
+	}
+
+	switch hook {
+	case Prerouting:
+		chain.Hooknum = nftables.ChainHookPrerouting
+	case Forward:
+		chain.Hooknum = nftables.ChainHookForward
+	case Output:
+		chain.Hooknum = nftables.ChainHookOutput
+		chain.Type = nftables.ChainTypeRoute
+	case Postrouting:
+		chain.Hooknum = nftables.ChainHookPostrouting
+	}
+
+	return chain
+}
+
+// Validate checks every rule, and that their names are unique.
+func Validate(rules []Rule) error {
+	names := map[string]bool{}
+
+	for _, rule := range rules {
+		if names[rule.Name] {
+			return fmt.Errorf("%w: more than one rule is named %s", ErrInvalidRule, rule.Name)
+		}
+
+		names[rule.Name] = true
+
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Controller contains all local information required for reconciliation.
+type Controller struct {
+	// rules are the classification rules, in order
+	rules []Rule
+	// log is the logger
+	log *zap.SugaredLogger
+}
+
+// NewClassifyController returns an instantiated controller. The rules should be valid.
+func NewClassifyController(rules []Rule, log *zap.SugaredLogger) *Controller {
+	return &Controller{
+		rules: rules,
+		log:   log.Named("Classification Controller"),
+	}
+}
+
+// desired returns the nftables rules of a hook, each tagged with the name and hash of the
+// classification rule it came from.
+func (c *Controller) desired(hook Hook) ([]*nftables.Rule, error) {
+	desired := []*nftables.Rule{}
+
+	for _, rule := range c.rules {
+		if rule.Hook != hook {
+			continue
+		}
+
+		compiled, err := rule.Compile()
+		if err != nil {
+			return nil, err
+		}
+
+		tag := firewall.Tag("classify:" + rule.Name + ":" + Hash(compiled))
+
+		for _, exprs := range compiled {
+			desired = append(desired, &nftables.Rule{ //nolint:exhaustruct
+				Table:    firewall.Table(),
+				Chain:    Chain(hook),
+				Exprs:    exprs,
+				UserData: tag,
+			})
+		}
+	}
+
+	return desired, nil
+}
+
+// Reconcile defines the reconciliation loop. A hook's chain is replaced in one transaction
+// when its rules differ from the desired ones, and deleted when it has none.
+func (c *Controller) Reconcile() error {
+	return firewall.Update(func(conn *nftables.Conn) error { //nolint:wrapcheck
+		for _, hook := range hooks {
+			desired, err := c.desired(hook)
+			if err != nil {
+				return err
+			}
+
+			existing, err := firewall.Rules(conn, Chain(hook))
+			if err != nil {
+				return err //nolint:wrapcheck
+			}
+
+			exists, err := firewall.HasChain(conn, Chain(hook))
+			if err != nil {
+				return err //nolint:wrapcheck
+			}
+
+			switch {
+			case len(desired) == 0 && exists:
+				conn.FlushChain(Chain(hook))
+				conn.DelChain(Chain(hook))
+				c.log.Infow("Deleted classification rules", "Hook", hook)
+			case len(desired) > 0 && !firewall.SameTags(existing, desired):
+				conn.AddChain(Chain(hook))
+				conn.FlushChain(Chain(hook))
+
+				for _, rule := range desired {
+					conn.AddRule(rule)
+				}
+
+				c.log.Infow("Updated classification rules", "Hook", hook, "Rules", len(desired))
+			}
+		}
+
+		return nil
+	})
+}
+
+// Release defines what happens on shutdown when shaping is to be left in place.
+func (c *Controller) Release() {
+	c.log.Info("Leaving classification rules in place")
+}
+
+// ReconcileDelete defines what happens on shutdown.
+func (c *Controller) ReconcileDelete() {
+	err := firewall.Remove(func(conn *nftables.Conn) error {
+		for _, hook := range hooks {
+			exists, err := firewall.HasChain(conn, Chain(hook))
+			if err != nil {
+				return err //nolint:wrapcheck
+			}
+
+			if exists {
+				conn.FlushChain(Chain(hook))
+				conn.DelChain(Chain(hook))
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		c.log.Errorw("Cannot delete classification rules", "error", err)
+
+		return
+	}
+
+	c.log.Info("Deleted classification rules")
+}
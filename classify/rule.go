@@ -0,0 +1,237 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+classify is a package for marking traffic so CAKE sorts it into the right tins. A declarative
+list of rules is compiled into nftables rules in sqm's table, which set the DSCP or firewall
+mark of matching packets.
+*/
+package classify
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+var ErrInvalidRule = errors.New("invalid classification rule")
+
+// Hook is where in the network stack a rule sees packets.
+type Hook string
+
+const (
+	Prerouting  Hook = "prerouting"
+	Forward     Hook = "forward"
+	Output      Hook = "output"
+	Postrouting Hook = "postrouting"
+)
+
+// ParseHook returns the hook with the given name, defaulting to Postrouting.
+func ParseHook(name string) (Hook, error) {
+	switch Hook(name) {
+	case "", Postrouting:
+		return Postrouting, nil
+	case Prerouting, Forward, Output:
+		return Hook(name), nil
+	default:
+		return "", fmt.Errorf("%w: unknown hook %q", ErrInvalidRule, name)
+	}
+}
+
+// Mark is a firewall mark value under a mask.
+type Mark struct {
+	Value uint32
+	Mask  uint32
+}
+
+// ParseMark parses a mark as value or value/mask, with the mask defaulting to all bits.
+func ParseMark(text string) (Mark, error) {
+	valueText, maskText, hasMask := strings.Cut(text, "/")
+
+	value, err := strconv.ParseUint(valueText, 0, 32)
+	if err != nil {
+		return Mark{}, fmt.Errorf("%w: invalid mark %q", ErrInvalidRule, text)
+	}
+
+	mask := uint64(0xffffffff)
+	if hasMask {
+		if mask, err = strconv.ParseUint(maskText, 0, 32); err != nil {
+			return Mark{}, fmt.Errorf("%w: invalid mark mask %q", ErrInvalidRule, text)
+		}
+	}
+
+	if value&^mask != 0 {
+		return Mark{}, fmt.Errorf("%w: mark %q sets bits outside its mask", ErrInvalidRule, text)
+	}
+
+	return Mark{Value: uint32(value), Mask: uint32(mask)}, nil
+}
+
+// dscpNames are the DSCP code points by name.
+var dscpNames = map[string]uint8{ //nolint:gochecknoglobals
+	"cs0": 0, "cs1": 8, "cs2": 16, "cs3": 24, "cs4": 32, "cs5": 40, "cs6": 48, "cs7": 56,
+	"af11": 10, "af12": 12, "af13": 14, "af21": 18, "af22": 20, "af23": 22,
+	"af31": 26, "af32": 28, "af33": 30, "af41": 34, "af42": 36, "af43": 38,
+	"ef": 46, "va": 44, "le": 1,
+}
+
+// ParseDSCP parses a DSCP code point given by name, such as ef or cs4, or by number.
+func ParseDSCP(text string) (uint8, error) {
+	if dscp, ok := dscpNames[strings.ToLower(text)]; ok {
+		return dscp, nil
+	}
+
+	dscp, err := strconv.ParseUint(text, 0, 8)
+	if err != nil || dscp >= 64 {
+		return 0, fmt.Errorf("%w: invalid DSCP %q", ErrInvalidRule, text)
+	}
+
+	return uint8(dscp), nil
+}
+
+// ParseProtocol parses a layer 4 protocol given by name or number.
+func ParseProtocol(text string) (uint8, error) {
+	switch strings.ToLower(text) {
+	case "tcp":
+		return unix.IPPROTO_TCP, nil
+	case "udp":
+		return unix.IPPROTO_UDP, nil
+	case "icmp":
+		return unix.IPPROTO_ICMP, nil
+	case "icmpv6":
+		return unix.IPPROTO_ICMPV6, nil
+	}
+
+	protocol, err := strconv.ParseUint(text, 0, 8)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid protocol %q", ErrInvalidRule, text)
+	}
+
+	return uint8(protocol), nil
+}
+
+// connStates are the conntrack state bits by name.
+var connStates = map[string]uint32{ //nolint:gochecknoglobals
+	"invalid":     1,
+	"established": 2,
+	"related":     4,
+	"new":         8,
+	"untracked":   64,
+}
+
+// ParseConnStates parses conntrack states into the bits nftables matches on.
+func ParseConnStates(names []string) (uint32, error) {
+	states := uint32(0)
+
+	for _, name := range names {
+		state, ok := connStates[strings.ToLower(name)]
+		if !ok {
+			return 0, fmt.Errorf("%w: unknown conntrack state %q", ErrInvalidRule, name)
+		}
+
+		states |= state
+	}
+
+	return states, nil
+}
+
+// ParsePrefixes parses addresses and prefixes, such as 192.168.2.1 or 2001:db8::/32.
+func ParsePrefixes(texts []string) ([]*net.IPNet, error) {
+	prefixes := make([]*net.IPNet, 0, len(texts))
+
+	for _, text := range texts {
+		if !strings.Contains(text, "/") {
+			ip := net.ParseIP(text)
+			if ip == nil {
+				return nil, fmt.Errorf("%w: invalid address %q", ErrInvalidRule, text)
+			}
+
+			bits := net.IPv6len * 8 //nolint:gomnd
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), net.IPv4len*8 //nolint:gomnd
+			}
+
+			prefixes = append(prefixes, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+
+			continue
+		}
+
+		_, prefix, err := net.ParseCIDR(text)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid prefix %q", ErrInvalidRule, text)
+		}
+
+		prefixes = append(prefixes, prefix)
+	}
+
+	return prefixes, nil
+}
+
+// Match selects packets. Empty fields match everything, and lists match any of their entries.
+type Match struct {
+	// InputInterface is the device a packet arrived on. A trailing * matches any suffix.
+	InputInterface string
+	// OutputInterface is the device a packet leaves by. A trailing * matches any suffix.
+	OutputInterface string
+	// Protocols are layer 4 protocol numbers, defaulting to TCP and UDP when ports are set
+	Protocols []uint8
+	// Ports match either the source or destination port
+	Ports            []uint16
+	SourcePorts      []uint16
+	DestinationPorts []uint16
+	Sources          []*net.IPNet
+	Destinations     []*net.IPNet
+	// ConnStates are conntrack state bits, any of which match
+	ConnStates uint32
+	// Mark matches the firewall mark
+	Mark *Mark
+}
+
+// Action is what's done to matching packets.
+type Action struct {
+	// DSCP is set on the packet
+	DSCP *uint8
+	// Mark sets the masked bits of the firewall mark
+	Mark *Mark
+}
+
+// Rule is a named classification rule.
+type Rule struct {
+	Name   string
+	Hook   Hook
+	Match  Match
+	Action Action
+}
+
+// Validate checks the rule can be compiled and is meaningful at its hook.
+func (r Rule) Validate() error {
+	switch {
+	case r.Name == "":
+		return fmt.Errorf("%w: rules need a name", ErrInvalidRule)
+	case r.Action.DSCP == nil && r.Action.Mark == nil:
+		return fmt.Errorf("%w: rule %s sets neither DSCP nor a mark", ErrInvalidRule, r.Name)
+	case r.Action.DSCP != nil && *r.Action.DSCP >= 64:
+		return fmt.Errorf("%w: rule %s sets DSCP %d", ErrInvalidRule, r.Name, *r.Action.DSCP)
+	case r.Hook == Prerouting && r.Match.OutputInterface != "":
+		return fmt.Errorf("%w: rule %s matches the output interface before routing", ErrInvalidRule, r.Name)
+	case r.Hook == Output && r.Match.InputInterface != "":
+		return fmt.Errorf("%w: rule %s matches the input interface of local traffic", ErrInvalidRule, r.Name)
+	}
+
+	hasPorts := len(r.Match.Ports)+len(r.Match.SourcePorts)+len(r.Match.DestinationPorts) > 0
+	for _, protocol := range r.Match.Protocols {
+		if hasPorts && protocol != unix.IPPROTO_TCP && protocol != unix.IPPROTO_UDP {
+			return fmt.Errorf("%w: rule %s matches ports of protocol %d", ErrInvalidRule, r.Name, protocol)
+		}
+	}
+
+	if _, err := r.Compile(); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/randomvariable/sqm/preflight"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var checkJSON bool
+
+// generateCheckCmd returns the check subcommand.
+func generateCheckCmd() *cobra.Command {
+	newCmd := &cobra.Command{ //nolint:exhaustruct
+		Use:   "check",
+		Short: "Check the kernel features and privileges sqm needs",
+		Long: LongDesc(`
+			Check sqm has CAP_NET_ADMIN and the kernel modules it needs, then set up an IFB device,
+			a CAKE qdisc, an ingress qdisc and a mirred filter in a throwaway network namespace.
+			The same checks run when the daemon starts.
+		`),
+		Example: Examples(`
+			sqm check
+			sqm check --json
+		`),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			report := preflight.Run(true)
+
+			if checkJSON {
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetIndent("", "  ")
+
+				if err := encoder.Encode(report); err != nil {
+					return err //nolint:wrapcheck
+				}
+			} else {
+				report.Print(os.Stdout)
+			}
+
+			return report.Err() //nolint:wrapcheck
+		},
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+	}
+
+	newCmd.Flags().BoolVar(&checkJSON, "json", false, "Print the report as JSON")
+
+	return newCmd
+}
+
+// runPreflight runs the preflight checks at daemon start, logging anything that didn't pass.
+// The functional test is skipped rather than run in the current network namespace.
+func runPreflight(log *zap.SugaredLogger) error {
+	report := preflight.Run(false)
+
+	for _, check := range report.Checks {
+		switch check.Result {
+		case preflight.Pass:
+		case preflight.Skip:
+			log.Infow("Preflight check skipped", "check", check.Name, "detail", check.Detail)
+		case preflight.Fail:
+			log.Errorw("Preflight check failed", "check", check.Name, "error", check.Detail, "hint", check.Hint)
+		}
+	}
+
+	return report.Err() //nolint:wrapcheck
+}
@@ -0,0 +1,234 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/randomvariable/sqm/classify"
+	"github.com/randomvariable/sqm/config"
+	"github.com/randomvariable/sqm/ownership"
+	"github.com/randomvariable/sqm/policy"
+	"github.com/randomvariable/sqm/redirector"
+	"github.com/randomvariable/sqm/shaper"
+)
+
+// classificationRules converts the classification rules of the configuration file.
+func classificationRules(cfgs []config.ClassificationRule) ([]classify.Rule, error) {
+	rules := make([]classify.Rule, 0, len(cfgs))
+
+	for _, cfg := range cfgs {
+		rule, err := classificationRule(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("classification rule %q: %w", cfg.Name, err)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, classify.Validate(rules) //nolint:wrapcheck
+}
+
+func classificationRule(cfg config.ClassificationRule) (classify.Rule, error) {
+	rule := classify.Rule{ //nolint:exhaustruct
+		Name: cfg.Name,
+	}
+
+	var err error
+
+	if rule.Hook, err = classify.ParseHook(cfg.Hook); err != nil {
+		return rule, err //nolint:wrapcheck
+	}
+
+	if rule.Match, err = classificationMatch(cfg.Match); err != nil {
+		return rule, err
+	}
+
+	if cfg.Set.DSCP != "" {
+		dscp, err := classify.ParseDSCP(cfg.Set.DSCP)
+		if err != nil {
+			return rule, err //nolint:wrapcheck
+		}
+
+		rule.Action.DSCP = &dscp
+	}
+
+	if cfg.Set.Mark != "" {
+		mark, err := classify.ParseMark(cfg.Set.Mark)
+		if err != nil {
+			return rule, err //nolint:wrapcheck
+		}
+
+		rule.Action.Mark = &mark
+	}
+
+	return rule, nil
+}
+
+// classificationMatch converts the match of a classification rule or policy.
+func classificationMatch(cfg config.ClassificationMatch) (classify.Match, error) {
+	match := classify.Match{ //nolint:exhaustruct
+		InputInterface:   cfg.InputInterface,
+		OutputInterface:  cfg.OutputInterface,
+		Ports:            cfg.Ports,
+		SourcePorts:      cfg.SourcePorts,
+		DestinationPorts: cfg.DestinationPorts,
+	}
+
+	for _, name := range cfg.Protocols {
+		protocol, err := classify.ParseProtocol(name)
+		if err != nil {
+			return match, err //nolint:wrapcheck
+		}
+
+		match.Protocols = append(match.Protocols, protocol)
+	}
+
+	var err error
+
+	if match.Sources, err = classify.ParsePrefixes(cfg.SourceAddresses); err != nil {
+		return match, err //nolint:wrapcheck
+	}
+
+	if match.Destinations, err = classify.ParsePrefixes(cfg.DestinationAddresses); err != nil {
+		return match, err //nolint:wrapcheck
+	}
+
+	if match.ConnStates, err = classify.ParseConnStates(cfg.ConnStates); err != nil {
+		return match, err //nolint:wrapcheck
+	}
+
+	if cfg.Mark != "" {
+		mark, err := classify.ParseMark(cfg.Mark)
+		if err != nil {
+			return match, err //nolint:wrapcheck
+		}
+
+		match.Mark = &mark
+	}
+
+	return match, nil
+}
+
+// shaperClasses converts the classes of a hierarchical shaper.
+func shaperClasses(cfgs []config.ShaperClass) ([]shaper.Class, error) {
+	classes := make([]shaper.Class, 0, len(cfgs))
+
+	for _, cfg := range cfgs {
+		class := shaper.Class{Name: cfg.Name, Rate: cfg.Rate, Ceil: 1, Prefixes: nil, VLANs: cfg.VLANs, Marks: nil}
+
+		if cfg.Ceil != nil {
+			class.Ceil = *cfg.Ceil
+		}
+
+		var err error
+
+		if class.Prefixes, err = classify.ParsePrefixes(cfg.Addresses); err != nil {
+			return nil, fmt.Errorf("class %q: %w", cfg.Name, err)
+		}
+
+		for _, text := range cfg.Marks {
+			mark, err := classify.ParseMark(text)
+			if err != nil {
+				return nil, fmt.Errorf("class %q: %w", cfg.Name, err)
+			}
+
+			class.Marks = append(class.Marks, mark)
+		}
+
+		classes = append(classes, class)
+	}
+
+	return classes, nil
+}
+
+// policies converts the policies of an interface, whose classes are marked for the root
+// device's diffserv mode.
+func policies(cfgs []config.Policy, mode shaper.DiffServMode) ([]policy.Policy, error) {
+	result := make([]policy.Policy, 0, len(cfgs))
+
+	for _, cfg := range cfgs {
+		class, err := policy.ParseClass(cfg.Class)
+		if err != nil {
+			return nil, fmt.Errorf("policy %q: %w", cfg.Name, err)
+		}
+
+		match, err := classificationMatch(cfg.Match)
+		if err != nil {
+			return nil, fmt.Errorf("policy %q: %w", cfg.Name, err)
+		}
+
+		result = append(result, policy.Policy{Name: cfg.Name, Class: class, Match: match})
+	}
+
+	return result, policy.Validate(result, mode) //nolint:wrapcheck
+}
+
+// exclusions converts the exclusions of an interface. Egress exclusions are put in the highest
+// priority tin of the root device's CAKE qdisc, or sent straight out by a hierarchical
+// shaper's HTB qdisc, which skb priorities naming the qdisc itself do.
+func exclusions(cfgs []config.Exclusion, egress shaper.Profile) (redirector.Exclusions, error) {
+	result := redirector.Exclusions{Ingress: nil, Egress: nil, EgressPriority: 0}
+
+	tins, err := egress.DiffServ.Tins()
+	if err != nil {
+		return result, err //nolint:wrapcheck
+	}
+
+	result.EgressPriority = ownership.EgressHandle<<16 | uint32(len(tins)) //nolint:gomnd
+	if len(egress.Classes) > 0 {
+		result.EgressPriority = ownership.EgressHandle << 16 //nolint:gomnd
+	}
+
+	for _, cfg := range cfgs {
+		exclusion := redirector.Exclusion{Name: cfg.Name, Prefixes: nil, Protocols: nil, Mark: nil}
+
+		if exclusion.Prefixes, err = classify.ParsePrefixes(cfg.Addresses); err != nil {
+			return result, fmt.Errorf("exclusion %q: %w", cfg.Name, err)
+		}
+
+		for _, name := range cfg.Protocols {
+			protocol, err := classify.ParseProtocol(name)
+			if err != nil {
+				return result, fmt.Errorf("exclusion %q: %w", cfg.Name, err)
+			}
+
+			exclusion.Protocols = append(exclusion.Protocols, protocol)
+		}
+
+		if cfg.Mark != "" {
+			mark, err := classify.ParseMark(cfg.Mark)
+			if err != nil {
+				return result, fmt.Errorf("exclusion %q: %w", cfg.Name, err)
+			}
+
+			exclusion.Mark = &mark
+		}
+
+		if len(exclusion.Prefixes) == 0 && len(exclusion.Protocols) == 0 && exclusion.Mark == nil {
+			return result, fmt.Errorf("%w: exclusion %q would exclude all traffic", config.ErrInvalidConfig, cfg.Name)
+		}
+
+		// Ingress filters run before netfilter, so the mark of ingress traffic is always unset.
+		if exclusion.Mark != nil && cfg.Direction != "egress" {
+			return result, fmt.Errorf("%w: exclusion %q matches a mark, which ingress traffic doesn't have yet, "+
+				"so needs direction egress", config.ErrInvalidConfig, cfg.Name)
+		}
+
+		switch cfg.Direction {
+		case "", "both":
+			result.Ingress = append(result.Ingress, exclusion)
+			result.Egress = append(result.Egress, exclusion)
+		case "ingress":
+			result.Ingress = append(result.Ingress, exclusion)
+		case "egress":
+			result.Egress = append(result.Egress, exclusion)
+		default:
+			return result, fmt.Errorf("%w: exclusion %q has unknown direction %q", config.ErrInvalidConfig, cfg.Name,
+				cfg.Direction)
+		}
+	}
+
+	return result, nil
+}
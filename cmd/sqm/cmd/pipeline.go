@@ -0,0 +1,341 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/randomvariable/sqm/config"
+	"github.com/randomvariable/sqm/datastore"
+	"github.com/randomvariable/sqm/dscp"
+	"github.com/randomvariable/sqm/links"
+	"github.com/randomvariable/sqm/manager"
+	"github.com/randomvariable/sqm/offload"
+	"github.com/randomvariable/sqm/persist"
+	"github.com/randomvariable/sqm/policy"
+	"github.com/randomvariable/sqm/ratesource"
+	"github.com/randomvariable/sqm/redirector"
+	"github.com/randomvariable/sqm/schedule"
+	"github.com/randomvariable/sqm/shaper"
+	"github.com/randomvariable/sqm/usage"
+)
+
+// addInterface adds a group of controllers managing one interface to the manager.
+func addInterface(mgr *manager.Manager, iface config.Interface) (*manager.Group, error) {
+	group := mgr.NewGroup(iface.Name, "Interface", iface.Name)
+
+	if err := addControllers(group, iface); err != nil {
+		mgr.RemoveGroup(group)
+
+		return nil, err
+	}
+
+	return group, nil
+}
+
+// addControllers adds the controllers managing an interface to its group.
+func addControllers(group *manager.Group, iface config.Interface) error {
+	egressProfile, err := shaperProfile(iface.Shaper.Egress)
+	if err != nil {
+		return err
+	}
+
+	ingressProfile, err := shaperProfile(iface.Shaper.Ingress)
+	if err != nil {
+		return err
+	}
+
+	modeName := iface.RedirectMode
+	if modeName == "" {
+		modeName = redirectMode
+	}
+
+	mode, err := redirector.ParseMode(modeName)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+
+	var marks *dscp.Marks
+
+	if iface.DSCPRestore != nil {
+		if marks, err = dscpMarks(*iface.DSCPRestore); err != nil {
+			return err
+		}
+	}
+
+	classPolicies, err := policies(iface.Policies, egressProfile.DiffServ)
+	if err != nil {
+		return err
+	}
+
+	excluded, err := exclusions(iface.Exclusions, egressProfile)
+	if err != nil {
+		return err
+	}
+
+	egressProfiles, ingressProfiles, err := alternativeProfiles(iface.Profiles, egressProfile, ingressProfile)
+	if err != nil {
+		return err
+	}
+
+	scheduled, err := schedules(iface.Schedules, iface.Profiles)
+	if err != nil {
+		return err
+	}
+
+	var dataCap *usage.Allowance
+
+	if iface.DataCap != nil {
+		capped, err := allowance(*iface.DataCap, iface.Profiles)
+		if err != nil {
+			return err
+		}
+
+		dataCap = &capped
+	}
+
+	inputs, options, err := newRateInputs(iface.RateSources)
+	if err != nil {
+		return err
+	}
+
+	rateController := ratesource.NewRateController(inputs, options, group.Data, group.Log)
+	group.AddController("Rate Source", rateController, rateInterval)
+
+	if len(scheduled) > 0 {
+		scheduleController := schedule.NewScheduleController(scheduled, group.Data, group.Log)
+		group.AddController("Schedule", scheduleController, time.Second*shortTickerSeconds)
+	}
+
+	if stateDir != "" {
+		stateFile := filepath.Join(stateDir, iface.Name+".json")
+		restoreState(stateFile, rateController, group.Log)
+		persistController := persist.NewPersistController(stateFile, group.Data, group.Log)
+		group.AddController("Persist", persistController, time.Second*longTickerSeconds,
+			datastore.KeyIngressRate, datastore.KeyEgressRate, datastore.KeyIngressSource, datastore.KeyEgressSource)
+	}
+
+	rootDeviceController := links.NewDeviceController(iface.Name, group.Data, false, group.Log)
+	group.AddController("Root Device", rootDeviceController, time.Second*shortTickerSeconds)
+	ifbName := iface.IFBName
+	if ifbName == "" {
+		ifbName = links.IFBName(iface.Name)
+	}
+
+	group.Log.Infow("Using IFB device", "IFBDevice", ifbName)
+	ifbDeviceController := links.NewDeviceController(ifbName, group.Data, true, group.Log)
+	ifbDeviceController.Migrate = migrateIFB
+	group.AddController("IFB Device", ifbDeviceController, time.Second*shortTickerSeconds,
+		datastore.KeyRootDevice)
+
+	rootShaperController, err := shaper.NewShaperController(false, egressProfile, egressProfiles, group.Data,
+		group.Log)
+	if err != nil {
+		return fmt.Errorf("cannot create root device shaper: %w", err)
+	}
+
+	group.AddController("Root Device Shaper", rootShaperController, time.Second*longTickerSeconds,
+		datastore.KeyEgressRate, datastore.KeyRootDevice, datastore.KeyAdjustments)
+
+	ifbShaperController, err := shaper.NewShaperController(true, ingressProfile, ingressProfiles, group.Data,
+		group.Log)
+	if err != nil {
+		rootShaperController.Close()
+
+		return fmt.Errorf("cannot create IFB device shaper: %w", err)
+	}
+
+	group.AddController("IFB Device Shaper", ifbShaperController, time.Second*longTickerSeconds,
+		datastore.KeyIngressRate, datastore.KeyIfbDevice, datastore.KeyAdjustments)
+
+	redirectController, err := redirector.NewRedirectorController(mode, excluded, group.Data, group.Log)
+	if err != nil {
+		// The group hasn't started, so shaping adopted from an earlier run must be left alone.
+		rootShaperController.Close()
+		ifbShaperController.Close()
+
+		return fmt.Errorf("cannot create redirector: %w", err)
+	}
+
+	group.AddController("Redirector", redirectController, time.Second*longTickerSeconds,
+		datastore.KeyRootDevice, datastore.KeyIfbDevice)
+
+	offloadController := offload.NewOffloadController(offloadUnhealthy, group.Data, group.Log)
+	group.AddController("Offload", offloadController, time.Second*longTickerSeconds, datastore.KeyRootDevice)
+
+	if dataCap != nil {
+		usageFile := ""
+		if stateDir != "" {
+			usageFile = filepath.Join(stateDir, iface.Name+".usage.json")
+		}
+
+		usageController := usage.NewUsageController(usageFile, *dataCap, group.Data, group.Log)
+		group.AddController("Usage", usageController, time.Second*shortTickerSeconds)
+	}
+
+	if marks != nil {
+		storeController := dscp.NewStoreController(iface.Name, *marks, group.Data, group.Log)
+		group.AddController("DSCP Store", storeController, time.Second*longTickerSeconds, datastore.KeyRootDevice)
+
+		restoreController := dscp.NewRestoreController(*marks, group.Data, group.Log)
+		group.AddController("DSCP Restore", restoreController, time.Second*longTickerSeconds,
+			datastore.KeyIfbDevice)
+	}
+
+	if len(classPolicies) > 0 {
+		ingressLayout := shaper.DiffServMode("")
+		if marks != nil {
+			ingressLayout = ingressProfile.DiffServ
+		}
+
+		policyController := policy.NewPolicyController(iface.Name, classPolicies, egressProfile.DiffServ,
+			ingressLayout, group.Data, group.Log)
+		group.AddController("Policy", policyController, time.Second*shortTickerSeconds, datastore.KeyRootDevice)
+	}
+
+	return nil
+}
+
+// dynamicPipelines adds and removes interface pipelines as the discovery controller finds
+// matching links. It is only called with the discovery controller's lock held.
+type dynamicPipelines struct {
+	// mgr is the manager groups are added to
+	mgr *manager.Manager
+	// templates are the pattern interfaces, in the same order as the discovery patterns
+	templates []config.Interface
+	// groups are the running pipelines by link name
+	groups map[string]*manager.Group
+}
+
+// newDiscoveryController returns a controller that adds pipelines for links matching any of
+// the pattern interfaces.
+func newDiscoveryController(mgr *manager.Manager, templates []config.Interface) (*links.DiscoveryController, error) {
+	patterns := make([]links.Pattern, 0, len(templates))
+
+	for _, template := range templates {
+		var (
+			pattern links.Pattern
+			err     error
+		)
+
+		if template.Match != "" {
+			pattern, err = links.NewGlobPattern(template.Match)
+		} else {
+			pattern, err = links.NewRegexPattern(template.Regex)
+		}
+
+		if err != nil {
+			return nil, err //nolint:wrapcheck
+		}
+
+		patterns = append(patterns, pattern)
+	}
+
+	pipelines := &dynamicPipelines{
+		mgr:       mgr,
+		templates: templates,
+		groups:    map[string]*manager.Group{},
+	}
+
+	return links.NewDiscoveryController(patterns, pipelines, mgr.Log), nil
+}
+
+// Add implements links.Pipelines.
+func (p *dynamicPipelines) Add(name string, pattern int) error {
+	iface := p.templates[pattern]
+	iface.Name = name
+
+	group, err := addInterface(p.mgr, iface)
+	if err != nil {
+		return err
+	}
+
+	p.groups[name] = group
+	p.mgr.StartGroup(group)
+
+	return nil
+}
+
+// Remove implements links.Pipelines.
+func (p *dynamicPipelines) Remove(name string) {
+	group, ok := p.groups[name]
+	if !ok {
+		return
+	}
+
+	p.mgr.RemoveGroup(group)
+	delete(p.groups, name)
+}
+
+// shaperProfile overlays the configured settings on the default profile.
+func shaperProfile(cfg config.ShaperProfile) (shaper.Profile, error) {
+	return overlayProfile(shaper.DefaultProfile(), cfg)
+}
+
+// overlayProfile overlays the configured settings on a profile.
+func overlayProfile(profile shaper.Profile, cfg config.ShaperProfile) (shaper.Profile, error) {
+	if cfg.DiffServ != "" {
+		profile.DiffServ = shaper.DiffServMode(cfg.DiffServ)
+	}
+
+	if cfg.ATM != "" {
+		profile.ATM = shaper.ATMMode(cfg.ATM)
+	}
+
+	if cfg.Overhead != nil {
+		profile.Overhead = *cfg.Overhead
+	}
+
+	if cfg.MPU != nil {
+		profile.MPU = *cfg.MPU
+	}
+
+	if cfg.NAT != nil {
+		profile.NAT = *cfg.NAT
+	}
+
+	if cfg.AckFilter != nil {
+		profile.AckFilter = *cfg.AckFilter
+	}
+
+	if cfg.SplitGSO != nil {
+		profile.SplitGSO = *cfg.SplitGSO
+	}
+
+	if cfg.Wash != nil {
+		profile.Wash = *cfg.Wash
+	}
+
+	if cfg.FwMark != nil {
+		profile.FwMark = shaper.FwMark{Mask: cfg.FwMark.Mask, Tins: cfg.FwMark.Tins}
+	}
+
+	if len(cfg.Classes) > 0 {
+		classes, err := shaperClasses(cfg.Classes)
+		if err != nil {
+			return profile, err
+		}
+
+		profile.Classes = classes
+	}
+
+	return profile, profile.Validate() //nolint:wrapcheck
+}
+
+// dscpMarks returns the conntrack mark layout for DSCP restoration from the configuration.
+func dscpMarks(cfg config.DSCPRestore) (*dscp.Marks, error) {
+	marks := dscp.DefaultMarks()
+
+	if cfg.Mask != nil {
+		marks.Mask = *cfg.Mask
+	}
+
+	if cfg.StateMask != nil {
+		marks.StateMask = *cfg.StateMask
+	}
+
+	return &marks, marks.Validate() //nolint:wrapcheck
+}
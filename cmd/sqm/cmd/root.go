@@ -9,19 +9,49 @@ import (
 	"os"
 	"time"
 
-	"github.com/randomvariable/sqm/links"
+	"github.com/randomvariable/sqm/classify"
+	"github.com/randomvariable/sqm/command"
+	"github.com/randomvariable/sqm/config"
 	"github.com/randomvariable/sqm/manager"
+	"github.com/randomvariable/sqm/persist"
+	"github.com/randomvariable/sqm/ratesource"
 	"github.com/randomvariable/sqm/redirector"
-	"github.com/randomvariable/sqm/shaper"
 	"github.com/randomvariable/sqm/snmp"
+	"github.com/randomvariable/sqm/status"
 	"github.com/spf13/cobra"
 )
 
 var (
-	rootDevice string
-	ingressOID string
-	egressOID  string
-	snmpHost   string
+	configFile    string
+	statusSocket  string
+	rootDevice    string
+	ifbName       string
+	rateSource    string
+	ingressOID    string
+	egressOID     string
+	snmpHost      string
+	tr064URL      string
+	tr064Username string
+	tr064Password string
+	httpURL       string
+	httpUsername  string
+	httpPassword  string
+	httpToken     string
+	httpIngress   httpValueFlags
+	httpEgress    httpValueFlags
+	cmdLine       string
+	cmdTimeout    time.Duration
+	cmdUnit       string
+	rateInterval  time.Duration
+	stateDir      string
+	stateMaxAge   time.Duration
+	keepOnExit    bool
+	skipCheck     bool
+	migrateIFB    bool
+
+	offloadUnhealthy bool
+	redirectMode     string
+	restoreDSCP      bool
 )
 
 const (
@@ -37,45 +67,117 @@ func generateNewRoot() *cobra.Command {
 		Use:   "sqm",
 		Short: "sqm",
 		Long: LongDesc(`
-			sqm sets up the Cake scheduler bi-directionally, and can introspect modems via SNMP to update bandwidth targets.
+			sqm sets up the Cake scheduler bi-directionally, and can introspect modems via SNMP, TR-064, HTTP or an external command to update bandwidth targets.
 		`),
 		Example: Examples(`
 			sqm --interface ppp0
+			sqm --interface ppp0 --rate-source tr064 --tr064-url http://fritz.box:49000/tr64desc.xml
+			sqm --interface ppp0 --rate-source http --http-url http://192.168.2.1/status.json --http-ingress-jsonpath $.dsl.down --http-egress-jsonpath $.dsl.up
+			sqm --interface ppp0 --rate-source command --command "/usr/local/bin/modem-rates" --rate-interval 1m
+			sqm --interface ppp0 --config /etc/sqm/sqm.yaml
+			sqm --config /etc/sqm/dual-wan.yaml
 		`),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			mgr, err := manager.NewManager()
 			if err != nil {
 				return fmt.Errorf("cannot create manager: %w", err)
 			}
-			snmpController := snmp.NewSNMPController(ingressOID, egressOID, snmpHost, mgr.Data, mgr.Log)
-			mgr.AddController("SNMP", snmpController, time.Second*shortTickerSeconds)
-			rootDeviceController := links.NewDeviceController(rootDevice, mgr.Data, false, mgr.Log)
-			mgr.AddController("Root Device", rootDeviceController, time.Second*shortTickerSeconds)
-			ifbDeviceController := links.NewDeviceController(rootDevice, mgr.Data, true, mgr.Log)
-			mgr.AddController("IFB Device", ifbDeviceController, time.Second*shortTickerSeconds)
-			rootShaperController, err := shaper.NewShaperController(false, mgr.Data, mgr.Log)
-			if err != nil {
-				os.Exit(1)
+			mgr.KeepOnExit = keepOnExit
+			if !skipCheck {
+				if err := runPreflight(mgr.Log); err != nil {
+					return fmt.Errorf("%w, run sqm check for details or pass --skip-check", err)
+				}
 			}
-			mgr.AddController("Root Device Shaper", rootShaperController, time.Second*longTickerSeconds)
-			ifbShaperController, err := shaper.NewShaperController(true, mgr.Data, mgr.Log)
+			cfg, err := loadConfig()
 			if err != nil {
-				os.Exit(1)
+				return err
 			}
-			mgr.AddController("IFB Device Shaper", ifbShaperController, time.Second*longTickerSeconds)
-			redirectController := redirector.NewRedirectorController(mgr.Data, mgr.Log)
-			mgr.AddController("Redirector", redirectController, time.Second*longTickerSeconds)
+			templates := []config.Interface{}
+			for _, iface := range cfg.Interfaces {
+				if iface.Dynamic() {
+					templates = append(templates, iface)
+
+					continue
+				}
+				if _, err := addInterface(mgr, iface); err != nil {
+					return fmt.Errorf("interface %s: %w", iface.Name, err)
+				}
+			}
+			if len(templates) > 0 {
+				discoveryController, err := newDiscoveryController(mgr, templates)
+				if err != nil {
+					return err
+				}
+				mgr.AddController("Discovery", discoveryController, time.Second*longTickerSeconds)
+			}
+			if len(cfg.Classification) > 0 {
+				rules, err := classificationRules(cfg.Classification)
+				if err != nil {
+					return err
+				}
+				mgr.AddController("Classification", classify.NewClassifyController(rules, mgr.Log),
+					time.Second*longTickerSeconds)
+			}
+			statusController := status.NewStatusController(statusSocket, mgr, mgr.Log)
+			mgr.AddController("Status", statusController, time.Second*longTickerSeconds)
 
 			return mgr.Start() //nolint:wrapcheck
 		},
 		Args: cobra.NoArgs,
 	}
 
+	newCmd.AddCommand(generateStatusCmd())
+	newCmd.AddCommand(generateCheckCmd())
+
 	newCmd.PersistentFlags().StringVarP(&rootDevice, "interface", "d", "ppp0", "Device to configure")
+	newCmd.PersistentFlags().StringVar(&ifbName, "ifb-name", "",
+		"IFB device name, derived from --interface if empty")
+	newCmd.PersistentFlags().StringVarP(&configFile, "config", "c", "",
+		"Configuration file, for settings that can't be given as flags")
+	newCmd.PersistentFlags().StringVar(&stateDir, "state-dir", persist.DefaultStateDir,
+		"Directory to save the last known rates of each interface to, empty to disable")
+	newCmd.PersistentFlags().DurationVar(&stateMaxAge, "state-max-age", persist.DefaultMaxAge,
+		"Oldest saved rates to use on startup, zero for any age")
+	newCmd.PersistentFlags().BoolVar(&keepOnExit, "keep-on-exit", false,
+		"Leave shaping in place when stopping, for the next start to adopt")
+	newCmd.Flags().BoolVar(&skipCheck, "skip-check", false, "Start without running the preflight checks")
+	newCmd.PersistentFlags().BoolVar(&migrateIFB, "migrate-ifb", false,
+		"Take over IFB devices without an alias, as left by releases before IFB devices were marked")
+	newCmd.PersistentFlags().BoolVar(&offloadUnhealthy, "offload-unhealthy", false,
+		"Report interfaces unhealthy while a flowtable offloads traffic past shaping")
+	newCmd.PersistentFlags().StringVar(&redirectMode, "redirect-mode", string(redirector.ModeClsact),
+		"How ingress traffic is redirected to the IFB device, clsact or ingress for kernels without clsact")
+	newCmd.PersistentFlags().BoolVar(&restoreDSCP, "restore-dscp", false,
+		"Restore the DSCP of ingress traffic from egress traffic on the same connection, via conntrack marks")
+	newCmd.PersistentFlags().StringVar(&statusSocket, "status-socket", status.DefaultSocketPath,
+		"Unix socket to serve status on")
 	newCmd.PersistentFlags().StringVarP(&ingressOID, "--ingress-oid", "i",
 		snmp.ZyxelSNMPIngressOID, "SNMP OID for ingress")
 	newCmd.PersistentFlags().StringVarP(&egressOID, "--egress-oid", "e", snmp.ZyxelSNMPEgressOID, "SNMP OID for egress")
 	newCmd.PersistentFlags().StringVarP(&snmpHost, "--snmp-host", "l", "192.168.2.1", "SNMP Host")
+	newCmd.PersistentFlags().StringVar(&rateSource, "rate-source", rateSourceSNMP,
+		"Where to read line rates from, one of snmp, tr064, http or command")
+	newCmd.PersistentFlags().StringVar(&tr064URL, "tr064-url", "",
+		"TR-064 or UPnP IGD device description URL, discovered via SSDP if empty")
+	newCmd.PersistentFlags().StringVar(&tr064Username, "tr064-username", "", "TR-064 username")
+	newCmd.PersistentFlags().StringVar(&tr064Password, "tr064-password", "",
+		"TR-064 password, defaults to the "+tr064PasswordEnv+" environment variable")
+	newCmd.PersistentFlags().StringVar(&httpURL, "http-url", "", "Status page or JSON endpoint to read rates from")
+	newCmd.PersistentFlags().StringVar(&httpUsername, "http-username", "", "Basic authentication username for --http-url")
+	newCmd.PersistentFlags().StringVar(&httpPassword, "http-password", "",
+		"Basic authentication password, defaults to the "+httpPasswordEnv+" environment variable")
+	newCmd.PersistentFlags().StringVar(&httpToken, "http-bearer-token", "",
+		"Bearer token, defaults to the "+httpTokenEnv+" environment variable")
+	addHTTPValueFlags(newCmd, "ingress", &httpIngress)
+	addHTTPValueFlags(newCmd, "egress", &httpEgress)
+	newCmd.PersistentFlags().StringVar(&cmdLine, "command", "",
+		"Shell command that prints ingress and egress rates as key=value lines or JSON")
+	newCmd.PersistentFlags().DurationVar(&cmdTimeout, "command-timeout", command.DefaultTimeout,
+		"How long --command may run for")
+	newCmd.PersistentFlags().StringVar(&cmdUnit, "command-unit", string(ratesource.KilobitsPerSecond),
+		"Unit of the rates printed by --command if it doesn't print a unit, one of bps, kbps, mbps or gbps")
+	newCmd.PersistentFlags().DurationVar(&rateInterval, "rate-interval", time.Second*shortTickerSeconds,
+		"Interval between reading line rates")
 
 	return newCmd
 }
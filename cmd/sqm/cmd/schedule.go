@@ -0,0 +1,93 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/randomvariable/sqm/config"
+	"github.com/randomvariable/sqm/datastore"
+	"github.com/randomvariable/sqm/schedule"
+	"github.com/randomvariable/sqm/shaper"
+)
+
+// alternativeProfiles overlays the profiles of an interface on the settings of each direction.
+func alternativeProfiles(cfgs map[string]config.ShaperProfile, egress, ingress shaper.Profile) (
+	map[string]shaper.Profile, map[string]shaper.Profile, error,
+) {
+	egressProfiles := make(map[string]shaper.Profile, len(cfgs))
+	ingressProfiles := make(map[string]shaper.Profile, len(cfgs))
+
+	for name, cfg := range cfgs {
+		var err error
+
+		if egressProfiles[name], err = overlayProfile(egress, cfg); err != nil {
+			return nil, nil, fmt.Errorf("profile %q: %w", name, err)
+		}
+
+		if ingressProfiles[name], err = overlayProfile(ingress, cfg); err != nil {
+			return nil, nil, fmt.Errorf("profile %q: %w", name, err)
+		}
+	}
+
+	return egressProfiles, ingressProfiles, nil
+}
+
+// schedules converts the schedules of an interface.
+func schedules(cfgs []config.Schedule, profiles map[string]config.ShaperProfile) ([]schedule.Schedule, error) {
+	result := make([]schedule.Schedule, 0, len(cfgs))
+
+	for _, cfg := range cfgs {
+		days, err := schedule.ParseDays(cfg.Days)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %q: %w", cfg.Name, err)
+		}
+
+		start, err := schedule.ParseTime(cfg.Start)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %q: %w", cfg.Name, err)
+		}
+
+		end, err := schedule.ParseTime(cfg.End)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %q: %w", cfg.Name, err)
+		}
+
+		ingress, err := shapingAdjustment(cfg.Ingress, profiles)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %q: %w", cfg.Name, err)
+		}
+
+		egress, err := shapingAdjustment(cfg.Egress, profiles)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %q: %w", cfg.Name, err)
+		}
+
+		result = append(result, schedule.Schedule{
+			Name:    cfg.Name,
+			Window:  schedule.Window{Days: days, Start: start, End: end},
+			Ingress: ingress,
+			Egress:  egress,
+		})
+	}
+
+	if err := schedule.Validate(result); err != nil {
+		return nil, fmt.Errorf("cannot use schedules: %w", err)
+	}
+
+	return result, nil
+}
+
+// shapingAdjustment converts an adjustment to one direction, checking the profile it uses exists.
+func shapingAdjustment(cfg config.Adjustment, profiles map[string]config.ShaperProfile) (
+	datastore.Adjustment, error,
+) {
+	adjustment := datastore.Adjustment{Multiplier: cfg.Multiplier, Cap: cfg.Cap, Profile: cfg.Profile}
+
+	if _, ok := profiles[cfg.Profile]; cfg.Profile != "" && !ok {
+		return adjustment, fmt.Errorf("%w: no profile is named %q", config.ErrInvalidConfig, cfg.Profile)
+	}
+
+	return adjustment, nil
+}
@@ -0,0 +1,316 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/randomvariable/sqm/command"
+	"github.com/randomvariable/sqm/config"
+	"github.com/randomvariable/sqm/httpscrape"
+	"github.com/randomvariable/sqm/links"
+	"github.com/randomvariable/sqm/persist"
+	"github.com/randomvariable/sqm/ratesource"
+	"github.com/randomvariable/sqm/snmp"
+	"github.com/randomvariable/sqm/tr064"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrUnknownRateSource  = errors.New("unknown rate source")
+	ErrMissingSection     = errors.New("rate source is missing its configuration section")
+	ErrAmbiguousExtractor = errors.New("exactly one of a JSONPath or regular expression must be set")
+)
+
+const (
+	rateSourceSNMP    = "snmp"
+	rateSourceTR064   = "tr064"
+	rateSourceHTTP    = "http"
+	rateSourceCommand = "command"
+
+	tr064PasswordEnv = "SQM_TR064_PASSWORD"
+	httpPasswordEnv  = "SQM_HTTP_PASSWORD"
+	httpTokenEnv     = "SQM_HTTP_BEARER_TOKEN"
+)
+
+// httpValueFlags holds the flags describing how to extract one rate from a HTTP response.
+type httpValueFlags struct {
+	jsonPath string
+	regex    string
+	unit     string
+}
+
+// addHTTPValueFlags registers the extraction flags for one direction.
+func addHTTPValueFlags(cmd *cobra.Command, direction string, flags *httpValueFlags) {
+	cmd.PersistentFlags().StringVar(&flags.jsonPath, "http-"+direction+"-jsonpath", "",
+		"JSONPath expression selecting the "+direction+" rate")
+	cmd.PersistentFlags().StringVar(&flags.regex, "http-"+direction+"-regex", "",
+		"Regular expression whose first or \"value\" capture group is the "+direction+" rate")
+	cmd.PersistentFlags().StringVar(&flags.unit, "http-"+direction+"-unit", string(ratesource.KilobitsPerSecond),
+		"Unit of the "+direction+" rate, one of bps, kbps, mbps or gbps")
+}
+
+func (f httpValueFlags) config() config.HTTPValue {
+	return config.HTTPValue{JSONPath: f.jsonPath, Regex: f.regex, Unit: f.unit}
+}
+
+// valueOrEnv returns value, or the named environment variable if value is empty.
+func valueOrEnv(value, env string) string {
+	if value == "" {
+		return os.Getenv(env)
+	}
+
+	return value
+}
+
+// flagRateSource returns the single rate source selected on the command line.
+func flagRateSource() config.RateSource {
+	return config.RateSource{
+		Name:       rateSource,
+		Type:       rateSource,
+		Priority:   0,
+		Interval:   0,
+		Directions: nil,
+		SNMP: &config.SNMPSource{
+			Host:       snmpHost,
+			IngressOID: ingressOID,
+			EgressOID:  egressOID,
+		},
+		TR064: &config.TR064Source{
+			URL:      tr064URL,
+			Username: tr064Username,
+			Password: valueOrEnv(tr064Password, tr064PasswordEnv),
+		},
+		HTTP: &config.HTTPSource{
+			URL:         httpURL,
+			Username:    httpUsername,
+			Password:    valueOrEnv(httpPassword, httpPasswordEnv),
+			BearerToken: valueOrEnv(httpToken, httpTokenEnv),
+			Ingress:     httpIngress.config(),
+			Egress:      httpEgress.config(),
+		},
+		Command: &config.CommandSource{
+			Command: cmdLine,
+			Timeout: cmdTimeout,
+			Unit:    cmdUnit,
+		},
+	}
+}
+
+// newRateInputs builds the rate sources and combination options from the configuration.
+func newRateInputs(cfg config.RateSources) ([]ratesource.Input, ratesource.Options, error) {
+	strategy, err := ratesource.ParseStrategy(cfg.Strategy)
+	if err != nil {
+		return nil, ratesource.Options{}, err //nolint:wrapcheck
+	}
+
+	options := ratesource.Options{
+		Strategy:   strategy,
+		StaleAfter: cfg.StaleAfter,
+		Fallback:   nil,
+	}
+
+	if cfg.Fallback != nil {
+		options.Fallback = &ratesource.Reading{Ingress: cfg.Fallback.Ingress, Egress: cfg.Fallback.Egress}
+	}
+
+	inputs := make([]ratesource.Input, 0, len(cfg.Sources))
+
+	for _, sourceCfg := range cfg.Sources {
+		source, err := newRateSource(sourceCfg)
+		if err != nil {
+			return nil, ratesource.Options{}, fmt.Errorf("rate source %q: %w", sourceCfg.Name, err)
+		}
+
+		directions := []ratesource.Direction{}
+		for _, direction := range sourceCfg.Directions {
+			directions = append(directions, ratesource.Direction(direction))
+		}
+
+		inputs = append(inputs, ratesource.Input{
+			Name:       sourceCfg.Name,
+			Source:     source,
+			Priority:   sourceCfg.Priority,
+			Interval:   sourceCfg.Interval,
+			Directions: directions,
+		})
+	}
+
+	return inputs, options, nil
+}
+
+// newRateSource returns the rate source described by the configuration.
+func newRateSource(cfg config.RateSource) (ratesource.Source, error) {
+	switch cfg.Type {
+	case rateSourceSNMP:
+		if cfg.SNMP == nil {
+			return nil, ErrMissingSection
+		}
+
+		return snmp.NewSNMPSource(cfg.SNMP.IngressOID, cfg.SNMP.EgressOID, cfg.SNMP.Host), nil
+	case rateSourceTR064:
+		if cfg.TR064 == nil {
+			return nil, ErrMissingSection
+		}
+
+		return tr064.NewTR064Source(cfg.TR064.URL, cfg.TR064.Username, cfg.TR064.Password), nil
+	case rateSourceHTTP:
+		if cfg.HTTP == nil {
+			return nil, ErrMissingSection
+		}
+
+		return newHTTPSource(*cfg.HTTP)
+	case rateSourceCommand:
+		if cfg.Command == nil {
+			return nil, ErrMissingSection
+		}
+
+		unit, err := ratesource.ParseUnit(defaultUnit(cfg.Command.Unit))
+		if err != nil {
+			return nil, fmt.Errorf("invalid command unit: %w", err)
+		}
+
+		return command.NewCommandSource(cfg.Command.Command, cfg.Command.Timeout, unit), nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownRateSource, cfg.Type)
+	}
+}
+
+// newHTTPSource returns a HTTP scrape rate source.
+func newHTTPSource(cfg config.HTTPSource) (ratesource.Source, error) {
+	ingress, err := newHTTPValue("ingress", cfg.Ingress)
+	if err != nil {
+		return nil, err
+	}
+
+	egress, err := newHTTPValue("egress", cfg.Egress)
+	if err != nil {
+		return nil, err
+	}
+
+	auth := httpscrape.Auth{
+		Username:    cfg.Username,
+		Password:    cfg.Password,
+		BearerToken: cfg.BearerToken,
+	}
+
+	return httpscrape.NewHTTPSource(cfg.URL, auth, ingress, egress), nil
+}
+
+// newHTTPValue builds the extractor for one direction.
+func newHTTPValue(direction string, cfg config.HTTPValue) (httpscrape.Value, error) {
+	unit, err := ratesource.ParseUnit(defaultUnit(cfg.Unit))
+	if err != nil {
+		return httpscrape.Value{}, fmt.Errorf("%s: %w", direction, err)
+	}
+
+	var extractor httpscrape.Extractor
+
+	switch {
+	case cfg.JSONPath != "" && cfg.Regex == "":
+		extractor, err = httpscrape.NewJSONPathExtractor(cfg.JSONPath)
+	case cfg.Regex != "" && cfg.JSONPath == "":
+		extractor, err = httpscrape.NewRegexExtractor(cfg.Regex)
+	default:
+		err = ErrAmbiguousExtractor
+	}
+
+	if err != nil {
+		return httpscrape.Value{}, fmt.Errorf("%s: %w", direction, err)
+	}
+
+	return httpscrape.Value{Extractor: extractor, Unit: unit}, nil
+}
+
+// defaultUnit returns kbps if no unit is given.
+func defaultUnit(unit string) string {
+	if unit == "" {
+		return string(ratesource.KilobitsPerSecond)
+	}
+
+	return unit
+}
+
+// loadConfig loads the configuration file if given. If the file doesn't list any interfaces,
+// the interface given on the command line is managed, using the rate source from the
+// command line if the file doesn't configure any.
+func loadConfig() (*config.Config, error) {
+	cfg := &config.Config{} //nolint:exhaustruct
+
+	if configFile != "" {
+		loaded, err := config.Load(configFile)
+		if err != nil {
+			return nil, err //nolint:wrapcheck
+		}
+
+		cfg = loaded
+	}
+
+	if len(cfg.Interfaces) > 0 {
+		return cfg, nil
+	}
+
+	if len(cfg.RateSources.Sources) == 0 {
+		cfg.RateSources.Sources = []config.RateSource{flagRateSource()}
+	}
+
+	if len(ifbName) > links.MaxNameLength {
+		return nil, fmt.Errorf("%w: --ifb-name %q is longer than %d characters", config.ErrInvalidConfig, ifbName,
+			links.MaxNameLength)
+	}
+
+	cfg.Interfaces = []config.Interface{{ //nolint:exhaustruct
+		Name:        rootDevice,
+		IFBName:     ifbName,
+		RateSources: cfg.RateSources,
+		Shaper:      cfg.Shaper,
+		Policies:    cfg.Policies,
+		Exclusions:  cfg.Exclusions,
+		Profiles:    cfg.Profiles,
+		Schedules:   cfg.Schedules,
+		DataCap:     cfg.DataCap,
+	}}
+
+	if restoreDSCP {
+		cfg.Interfaces[0].DSCPRestore = &config.DSCPRestore{Mask: nil, StateMask: nil}
+	}
+
+	return cfg, nil
+}
+
+// restoreState uses the last known rates from the state file as provisional rates.
+func restoreState(stateFile string, rateController *ratesource.Controller, log *zap.SugaredLogger) {
+	now := time.Now()
+
+	state, err := persist.Load(stateFile, stateMaxAge, now)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Warnw("Not using saved rates", "error", err)
+		}
+
+		return
+	}
+
+	reading := ratesource.Reading{Ingress: state.IngressRate, Egress: state.EgressRate}
+	if err := ratesource.Validate(reading); err != nil {
+		log.Warnw("Not using invalid saved rates", "error", err)
+
+		return
+	}
+
+	until := time.Time{}
+	if stateMaxAge > 0 {
+		until = state.Timestamp.Add(stateMaxAge)
+	}
+
+	rateController.SetProvisional(reading, until)
+	log.Infow("Using saved rates until a rate source is available",
+		"ingress", state.IngressRate, "ingressSource", state.IngressSource,
+		"egress", state.EgressRate, "egressSource", state.EgressSource,
+		"savedAt", state.Timestamp)
+}
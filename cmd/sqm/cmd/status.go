@@ -0,0 +1,198 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/randomvariable/sqm/datastore"
+	"github.com/randomvariable/sqm/status"
+	"github.com/randomvariable/sqm/usage"
+	"github.com/spf13/cobra"
+)
+
+var statusJSON bool
+
+// generateStatusCmd returns the status subcommand.
+func generateStatusCmd() *cobra.Command {
+	newCmd := &cobra.Command{ //nolint:exhaustruct
+		Use:   "status",
+		Short: "Show the status of a running sqm daemon",
+		Long: LongDesc(`
+			Show the rates in effect, where they came from and the health of each rate source.
+		`),
+		Example: Examples(`
+			sqm status
+			sqm status --status-socket /run/sqm/ppp0.sock --json
+		`),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			report, err := status.Fetch(statusSocket)
+			if err != nil {
+				return err //nolint:wrapcheck
+			}
+
+			if statusJSON {
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetIndent("", "  ")
+
+				return encoder.Encode(report) //nolint:wrapcheck
+			}
+
+			printReport(os.Stdout, report)
+
+			return nil
+		},
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+	}
+
+	newCmd.Flags().BoolVar(&statusJSON, "json", false, "Print the status as JSON")
+
+	return newCmd
+}
+
+// printReport writes a human readable report.
+func printReport(out io.Writer, report status.Report) {
+	for i, iface := range report.Interfaces {
+		if i > 0 {
+			fmt.Fprintln(out)
+		}
+
+		printInterfaceReport(out, iface)
+	}
+}
+
+// printInterfaceReport writes a human readable report for one interface.
+func printInterfaceReport(out io.Writer, report status.InterfaceReport) {
+	fmt.Fprintf(out, "Interface:    %s\n", report.Name)
+	fmt.Fprintf(out, "Healthy:      %t\n", report.Healthy)
+	fmt.Fprintf(out, "Root device:  %s\n", report.RootDevice)
+	fmt.Fprintf(out, "IFB device:   %s\n", report.IfbDevice)
+	fmt.Fprintf(out, "Ingress rate: %d kbps (from %s)%s\n", report.IngressRate, report.IngressSource,
+		shapedAt(report.IngressRate, report.ShapedIngressRate))
+	fmt.Fprintf(out, "Egress rate:  %d kbps (from %s)%s\n", report.EgressRate, report.EgressSource,
+		shapedAt(report.EgressRate, report.ShapedEgressRate))
+
+	if report.Usage != nil {
+		fmt.Fprintf(out, "Data used:    %s since %s (ingress %s, egress %s)\n",
+			usage.FormatGigabytes(report.Usage.Total()), report.Usage.PeriodStart.Format("2006-01-02"),
+			usage.FormatGigabytes(report.Usage.IngressBytes), usage.FormatGigabytes(report.Usage.EgressBytes))
+	}
+	fmt.Fprintln(out)
+
+	writer := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0) //nolint:gomnd
+	fmt.Fprintln(writer, "SOURCE\tHEALTHY\tINGRESS\tEGRESS\tLAST SUCCESS\tLAST ERROR")
+
+	for _, source := range report.RateSources {
+		lastSuccess := "never"
+		if !source.LastSuccess.IsZero() {
+			lastSuccess = source.LastSuccess.Format(time.RFC3339)
+		}
+
+		fmt.Fprintf(writer, "%s\t%t\t%d\t%d\t%s\t%s\n",
+			source.Name, source.Healthy, source.Ingress, source.Egress, lastSuccess, source.LastError)
+	}
+
+	writer.Flush()
+
+	printClasses(out, report.Classes)
+
+	warnings := make(map[string]string, len(report.Warnings))
+	for name, warning := range report.Warnings {
+		warnings[name] = warning.Message
+	}
+
+	adjustments := make(map[string]string, len(report.Adjustments))
+	for name, adjustment := range report.Adjustments {
+		adjustments[name] = fmt.Sprintf("%s (ingress %s, egress %s)", adjustment.Reason,
+			describeAdjustment(adjustment.Ingress), describeAdjustment(adjustment.Egress))
+	}
+
+	printSection(out, "Adjustments", adjustments)
+	printSection(out, "Conflicts", report.Conflicts)
+	printSection(out, "Warnings", warnings)
+}
+
+// shapedAt describes the rate the shaper is set to, if adjustments changed it.
+func shapedAt(rate, shaped int64) string {
+	if rate == shaped {
+		return ""
+	}
+
+	return fmt.Sprintf(", shaped at %d kbps", shaped)
+}
+
+// describeAdjustment describes what an adjustment does to one direction.
+func describeAdjustment(adjustment datastore.Adjustment) string {
+	changes := []string{}
+
+	if adjustment.Multiplier > 0 {
+		changes = append(changes, fmt.Sprintf("x%g", adjustment.Multiplier))
+	}
+
+	if adjustment.Cap > 0 {
+		changes = append(changes, fmt.Sprintf("cap %d kbps", adjustment.Cap))
+	}
+
+	if adjustment.Profile != "" {
+		changes = append(changes, "profile "+adjustment.Profile)
+	}
+
+	if len(changes) == 0 {
+		return "unchanged"
+	}
+
+	return strings.Join(changes, " ")
+}
+
+// printClasses writes the traffic each policy class matched, if there are policies.
+func printClasses(out io.Writer, classes []datastore.ClassCounter) {
+	if len(classes) == 0 {
+		return
+	}
+
+	fmt.Fprintln(out)
+
+	writer := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0) //nolint:gomnd
+	fmt.Fprintln(writer, "CLASS\tEGRESS TIN\tINGRESS TIN\tPACKETS\tBYTES")
+
+	for _, class := range classes {
+		ingressTin := class.IngressTin
+		if ingressTin == "" {
+			ingressTin = "-"
+		}
+
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%d\t%d\n", class.Class, class.EgressTin, ingressTin, class.Packets, class.Bytes)
+	}
+
+	writer.Flush()
+}
+
+// printSection writes a titled list of descriptions by name, if there are any.
+func printSection(out io.Writer, title string, descriptions map[string]string) {
+	if len(descriptions) == 0 {
+		return
+	}
+
+	names := make([]string, 0, len(descriptions))
+	for name := range descriptions {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, title+":")
+
+	for _, name := range names {
+		fmt.Fprintf(out, "  %s: %s\n", name, descriptions[name])
+	}
+}
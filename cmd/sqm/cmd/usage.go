@@ -0,0 +1,41 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/randomvariable/sqm/config"
+	"github.com/randomvariable/sqm/usage"
+)
+
+const bytesPerGigabyte = 1e9
+
+// allowance converts the data cap of an interface.
+func allowance(cfg config.DataCap, profiles map[string]config.ShaperProfile) (usage.Allowance, error) {
+	result := usage.Allowance{ResetDay: cfg.ResetDay, Thresholds: make([]usage.Threshold, 0, len(cfg.Thresholds))}
+	if result.ResetDay == 0 {
+		result.ResetDay = 1
+	}
+
+	for _, threshold := range cfg.Thresholds {
+		ingress, err := shapingAdjustment(threshold.Ingress, profiles)
+		if err != nil {
+			return result, fmt.Errorf("data cap threshold %g GB: %w", threshold.Gigabytes, err)
+		}
+
+		egress, err := shapingAdjustment(threshold.Egress, profiles)
+		if err != nil {
+			return result, fmt.Errorf("data cap threshold %g GB: %w", threshold.Gigabytes, err)
+		}
+
+		result.Thresholds = append(result.Thresholds, usage.Threshold{
+			Bytes:   uint64(threshold.Gigabytes * bytesPerGigabyte),
+			Ingress: ingress,
+			Egress:  egress,
+		})
+	}
+
+	return result, result.Validate() //nolint:wrapcheck
+}
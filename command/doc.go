@@ -0,0 +1,6 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// command defines a rate source that runs an external command which prints the line rates,
+// for modems that can only be queried over telnet, a serial console or a vendor CLI.
+package command
@@ -0,0 +1,117 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package command
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/randomvariable/sqm/ratesource"
+)
+
+var ErrMissingKey = errors.New("missing key in command output")
+
+const (
+	ingressKey = "ingress"
+	egressKey  = "egress"
+	unitKey    = "unit"
+)
+
+// output is the parsed output of a command.
+type output map[string]string
+
+// parseOutput parses either a JSON object or key=value lines into a map.
+func parseOutput(stdout []byte) (output, error) {
+	trimmed := bytes.TrimSpace(stdout)
+	if bytes.HasPrefix(trimmed, []byte("{")) {
+		return parseJSON(trimmed)
+	}
+
+	return parseKeyValues(trimmed), nil
+}
+
+func parseJSON(stdout []byte) (output, error) {
+	raw := map[string]interface{}{}
+
+	decoder := json.NewDecoder(bytes.NewReader(stdout))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("cannot decode JSON output: %w", err)
+	}
+
+	result := output{}
+	for key, value := range raw {
+		result[strings.ToLower(key)] = fmt.Sprint(value)
+	}
+
+	return result, nil
+}
+
+// parseKeyValues parses lines of key=value, ignoring blank lines, comments and anything else.
+func parseKeyValues(stdout []byte) output {
+	result := output{}
+	scanner := bufio.NewScanner(bytes.NewReader(stdout))
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+
+		result[strings.ToLower(strings.TrimSpace(key))] = strings.Trim(strings.TrimSpace(value), `"`)
+	}
+
+	return result
+}
+
+// reading converts the output into a reading, using defaultUnit unless the output has a unit key.
+func (o output) reading(defaultUnit ratesource.Unit) (ratesource.Reading, error) {
+	unit := defaultUnit
+
+	if name, ok := o[unitKey]; ok {
+		parsed, err := ratesource.ParseUnit(name)
+		if err != nil {
+			return ratesource.Reading{}, err //nolint:wrapcheck
+		}
+
+		unit = parsed
+	}
+
+	ingress, err := o.rate(ingressKey, unit)
+	if err != nil {
+		return ratesource.Reading{}, err
+	}
+
+	egress, err := o.rate(egressKey, unit)
+	if err != nil {
+		return ratesource.Reading{}, err
+	}
+
+	return ratesource.Reading{Ingress: ingress, Egress: egress}, nil
+}
+
+func (o output) rate(key string, unit ratesource.Unit) (int64, error) {
+	raw, ok := o[key]
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", ErrMissingKey, key)
+	}
+
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse %s value %q: %w", key, raw, err)
+	}
+
+	return ratesource.ToKbps(value, unit) //nolint:wrapcheck
+}
@@ -0,0 +1,94 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package command
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/randomvariable/sqm/ratesource"
+)
+
+func TestParseOutput(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		stdout  string
+		want    ratesource.Reading
+		wantErr error
+	}{
+		{
+			name:    "key=value in the default unit",
+			stdout:  "ingress=80000\negress=20000\n",
+			want:    ratesource.Reading{Ingress: 80000, Egress: 20000},
+			wantErr: nil,
+		},
+		{
+			name:    "key=value with a unit",
+			stdout:  "# line rates\n\n INGRESS = \"80\"\nstatus: up\negress=20.5\nunit=Mbps\n",
+			want:    ratesource.Reading{Ingress: 80000, Egress: 20500},
+			wantErr: nil,
+		},
+		{
+			name:    "JSON in the default unit",
+			stdout:  `{"ingress": 80000, "egress": "20000"}`,
+			want:    ratesource.Reading{Ingress: 80000, Egress: 20000},
+			wantErr: nil,
+		},
+		{
+			name:    "JSON with a unit",
+			stdout:  "  {\"Ingress\": 80000000, \"Egress\": 2e7, \"unit\": \"bps\"}\n",
+			want:    ratesource.Reading{Ingress: 80000, Egress: 20000},
+			wantErr: nil,
+		},
+		{
+			name:    "missing egress",
+			stdout:  "ingress=80000\n",
+			want:    ratesource.Reading{},
+			wantErr: ErrMissingKey,
+		},
+		{
+			name:    "unknown unit",
+			stdout:  `{"ingress": 80, "egress": 20, "unit": "baud"}`,
+			want:    ratesource.Reading{},
+			wantErr: ratesource.ErrUnknownUnit,
+		},
+	}
+
+	for _, tt := range tests {
+		out, err := parseOutput([]byte(tt.stdout))
+		if err != nil {
+			t.Fatalf("%s: parseOutput() error = %v", tt.name, err)
+		}
+
+		reading, err := out.reading(ratesource.KilobitsPerSecond)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: reading() error = %v, want %v", tt.name, err, tt.wantErr)
+
+			continue
+		}
+
+		if reading != tt.want {
+			t.Errorf("%s: reading() = %+v, want %+v", tt.name, reading, tt.want)
+		}
+	}
+}
+
+func TestParseOutputErrors(t *testing.T) {
+	t.Parallel()
+
+	if _, err := parseOutput([]byte(`{"ingress": 80000,`)); err == nil {
+		t.Error("parseOutput() of truncated JSON succeeded")
+	}
+
+	out, err := parseOutput([]byte("ingress=fast\negress=20000\n"))
+	if err != nil {
+		t.Fatalf("parseOutput() error = %v", err)
+	}
+
+	if _, err := out.reading(ratesource.KilobitsPerSecond); err == nil {
+		t.Error("reading() of a non-numeric rate succeeded")
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package command
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/randomvariable/sqm/ratesource"
+)
+
+var ErrTimeout = errors.New("command timed out")
+
+const (
+	// DefaultTimeout is how long a command may run for if no timeout is given.
+	DefaultTimeout = 30 * time.Second
+	// maxStderrLength bounds how much stderr is included in errors.
+	maxStderrLength = 256
+)
+
+// Source runs a command that prints the line rates on stdout, either as key=value lines:
+//
+//	ingress=80000
+//	egress=20000
+//	unit=kbps
+//
+// or as a JSON object with the same keys. The unit key is optional.
+type Source struct {
+	// command is run with /bin/sh -c
+	command string
+	// timeout is how long the command may run for
+	timeout time.Duration
+	// unit is the unit rates are reported in when the output has no unit key
+	unit ratesource.Unit
+}
+
+// NewCommandSource returns an instantiated external command rate source.
+func NewCommandSource(command string, timeout time.Duration, unit ratesource.Unit) Source {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	return Source{
+		command: command,
+		timeout: timeout,
+		unit:    unit,
+	}
+}
+
+// Read returns the current line rates.
+func (s Source) Read() (ratesource.Reading, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command("/bin/sh", "-c", s.command) //nolint:gosec
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// Run in its own process group so children of the shell are killed on timeout too.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true} //nolint:exhaustruct
+
+	if err := cmd.Start(); err != nil {
+		return ratesource.Reading{}, fmt.Errorf("cannot start command: %w", err)
+	}
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return ratesource.Reading{}, fmt.Errorf("command failed: %w: %s", err, truncate(stderr.String()))
+		}
+	case <-time.After(s.timeout):
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+
+		return ratesource.Reading{}, fmt.Errorf("%w after %s", ErrTimeout, s.timeout)
+	}
+
+	out, err := parseOutput(stdout.Bytes())
+	if err != nil {
+		return ratesource.Reading{}, err
+	}
+
+	return out.reading(s.unit)
+}
+
+// truncate shortens stderr for inclusion in an error message.
+func truncate(stderr string) string {
+	stderr = strings.TrimSpace(stderr)
+	if len(stderr) > maxStderrLength {
+		return stderr[:maxStderrLength] + "..."
+	}
+
+	return stderr
+}
@@ -0,0 +1,79 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package command
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/randomvariable/sqm/ratesource"
+)
+
+func TestSourceRead(t *testing.T) {
+	t.Parallel()
+
+	source := NewCommandSource("echo ingress=80; echo egress=20", 0, ratesource.MegabitsPerSecond)
+
+	reading, err := source.Read()
+	if err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+
+	if want := (ratesource.Reading{Ingress: 80000, Egress: 20000}); reading != want {
+		t.Errorf("Read() = %+v, want %+v", reading, want)
+	}
+
+	_, err = NewCommandSource("echo broken >&2; exit 3", 0, ratesource.KilobitsPerSecond).Read()
+	if err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("Read() error = %v, want the command's stderr", err)
+	}
+}
+
+func TestSourceTimeout(t *testing.T) {
+	t.Parallel()
+
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	// The backgrounded sleep holds stdout open, so Read only returns if it's killed as well as
+	// the shell.
+	source := NewCommandSource("sleep 30 & echo $! > "+pidFile+"; wait", 200*time.Millisecond,
+		ratesource.KilobitsPerSecond)
+
+	start := time.Now()
+
+	_, err := source.Read()
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("Read() error = %v, want %v", err, ErrTimeout)
+	}
+
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Read() took %s to time out", elapsed)
+	}
+
+	raw, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatalf("cannot read sleep's pid: %v", err)
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(raw)))
+	if err != nil {
+		t.Fatalf("cannot parse sleep's pid %q: %v", raw, err)
+	}
+
+	// The orphaned sleep is reaped by init, which may take a moment.
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if err := syscall.Kill(pid, 0); errors.Is(err, syscall.ESRCH) {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Errorf("sleep (pid %d) is still running after the timeout", pid)
+}
@@ -0,0 +1,469 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/randomvariable/sqm/links"
+	"gopkg.in/yaml.v2"
+)
+
+var ErrInvalidConfig = errors.New("invalid configuration")
+
+// Config is the top level configuration file.
+type Config struct {
+	// RateSources describes where line rates are read from for the interface given on the
+	// command line
+	RateSources RateSources `yaml:"rateSources"`
+	// Shaper holds the CAKE settings for the interface given on the command line
+	Shaper ShaperProfiles `yaml:"shaper"`
+	// Policies sort traffic leaving the interface given on the command line into classes
+	Policies []Policy `yaml:"policies"`
+	// Exclusions is traffic on the interface given on the command line that isn't shaped
+	Exclusions []Exclusion `yaml:"exclusions"`
+	// Profiles are alternative shaper settings for the interface given on the command line,
+	// by name
+	Profiles map[string]ShaperProfile `yaml:"profiles"`
+	// Schedules change how the interface given on the command line is shaped at given times
+	Schedules []Schedule `yaml:"schedules"`
+	// DataCap, if set, accounts for the data the interface given on the command line uses
+	DataCap *DataCap `yaml:"dataCap"`
+	// Interfaces, if set, are managed instead of the interface given on the command line
+	Interfaces []Interface `yaml:"interfaces"`
+	// Classification rules set the DSCP or firewall mark of matching traffic, in order
+	Classification []ClassificationRule `yaml:"classification"`
+}
+
+// Interface describes a managed interface, with its own rate sources and shaping.
+// Exactly one of Name, Match or Regex should be set. Match and Regex select every link
+// whose name matches, each link getting its own pipeline while it exists.
+type Interface struct {
+	// Name is the root device
+	Name string `yaml:"name"`
+	// Match is a glob such as ppp* or eth0.*
+	Match string `yaml:"match"`
+	// Regex is a regular expression matched against the whole link name
+	Regex string `yaml:"regex"`
+	// IFBName overrides the IFB device name derived from Name
+	IFBName string `yaml:"ifbName"`
+	// RedirectMode is clsact or ingress, defaulting to --redirect-mode
+	RedirectMode string `yaml:"redirectMode"`
+	// DSCPRestore, if set, restores the DSCP of ingress traffic from egress traffic
+	DSCPRestore *DSCPRestore `yaml:"dscpRestore"`
+	// RateSources describes where line rates are read from
+	RateSources RateSources `yaml:"rateSources"`
+	// Shaper holds the CAKE settings
+	Shaper ShaperProfiles `yaml:"shaper"`
+	// Policies sort traffic leaving the interface into classes, the first match winning
+	Policies []Policy `yaml:"policies"`
+	// Exclusions is traffic on the interface that isn't shaped
+	Exclusions []Exclusion `yaml:"exclusions"`
+	// Profiles are alternative shaper settings schedules can use, by name
+	Profiles map[string]ShaperProfile `yaml:"profiles"`
+	// Schedules change how the interface is shaped at given times, the first match winning
+	Schedules []Schedule `yaml:"schedules"`
+	// DataCap, if set, accounts for the data the interface uses each billing period
+	DataCap *DataCap `yaml:"dataCap"`
+}
+
+// Dynamic returns whether the interface selects links by pattern.
+func (i Interface) Dynamic() bool {
+	return i.Name == ""
+}
+
+// Selector returns whichever of the name, glob or regular expression is set.
+func (i Interface) Selector() string {
+	switch {
+	case i.Name != "":
+		return i.Name
+	case i.Match != "":
+		return i.Match
+	default:
+		return i.Regex
+	}
+}
+
+// DSCPRestore describes where DSCP is kept in the conntrack mark, so ingress traffic gets the
+// DSCP egress traffic on the same connection had. Unset fields keep their defaults.
+type DSCPRestore struct {
+	// Mask is the six contiguous conntrack mark bits DSCP is stored in
+	Mask *uint32 `yaml:"mask"`
+	// StateMask is the conntrack mark bit set once DSCP is stored
+	StateMask *uint32 `yaml:"stateMask"`
+}
+
+// Exclusion is traffic that bypasses shaping. Every set field must match, and lists match any
+// of their entries.
+type Exclusion struct {
+	// Name identifies the exclusion in logs
+	Name string `yaml:"name"`
+	// Direction is ingress, egress or both, the default
+	Direction string `yaml:"direction"`
+	// Addresses are the addresses or prefixes of the far end: the source on ingress and the
+	// destination on egress
+	Addresses []string `yaml:"addresses"`
+	// Protocols are names such as tcp or icmpv6, or numbers
+	Protocols []string `yaml:"protocols"`
+	// Mark is a firewall mark as value or value/mask, only for egress exclusions
+	Mark string `yaml:"mark"`
+}
+
+// Schedule changes how an interface is shaped during a recurring window of the week.
+type Schedule struct {
+	// Name identifies the schedule in logs and status
+	Name string `yaml:"name"`
+	// Days are days of the week as in a crontab, such as mon-fri or sat,sun, every day if unset
+	Days string `yaml:"days"`
+	// Start and End are local times as HH:MM. A window ending before it starts runs past
+	// midnight, and one ending as it starts lasts all day.
+	Start string `yaml:"start"`
+	End   string `yaml:"end"`
+	// Ingress and Egress change the shaping of each direction
+	Ingress Adjustment `yaml:"ingress"`
+	Egress  Adjustment `yaml:"egress"`
+}
+
+// Adjustment changes the shaping of one direction, such as while a schedule is in effect.
+type Adjustment struct {
+	// Multiplier scales the line rate
+	Multiplier float64 `yaml:"multiplier"`
+	// Cap is the most to shape to in kbps
+	Cap int64 `yaml:"cap"`
+	// Profile names one of the interface's profiles, overlaid on its shaper settings
+	Profile string `yaml:"profile"`
+}
+
+// DataCap steps down the shaping of an interface as it uses up a monthly data allowance.
+type DataCap struct {
+	// ResetDay is the day of the month the billing period starts, defaulting to the first. Months
+	// too short to have it reset on their last day.
+	ResetDay int `yaml:"resetDay"`
+	// Thresholds are in increasing order of usage, the highest one crossed applying
+	Thresholds []DataCapThreshold `yaml:"thresholds"`
+}
+
+// DataCapThreshold changes the shaping once the data used in both directions reaches it.
+type DataCapThreshold struct {
+	// Gigabytes is the usage in decimal gigabytes
+	Gigabytes float64 `yaml:"gigabytes"`
+	// Ingress and Egress change the shaping of each direction
+	Ingress Adjustment `yaml:"ingress"`
+	Egress  Adjustment `yaml:"egress"`
+}
+
+// Policy sorts the traffic it matches into a class, without needing to know DSCP.
+type Policy struct {
+	// Name identifies the policy in logs and nftables comments
+	Name string `yaml:"name"`
+	// Class is one of voice, video, best-effort or bulk
+	Class string `yaml:"class"`
+	// Match selects traffic as for classification rules, except by output interface
+	Match ClassificationMatch `yaml:"match"`
+}
+
+// ClassificationRule sets the DSCP or firewall mark of packets matching every set field of
+// Match. Later rules override what earlier ones set.
+type ClassificationRule struct {
+	// Name identifies the rule in logs and nftables comments
+	Name string `yaml:"name"`
+	// Hook is one of prerouting, forward, output or postrouting, defaulting to postrouting
+	Hook  string              `yaml:"hook"`
+	Match ClassificationMatch `yaml:"match"`
+	Set   ClassificationSet   `yaml:"set"`
+}
+
+// ClassificationMatch selects packets. Lists match any of their entries.
+type ClassificationMatch struct {
+	// InputInterface is the arriving device, a trailing * matching any suffix
+	InputInterface string `yaml:"iif"`
+	// OutputInterface is the leaving device, a trailing * matching any suffix
+	OutputInterface string `yaml:"oif"`
+	// Protocols are names such as tcp or udp, or numbers, defaulting to tcp and udp with ports
+	Protocols []string `yaml:"protocols"`
+	// Ports match either the source or destination port
+	Ports                []uint16 `yaml:"ports"`
+	SourcePorts          []uint16 `yaml:"sourcePorts"`
+	DestinationPorts     []uint16 `yaml:"destinationPorts"`
+	SourceAddresses      []string `yaml:"sourceAddresses"`
+	DestinationAddresses []string `yaml:"destinationAddresses"`
+	// ConnStates are conntrack states such as new, established or related
+	ConnStates []string `yaml:"ctState"`
+	// Mark is a firewall mark as value or value/mask
+	Mark string `yaml:"mark"`
+}
+
+// ClassificationSet is what a rule sets. At least one field should be set.
+type ClassificationSet struct {
+	// DSCP is a name such as ef, cs1 or af41, or a number
+	DSCP string `yaml:"dscp"`
+	// Mark is a firewall mark as value or value/mask, setting only the masked bits
+	Mark string `yaml:"mark"`
+}
+
+// ShaperProfiles holds the CAKE settings for each direction.
+type ShaperProfiles struct {
+	Egress  ShaperProfile `yaml:"egress"`
+	Ingress ShaperProfile `yaml:"ingress"`
+}
+
+// ShaperProfile overrides the default CAKE settings. Unset fields keep their defaults.
+type ShaperProfile struct {
+	// DiffServ is one of besteffort, diffserv3, diffserv4, diffserv8 or precedence
+	DiffServ string `yaml:"diffserv"`
+	// Overhead is the per packet overhead in bytes
+	Overhead *uint32 `yaml:"overhead"`
+	// ATM is one of none, atm or ptm
+	ATM string `yaml:"atm"`
+	// MPU is the minimum packet size in bytes
+	MPU       *uint32 `yaml:"mpu"`
+	NAT       *bool   `yaml:"nat"`
+	AckFilter *bool   `yaml:"ackFilter"`
+	SplitGSO  *bool   `yaml:"splitGSO"`
+	Wash      *bool   `yaml:"wash"`
+	// FwMark selects tins from the firewall mark rather than DSCP
+	FwMark *FwMark `yaml:"fwmark"`
+	// Classes, if set, shape with an HTB qdisc with a class and CAKE qdisc for each, and one
+	// for traffic no class matches
+	Classes []ShaperClass `yaml:"classes"`
+}
+
+// ShaperClass is a share of the line rate for the traffic it matches. Traffic matching any
+// of its addresses, VLANs or marks is in the class.
+type ShaperClass struct {
+	// Name identifies the class in logs
+	Name string `yaml:"name"`
+	// Rate is the fraction of the line rate the class is guaranteed
+	Rate float64 `yaml:"rate"`
+	// Ceil is the largest fraction of the line rate the class may use, all of it if unset
+	Ceil *float64 `yaml:"ceil"`
+	// Addresses are the addresses or prefixes of the local end: the source on egress and the
+	// destination on ingress
+	Addresses []string `yaml:"addresses"`
+	// VLANs are the IDs of VLANs whose tagged traffic is in the class
+	VLANs []uint16 `yaml:"vlans"`
+	// Marks are firewall marks as value or value/mask
+	Marks []string `yaml:"marks"`
+}
+
+// FwMark describes how CAKE selects tins from the firewall mark.
+type FwMark struct {
+	// Mask is the firewall mark bits CAKE reads
+	Mask uint32 `yaml:"mask"`
+	// Tins maps firewall mark values to the tin each should select, such as Voice or Tin 3
+	Tins map[uint32]string `yaml:"tins"`
+}
+
+// RateSources describes a set of rate sources and how they're combined.
+type RateSources struct {
+	// Strategy is one of first-healthy, min, max or priority
+	Strategy string `yaml:"strategy"`
+	// StaleAfter is how long since its last successful read a source is still usable
+	StaleAfter time.Duration `yaml:"staleAfter"`
+	// Fallback is used when every source is stale
+	Fallback *Rates `yaml:"fallback"`
+	// Sources are the rate sources
+	Sources []RateSource `yaml:"sources"`
+}
+
+// Rates is a pair of rates in kbps.
+type Rates struct {
+	Ingress int64 `yaml:"ingress"`
+	Egress  int64 `yaml:"egress"`
+}
+
+// RateSource describes a single rate source. Exactly one of the type specific
+// sections matching Type should be set.
+type RateSource struct {
+	// Name identifies the source in logs and status
+	Name string `yaml:"name"`
+	// Type is one of snmp, tr064, http or command
+	Type string `yaml:"type"`
+	// Priority is used by the priority strategy, lower is preferred
+	Priority int `yaml:"priority"`
+	// Interval is the minimum time between reads, defaults to every reconciliation
+	Interval time.Duration `yaml:"interval"`
+	// Directions limits the source to ingress or egress, defaults to both
+	Directions []string `yaml:"directions"`
+
+	SNMP    *SNMPSource    `yaml:"snmp"`
+	TR064   *TR064Source   `yaml:"tr064"`
+	HTTP    *HTTPSource    `yaml:"http"`
+	Command *CommandSource `yaml:"command"`
+}
+
+// SNMPSource configures a SNMP rate source.
+type SNMPSource struct {
+	Host       string `yaml:"host"`
+	IngressOID string `yaml:"ingressOID"`
+	EgressOID  string `yaml:"egressOID"`
+}
+
+// TR064Source configures a TR-064 or UPnP IGD rate source.
+type TR064Source struct {
+	URL      string `yaml:"url"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// HTTPSource configures a HTTP scrape rate source.
+type HTTPSource struct {
+	URL         string    `yaml:"url"`
+	Username    string    `yaml:"username"`
+	Password    string    `yaml:"password"`
+	BearerToken string    `yaml:"bearerToken"`
+	Ingress     HTTPValue `yaml:"ingress"`
+	Egress      HTTPValue `yaml:"egress"`
+}
+
+// HTTPValue describes how to extract one rate. Exactly one of JSONPath or Regex should be set.
+type HTTPValue struct {
+	JSONPath string `yaml:"jsonPath"`
+	Regex    string `yaml:"regex"`
+	Unit     string `yaml:"unit"`
+}
+
+// CommandSource configures an external command rate source.
+type CommandSource struct {
+	Command string        `yaml:"command"`
+	Timeout time.Duration `yaml:"timeout"`
+	Unit    string        `yaml:"unit"`
+}
+
+// Load reads and validates a configuration file.
+func Load(path string) (*Config, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read configuration file: %w", err)
+	}
+
+	cfg := &Config{} //nolint:exhaustruct
+	if err := yaml.UnmarshalStrict(raw, cfg); err != nil {
+		return nil, fmt.Errorf("cannot parse configuration file %s: %w", path, err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// Validate checks the configuration for errors that can be found without touching the system.
+func (c *Config) Validate() error {
+	if err := c.RateSources.Validate(); err != nil {
+		return err
+	}
+
+	names := map[string]bool{}
+	ifbNames := map[string]bool{}
+
+	for i, iface := range c.Interfaces {
+		selectors := 0
+
+		for _, selector := range []string{iface.Name, iface.Match, iface.Regex} {
+			if selector != "" {
+				selectors++
+			}
+		}
+
+		if selectors != 1 {
+			return fmt.Errorf("%w: interface %d needs exactly one of name, match or regex", ErrInvalidConfig, i)
+		}
+
+		if iface.Name != "" {
+			if names[iface.Name] {
+				return fmt.Errorf("%w: duplicate interface %q", ErrInvalidConfig, iface.Name)
+			}
+
+			names[iface.Name] = true
+		}
+
+		if err := iface.validateIFBName(ifbNames); err != nil {
+			return err
+		}
+
+		if err := iface.RateSources.Validate(); err != nil {
+			return fmt.Errorf("interface %q: %w", iface.Selector(), err)
+		}
+
+		if len(iface.RateSources.Sources) == 0 && iface.RateSources.Fallback == nil {
+			return fmt.Errorf("%w: interface %q needs rate sources or fallback rates", ErrInvalidConfig, iface.Selector())
+		}
+	}
+
+	return nil
+}
+
+// validateIFBName checks an IFB name override is usable and not already taken.
+func (i Interface) validateIFBName(taken map[string]bool) error {
+	if i.IFBName == "" {
+		return nil
+	}
+
+	if i.Dynamic() {
+		return fmt.Errorf("%w: interface %q matches many links so can't have an ifbName", ErrInvalidConfig,
+			i.Selector())
+	}
+
+	if len(i.IFBName) > links.MaxNameLength {
+		return fmt.Errorf("%w: ifbName %q is longer than %d characters", ErrInvalidConfig, i.IFBName,
+			links.MaxNameLength)
+	}
+
+	if taken[i.IFBName] {
+		return fmt.Errorf("%w: duplicate ifbName %q", ErrInvalidConfig, i.IFBName)
+	}
+
+	taken[i.IFBName] = true
+
+	return nil
+}
+
+// Validate checks the rate sources are well formed.
+func (r RateSources) Validate() error {
+	names := map[string]bool{}
+
+	for i, source := range r.Sources {
+		if source.Name == "" {
+			return fmt.Errorf("%w: rate source %d has no name", ErrInvalidConfig, i)
+		}
+
+		if names[source.Name] {
+			return fmt.Errorf("%w: duplicate rate source name %q", ErrInvalidConfig, source.Name)
+		}
+
+		names[source.Name] = true
+
+		for _, direction := range source.Directions {
+			if direction != "ingress" && direction != "egress" {
+				return fmt.Errorf("%w: rate source %q has unknown direction %q", ErrInvalidConfig, source.Name, direction)
+			}
+		}
+	}
+
+	if r.Fallback != nil && (r.Fallback.Ingress <= 0 || r.Fallback.Egress <= 0) {
+		return fmt.Errorf("%w: fallback rates must be positive", ErrInvalidConfig)
+	}
+
+	return nil
+}
+
+// Serves returns whether the source should be used for the given direction.
+func (r RateSource) Serves(direction string) bool {
+	if len(r.Directions) == 0 {
+		return true
+	}
+
+	for _, d := range r.Directions {
+		if d == direction {
+			return true
+		}
+	}
+
+	return false
+}
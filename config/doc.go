@@ -0,0 +1,8 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+config defines the optional YAML configuration file for sqm, used for settings that
+are too structured to express as command line flags.
+*/
+package config
@@ -0,0 +1,156 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package datastore
+
+import (
+	"sort"
+)
+
+// Adjustment changes how one direction is shaped, on top of the line rate.
+type Adjustment struct {
+	// Multiplier scales the line rate, zero to leave it
+	Multiplier float64 `json:"multiplier,omitempty"`
+	// Cap is the most the shaper is set to in kbps, zero for no cap
+	Cap int64 `json:"cap,omitempty"`
+	// Profile names the shaper profile to use instead of the configured one, if set
+	Profile string `json:"profile,omitempty"`
+}
+
+// apply returns the rate in kbps after the adjustment.
+func (a Adjustment) apply(rate int64) int64 {
+	if a.Multiplier > 0 {
+		rate = int64(float64(rate) * a.Multiplier)
+	}
+
+	if a.Cap > 0 && rate > a.Cap {
+		rate = a.Cap
+	}
+
+	return rate
+}
+
+// Adjustments are what one controller, such as the scheduler, does to both directions.
+type Adjustments struct {
+	// Reason describes why, such as the name of the schedule in effect
+	Reason  string     `json:"reason"`
+	Ingress Adjustment `json:"ingress"`
+	Egress  Adjustment `json:"egress"`
+}
+
+// Adjustments returns the adjustments in effect by the name of what made them.
+func (d *Data) Adjustments() map[string]Adjustments {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return copyAdjustments(d.adjustments)
+}
+
+// SetAdjustments records the adjustments made by name, or clears them if the reason is empty.
+func (d *Data) SetAdjustments(name string, adjustments Adjustments) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.adjustments[name] == adjustments {
+		return false
+	}
+
+	if adjustments.Reason == "" {
+		delete(d.adjustments, name)
+	} else {
+		d.adjustments[name] = adjustments
+	}
+
+	d.changed(KeyAdjustments)
+
+	return true
+}
+
+// ShapedIngressRate returns the ingress rate the shaper is set to, after any adjustments.
+func (d *Data) ShapedIngressRate() int64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return shapedRate(d.ingressRate, d.adjustments, ingressOf)
+}
+
+// ShapedEgressRate returns the egress rate the shaper is set to, after any adjustments.
+func (d *Data) ShapedEgressRate() int64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return shapedRate(d.egressRate, d.adjustments, egressOf)
+}
+
+// IngressProfile returns the name of the shaper profile an adjustment selects for ingress, if any.
+func (d *Data) IngressProfile() string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return profile(d.adjustments, ingressOf)
+}
+
+// EgressProfile returns the name of the shaper profile an adjustment selects for egress, if any.
+func (d *Data) EgressProfile() string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return profile(d.adjustments, egressOf)
+}
+
+// shapedRate applies every adjustment of a direction to a rate in name order, keeping a rate
+// that's known above zero.
+func shapedRate(rate int64, adjustments map[string]Adjustments, direction func(Adjustments) Adjustment) int64 {
+	shaped := rate
+
+	for _, name := range adjustmentNames(adjustments) {
+		shaped = direction(adjustments[name]).apply(shaped)
+	}
+
+	if rate > 0 && shaped < 1 {
+		return 1
+	}
+
+	return shaped
+}
+
+// profile returns the last profile selected for a direction in name order.
+func profile(adjustments map[string]Adjustments, direction func(Adjustments) Adjustment) string {
+	selected := ""
+
+	for _, name := range adjustmentNames(adjustments) {
+		if adjusted := direction(adjustments[name]).Profile; adjusted != "" {
+			selected = adjusted
+		}
+	}
+
+	return selected
+}
+
+func ingressOf(adjustments Adjustments) Adjustment {
+	return adjustments.Ingress
+}
+
+func egressOf(adjustments Adjustments) Adjustment {
+	return adjustments.Egress
+}
+
+func adjustmentNames(adjustments map[string]Adjustments) []string {
+	names := make([]string, 0, len(adjustments))
+	for name := range adjustments {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func copyAdjustments(adjustments map[string]Adjustments) map[string]Adjustments {
+	result := make(map[string]Adjustments, len(adjustments))
+	for name, adjustment := range adjustments {
+		result[name] = adjustment
+	}
+
+	return result
+}
@@ -6,39 +6,99 @@ package datastore
 import (
 	"errors"
 	"sync"
+	"time"
 
 	"github.com/vishvananda/netlink"
 )
 
 var ErrDeviceNotYetReady = errors.New("device not yet ready")
 
+// Warning describes something that stops shaping working as intended.
+type Warning struct {
+	Message string `json:"message"`
+	// Unhealthy stops the interface being reported healthy while the warning stands
+	Unhealthy bool `json:"unhealthy"`
+}
+
+// RateSourceStatus describes the health of a single rate source.
+type RateSourceStatus struct {
+	Name        string    `json:"name"`
+	Healthy     bool      `json:"healthy"`
+	Ingress     int64     `json:"ingress"`
+	Egress      int64     `json:"egress"`
+	LastSuccess time.Time `json:"lastSuccess"`
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+// ClassCounter is the traffic leaving the root device that a policy class matched.
+type ClassCounter struct {
+	Class string `json:"class"`
+	// EgressTin is the CAKE tin the class is sorted into on egress
+	EgressTin string `json:"egressTin"`
+	// IngressTin is the CAKE tin the class is sorted into on ingress, if DSCP is restored there
+	IngressTin string `json:"ingressTin,omitempty"`
+	Packets    uint64 `json:"packets"`
+	Bytes      uint64 `json:"bytes"`
+}
+
+// Data is the state shared between controllers. Every read and write takes mu, and every
+// change bumps the generation of its key and notifies subscribers of that key.
 type Data struct {
-	mu          sync.Mutex
-	ingressRate int64
-	egressRate  int64
-	rootDevice  netlink.Link
-	ifbDevice   netlink.Link
+	mu            sync.RWMutex
+	ingressRate   int64
+	egressRate    int64
+	ingressSource string
+	egressSource  string
+	rateSources   []RateSourceStatus
+	rootDevice    netlink.Link
+	ifbDevice     netlink.Link
+	conflicts     map[string]string
+	warnings      map[string]Warning
+	classes       []ClassCounter
+	adjustments   map[string]Adjustments
+	usage         *Usage
+	generations   map[Key]uint64
+	subscriptions map[*Subscription]struct{}
 }
 
 func NewDataStore() *Data {
 	return &Data{
-		mu:          sync.Mutex{},
-		ingressRate: 0,
-		egressRate:  0,
-		rootDevice:  nil,
-		ifbDevice:   nil,
+		mu:            sync.RWMutex{},
+		ingressRate:   0,
+		egressRate:    0,
+		ingressSource: "",
+		egressSource:  "",
+		rateSources:   []RateSourceStatus{},
+		rootDevice:    nil,
+		ifbDevice:     nil,
+		conflicts:     map[string]string{},
+		warnings:      map[string]Warning{},
+		classes:       []ClassCounter{},
+		adjustments:   map[string]Adjustments{},
+		usage:         nil,
+		generations:   map[Key]uint64{},
+		subscriptions: map[*Subscription]struct{}{},
 	}
 }
 
 func (d *Data) IngressRate() int64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
 	return d.ingressRate
 }
 
 func (d *Data) EgressRate() int64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
 	return d.egressRate
 }
 
 func (d *Data) RootDevice() (netlink.Link, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
 	if d.rootDevice == nil {
 		return nil, ErrDeviceNotYetReady
 	}
@@ -47,6 +107,9 @@ func (d *Data) RootDevice() (netlink.Link, error) {
 }
 
 func (d *Data) IfbDevice() (netlink.Link, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
 	if d.ifbDevice == nil {
 		return nil, ErrDeviceNotYetReady
 	}
@@ -60,6 +123,7 @@ func (d *Data) SetIngressRate(newVal int64) bool {
 
 	if d.ingressRate != newVal {
 		d.ingressRate = newVal
+		d.changed(KeyIngressRate)
 
 		return true
 	}
@@ -73,6 +137,37 @@ func (d *Data) SetEgressRate(newVal int64) bool {
 
 	if d.egressRate != newVal {
 		d.egressRate = newVal
+		d.changed(KeyEgressRate)
+
+		return true
+	}
+
+	return false
+}
+
+// IngressSource returns the name of the rate source the ingress rate came from.
+func (d *Data) IngressSource() string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.ingressSource
+}
+
+// EgressSource returns the name of the rate source the egress rate came from.
+func (d *Data) EgressSource() string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.egressSource
+}
+
+func (d *Data) SetIngressSource(name string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.ingressSource != name {
+		d.ingressSource = name
+		d.changed(KeyIngressSource)
 
 		return true
 	}
@@ -80,6 +175,59 @@ func (d *Data) SetEgressRate(newVal int64) bool {
 	return false
 }
 
+func (d *Data) SetEgressSource(name string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.egressSource != name {
+		d.egressSource = name
+		d.changed(KeyEgressSource)
+
+		return true
+	}
+
+	return false
+}
+
+// RateSources returns a copy of the health of each rate source.
+func (d *Data) RateSources() []RateSourceStatus {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return append([]RateSourceStatus{}, d.rateSources...)
+}
+
+// SetRateSources records the health of every rate source, returning whether it changed.
+func (d *Data) SetRateSources(statuses []RateSourceStatus) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if sameRateSources(d.rateSources, statuses) {
+		return false
+	}
+
+	d.rateSources = append([]RateSourceStatus{}, statuses...)
+	d.changed(KeyRateSources)
+
+	return true
+}
+
+func sameRateSources(old, statuses []RateSourceStatus) bool {
+	if len(old) != len(statuses) {
+		return false
+	}
+
+	for i := range old {
+		if old[i].Name != statuses[i].Name || old[i].Healthy != statuses[i].Healthy ||
+			old[i].Ingress != statuses[i].Ingress || old[i].Egress != statuses[i].Egress ||
+			!old[i].LastSuccess.Equal(statuses[i].LastSuccess) || old[i].LastError != statuses[i].LastError {
+			return false
+		}
+	}
+
+	return true
+}
+
 func isSameDevice(old netlink.Link, newLink netlink.Link) bool {
 	if old == nil {
 		return false
@@ -102,6 +250,7 @@ func (d *Data) SetRootDevice(newLink netlink.Link) bool {
 
 	if !isSameDevice(d.rootDevice, newLink) {
 		d.rootDevice = newLink
+		d.changed(KeyRootDevice)
 
 		return true
 	}
@@ -115,9 +264,115 @@ func (d *Data) SetIfbDevice(newLink netlink.Link) bool {
 
 	if !isSameDevice(d.ifbDevice, newLink) {
 		d.ifbDevice = newLink
+		d.changed(KeyIfbDevice)
 
 		return true
 	}
 
 	return false
 }
+
+// Conflicts returns the tc objects or links sqm can't manage because something else owns
+// them, describing each conflict.
+func (d *Data) Conflicts() map[string]string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return copyConflicts(d.conflicts)
+}
+
+// SetConflict records a conflict over an object, or clears it if the description is empty.
+func (d *Data) SetConflict(object string, description string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.conflicts[object] == description {
+		return false
+	}
+
+	if description == "" {
+		delete(d.conflicts, object)
+	} else {
+		d.conflicts[object] = description
+	}
+
+	d.changed(KeyConflicts)
+
+	return true
+}
+
+func copyConflicts(conflicts map[string]string) map[string]string {
+	result := make(map[string]string, len(conflicts))
+	for object, description := range conflicts {
+		result[object] = description
+	}
+
+	return result
+}
+
+// Warnings returns the conditions that stop shaping working as intended by name.
+func (d *Data) Warnings() map[string]Warning {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return copyWarnings(d.warnings)
+}
+
+// SetWarning records a warning, or clears it if the message is empty.
+func (d *Data) SetWarning(name string, warning Warning) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.warnings[name] == warning {
+		return false
+	}
+
+	if warning.Message == "" {
+		delete(d.warnings, name)
+	} else {
+		d.warnings[name] = warning
+	}
+
+	d.changed(KeyWarnings)
+
+	return true
+}
+
+func copyWarnings(warnings map[string]Warning) map[string]Warning {
+	result := make(map[string]Warning, len(warnings))
+	for name, warning := range warnings {
+		result[name] = warning
+	}
+
+	return result
+}
+
+// ClassCounters returns a copy of the traffic each policy class matched.
+func (d *Data) ClassCounters() []ClassCounter {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return append([]ClassCounter{}, d.classes...)
+}
+
+func (d *Data) SetClassCounters(counters []ClassCounter) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.classes) == len(counters) {
+		same := true
+
+		for i := range counters {
+			same = same && d.classes[i] == counters[i]
+		}
+
+		if same {
+			return false
+		}
+	}
+
+	d.classes = append([]ClassCounter{}, counters...)
+	d.changed(KeyClassCounters)
+
+	return true
+}
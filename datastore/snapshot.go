@@ -0,0 +1,65 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package datastore
+
+import (
+	"github.com/vishvananda/netlink"
+)
+
+// Snapshot is a consistent copy of the datastore at a point in time.
+type Snapshot struct {
+	IngressRate   int64
+	EgressRate    int64
+	IngressSource string
+	EgressSource  string
+	RateSources   []RateSourceStatus
+	// RootDevice is nil if not yet ready
+	RootDevice netlink.Link
+	// IfbDevice is nil if not yet ready
+	IfbDevice netlink.Link
+	// Conflicts describes objects owned by something other than sqm
+	Conflicts map[string]string
+	// Warnings describes conditions that stop shaping working as intended
+	Warnings map[string]Warning
+	// ClassCounters is the traffic each policy class matched
+	ClassCounters []ClassCounter
+	// ShapedIngressRate and ShapedEgressRate are the rates after any adjustments
+	ShapedIngressRate int64
+	ShapedEgressRate  int64
+	// Adjustments change the rates or profiles the shaper uses, by what made them
+	Adjustments map[string]Adjustments
+	// Usage is the data used in the current billing period, nil if it isn't accounted
+	Usage *Usage
+	// Generations is the generation of every key that has changed
+	Generations map[Key]uint64
+}
+
+// Snapshot returns a consistent copy of the datastore.
+func (d *Data) Snapshot() Snapshot {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	generations := make(map[Key]uint64, len(d.generations))
+	for key, generation := range d.generations {
+		generations[key] = generation
+	}
+
+	return Snapshot{
+		IngressRate:       d.ingressRate,
+		EgressRate:        d.egressRate,
+		IngressSource:     d.ingressSource,
+		EgressSource:      d.egressSource,
+		RateSources:       append([]RateSourceStatus{}, d.rateSources...),
+		RootDevice:        d.rootDevice,
+		IfbDevice:         d.ifbDevice,
+		Conflicts:         copyConflicts(d.conflicts),
+		Warnings:          copyWarnings(d.warnings),
+		ClassCounters:     append([]ClassCounter{}, d.classes...),
+		ShapedIngressRate: shapedRate(d.ingressRate, d.adjustments, ingressOf),
+		ShapedEgressRate:  shapedRate(d.egressRate, d.adjustments, egressOf),
+		Adjustments:       copyAdjustments(d.adjustments),
+		Usage:             copyUsage(d.usage),
+		Generations:       generations,
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package datastore
+
+import (
+	"time"
+)
+
+// Usage is the data an interface has used in the current billing period.
+type Usage struct {
+	// PeriodStart is when the billing period started
+	PeriodStart time.Time `json:"periodStart"`
+	// IngressBytes and EgressBytes are what went through the IFB and root devices
+	IngressBytes uint64 `json:"ingressBytes"`
+	EgressBytes  uint64 `json:"egressBytes"`
+	// Threshold is the highest data cap threshold crossed in bytes, zero if none
+	Threshold uint64 `json:"threshold,omitempty"`
+}
+
+// Total returns the bytes used in both directions.
+func (u Usage) Total() uint64 {
+	return u.IngressBytes + u.EgressBytes
+}
+
+// Usage returns the data used in the current billing period, or nil if it isn't accounted.
+func (d *Data) Usage() *Usage {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return copyUsage(d.usage)
+}
+
+// SetUsage records the data used in the current billing period.
+func (d *Data) SetUsage(usage Usage) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.usage != nil && *d.usage == usage {
+		return false
+	}
+
+	d.usage = &usage
+	d.changed(KeyUsage)
+
+	return true
+}
+
+func copyUsage(usage *Usage) *Usage {
+	if usage == nil {
+		return nil
+	}
+
+	result := *usage
+
+	return &result
+}
@@ -0,0 +1,90 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package datastore
+
+// Key identifies a value in the datastore for versioning and notification.
+type Key string
+
+const (
+	KeyIngressRate   Key = "ingressRate"
+	KeyEgressRate    Key = "egressRate"
+	KeyIngressSource Key = "ingressSource"
+	KeyEgressSource  Key = "egressSource"
+	KeyRateSources   Key = "rateSources"
+	KeyRootDevice    Key = "rootDevice"
+	KeyIfbDevice     Key = "ifbDevice"
+	KeyConflicts     Key = "conflicts"
+	KeyWarnings      Key = "warnings"
+	KeyClassCounters Key = "classCounters"
+	KeyAdjustments   Key = "adjustments"
+	KeyUsage         Key = "usage"
+)
+
+// Subscription notifies of changes to a set of keys. Notifications are coalesced, so a
+// receiver that falls behind sees a single notification for any number of changes, and
+// should re-read the keys it cares about.
+type Subscription struct {
+	// C receives a value after any of the keys change
+	C <-chan struct{}
+	// notify is the sending side of C
+	notify chan struct{}
+	// keys are the keys being watched
+	keys map[Key]bool
+	// data is the datastore subscribed to
+	data *Data
+}
+
+// Subscribe returns a subscription to changes of the given keys.
+func (d *Data) Subscribe(keys ...Key) *Subscription {
+	notify := make(chan struct{}, 1)
+	sub := &Subscription{
+		C:      notify,
+		notify: notify,
+		keys:   map[Key]bool{},
+		data:   d,
+	}
+
+	for _, key := range keys {
+		sub.keys[key] = true
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.subscriptions[sub] = struct{}{}
+
+	return sub
+}
+
+// Close stops notifications. C is not closed, so pending receives block forever.
+func (s *Subscription) Close() {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	delete(s.data.subscriptions, s)
+}
+
+// Generation returns how many times a key has changed.
+func (d *Data) Generation(key Key) uint64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.generations[key]
+}
+
+// changed bumps a key's generation and notifies subscribers. mu must be held for writing.
+func (d *Data) changed(key Key) {
+	d.generations[key]++
+
+	for sub := range d.subscriptions {
+		if !sub.keys[key] {
+			continue
+		}
+
+		select {
+		case sub.notify <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package datastore
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+const (
+	writers = 8
+	writes  = 200
+)
+
+// notified returns whether a subscription has a pending notification, consuming it.
+func notified(sub *Subscription) bool {
+	select {
+	case <-sub.C:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	data := NewDataStore()
+
+	rates := data.Subscribe(KeyIngressRate, KeyEgressRate)
+	sources := data.Subscribe(KeyEgressSource)
+	idle := data.Subscribe(KeyUsage, KeyWarnings)
+
+	defer rates.Close()
+	defer sources.Close()
+	defer idle.Close()
+
+	var (
+		wg             sync.WaitGroup
+		ingressChanges uint64
+		sourceChanges  uint64
+	)
+
+	for writer := 0; writer < writers; writer++ {
+		writer := writer
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < writes; i++ {
+				// Writers race over a few values, so some writes change nothing.
+				if data.SetIngressRate(int64(i % 3)) {
+					atomic.AddUint64(&ingressChanges, 1)
+				}
+
+				if data.SetEgressSource(fmt.Sprintf("source%d", writer%2)) {
+					atomic.AddUint64(&sourceChanges, 1)
+				}
+			}
+		}()
+	}
+
+	// Drain notifications while the writers run, as a controller would.
+	done := make(chan struct{})
+	drained := make(chan int)
+
+	go func() {
+		count := 0
+
+		for {
+			select {
+			case <-rates.C:
+				count++
+			case <-done:
+				drained <- count
+
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(done)
+
+	received := <-drained
+	if notified(rates) {
+		received++
+	}
+
+	if got := data.Generation(KeyIngressRate); got != ingressChanges {
+		t.Errorf("Generation(%s) = %d, want %d", KeyIngressRate, got, ingressChanges)
+	}
+
+	if got := data.Generation(KeyEgressSource); got != sourceChanges {
+		t.Errorf("Generation(%s) = %d, want %d", KeyEgressSource, got, sourceChanges)
+	}
+
+	if ingressChanges > 0 && (received == 0 || uint64(received) > ingressChanges) {
+		t.Errorf("rate subscription received %d notifications for %d changes", received, ingressChanges)
+	}
+
+	if sourceChanges > 0 && !notified(sources) {
+		t.Error("source subscription wasn't notified")
+	}
+
+	if notified(sources) {
+		t.Error("source subscription has a second notification pending, want one coalesced notification")
+	}
+
+	if notified(idle) {
+		t.Error("subscription to unchanged keys was notified")
+	}
+
+	for _, key := range []Key{KeyEgressRate, KeyUsage, KeyWarnings} {
+		if got := data.Generation(key); got != 0 {
+			t.Errorf("Generation(%s) = %d, want 0", key, got)
+		}
+	}
+}
+
+func TestSubscription(t *testing.T) {
+	data := NewDataStore()
+	sub := data.Subscribe(KeyIngressRate)
+
+	data.SetIngressRate(100)
+	data.SetIngressRate(200)
+
+	if !notified(sub) {
+		t.Fatal("subscription wasn't notified of a change")
+	}
+
+	if notified(sub) {
+		t.Error("two changes gave two notifications, want them coalesced")
+	}
+
+	if data.SetIngressRate(200) {
+		t.Error("SetIngressRate() = true for an unchanged value")
+	}
+
+	if notified(sub) {
+		t.Error("subscription was notified of an unchanged value")
+	}
+
+	if got := data.Generation(KeyIngressRate); got != 2 {
+		t.Errorf("Generation(%s) = %d, want 2", KeyIngressRate, got)
+	}
+
+	data.SetEgressRate(100)
+
+	if notified(sub) {
+		t.Error("subscription was notified of a key it doesn't watch")
+	}
+
+	sub.Close()
+	data.SetIngressRate(300)
+
+	if notified(sub) {
+		t.Error("closed subscription was notified")
+	}
+}
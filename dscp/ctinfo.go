@@ -0,0 +1,276 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package dscp
+
+import (
+	"bytes"
+	"fmt"
+	"syscall"
+
+	"github.com/randomvariable/sqm/ownership"
+	"github.com/randomvariable/sqm/tcutil"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// Neither netlink library sqm uses knows the ctinfo action, and go-tc refuses to list filters
+// using it, so the filter is built and read here. That's also why ctinfo isn't an action of the
+// redirect filter ahead of mirred: the redirector could no longer list its own filter.
+const (
+	// Priority is the priority of the ctinfo filter on the IFB device's egress hook
+	Priority = 10
+	// Attributes from linux/tc_act/tc_ctinfo.h
+	tcaCtinfoAct           = 3
+	tcaCtinfoZone          = 4
+	tcaCtinfoDSCPMask      = 5
+	tcaCtinfoDSCPStateMask = 6
+	// tcaActCookie is TCA_ACT_COOKIE
+	tcaActCookie = 6
+	// attrTypeMask strips the nested and byte order flags from an attribute type
+	attrTypeMask = ^uint16(unix.NLA_F_NESTED | unix.NLA_F_NET_BYTEORDER)
+)
+
+// egressParent is the parent of filters on a clsact qdisc's egress hook.
+const egressParent = uint32(netlink.HANDLE_MIN_EGRESS)
+
+// action is the part of a tc action the ctinfo filter is checked against.
+type action struct {
+	kind      string
+	cookie    []byte
+	verdict   int32
+	zone      uint16
+	mask      uint32
+	stateMask uint32
+}
+
+// filter is the part of a u32 filter the ctinfo filter is checked against.
+type filter struct {
+	handle  uint32
+	info    uint32
+	actions []action
+}
+
+// owned returns whether sqm added the filter.
+func (f filter) owned() bool {
+	for _, a := range f.actions {
+		if bytes.Equal(a.cookie, ownership.Cookie()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// mismatch compares the filter with the one sqm would add, returning what's wrong with it, or
+// an empty string if it's as wanted.
+func (f filter) mismatch(marks Marks) string {
+	switch {
+	case f.info>>16 != Priority: //nolint:gomnd
+		return fmt.Sprintf("at priority %d rather than %d", f.info>>16, Priority) //nolint:gomnd
+	case f.info&0xffff != tcutil.ProtocolAll: //nolint:gomnd
+		return fmt.Sprintf("matches protocol %#04x rather than all", f.info&0xffff) //nolint:gomnd
+	case len(f.actions) != 1 || f.actions[0].kind != "ctinfo":
+		return "doesn't have exactly one ctinfo action"
+	}
+
+	a := f.actions[0]
+
+	switch {
+	case a.verdict != int32(netlink.TC_ACT_PIPE):
+		return fmt.Sprintf("verdict %d isn't pipe", a.verdict)
+	case a.zone != 0:
+		return fmt.Sprintf("uses conntrack zone %d", a.zone)
+	case a.mask != marks.Mask || a.stateMask != marks.StateMask:
+		return fmt.Sprintf("uses marks %08x/%08x rather than %s", a.mask, a.stateMask, marks)
+	}
+
+	return ""
+}
+
+// tcMsg returns the header of a request about a filter on the device's egress hook.
+func tcMsg(ifindex int, handle uint32, info uint32) *nl.TcMsg {
+	return &nl.TcMsg{ //nolint:exhaustruct
+		Family:  nl.FAMILY_ALL,
+		Ifindex: int32(ifindex),
+		Handle:  handle,
+		Parent:  egressParent,
+		Info:    info,
+	}
+}
+
+// addFilter adds a u32 filter matching everything with a ctinfo action restoring DSCP.
+func addFilter(ifindex int, marks Marks) error {
+	req := nl.NewNetlinkRequest(unix.RTM_NEWTFILTER, unix.NLM_F_CREATE|unix.NLM_F_EXCL|unix.NLM_F_ACK)
+	req.AddData(tcMsg(ifindex, 0, uint32(Priority)<<16|tcutil.ProtocolAll)) //nolint:gomnd
+	req.AddData(nl.NewRtAttr(nl.TCA_KIND, nl.ZeroTerminated("u32")))
+	req.AddData(filterOptions(marks))
+
+	if _, err := req.Execute(unix.NETLINK_ROUTE, 0); err != nil {
+		return fmt.Errorf("cannot add ctinfo filter: %w", err)
+	}
+
+	return nil
+}
+
+// filterOptions returns the options of a u32 filter matching everything with a ctinfo action
+// restoring DSCP.
+func filterOptions(marks Marks) *nl.RtAttr {
+	sel := nl.TcU32Sel{ //nolint:exhaustruct
+		Flags: nl.TC_U32_TERMINAL,
+		Nkeys: 1,
+		Keys:  []nl.TcU32Key{{Mask: 0, Val: 0, Off: 0, OffMask: 0}},
+	}
+	gen := nl.TcGen{Index: 0, Capab: 0, Action: int32(netlink.TC_ACT_PIPE), Refcnt: 0, Bindcnt: 0}
+
+	options := nl.NewRtAttr(nl.TCA_OPTIONS, nil)
+	options.AddRtAttr(nl.TCA_U32_SEL, sel.Serialize())
+	act := options.AddRtAttr(nl.TCA_U32_ACT, nil).AddRtAttr(nl.TCA_ACT_TAB, nil)
+	act.AddRtAttr(nl.TCA_ACT_KIND, nl.ZeroTerminated("ctinfo"))
+	act.AddRtAttr(tcaActCookie, ownership.Cookie())
+	params := act.AddRtAttr(nl.TCA_ACT_OPTIONS|unix.NLA_F_NESTED, nil)
+	params.AddRtAttr(tcaCtinfoAct, gen.Serialize())
+	params.AddRtAttr(tcaCtinfoZone, nl.Uint16Attr(0))
+	params.AddRtAttr(tcaCtinfoDSCPMask, nl.Uint32Attr(marks.Mask))
+	params.AddRtAttr(tcaCtinfoDSCPStateMask, nl.Uint32Attr(marks.StateMask))
+
+	return options
+}
+
+// deleteFilter deletes a filter from the device's egress hook.
+func deleteFilter(ifindex int, f filter) error {
+	req := nl.NewNetlinkRequest(unix.RTM_DELTFILTER, unix.NLM_F_ACK)
+	req.AddData(tcMsg(ifindex, f.handle, f.info))
+	req.AddData(nl.NewRtAttr(nl.TCA_KIND, nl.ZeroTerminated("u32")))
+
+	if _, err := req.Execute(unix.NETLINK_ROUTE, 0); err != nil {
+		return fmt.Errorf("cannot delete ctinfo filter: %w", err)
+	}
+
+	return nil
+}
+
+// listFilters returns the u32 filters with actions on the device's egress hook, leaving out
+// the entries u32 makes for each priority and hash table.
+func listFilters(ifindex int) ([]filter, error) {
+	req := nl.NewNetlinkRequest(unix.RTM_GETTFILTER, unix.NLM_F_DUMP)
+	req.AddData(tcMsg(ifindex, 0, 0))
+
+	msgs, err := req.Execute(unix.NETLINK_ROUTE, unix.RTM_NEWTFILTER)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list filters: %w", err)
+	}
+
+	filters := []filter{}
+
+	for _, msg := range msgs {
+		header := nl.DeserializeTcMsg(msg)
+
+		attrs, err := nl.ParseRouteAttr(msg[header.Len():])
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse filter: %w", err)
+		}
+
+		f := filter{handle: header.Handle, info: header.Info, actions: nil}
+		kind := ""
+
+		for _, attr := range attrs {
+			switch attr.Attr.Type & attrTypeMask {
+			case nl.TCA_KIND:
+				kind = string(bytes.TrimRight(attr.Value, "\x00"))
+			case nl.TCA_OPTIONS:
+				if f.actions, err = parseU32Actions(attr.Value); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		if kind == "u32" && len(f.actions) > 0 {
+			filters = append(filters, f)
+		}
+	}
+
+	return filters, nil
+}
+
+// parseU32Actions returns the actions of a u32 filter from its options.
+func parseU32Actions(data []byte) ([]action, error) {
+	options, err := nl.ParseRouteAttr(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse filter options: %w", err)
+	}
+
+	actions := []action{}
+
+	for _, option := range options {
+		if option.Attr.Type&attrTypeMask != nl.TCA_U32_ACT {
+			continue
+		}
+
+		table, err := nl.ParseRouteAttr(option.Value)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse filter actions: %w", err)
+		}
+
+		for _, entry := range table {
+			a, err := parseAction(entry)
+			if err != nil {
+				return nil, err
+			}
+
+			actions = append(actions, a)
+		}
+	}
+
+	return actions, nil
+}
+
+// parseAction reads an action, along with its parameters if it's ctinfo.
+func parseAction(entry syscall.NetlinkRouteAttr) (action, error) {
+	a := action{kind: "", cookie: nil, verdict: 0, zone: 0, mask: 0, stateMask: 0}
+
+	attrs, err := nl.ParseRouteAttr(entry.Value)
+	if err != nil {
+		return a, fmt.Errorf("cannot parse action: %w", err)
+	}
+
+	var params []byte
+
+	for _, attr := range attrs {
+		switch attr.Attr.Type & attrTypeMask {
+		case nl.TCA_ACT_KIND:
+			a.kind = string(bytes.TrimRight(attr.Value, "\x00"))
+		case tcaActCookie:
+			a.cookie = attr.Value
+		case nl.TCA_ACT_OPTIONS:
+			params = attr.Value
+		}
+	}
+
+	if a.kind != "ctinfo" || params == nil {
+		return a, nil
+	}
+
+	attrs, err = nl.ParseRouteAttr(params)
+	if err != nil {
+		return a, fmt.Errorf("cannot parse ctinfo parameters: %w", err)
+	}
+
+	for _, attr := range attrs {
+		switch attr.Attr.Type & attrTypeMask {
+		case tcaCtinfoAct:
+			if len(attr.Value) >= nl.SizeofTcGen {
+				a.verdict = nl.DeserializeTcGen(attr.Value).Action
+			}
+		case tcaCtinfoZone:
+			a.zone = nl.NativeEndian().Uint16(attr.Value)
+		case tcaCtinfoDSCPMask:
+			a.mask = nl.NativeEndian().Uint32(attr.Value)
+		case tcaCtinfoDSCPStateMask:
+			a.stateMask = nl.NativeEndian().Uint32(attr.Value)
+		}
+	}
+
+	return a, nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package dscp
+
+import (
+	"testing"
+
+	"github.com/randomvariable/sqm/ownership"
+	"github.com/randomvariable/sqm/tcutil"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// roundTrip returns the filter sqm adds for the marks, as listFilters would read it back.
+func roundTrip(t *testing.T, marks Marks) filter {
+	t.Helper()
+
+	attrs, err := nl.ParseRouteAttr(filterOptions(marks).Serialize())
+	if err != nil || len(attrs) != 1 {
+		t.Fatalf("cannot parse filter options: %v", err)
+	}
+
+	actions, err := parseU32Actions(attrs[0].Value)
+	if err != nil {
+		t.Fatalf("parseU32Actions() error = %v", err)
+	}
+
+	return filter{handle: 0x800, info: uint32(Priority)<<16 | tcutil.ProtocolAll, actions: actions}
+}
+
+func TestParseU32Actions(t *testing.T) {
+	marks := Marks{Mask: 0x0000fc00, StateMask: 0x00000100}
+	f := roundTrip(t, marks)
+
+	want := action{
+		kind:      "ctinfo",
+		cookie:    ownership.Cookie(),
+		verdict:   int32(netlink.TC_ACT_PIPE),
+		zone:      0,
+		mask:      marks.Mask,
+		stateMask: marks.StateMask,
+	}
+
+	if len(f.actions) != 1 {
+		t.Fatalf("parseU32Actions() returned %d actions, want 1", len(f.actions))
+	}
+
+	got := f.actions[0]
+	if got.kind != want.kind || string(got.cookie) != string(want.cookie) || got.verdict != want.verdict ||
+		got.zone != want.zone || got.mask != want.mask || got.stateMask != want.stateMask {
+		t.Errorf("parseU32Actions() = %+v, want %+v", got, want)
+	}
+
+	if !f.owned() {
+		t.Error("owned() = false, want true")
+	}
+}
+
+func TestMismatch(t *testing.T) {
+	marks := DefaultMarks()
+
+	tests := []struct {
+		name   string
+		change func(f *filter)
+		want   bool
+	}{
+		{name: "as added", change: func(f *filter) {}, want: false},
+		{name: "other priority", change: func(f *filter) { f.info = 11<<16 | tcutil.ProtocolAll }, want: true},
+		{name: "IPv4 only", change: func(f *filter) { f.info = uint32(Priority)<<16 | tcutil.ProtocolIPv4 }, want: true},
+		{name: "no actions", change: func(f *filter) { f.actions = nil }, want: true},
+		{
+			name:   "extra action",
+			change: func(f *filter) { f.actions = append(f.actions, action{kind: "mirred"}) }, //nolint:exhaustruct
+			want:   true,
+		},
+		{name: "other verdict", change: func(f *filter) { f.actions[0].verdict = int32(netlink.TC_ACT_OK) }, want: true},
+		{name: "conntrack zone", change: func(f *filter) { f.actions[0].zone = 1 }, want: true},
+		{name: "other mask", change: func(f *filter) { f.actions[0].mask = 0x00fc0000 }, want: true},
+		{name: "other state mask", change: func(f *filter) { f.actions[0].stateMask = 0 }, want: true},
+	}
+
+	for _, tt := range tests {
+		f := roundTrip(t, marks)
+		tt.change(&f)
+
+		if reason := f.mismatch(marks); (reason != "") != tt.want {
+			t.Errorf("%s: mismatch() = %q, want a mismatch %t", tt.name, reason, tt.want)
+		}
+	}
+}
+
+func TestOwned(t *testing.T) {
+	f := filter{handle: 0x800, info: 0, actions: []action{{kind: "ctinfo"}}} //nolint:exhaustruct
+	if f.owned() {
+		t.Error("owned() = true for a filter without sqm's cookie")
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+dscp is a package for restoring the DSCP markings of ingress traffic, which ISPs often wash,
+from the markings of egress traffic on the same connection. DSCP is stored in the conntrack
+mark on egress by nftables rules, and copied back by the ctinfo action on the IFB device before
+CAKE picks a tin.
+*/
+package dscp
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+var ErrInvalidMarks = errors.New("invalid conntrack mark layout")
+
+const (
+	// DefaultMask is the conntrack mark bits DSCP is stored in by default
+	DefaultMask = uint32(0xfc000000)
+	// DefaultStateMask is the conntrack mark bit set by default once DSCP is stored
+	DefaultStateMask = uint32(0x01000000)
+	// dscpBits is the width of the DSCP field
+	dscpBits = 6
+)
+
+// Marks is where DSCP is kept in the conntrack mark.
+type Marks struct {
+	// Mask covers the six bits DSCP is stored in
+	Mask uint32
+	// StateMask is set once DSCP has been stored, so connections without it aren't changed.
+	// Zero always restores.
+	StateMask uint32
+}
+
+// DefaultMarks returns the layout used by sqm-scripts' ctinfo scripts.
+func DefaultMarks() Marks {
+	return Marks{Mask: DefaultMask, StateMask: DefaultStateMask}
+}
+
+// Validate checks the mask is six contiguous bits that don't overlap the state mask, as the
+// ctinfo action requires.
+func (m Marks) Validate() error {
+	if m.Mask>>m.shift() != 1<<dscpBits-1 {
+		return fmt.Errorf("%w: mask %#08x isn't six contiguous bits", ErrInvalidMarks, m.Mask)
+	}
+
+	if m.Mask&m.StateMask != 0 {
+		return fmt.Errorf("%w: state mask %#08x overlaps mask %#08x", ErrInvalidMarks, m.StateMask, m.Mask)
+	}
+
+	return nil
+}
+
+// String returns the layout as mask/statemask.
+func (m Marks) String() string {
+	return fmt.Sprintf("%08x/%08x", m.Mask, m.StateMask)
+}
+
+// shift returns the position of the lowest bit DSCP is stored in.
+func (m Marks) shift() int {
+	return bits.TrailingZeros32(m.Mask)
+}
+
+// value returns the conntrack mark bits storing a DSCP value.
+func (m Marks) value(dscp uint8) uint32 {
+	return uint32(dscp)<<m.shift() | m.StateMask
+}
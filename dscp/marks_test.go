@@ -0,0 +1,39 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package dscp
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMarksValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		marks   Marks
+		wantErr error
+	}{
+		{name: "default", marks: DefaultMarks(), wantErr: nil},
+		{name: "low bits", marks: Marks{Mask: 0x3f, StateMask: 0x40}, wantErr: nil},
+		{name: "no state mask", marks: Marks{Mask: 0x7e000000, StateMask: 0}, wantErr: nil},
+		{name: "no mask", marks: Marks{Mask: 0, StateMask: 0x01}, wantErr: ErrInvalidMarks},
+		{name: "too few bits", marks: Marks{Mask: 0xf0000000, StateMask: 0}, wantErr: ErrInvalidMarks},
+		{name: "too many bits", marks: Marks{Mask: 0xfe000000, StateMask: 0}, wantErr: ErrInvalidMarks},
+		{name: "not contiguous", marks: Marks{Mask: 0xf8000001, StateMask: 0}, wantErr: ErrInvalidMarks},
+		{name: "overlapping", marks: Marks{Mask: 0xfc000000, StateMask: 0x04000000}, wantErr: ErrInvalidMarks},
+	}
+
+	for _, tt := range tests {
+		if err := tt.marks.Validate(); !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: Validate() error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestMarksValue(t *testing.T) {
+	// EF, 46, in the top six bits with the state bit below them.
+	if got, want := DefaultMarks().value(46), uint32(0xb9000000); got != want {
+		t.Errorf("value(46) = %#08x, want %#08x", got, want)
+	}
+}
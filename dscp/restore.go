@@ -0,0 +1,182 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package dscp
+
+import (
+	"fmt"
+
+	"github.com/randomvariable/sqm/datastore"
+	"github.com/randomvariable/sqm/links"
+	"github.com/vishvananda/netlink"
+	"go.uber.org/zap"
+)
+
+// WarningName is the name of the warning set while DSCP can't be restored.
+const WarningName = "dscp restore"
+
+// RestoreController restores the DSCP of ingress traffic from conntrack marks with a ctinfo
+// action on the IFB device's egress hook, which packets pass through after being redirected
+// and before CAKE sorts them into tins. It's a filter of its own rather than an action of the
+// redirect filter, as the redirector lists its filters with go-tc, which can't parse ctinfo.
+type RestoreController struct {
+	// marks is where DSCP is stored
+	marks Marks
+	// data is the shared datastore
+	data *datastore.Data
+	// log is the logger
+	log *zap.SugaredLogger
+}
+
+// NewRestoreController returns an instantiated controller.
+func NewRestoreController(marks Marks, data *datastore.Data, log *zap.SugaredLogger) *RestoreController {
+	return &RestoreController{
+		marks: marks,
+		data:  data,
+		log:   log.Named("DSCP Restore Controller"),
+	}
+}
+
+// Reconcile defines the reconciliation loop.
+func (c *RestoreController) Reconcile() error {
+	ifbDevice, err := c.data.IfbDevice()
+	if err != nil {
+		return fmt.Errorf("error getting ifb device: %w", err)
+	}
+
+	err = c.reconcile(ifbDevice)
+
+	warning := datastore.Warning{Message: "", Unhealthy: false}
+	if err != nil {
+		warning.Message = "ingress DSCP isn't restored from conntrack marks: " + err.Error()
+	}
+
+	if c.data.SetWarning(WarningName, warning) && err == nil {
+		c.log.Infow("Restoring DSCP from conntrack marks", "Marks", c.marks.String())
+	}
+
+	return err
+}
+
+// reconcile ensures the IFB device has a clsact qdisc, with a single ctinfo filter as wanted
+// on its egress hook.
+func (c *RestoreController) reconcile(ifbDevice netlink.Link) error {
+	if err := links.Current(ifbDevice); err != nil {
+		return err //nolint:wrapcheck
+	}
+
+	if err := c.ensureClsact(ifbDevice); err != nil {
+		return err
+	}
+
+	filters, err := listFilters(ifbDevice.Attrs().Index)
+	if err != nil {
+		return err
+	}
+
+	found := false
+
+	for _, f := range filters {
+		if !f.owned() {
+			continue
+		}
+
+		reason := f.mismatch(c.marks)
+		if reason == "" && found {
+			reason = "duplicate"
+		}
+
+		if reason == "" {
+			found = true
+
+			continue
+		}
+
+		if err := deleteFilter(ifbDevice.Attrs().Index, f); err != nil {
+			return err
+		}
+
+		c.log.Warnw("Repairing ctinfo filter", "Reason", reason)
+	}
+
+	if found {
+		return nil
+	}
+
+	if err := addFilter(ifbDevice.Attrs().Index, c.marks); err != nil {
+		return err
+	}
+
+	c.log.Info("Added ctinfo filter")
+
+	return nil
+}
+
+// ensureClsact adds a clsact qdisc to the IFB device if it doesn't have one.
+func (c *RestoreController) ensureClsact(ifbDevice netlink.Link) error {
+	qdiscs, err := netlink.QdiscList(ifbDevice)
+	if err != nil {
+		return fmt.Errorf("error listing qdiscs: %w", err)
+	}
+
+	for _, qdisc := range qdiscs {
+		if qdisc.Attrs().Parent == netlink.HANDLE_CLSACT && qdisc.Type() == "clsact" {
+			return nil
+		}
+	}
+
+	if err := netlink.QdiscAdd(&netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: ifbDevice.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0), //nolint:gomnd
+			Parent:    netlink.HANDLE_CLSACT,
+			Refcnt:    0,
+		},
+		QdiscType: "clsact",
+	}); err != nil {
+		return fmt.Errorf("error adding clsact qdisc: %w", err)
+	}
+
+	return nil
+}
+
+// Release defines what happens on shutdown when shaping is to be left in place.
+func (c *RestoreController) Release() {
+	c.log.Info("Leaving ctinfo filter in place")
+}
+
+// ReconcileDelete defines what happens on shutdown. The IFB device is usually deleted too,
+// taking the filter with it.
+func (c *RestoreController) ReconcileDelete() {
+	ifbDevice, err := c.data.IfbDevice()
+	if err != nil {
+		return
+	}
+
+	filters, err := listFilters(ifbDevice.Attrs().Index)
+	if err != nil {
+		c.log.Warnw("Cannot list filters", "error", err)
+
+		return
+	}
+
+	deleted := false
+
+	for _, f := range filters {
+		if !f.owned() {
+			continue
+		}
+
+		if err := deleteFilter(ifbDevice.Attrs().Index, f); err != nil {
+			c.log.Errorw("Cannot delete ctinfo filter", "error", err)
+
+			continue
+		}
+
+		deleted = true
+	}
+
+	if deleted {
+		c.log.Info("Deleted ctinfo filter")
+	}
+}
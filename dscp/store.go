@@ -0,0 +1,207 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package dscp
+
+import (
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/randomvariable/sqm/datastore"
+	"github.com/randomvariable/sqm/firewall"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// StoreController stores the DSCP of packets leaving the root device in their connection's
+// conntrack mark.
+type StoreController struct {
+	// device is the root device name
+	device string
+	// marks is where DSCP is stored
+	marks Marks
+	// data is the shared datastore
+	data *datastore.Data
+	// log is the logger
+	log *zap.SugaredLogger
+}
+
+// NewStoreController returns an instantiated controller.
+func NewStoreController(device string, marks Marks, data *datastore.Data, log *zap.SugaredLogger) *StoreController {
+	return &StoreController{
+		device: device,
+		marks:  marks,
+		data:   data,
+		log:    log.Named("DSCP Store Controller"),
+	}
+}
+
+// chain returns the chain holding the device's store rules.
+func (c *StoreController) chain() *nftables.Chain {
+	return firewall.Chain("dscp-" + c.device)
+}
+
+// jumpTag marks the rule jumping to the device's chain.
+func (c *StoreController) jumpTag() []byte {
+	return firewall.Tag("dscp:" + c.device)
+}
+
+// storeTag marks the store rules, including the layout so a change replaces them.
+func (c *StoreController) storeTag() []byte {
+	return firewall.Tag("dscp:" + c.device + ":" + c.marks.String())
+}
+
+// Reconcile defines the reconciliation loop. There's one rule per DSCP value and IP version,
+// and they're all replaced if any are missing.
+func (c *StoreController) Reconcile() error {
+	if _, err := c.data.RootDevice(); err != nil {
+		return fmt.Errorf("error getting root device: %w", err)
+	}
+
+	return firewall.Update(func(conn *nftables.Conn) error { //nolint:wrapcheck
+		jumps, err := firewall.Rules(conn, firewall.Postrouting())
+		if err != nil {
+			return err //nolint:wrapcheck
+		}
+
+		stores, err := firewall.Rules(conn, c.chain())
+		if err != nil {
+			return err //nolint:wrapcheck
+		}
+
+		desired := c.storeRules()
+		if len(firewall.Tagged(stores, c.storeTag())) != len(desired) || len(stores) != len(desired) {
+			conn.AddChain(c.chain())
+			conn.FlushChain(c.chain())
+
+			for _, rule := range desired {
+				conn.AddRule(rule)
+			}
+
+			c.log.Infow("Storing DSCP in conntrack marks", "Marks", c.marks.String())
+		}
+
+		if len(firewall.Tagged(jumps, c.jumpTag())) == 0 {
+			conn.AddChain(firewall.Postrouting())
+			conn.AddRule(c.jumpRule())
+		}
+
+		return nil
+	})
+}
+
+// jumpRule returns the rule sending packets leaving the root device to its chain.
+func (c *StoreController) jumpRule() *nftables.Rule {
+	return &nftables.Rule{ //nolint:exhaustruct
+		Table: firewall.Table(),
+		Chain: firewall.Postrouting(),
+		Exprs: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyOIFNAME, SourceRegister: false, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: firewall.IfName(c.device)},
+			&expr.Verdict{Kind: expr.VerdictJump, Chain: c.chain().Name},
+		},
+		UserData: c.jumpTag(),
+	}
+}
+
+// storeRules returns a rule for each DSCP value and IP version, setting the stored DSCP and
+// state bits of the conntrack mark while leaving the other bits alone.
+func (c *StoreController) storeRules() []*nftables.Rule {
+	rules := []*nftables.Rule{}
+	keep := ^(c.marks.Mask | c.marks.StateMask)
+
+	for dscp := uint8(0); dscp < 1<<dscpBits; dscp++ {
+		// The DSCP field is the top six bits of the IPv4 TOS byte, and straddles the first two
+		// bytes of the IPv6 header.
+		matches := [][]expr.Any{
+			dscpMatch(unix.NFPROTO_IPV4, 1, []byte{0xfc}, []byte{dscp << 2}),                  //nolint:gomnd
+			dscpMatch(unix.NFPROTO_IPV6, 0, []byte{0x0f, 0xc0}, []byte{dscp >> 2, dscp << 6}), //nolint:gomnd
+		}
+
+		for _, match := range matches {
+			exprs := append(match,
+				&expr.Ct{Register: 1, SourceRegister: false, Key: expr.CtKeyMARK},
+				&expr.Bitwise{
+					SourceRegister: 1,
+					DestRegister:   1,
+					Len:            4, //nolint:gomnd
+					Mask:           binaryutil.NativeEndian.PutUint32(keep),
+					Xor:            binaryutil.NativeEndian.PutUint32(c.marks.value(dscp)),
+				},
+				&expr.Ct{Register: 1, SourceRegister: true, Key: expr.CtKeyMARK},
+				&expr.Verdict{Kind: expr.VerdictReturn, Chain: ""},
+			)
+
+			rules = append(rules, &nftables.Rule{ //nolint:exhaustruct
+				Table:    firewall.Table(),
+				Chain:    c.chain(),
+				Exprs:    exprs,
+				UserData: c.storeTag(),
+			})
+		}
+	}
+
+	return rules
+}
+
+// dscpMatch returns the expressions matching a DSCP value in a header of the given family.
+func dscpMatch(family byte, offset uint32, mask []byte, value []byte) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, SourceRegister: false, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family}},
+		&expr.Payload{ //nolint:exhaustruct
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       offset,
+			Len:          uint32(len(mask)),
+		},
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            uint32(len(mask)),
+			Mask:           mask,
+			Xor:            make([]byte, len(mask)),
+		},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: value},
+	}
+}
+
+// Release defines what happens on shutdown when shaping is to be left in place.
+func (c *StoreController) Release() {
+	c.log.Info("Leaving DSCP store rules in place")
+}
+
+// ReconcileDelete defines what happens on shutdown.
+func (c *StoreController) ReconcileDelete() {
+	err := firewall.Remove(func(conn *nftables.Conn) error {
+		jumps, err := firewall.Rules(conn, firewall.Postrouting())
+		if err != nil {
+			return err //nolint:wrapcheck
+		}
+
+		for _, rule := range firewall.Tagged(jumps, c.jumpTag()) {
+			if err := conn.DelRule(rule); err != nil {
+				return fmt.Errorf("cannot delete rule: %w", err)
+			}
+		}
+
+		exists, err := firewall.HasChain(conn, c.chain())
+		if err != nil || !exists {
+			return err //nolint:wrapcheck
+		}
+
+		conn.FlushChain(c.chain())
+		conn.DelChain(c.chain())
+
+		return nil
+	})
+	if err != nil {
+		c.log.Errorw("Cannot delete DSCP store rules", "error", err)
+
+		return
+	}
+
+	c.log.Info("Deleted DSCP store rules")
+}
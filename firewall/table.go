@@ -0,0 +1,225 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+firewall is a package for managing sqm's nftables table. Every nftables rule sqm adds is kept
+in it and tagged with the part of sqm it belongs to, so it can be found and removed without
+touching anyone else's rules.
+*/
+package firewall
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/google/nftables"
+	"golang.org/x/sys/unix"
+)
+
+// TableName is the name of sqm's table, in the inet family.
+const TableName = "sqm"
+
+const (
+	// tagPrefix starts every tag, as it does the alias of every link sqm creates
+	tagPrefix = "sqm:"
+	// commentType is NFTNL_UDATA_RULE_COMMENT, so nft shows tags as rule comments
+	commentType = 0
+	// maxComment is NFTNL_UDATA_COMMENT_MAXLEN
+	maxComment = 128
+	// postroutingPriority runs sqm's postrouting rules after the mangle priority, so markings
+	// set there are seen
+	postroutingPriority = -140
+)
+
+// mu serialises changes to the table between the controllers of every interface.
+var mu sync.Mutex //nolint:gochecknoglobals
+
+// Table returns sqm's table.
+func Table() *nftables.Table {
+	return &nftables.Table{Name: TableName, Family: nftables.TableFamilyINet} //nolint:exhaustruct
+}
+
+// Postrouting returns the base chain for rules that see packets on their way out of a device.
+func Postrouting() *nftables.Chain {
+	return &nftables.Chain{ //nolint:exhaustruct
+		Name:     "postrouting",
+		Table:    Table(),
+		Hooknum:  nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityRef(postroutingPriority),
+		Type:     nftables.ChainTypeFilter,
+	}
+}
+
+// Chain returns a regular chain in sqm's table.
+func Chain(name string) *nftables.Chain {
+	return &nftables.Chain{Name: name, Table: Table()} //nolint:exhaustruct
+}
+
+// Update runs fn after adding sqm's table, then commits everything fn batched. Adding the table
+// is a no-op when it exists, as is fn adding a base chain that exists.
+func Update(fn func(conn *nftables.Conn) error) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	conn, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("cannot connect to nftables: %w", err)
+	}
+
+	conn.AddTable(Table())
+
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("cannot add nftables table %s: %w", TableName, err)
+	}
+
+	if err := fn(conn); err != nil {
+		return err
+	}
+
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("cannot update nftables table %s: %w", TableName, err)
+	}
+
+	return nil
+}
+
+// Remove runs fn, commits everything it batched, then deletes sqm's table if no rules are
+// left in it.
+func Remove(fn func(conn *nftables.Conn) error) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	conn, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("cannot connect to nftables: %w", err)
+	}
+
+	if err := fn(conn); err != nil {
+		return err
+	}
+
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("cannot update nftables table %s: %w", TableName, err)
+	}
+
+	chains, err := chains(conn)
+	if err != nil {
+		return err
+	}
+
+	for _, chain := range chains {
+		rules, err := conn.GetRules(Table(), chain)
+		if err != nil {
+			return fmt.Errorf("cannot list rules of chain %s: %w", chain.Name, err)
+		}
+
+		if len(rules) > 0 {
+			return nil
+		}
+	}
+
+	conn.DelTable(Table())
+
+	if err := conn.Flush(); err != nil && !errors.Is(err, unix.ENOENT) {
+		return fmt.Errorf("cannot delete nftables table %s: %w", TableName, err)
+	}
+
+	return nil
+}
+
+// Tag returns the user data marking a rule as owner's, shown by nft as the rule's comment.
+func Tag(owner string) []byte {
+	comment := tagPrefix + owner
+	if len(comment) >= maxComment {
+		comment = comment[:maxComment-1]
+	}
+
+	return append([]byte{commentType, byte(len(comment) + 1)}, append([]byte(comment), 0)...)
+}
+
+// Tagged returns the rules carrying tag.
+func Tagged(rules []*nftables.Rule, tag []byte) []*nftables.Rule {
+	tagged := []*nftables.Rule{}
+
+	for _, rule := range rules {
+		if bytes.Equal(rule.UserData, tag) {
+			tagged = append(tagged, rule)
+		}
+	}
+
+	return tagged
+}
+
+// SameTags returns whether two lists of rules carry the same tags in the same order.
+func SameTags(existing []*nftables.Rule, desired []*nftables.Rule) bool {
+	if len(existing) != len(desired) {
+		return false
+	}
+
+	for i := range existing {
+		if !bytes.Equal(existing[i].UserData, desired[i].UserData) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// chains returns the chains in sqm's table.
+func chains(conn *nftables.Conn) ([]*nftables.Chain, error) {
+	all, err := conn.ListChainsOfTableFamily(nftables.TableFamilyINet)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list nftables chains: %w", err)
+	}
+
+	chains := []*nftables.Chain{}
+
+	for _, chain := range all {
+		if chain.Table.Name == TableName {
+			chains = append(chains, chain)
+		}
+	}
+
+	return chains, nil
+}
+
+// HasChain returns whether sqm's table has a chain.
+func HasChain(conn *nftables.Conn, chain *nftables.Chain) (bool, error) {
+	chains, err := chains(conn)
+	if err != nil {
+		return false, err
+	}
+
+	for _, existing := range chains {
+		if existing.Name == chain.Name {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Rules returns the rules of a chain in sqm's table, or none if the chain doesn't exist.
+func Rules(conn *nftables.Conn, chain *nftables.Chain) ([]*nftables.Rule, error) {
+	exists, err := HasChain(conn, chain)
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	rules, err := conn.GetRules(Table(), chain)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list rules of chain %s: %w", chain.Name, err)
+	}
+
+	return rules, nil
+}
+
+// IfName returns an interface name as nftables compares it.
+func IfName(name string) []byte {
+	b := make([]byte, unix.IFNAMSIZ)
+	copy(b, name)
+
+	return b
+}
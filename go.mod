@@ -9,20 +9,23 @@ replace github.com/randomvariable/sqm/hack/tools => ./hack/tools
 
 require (
 	github.com/MakeNowJust/heredoc v1.0.0
-	github.com/florianl/go-tc v0.4.2
+	github.com/florianl/go-tc v0.4.4
+	github.com/google/nftables v0.1.0
 	github.com/gosnmp/gosnmp v1.35.0
 	github.com/magefile/mage v1.14.0
 	github.com/spf13/cobra v1.6.1
 	github.com/vishvananda/netlink v1.1.1-0.20210330154013-f5de75959ad5
+	github.com/vishvananda/netns v0.0.1
 	go.uber.org/zap v1.24.0
 	golang.org/x/sys v0.3.0
+	gopkg.in/yaml.v2 v2.4.0
 	k8s.io/apimachinery v0.26.0
 )
 
 require (
 	github.com/go-logr/logr v1.2.3 // indirect
 	github.com/gogo/protobuf v1.3.2 // indirect
-	github.com/google/go-cmp v0.5.9 // indirect
+	github.com/google/go-cmp v0.6.0 // indirect
 	github.com/google/gofuzz v1.2.0 // indirect
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/josharian/native v1.1.0 // indirect
@@ -34,7 +37,6 @@ require (
 	github.com/rogpeppe/go-internal v1.9.0 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
 	github.com/stretchr/testify v1.8.1 // indirect
-	github.com/vishvananda/netns v0.0.1 // indirect
 	go.uber.org/atomic v1.10.0 // indirect
 	go.uber.org/goleak v1.2.0 // indirect
 	go.uber.org/multierr v1.9.0 // indirect
@@ -43,7 +45,6 @@ require (
 	golang.org/x/text v0.5.0 // indirect
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
 	gopkg.in/inf.v0 v0.9.1 // indirect
-	gopkg.in/yaml.v2 v2.4.0 // indirect
 	k8s.io/klog/v2 v2.80.1 // indirect
 	k8s.io/utils v0.0.0-20221128185143-99ec85e7a448 // indirect
 	sigs.k8s.io/json v0.0.0-20221116044647-bc3834ca7abd // indirect
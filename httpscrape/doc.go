@@ -0,0 +1,7 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// httpscrape defines a rate source that polls a web status page or JSON endpoint and
+// extracts the line rates with a JSONPath expression or a regular expression.
+// Typically for use with modems that don't expose SNMP or TR-064.
+package httpscrape
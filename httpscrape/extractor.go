@@ -0,0 +1,119 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package httpscrape
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrNoMatch        = errors.New("expression did not match")
+	ErrNotNumeric     = errors.New("extracted value is not numeric")
+	ErrNoCaptureGroup = errors.New("regular expression has no capture group")
+)
+
+// Extractor pulls a single numeric value out of a response body.
+type Extractor interface {
+	Extract(body []byte) (float64, error)
+}
+
+// jsonPathExtractor extracts a value from a JSON document.
+type jsonPathExtractor struct {
+	// expr is the original expression, for error messages
+	expr string
+	// steps is the parsed expression
+	steps []pathStep
+}
+
+// NewJSONPathExtractor returns an extractor for a JSONPath expression such as $.dsl.downstream.
+func NewJSONPathExtractor(expr string) (Extractor, error) {
+	steps, err := parseJSONPath(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	return jsonPathExtractor{expr: expr, steps: steps}, nil
+}
+
+// Extract implements Extractor.
+func (e jsonPathExtractor) Extract(body []byte) (float64, error) {
+	var doc interface{}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(&doc); err != nil {
+		return 0, fmt.Errorf("cannot decode JSON: %w", err)
+	}
+
+	value, err := evaluate(doc, e.steps)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", e.expr, err)
+	}
+
+	switch typed := value.(type) {
+	case json.Number:
+		return parseNumber(typed.String())
+	case string:
+		return parseNumber(typed)
+	default:
+		return 0, fmt.Errorf("%w: %s is %T", ErrNotNumeric, e.expr, value)
+	}
+}
+
+// regexExtractor extracts a value from the first capture group of a regular expression.
+type regexExtractor struct {
+	// re is the compiled expression
+	re *regexp.Regexp
+	// group is the index of the capture group holding the value
+	group int
+}
+
+// NewRegexExtractor returns an extractor for a regular expression. The value is taken from
+// the capture group named "value" if there is one, or the first capture group otherwise.
+func NewRegexExtractor(expr string) (Extractor, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regular expression: %w", err)
+	}
+
+	if re.NumSubexp() == 0 {
+		return nil, fmt.Errorf("%w: %q", ErrNoCaptureGroup, expr)
+	}
+
+	group := re.SubexpIndex("value")
+	if group == -1 {
+		group = 1
+	}
+
+	return regexExtractor{re: re, group: group}, nil
+}
+
+// Extract implements Extractor.
+func (e regexExtractor) Extract(body []byte) (float64, error) {
+	match := e.re.FindSubmatch(body)
+	if match == nil {
+		return 0, fmt.Errorf("%w: %s", ErrNoMatch, e.re)
+	}
+
+	return parseNumber(string(match[e.group]))
+}
+
+// parseNumber parses a number, tolerating surrounding whitespace and thousands separators.
+func parseNumber(raw string) (float64, error) {
+	cleaned := strings.ReplaceAll(strings.TrimSpace(raw), ",", "")
+
+	value, err := strconv.ParseFloat(cleaned, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q", ErrNotNumeric, raw)
+	}
+
+	return value, nil
+}
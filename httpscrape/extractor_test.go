@@ -0,0 +1,63 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package httpscrape
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRegexExtractor(t *testing.T) {
+	t.Parallel()
+
+	body := []byte(`<tr><td>Line 1</td><td>Downstream</td><td> 79,999 </td><td>Upstream</td><td>19999</td></tr>`)
+
+	tests := []struct {
+		name       string
+		expr       string
+		want       float64
+		wantNewErr error
+		wantErr    error
+	}{
+		{
+			name: "first group", expr: `Downstream</td><td>([^<]+)<`, want: 79999,
+			wantNewErr: nil, wantErr: nil,
+		},
+		{
+			name: "value group", expr: `Line (\d+).*Upstream</td><td>(?P<value>\d+)`, want: 19999,
+			wantNewErr: nil, wantErr: nil,
+		},
+		{
+			name: "named group other than value", expr: `Line (?P<line>\d+)`, want: 1,
+			wantNewErr: nil, wantErr: nil,
+		},
+		{name: "no group", expr: `Downstream`, want: 0, wantNewErr: ErrNoCaptureGroup, wantErr: nil},
+		{name: "no match", expr: `Attenuation</td><td>(\d+)`, want: 0, wantNewErr: nil, wantErr: ErrNoMatch},
+		{name: "not numeric", expr: `<td>(Line \d+)<`, want: 0, wantNewErr: nil, wantErr: ErrNotNumeric},
+	}
+
+	for _, tt := range tests {
+		extractor, err := NewRegexExtractor(tt.expr)
+		if !errors.Is(err, tt.wantNewErr) {
+			t.Errorf("%s: NewRegexExtractor() error = %v, want %v", tt.name, err, tt.wantNewErr)
+
+			continue
+		}
+
+		if err != nil {
+			continue
+		}
+
+		got, err := extractor.Extract(body)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: Extract() error = %v, want %v", tt.name, err, tt.wantErr)
+
+			continue
+		}
+
+		if got != tt.want {
+			t.Errorf("%s: Extract() = %g, want %g", tt.name, got, tt.want)
+		}
+	}
+}
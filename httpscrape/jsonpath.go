@@ -0,0 +1,124 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package httpscrape
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidJSONPath = errors.New("invalid JSONPath expression")
+	ErrPathNotFound    = errors.New("JSONPath did not match")
+)
+
+// pathStep is either a key into an object or an index into an array.
+type pathStep struct {
+	key   string
+	index int
+	isKey bool
+}
+
+// parseJSONPath parses the subset of JSONPath made of child and index selectors,
+// e.g. $.status.dsl["downstream rate"] or $.lines[0].rate.
+func parseJSONPath(expr string) ([]pathStep, error) {
+	rest := strings.TrimSpace(expr)
+	if !strings.HasPrefix(rest, "$") {
+		return nil, fmt.Errorf("%w: %q must start with $", ErrInvalidJSONPath, expr)
+	}
+
+	rest = rest[1:]
+	steps := []pathStep{}
+
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end == -1 {
+				end = len(rest) - 1
+			}
+
+			key := rest[1 : end+1]
+			if key == "" {
+				return nil, fmt.Errorf("%w: %q has an empty key", ErrInvalidJSONPath, expr)
+			}
+
+			steps = append(steps, pathStep{key: key, index: 0, isKey: true})
+			rest = rest[end+1:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end == -1 {
+				return nil, fmt.Errorf("%w: %q has an unterminated [", ErrInvalidJSONPath, expr)
+			}
+
+			step, err := parseBracket(rest[1:end])
+			if err != nil {
+				return nil, fmt.Errorf("%w: %q: %v", ErrInvalidJSONPath, expr, err) //nolint:errorlint
+			}
+
+			steps = append(steps, step)
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("%w: %q has unexpected %q", ErrInvalidJSONPath, expr, rest[0])
+		}
+	}
+
+	return steps, nil
+}
+
+// parseBracket parses the contents of a bracket selector, either a quoted key or an index.
+func parseBracket(selector string) (pathStep, error) {
+	selector = strings.TrimSpace(selector)
+	if len(selector) >= 2 && (selector[0] == '\'' || selector[0] == '"') && selector[len(selector)-1] == selector[0] {
+		return pathStep{key: selector[1 : len(selector)-1], index: 0, isKey: true}, nil
+	}
+
+	index, err := strconv.Atoi(selector)
+	if err != nil {
+		return pathStep{}, fmt.Errorf("bad index %q", selector) //nolint:goerr113
+	}
+
+	return pathStep{key: "", index: index, isKey: false}, nil
+}
+
+// evaluate walks a decoded JSON document along the given steps.
+func evaluate(doc interface{}, steps []pathStep) (interface{}, error) {
+	current := doc
+
+	for _, step := range steps {
+		if step.isKey {
+			obj, ok := current.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%w: %q is not an object key", ErrPathNotFound, step.key)
+			}
+
+			current, ok = obj[step.key]
+			if !ok {
+				return nil, fmt.Errorf("%w: no key %q", ErrPathNotFound, step.key)
+			}
+
+			continue
+		}
+
+		arr, ok := current.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%w: [%d] is not an array index", ErrPathNotFound, step.index)
+		}
+
+		index := step.index
+		if index < 0 {
+			index += len(arr)
+		}
+
+		if index < 0 || index >= len(arr) {
+			return nil, fmt.Errorf("%w: index %d out of range", ErrPathNotFound, step.index)
+		}
+
+		current = arr[index]
+	}
+
+	return current, nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package httpscrape
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func key(name string) pathStep {
+	return pathStep{key: name, index: 0, isKey: true}
+}
+
+func index(i int) pathStep {
+	return pathStep{key: "", index: i, isKey: false}
+}
+
+func TestParseJSONPath(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		expr    string
+		want    []pathStep
+		wantErr error
+	}{
+		{expr: "$", want: []pathStep{}, wantErr: nil},
+		{expr: "$.dsl.downstream", want: []pathStep{key("dsl"), key("downstream")}, wantErr: nil},
+		{expr: " $.lines[0].rate ", want: []pathStep{key("lines"), index(0), key("rate")}, wantErr: nil},
+		{expr: "$.lines[-1]", want: []pathStep{key("lines"), index(-1)}, wantErr: nil},
+		{expr: `$.status["downstream rate"]`, want: []pathStep{key("status"), key("downstream rate")}, wantErr: nil},
+		{expr: "$['a.b'][ 2 ]", want: []pathStep{key("a.b"), index(2)}, wantErr: nil},
+		{expr: "dsl.downstream", want: nil, wantErr: ErrInvalidJSONPath},
+		{expr: "$..rate", want: nil, wantErr: ErrInvalidJSONPath},
+		{expr: "$.lines[0", want: nil, wantErr: ErrInvalidJSONPath},
+		{expr: "$.lines[first]", want: nil, wantErr: ErrInvalidJSONPath},
+		{expr: "$rate", want: nil, wantErr: ErrInvalidJSONPath},
+	}
+
+	for _, tt := range tests {
+		steps, err := parseJSONPath(tt.expr)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("parseJSONPath(%q) error = %v, want %v", tt.expr, err, tt.wantErr)
+
+			continue
+		}
+
+		if !reflect.DeepEqual(steps, tt.want) {
+			t.Errorf("parseJSONPath(%q) = %+v, want %+v", tt.expr, steps, tt.want)
+		}
+	}
+}
+
+func TestJSONPathExtractor(t *testing.T) {
+	t.Parallel()
+
+	body := []byte(`{
+		"dsl": {"downstream": 79999, "upstream": "19,999", "state": "up"},
+		"lines": [{"rate": 1.5}, {"rate": 2.5}],
+		"status": {"downstream rate": 12345678901234567890}
+	}`)
+
+	tests := []struct {
+		expr    string
+		want    float64
+		wantErr error
+	}{
+		{expr: "$.dsl.downstream", want: 79999, wantErr: nil},
+		{expr: "$.dsl.upstream", want: 19999, wantErr: nil},
+		{expr: "$.lines[1].rate", want: 2.5, wantErr: nil},
+		{expr: "$.lines[-2].rate", want: 1.5, wantErr: nil},
+		{expr: `$.status["downstream rate"]`, want: 12345678901234567890, wantErr: nil},
+		{expr: "$.dsl.state", want: 0, wantErr: ErrNotNumeric},
+		{expr: "$.dsl", want: 0, wantErr: ErrNotNumeric},
+		{expr: "$.dsl.missing", want: 0, wantErr: ErrPathNotFound},
+		{expr: "$.lines[2].rate", want: 0, wantErr: ErrPathNotFound},
+		{expr: "$.dsl[0]", want: 0, wantErr: ErrPathNotFound},
+		{expr: "$.lines.rate", want: 0, wantErr: ErrPathNotFound},
+	}
+
+	for _, tt := range tests {
+		extractor, err := NewJSONPathExtractor(tt.expr)
+		if err != nil {
+			t.Fatalf("NewJSONPathExtractor(%q) error = %v", tt.expr, err)
+		}
+
+		got, err := extractor.Extract(body)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("Extract(%q) error = %v, want %v", tt.expr, err, tt.wantErr)
+
+			continue
+		}
+
+		if got != tt.want {
+			t.Errorf("Extract(%q) = %g, want %g", tt.expr, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package httpscrape
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/randomvariable/sqm/ratesource"
+)
+
+var ErrUnexpectedStatus = errors.New("unexpected HTTP status")
+
+const (
+	requestTimeout = 10 * time.Second
+	// maxBodySize bounds how much of a status page is read.
+	maxBodySize = 4 << 20
+)
+
+// Auth holds optional credentials. BearerToken takes precedence over basic authentication.
+type Auth struct {
+	Username    string
+	Password    string
+	BearerToken string
+}
+
+// Value describes how to extract one rate and the unit it is reported in.
+type Value struct {
+	Extractor Extractor
+	Unit      ratesource.Unit
+}
+
+// Source polls a URL and extracts the line rates from the response.
+type Source struct {
+	// url is the status page or endpoint to poll
+	url string
+	// auth holds the credentials
+	auth Auth
+	// ingress describes how to extract the ingress rate
+	ingress Value
+	// egress describes how to extract the egress rate
+	egress Value
+	// client is the HTTP client
+	client *http.Client
+}
+
+// NewHTTPSource returns an instantiated HTTP scrape rate source.
+func NewHTTPSource(url string, auth Auth, ingress, egress Value) Source {
+	return Source{
+		url:     url,
+		auth:    auth,
+		ingress: ingress,
+		egress:  egress,
+		client:  &http.Client{Timeout: requestTimeout}, //nolint:exhaustruct
+	}
+}
+
+// Read returns the current line rates.
+func (s Source) Read() (ratesource.Reading, error) {
+	body, err := s.fetch()
+	if err != nil {
+		return ratesource.Reading{}, err
+	}
+
+	ingress, err := extract(body, s.ingress)
+	if err != nil {
+		return ratesource.Reading{}, fmt.Errorf("cannot extract ingress rate: %w", err)
+	}
+
+	egress, err := extract(body, s.egress)
+	if err != nil {
+		return ratesource.Reading{}, fmt.Errorf("cannot extract egress rate: %w", err)
+	}
+
+	return ratesource.Reading{Ingress: ingress, Egress: egress}, nil
+}
+
+// fetch retrieves the response body.
+func (s Source) fetch() ([]byte, error) {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL: %w", err)
+	}
+
+	switch {
+	case s.auth.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+s.auth.BearerToken)
+	case s.auth.Username != "":
+		req.SetBasicAuth(s.auth.Username, s.auth.Password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request to %s failed: %w", s.url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s returned %s", ErrUnexpectedStatus, s.url, resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read response from %s: %w", s.url, err)
+	}
+
+	return body, nil
+}
+
+// extract applies a value's extractor and converts the result to kbps.
+func extract(body []byte, value Value) (int64, error) {
+	raw, err := value.Extractor.Extract(body)
+	if err != nil {
+		return 0, err //nolint:wrapcheck
+	}
+
+	return ratesource.ToKbps(raw, value.Unit) //nolint:wrapcheck
+}
@@ -0,0 +1,105 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package httpscrape
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/randomvariable/sqm/ratesource"
+)
+
+// regexValue returns a value extracted by a regular expression, failing the test if it doesn't
+// compile.
+func regexValue(t *testing.T, expr string, unit ratesource.Unit) Value {
+	t.Helper()
+
+	extractor, err := NewRegexExtractor(expr)
+	if err != nil {
+		t.Fatalf("NewRegexExtractor(%q) error = %v", expr, err)
+	}
+
+	return Value{Extractor: extractor, Unit: unit}
+}
+
+func TestSourceRead(t *testing.T) {
+	t.Parallel()
+
+	page := "down=80 up=20000"
+	// padding pushes the rates just past the end of what's read.
+	padding := strings.Repeat(" ", maxBodySize-len("down="))
+
+	tests := []struct {
+		name    string
+		auth    Auth
+		body    string
+		status  int
+		want    ratesource.Reading
+		wantErr error
+	}{
+		{
+			name: "basic auth", auth: Auth{Username: "admin", Password: "secret", BearerToken: ""}, body: page,
+			status: http.StatusOK, want: ratesource.Reading{Ingress: 80000, Egress: 20000}, wantErr: nil,
+		},
+		{
+			name: "bearer token", auth: Auth{Username: "admin", Password: "secret", BearerToken: "token"}, body: page,
+			status: http.StatusOK, want: ratesource.Reading{Ingress: 80000, Egress: 20000}, wantErr: nil,
+		},
+		{
+			name: "at the size limit", auth: Auth{}, body: padding[:len(padding)-len(page)] + page,
+			status: http.StatusOK, want: ratesource.Reading{Ingress: 80000, Egress: 20000}, wantErr: nil,
+		},
+		{
+			name: "beyond the size limit", auth: Auth{}, body: padding + page,
+			status: http.StatusOK, want: ratesource.Reading{}, wantErr: ErrNoMatch,
+		},
+		{
+			name: "error status", auth: Auth{}, body: page,
+			status: http.StatusForbidden, want: ratesource.Reading{}, wantErr: ErrUnexpectedStatus,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				want := ""
+
+				switch {
+				case tt.auth.BearerToken != "":
+					want = "Bearer " + tt.auth.BearerToken
+				case tt.auth.Username != "":
+					want = "Basic YWRtaW46c2VjcmV0"
+				}
+
+				if got := r.Header.Get("Authorization"); got != want {
+					t.Errorf("Authorization = %q, want %q", got, want)
+				}
+
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			source := NewHTTPSource(server.URL, tt.auth,
+				regexValue(t, `down=(\d+)`, ratesource.MegabitsPerSecond),
+				regexValue(t, `up=(?P<value>\d+)`, ratesource.KilobitsPerSecond))
+
+			reading, err := source.Read()
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Read() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if reading != tt.want {
+				t.Errorf("Read() = %+v, want %+v", reading, tt.want)
+			}
+		})
+	}
+}
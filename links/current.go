@@ -0,0 +1,30 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package links
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+)
+
+var ErrDeviceRecreated = errors.New("device was recreated")
+
+// Current checks a link held in the datastore still exists with the same ifindex, so
+// nothing is applied to a deleted link or to an unrelated link that has reused its index.
+// The device controllers pick up the new link on their next reconcile.
+func Current(dev netlink.Link) error {
+	link, err := netlink.LinkByName(dev.Attrs().Name)
+	if err != nil {
+		return fmt.Errorf("cannot find %s: %w", dev.Attrs().Name, err)
+	}
+
+	if link.Attrs().Index != dev.Attrs().Index {
+		return fmt.Errorf("%w: %s moved from ifindex %d to %d", ErrDeviceRecreated,
+			dev.Attrs().Name, dev.Attrs().Index, link.Attrs().Index)
+	}
+
+	return nil
+}
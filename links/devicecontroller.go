@@ -17,6 +17,8 @@ import (
 
 // DeviceController defines the controller.
 type DeviceController struct {
+	// Migrate claims an IFB device without an alias, as created by earlier releases
+	Migrate bool
 	// deviceName is the ip link name
 	deviceName string
 	// data is the shared datastore
@@ -25,26 +27,30 @@ type DeviceController struct {
 	log *zap.SugaredLogger
 	// create defines whether or not this controller is managing an IFB device or the root device
 	create bool
+	// rootIndex is the ifindex of the root device the IFB device was set up for
+	rootIndex int
+	// alias is the alias of the IFB device once it's known to be sqm's
+	alias string
 }
 
-// NewDeviceController creates an instantiated controller.
+// NewDeviceController creates an instantiated controller. When create is set, deviceName is
+// the name of the IFB device, usually from IFBName.
 func NewDeviceController(deviceName string,
 	data *datastore.Data, create bool, log *zap.SugaredLogger,
-) DeviceController {
-	if create {
-		deviceName = "ifb4" + deviceName
-	}
-
-	return DeviceController{
+) *DeviceController {
+	return &DeviceController{
+		Migrate:    false,
 		deviceName: deviceName,
 		data:       data,
 		log:        log.Named("Device Controller").With("DeviceName", deviceName),
 		create:     create,
+		rootIndex:  0,
+		alias:      "",
 	}
 }
 
 // ensureUp ensures the link is up or at least Unknown.
-func (d DeviceController) ensureUp(dev netlink.Link) error {
+func (d *DeviceController) ensureUp(dev netlink.Link) error {
 	if dev.Attrs().OperState != netlink.OperUp && dev.Attrs().OperState != netlink.OperUnknown {
 		d.log.Warnw("Device is not up, bringing up", "OperState", dev.Attrs().OperState.String())
 
@@ -56,8 +62,64 @@ func (d DeviceController) ensureUp(dev netlink.Link) error {
 	return nil
 }
 
+// ensureOwned checks an existing link with the IFB device's name is one sqm set up for this
+// root device, so an unrelated link is never shaped or deleted. IFB devices without an alias,
+// as created by earlier releases, are only claimed when Migrate is set, as nothing else marks
+// them as sqm's.
+func (d *DeviceController) ensureOwned(dev netlink.Link, rootName string) error {
+	if dev.Type() != "ifb" {
+		return fmt.Errorf("%w: %s is a %s device, not an IFB device", ErrNotOwned, d.deviceName, dev.Type())
+	}
+
+	alias := IFBAlias(rootName)
+
+	switch dev.Attrs().Alias {
+	case alias:
+	case "":
+		if !d.Migrate {
+			return fmt.Errorf("%w: %s has no alias, so may not be sqm's", ErrNotOwned, d.deviceName)
+		}
+
+		d.log.Infow("Marking IFB device as owned by sqm", "Alias", alias)
+
+		if err := netlink.LinkSetAlias(dev, alias); err != nil {
+			return fmt.Errorf("error setting alias: %w", err)
+		}
+
+		dev.Attrs().Alias = alias
+	default:
+		return fmt.Errorf("%w: %s has alias %q rather than %q", ErrNotOwned, d.deviceName,
+			dev.Attrs().Alias, alias)
+	}
+
+	d.alias = alias
+
+	return nil
+}
+
+// ensureMTU ensures the IFB device has the root device's MTU, which changes when PPP
+// renegotiates its MRU or an administrator changes it. It returns the updated link.
+func (d *DeviceController) ensureMTU(dev netlink.Link, mtu int) (netlink.Link, error) {
+	if dev.Attrs().MTU == mtu {
+		return dev, nil
+	}
+
+	d.log.Infow("Updating MTU to match root device", "OldMTU", dev.Attrs().MTU, "MTU", mtu)
+
+	if err := netlink.LinkSetMTU(dev, mtu); err != nil {
+		return nil, fmt.Errorf("error setting MTU: %w", err)
+	}
+
+	dev, err := netlink.LinkByName(d.deviceName)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving device link: %w", err)
+	}
+
+	return dev, nil
+}
+
 // Reconcile defines the reconciliation loop.
-func (d DeviceController) Reconcile() error {
+func (d *DeviceController) Reconcile() error {
 	dev, err := netlink.LinkByName(d.deviceName)
 	if err != nil {
 		if d.create {
@@ -67,19 +129,62 @@ func (d DeviceController) Reconcile() error {
 		return fmt.Errorf("error retrieving device link: %w", err)
 	}
 
-	updated := false
-
 	if d.create {
-		if err := d.ensureUp(dev); err != nil {
-			return err
+		return d.reconcileIfb(dev)
+	}
+
+	if old, err := d.data.RootDevice(); err == nil && old.Attrs().Index != dev.Attrs().Index {
+		d.log.Warnw("Root device was recreated", "OldDeviceIndex", old.Attrs().Index,
+			"DeviceIndex", dev.Attrs().Index)
+	}
+
+	if d.data.SetRootDevice(dev) {
+		d.log.Infow("Updated device", "DeviceIndex", dev.Attrs().Index, "DeviceMTU", dev.Attrs().MTU)
+	}
+
+	return nil
+}
+
+// reconcileIfb brings up the IFB device, replacing it if the root device has been recreated
+// since it was set up. The redirect on the old root device went with it, and replacing the
+// IFB device starts its shaping and redirection afresh.
+func (d *DeviceController) reconcileIfb(dev netlink.Link) error {
+	rootDevice, err := d.data.RootDevice()
+	if err != nil {
+		return fmt.Errorf("cannot reconcile IFB device without root device data: %w", err)
+	}
+
+	// Check ownership first, so a link that has since taken the IFB device's name isn't deleted
+	// as stale.
+	if err := d.ensureOwned(dev, rootDevice.Attrs().Name); err != nil {
+		return err
+	}
+
+	if d.rootIndex != 0 && d.rootIndex != rootDevice.Attrs().Index {
+		d.log.Warnw("Root device was recreated, replacing IFB device", "OldRootIndex", d.rootIndex,
+			"RootIndex", rootDevice.Attrs().Index)
+
+		if err := netlink.LinkDel(dev); err != nil {
+			return fmt.Errorf("cannot delete stale IFB device: %w", err)
 		}
 
-		updated = d.data.SetIfbDevice(dev)
-	} else {
-		updated = d.data.SetRootDevice(dev)
+		d.rootIndex = 0
+
+		return d.tryCreate()
+	}
+
+	if err := d.ensureUp(dev); err != nil {
+		return err
+	}
+
+	dev, err = d.ensureMTU(dev, rootDevice.Attrs().MTU)
+	if err != nil {
+		return err
 	}
 
-	if updated {
+	d.rootIndex = rootDevice.Attrs().Index
+
+	if d.data.SetIfbDevice(dev) {
 		d.log.Infow("Updated device", "DeviceIndex", dev.Attrs().Index, "DeviceMTU", dev.Attrs().MTU)
 	}
 
@@ -87,7 +192,7 @@ func (d DeviceController) Reconcile() error {
 }
 
 // tryCreate attempts to create a new IFB link.
-func (d DeviceController) tryCreate() error {
+func (d *DeviceController) tryCreate() error {
 	ifbLink := netlink.GenericLink{
 		LinkAttrs: netlink.NewLinkAttrs(),
 		LinkType:  "ifb",
@@ -104,20 +209,46 @@ func (d DeviceController) tryCreate() error {
 		return fmt.Errorf("cannot add IFB device: %w", err)
 	}
 
-	return nil
+	dev, err := netlink.LinkByName(d.deviceName)
+	if err != nil {
+		return fmt.Errorf("cannot retrieve new IFB device: %w", err)
+	}
+
+	alias := IFBAlias(rootDevice.Attrs().Name)
+	if err := netlink.LinkSetAlias(dev, alias); err != nil {
+		return fmt.Errorf("cannot set alias of new IFB device: %w", err)
+	}
+
+	dev.Attrs().Alias = alias
+
+	return d.reconcileIfb(dev)
+}
+
+// Release defines what happens on shutdown when shaping is to be left in place. The IFB
+// device is kept, to be adopted on the next start.
+func (d *DeviceController) Release() {
+	if d.create {
+		d.log.Info("Leaving device in place")
+	}
 }
 
 // ReconcileDelete defines what happens on shutdown.
-func (d DeviceController) ReconcileDelete() {
+func (d *DeviceController) ReconcileDelete() {
 	if !d.create {
 		return
 	}
 
-	ifbDevice, err := d.data.IfbDevice()
+	ifbDevice, err := netlink.LinkByName(d.deviceName)
 	if err != nil {
 		return
 	}
 
+	if d.alias == "" || ifbDevice.Attrs().Alias != d.alias {
+		d.log.Warnw("Not deleting IFB device sqm doesn't own", "Alias", ifbDevice.Attrs().Alias)
+
+		return
+	}
+
 	if err := netlink.LinkDel(ifbDevice); err != nil {
 		d.log.Errorw("Cannot delete IFB device", "error", err)
 	}
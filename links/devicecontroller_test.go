@@ -0,0 +1,188 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package links
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/randomvariable/sqm/datastore"
+	"github.com/randomvariable/sqm/netnstest"
+	"github.com/vishvananda/netlink"
+	"go.uber.org/zap"
+)
+
+// addIFB creates an IFB device with the given alias, as another program or an earlier release
+// might have.
+func addIFB(t *testing.T, alias string) netlink.Link {
+	t.Helper()
+
+	ifb := &netlink.GenericLink{LinkAttrs: netlink.NewLinkAttrs(), LinkType: "ifb"}
+	ifb.Name = IFBName(netnstest.RootName)
+
+	if err := netlink.LinkAdd(ifb); err != nil {
+		t.Skipf("kernel can't create IFB devices: %v", err)
+	}
+
+	link, err := netlink.LinkByName(ifb.Name)
+	if err != nil {
+		t.Fatalf("cannot find %s: %v", ifb.Name, err)
+	}
+
+	if alias != "" {
+		if err := netlink.LinkSetAlias(link, alias); err != nil {
+			t.Fatalf("cannot set alias of %s: %v", ifb.Name, err)
+		}
+	}
+
+	return link
+}
+
+// newControllers returns the root and IFB device controllers, with the root device reconciled.
+func newControllers(t *testing.T) (*DeviceController, *DeviceController) {
+	t.Helper()
+
+	data := datastore.NewDataStore()
+	log := zap.NewNop().Sugar()
+	root := NewDeviceController(netnstest.RootName, data, false, log)
+
+	if err := root.Reconcile(); err != nil {
+		t.Fatalf("cannot reconcile root device: %v", err)
+	}
+
+	return root, NewDeviceController(IFBName(netnstest.RootName), data, true, log)
+}
+
+// ifbAlias returns the alias of the IFB device.
+func ifbAlias(t *testing.T) string {
+	t.Helper()
+
+	link, err := netlink.LinkByName(IFBName(netnstest.RootName))
+	if err != nil {
+		t.Fatalf("cannot find IFB device: %v", err)
+	}
+
+	return link.Attrs().Alias
+}
+
+func TestIFBOwnership(t *testing.T) {
+	tests := []struct {
+		name string
+		// existing is the alias of an IFB device already present, "-" for none
+		existing  string
+		migrate   bool
+		wantErr   error
+		wantAlias string
+	}{
+		{
+			name:      "created",
+			existing:  "-",
+			migrate:   false,
+			wantErr:   nil,
+			wantAlias: IFBAlias(netnstest.RootName),
+		},
+		{
+			name:      "adopted",
+			existing:  IFBAlias(netnstest.RootName),
+			migrate:   false,
+			wantErr:   nil,
+			wantAlias: IFBAlias(netnstest.RootName),
+		},
+		{
+			name:      "unaliased",
+			existing:  "",
+			migrate:   false,
+			wantErr:   ErrNotOwned,
+			wantAlias: "",
+		},
+		{
+			name:      "unaliased and migrated",
+			existing:  "",
+			migrate:   true,
+			wantErr:   nil,
+			wantAlias: IFBAlias(netnstest.RootName),
+		},
+		{
+			name:      "someone else's",
+			existing:  "other:ifb",
+			migrate:   true,
+			wantErr:   ErrNotOwned,
+			wantAlias: "other:ifb",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			netnstest.EnterScratchNamespace(t)
+			netnstest.AddVeth(t)
+
+			if tt.existing != "-" {
+				addIFB(t, tt.existing)
+			}
+
+			_, ifb := newControllers(t)
+			ifb.Migrate = tt.migrate
+
+			err := ifb.Reconcile()
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Reconcile() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if alias := ifbAlias(t); alias != tt.wantAlias {
+				t.Errorf("IFB device alias = %q, want %q", alias, tt.wantAlias)
+			}
+
+			ifb.ReconcileDelete()
+
+			_, err = netlink.LinkByName(IFBName(netnstest.RootName))
+			if owned := tt.wantErr == nil; owned != (err != nil) {
+				t.Errorf("IFB device deleted on shutdown = %t, want %t", err != nil, owned)
+			}
+		})
+	}
+}
+
+func TestStaleIFBNotDeletedUnlessOwned(t *testing.T) {
+	netnstest.EnterScratchNamespace(t)
+	netnstest.AddVeth(t)
+	addIFB(t, IFBAlias(netnstest.RootName))
+
+	root, ifb := newControllers(t)
+	if err := ifb.Reconcile(); err != nil {
+		t.Fatalf("cannot reconcile IFB device: %v", err)
+	}
+
+	// Recreate the root device, and have another program take the IFB device's name meanwhile.
+	for _, name := range []string{netnstest.RootName, IFBName(netnstest.RootName)} {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			t.Fatalf("cannot find %s: %v", name, err)
+		}
+
+		if err := netlink.LinkDel(link); err != nil {
+			t.Fatalf("cannot delete %s: %v", name, err)
+		}
+	}
+
+	netnstest.AddVeth(t)
+	other := addIFB(t, "other:ifb")
+
+	if err := root.Reconcile(); err != nil {
+		t.Fatalf("cannot reconcile recreated root device: %v", err)
+	}
+
+	if err := ifb.Reconcile(); !errors.Is(err, ErrNotOwned) {
+		t.Fatalf("Reconcile() error = %v, want %v", err, ErrNotOwned)
+	}
+
+	link, err := netlink.LinkByName(IFBName(netnstest.RootName))
+	if err != nil {
+		t.Fatalf("other program's IFB device was deleted: %v", err)
+	}
+
+	if link.Attrs().Index != other.Attrs().Index {
+		t.Errorf("IFB device ifindex = %d, want %d", link.Attrs().Index, other.Attrs().Index)
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package links
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+	"go.uber.org/zap"
+)
+
+// Pipelines creates and removes the controllers managing a discovered link.
+type Pipelines interface {
+	// Add starts managing the named link, which matched the pattern at the given index
+	Add(name string, pattern int) error
+	// Remove stops managing the named link and tears down anything set up for it
+	Remove(name string)
+}
+
+// DiscoveryController watches for links matching a set of patterns, adding a pipeline
+// when one appears and removing it when it goes away.
+type DiscoveryController struct {
+	// patterns are checked in order, the first match wins
+	patterns []Pattern
+	// pipelines is told about links coming and going
+	pipelines Pipelines
+	// log is the logger
+	log *zap.SugaredLogger
+	// mu serialises syncs from the ticker and from link events
+	mu *sync.Mutex
+	// managed is the set of links with a pipeline
+	managed map[string]bool
+	// done stops the link subscription, nil while not subscribed
+	done chan struct{}
+}
+
+// NewDiscoveryController returns an instantiated controller.
+func NewDiscoveryController(patterns []Pattern, pipelines Pipelines, log *zap.SugaredLogger) *DiscoveryController {
+	return &DiscoveryController{
+		patterns:  patterns,
+		pipelines: pipelines,
+		log:       log.Named("Discovery Controller"),
+		mu:        &sync.Mutex{},
+		managed:   map[string]bool{},
+		done:      nil,
+	}
+}
+
+// Reconcile defines the reconciliation loop. Link events trigger a sync straight away;
+// reconciling on a ticker catches anything missed while the subscription was down.
+func (d *DiscoveryController) Reconcile() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.done == nil {
+		if err := d.subscribe(); err != nil {
+			d.log.Warnw("Cannot subscribe to link events, relying on periodic sync", "error", err)
+		}
+	}
+
+	return d.sync()
+}
+
+// subscribe starts watching link events. mu must be held.
+func (d *DiscoveryController) subscribe() error {
+	updates := make(chan netlink.LinkUpdate)
+	done := make(chan struct{})
+
+	if err := netlink.LinkSubscribe(updates, done); err != nil {
+		return fmt.Errorf("cannot subscribe to link updates: %w", err)
+	}
+
+	d.done = done
+
+	go func() {
+		for range updates {
+			d.mu.Lock()
+			// Events may still be buffered after shutdown, which must not add pipelines.
+			if d.done == done {
+				if err := d.sync(); err != nil {
+					d.log.Errorw("Cannot sync links", "error", err)
+				}
+			}
+			d.mu.Unlock()
+		}
+
+		// The subscription ended, so resubscribe on the next reconcile unless shutting down.
+		d.mu.Lock()
+		if d.done == done {
+			d.done = nil
+		}
+		d.mu.Unlock()
+	}()
+
+	return nil
+}
+
+// sync adds pipelines for new matching links and removes them for links that are gone.
+// mu must be held.
+func (d *DiscoveryController) sync() error {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return fmt.Errorf("cannot list links: %w", err)
+	}
+
+	present := map[string]bool{}
+
+	for _, link := range links {
+		name := link.Attrs().Name
+
+		pattern, ok := d.match(link)
+		if !ok {
+			continue
+		}
+
+		present[name] = true
+
+		if d.managed[name] {
+			continue
+		}
+
+		if err := d.pipelines.Add(name, pattern); err != nil {
+			d.log.Errorw("Cannot add pipeline for link", "link", name, "error", err)
+
+			continue
+		}
+
+		d.managed[name] = true
+		d.log.Infow("Link appeared, added pipeline", "link", name, "pattern", d.patterns[pattern].String())
+	}
+
+	for name := range d.managed {
+		if present[name] {
+			continue
+		}
+
+		d.pipelines.Remove(name)
+		delete(d.managed, name)
+		d.log.Infow("Link disappeared, removed pipeline", "link", name)
+	}
+
+	return nil
+}
+
+// match returns the index of the first pattern matching the link. IFB and loopback
+// devices are never matched, so a broad pattern can't shape sqm's own devices.
+func (d *DiscoveryController) match(link netlink.Link) (int, bool) {
+	if link.Type() == "ifb" || link.Attrs().Flags&net.FlagLoopback != 0 {
+		return 0, false
+	}
+
+	for i, pattern := range d.patterns {
+		if pattern.Match(link.Attrs().Name) {
+			return i, true
+		}
+	}
+
+	return 0, false
+}
+
+// ReconcileDelete defines what happens on shutdown. Pipelines are torn down by the manager.
+func (d *DiscoveryController) ReconcileDelete() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.done != nil {
+		close(d.done)
+		d.done = nil
+	}
+
+	d.log.Info("Discovery shut down")
+}
@@ -0,0 +1,52 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package links
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+var ErrNotOwned = errors.New("link is not owned by sqm")
+
+const (
+	// MaxNameLength is the longest link name the kernel accepts, IFNAMSIZ less the terminator.
+	MaxNameLength = 15
+	// IFBPrefix starts the name of every IFB device sqm creates.
+	IFBPrefix = "ifb4"
+	// OwnerAliasPrefix starts the alias of every link sqm creates.
+	OwnerAliasPrefix = "sqm:"
+	// hashLength is the number of hex digits of the root device name's hash in long IFB names.
+	hashLength = 4
+)
+
+// IFBName returns the IFB device name for a root device. Names that fit are "ifb4" and the
+// root device name, as in earlier releases. Longer names are truncated and end in a hash of
+// the whole root device name, so that e.g. wg-office-uplink and wg-office-backup differ.
+func IFBName(rootName string) string {
+	name := IFBPrefix + rootName
+	if len(name) <= MaxNameLength {
+		return name
+	}
+
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(rootName))
+	suffix := fmt.Sprintf("-%0*x", hashLength, hash.Sum32()&0xffff)
+
+	return name[:MaxNameLength-len(suffix)] + suffix
+}
+
+// IFBAlias returns the alias marking an IFB device as sqm's, recording its root device.
+func IFBAlias(rootName string) string {
+	return OwnerAliasPrefix + "ifb:" + rootName
+}
+
+// IsOwned returns whether the link carries an alias marking it as sqm's.
+func IsOwned(link netlink.Link) bool {
+	return strings.HasPrefix(link.Attrs().Alias, OwnerAliasPrefix)
+}
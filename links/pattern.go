@@ -0,0 +1,57 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package links
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+)
+
+// Pattern matches link names with either a glob or a regular expression.
+type Pattern struct {
+	// glob is a path.Match pattern, used if re is nil
+	glob string
+	// re is an anchored regular expression
+	re *regexp.Regexp
+}
+
+// NewGlobPattern returns a pattern matching a glob such as ppp* or eth0.*.
+func NewGlobPattern(glob string) (Pattern, error) {
+	if _, err := path.Match(glob, ""); err != nil {
+		return Pattern{}, fmt.Errorf("invalid glob %q: %w", glob, err)
+	}
+
+	return Pattern{glob: glob, re: nil}, nil
+}
+
+// NewRegexPattern returns a pattern matching a regular expression against the whole name.
+func NewRegexPattern(expr string) (Pattern, error) {
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return Pattern{}, fmt.Errorf("invalid regular expression %q: %w", expr, err)
+	}
+
+	return Pattern{glob: "", re: re}, nil
+}
+
+// Match returns whether the link name matches.
+func (p Pattern) Match(name string) bool {
+	if p.re != nil {
+		return p.re.MatchString(name)
+	}
+
+	matched, _ := path.Match(p.glob, name)
+
+	return matched
+}
+
+// String returns the pattern as configured.
+func (p Pattern) String() string {
+	if p.re != nil {
+		return p.re.String()
+	}
+
+	return p.glob
+}
@@ -0,0 +1,153 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package manager
+
+import (
+	"sync"
+	"time"
+
+	"github.com/randomvariable/sqm/datastore"
+	"go.uber.org/zap"
+)
+
+// Group is a set of controllers that share a datastore and logger, such as all the
+// controllers managing one interface.
+type Group struct {
+	// Name identifies the group, typically the interface name
+	Name string
+	// Data is the datastore shared by the group's controllers
+	Data *datastore.Data
+	// Log is the logger, with fields identifying the group
+	Log *zap.SugaredLogger
+
+	controllers []controllerInfo
+	tickers     []*time.Ticker
+	wg          *sync.WaitGroup
+	done        chan bool
+	stopOnce    *sync.Once
+	// keep is set before done is closed if controllers should leave what they set up in place
+	keep bool
+}
+
+func newGroup(name string, data *datastore.Data, log *zap.SugaredLogger) *Group {
+	return &Group{
+		Name:        name,
+		Data:        data,
+		Log:         log,
+		controllers: []controllerInfo{},
+		tickers:     []*time.Ticker{},
+		wg:          &sync.WaitGroup{},
+		done:        make(chan bool),
+		stopOnce:    &sync.Once{},
+		keep:        false,
+	}
+}
+
+// AddController adds a controller for start up. The controller is reconciled every t, and
+// as soon as any of the watched datastore keys change.
+func (g *Group) AddController(name string, c controller, t time.Duration, watches ...datastore.Key) {
+	g.controllers = append(g.controllers, controllerInfo{name: name, controller: c, tickerDuration: t, watches: watches})
+}
+
+// newTicker sets up the reconciliation loops for each controller. Besides the ticker,
+// the controller is reconciled whenever any of the watched datastore keys change.
+func (g *Group) newTicker(name string,
+	duration time.Duration,
+	watches []datastore.Key,
+	ctrl controller,
+) *time.Ticker {
+	g.wg.Add(1)
+
+	ticker := time.NewTicker(duration)
+
+	// A nil channel blocks forever, so controllers without watches only use the ticker.
+	var (
+		sub     *datastore.Subscription
+		changed <-chan struct{}
+	)
+
+	if len(watches) > 0 {
+		sub = g.Data.Subscribe(watches...)
+		changed = sub.C
+	}
+
+	// The first reconcile runs on the same goroutine as the rest, so a controller is never
+	// reconciled concurrently with itself. Changes during it are picked up by the subscription.
+	go func() {
+		g.checkReconciliationWithError(name, ctrl.Reconcile)
+
+		for {
+			select {
+			case <-g.done:
+				if sub != nil {
+					sub.Close()
+				}
+
+				g.shutdown(ctrl)
+				g.wg.Done()
+
+				return
+			case <-ticker.C:
+				g.checkReconciliationWithError(name, ctrl.Reconcile)
+			case <-changed:
+				g.checkReconciliationWithError(name, ctrl.Reconcile)
+			}
+		}
+	}()
+
+	return ticker
+}
+
+// shutdown runs a controller's delete reconciliation, or releases it if the group is stopping
+// with everything kept in place and the controller supports that.
+func (g *Group) shutdown(ctrl controller) {
+	if r, ok := ctrl.(releaser); ok && g.keep {
+		r.Release()
+
+		return
+	}
+
+	ctrl.ReconcileDelete()
+}
+
+func (g *Group) checkReconciliationWithError(name string, f func() error) {
+	if err := f(); err != nil {
+		log := g.Log.Desugar().WithOptions(zap.AddCallerSkip(1)).Sugar().With("controller", name)
+		log.Error(err)
+	}
+}
+
+// startController starts reconciliation of a controller.
+func (g *Group) startController(info controllerInfo) {
+	g.tickers = append(g.tickers, g.newTicker(
+		info.name,
+		info.tickerDuration,
+		info.watches,
+		info.controller,
+	))
+
+	g.Log.Info("Started " + info.name + " controller")
+}
+
+// start starts all of the group's controllers.
+func (g *Group) start() {
+	for _, c := range g.controllers {
+		g.startController(c)
+	}
+}
+
+// stop stops all of the group's controllers, running their delete reconciliation unless keep
+// is set. Only the first call has any effect.
+func (g *Group) stop(keep bool) {
+	g.stopOnce.Do(func() {
+		g.keep = keep
+
+		for _, ticker := range g.tickers {
+			ticker.Stop()
+		}
+
+		close(g.done)
+		g.wg.Wait()
+	})
+}
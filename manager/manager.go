@@ -18,12 +18,15 @@ import (
 
 // Manager defines the overall runtime manager.
 type Manager struct {
-	Data        *datastore.Data
-	Log         *zap.SugaredLogger
-	tickers     []*time.Ticker
-	wg          *sync.WaitGroup
-	done        chan bool
-	controllers []controllerInfo
+	Log *zap.SugaredLogger
+	// KeepOnExit leaves shaping in place when the daemon stops, for the next start to adopt
+	KeepOnExit bool
+	// mu guards groups
+	mu sync.Mutex
+	// global holds controllers that aren't tied to an interface
+	global *Group
+	// groups holds the controllers for each interface, in the order added
+	groups []*Group
 }
 
 // NewManager returns an instantiated manager.
@@ -35,67 +38,96 @@ func NewManager() (*Manager, error) {
 		return nil, fmt.Errorf("failed to set up logger: %w", err)
 	}
 
+	log := logger.Sugar()
 	mgr := &Manager{
-		Data:        datastore.NewDataStore(),
-		wg:          &sync.WaitGroup{},
-		done:        make(chan bool),
-		Log:         logger.Sugar(),
-		tickers:     []*time.Ticker{},
-		controllers: []controllerInfo{},
+		Log:        log,
+		KeepOnExit: false,
+		mu:         sync.Mutex{},
+		global:     newGroup("", datastore.NewDataStore(), log),
+		groups:     []*Group{},
 	}
 
 	return mgr, nil
 }
 
-// newTicker sets up the reconciliation loops for each controller.
-func (m *Manager) newTicker(name string,
-	done chan bool,
-	waitgroup *sync.WaitGroup,
-	duration time.Duration,
-	reconcileFunc func() error,
-	deleteFunc func(),
-) *time.Ticker {
-	waitgroup.Add(1)
+// NewGroup returns a group of controllers with its own datastore, logging with the given
+// key and value pairs. The group is started with the manager, or by StartGroup if the
+// manager is already running.
+func (m *Manager) NewGroup(name string, fields ...interface{}) *Group {
+	group := newGroup(name, datastore.NewDataStore(), m.Log.With(fields...))
 
-	ticker := time.NewTicker(duration)
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	go func() {
-		for {
-			select {
-			case <-done:
-				deleteFunc()
-				waitgroup.Done()
-
-				return
-			case <-ticker.C:
-				m.checkReconciliationWithError(name, reconcileFunc)
-			}
+	m.groups = append(m.groups, group)
+
+	return group
+}
+
+// StartGroup starts a group created after the manager was started.
+func (m *Manager) StartGroup(group *Group) {
+	group.start()
+}
+
+// RemoveGroup stops a group, running its controllers' delete reconciliation, and forgets it.
+func (m *Manager) RemoveGroup(group *Group) {
+	group.stop(false)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, g := range m.groups {
+		if g == group {
+			m.groups = append(m.groups[:i], m.groups[i+1:]...)
+
+			break
 		}
-	}()
+	}
+}
+
+// DataStores returns the datastore of every group by name.
+func (m *Manager) DataStores() map[string]*datastore.Data {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stores := make(map[string]*datastore.Data, len(m.groups))
+	for _, group := range m.groups {
+		stores[group.Name] = group.Data
+	}
 
-	return ticker
+	return stores
 }
 
-// nolint: godox,nolintlint
 // setupCloseHandler traps Ctrl+C then runs each controller's delete reconciliation.
-func (m *Manager) setupCloseHandler(done chan bool) {
-	chnl := make(chan os.Signal)
+func (m *Manager) setupCloseHandler() {
+	chnl := make(chan os.Signal, 1)
 
-	/* TODO @randomvariable: sigchanyzer: misuse of unbuffered os.Signal channel as
-	argument to signal.Notify (govet)go-golangci-lint */
-
-	signal.Notify(chnl, os.Interrupt, syscall.SIGTERM) //nolint:govet
+	signal.Notify(chnl, os.Interrupt, syscall.SIGTERM)
 
 	go func() {
 		<-chnl
 		m.Log.Info("Shutting down")
 
-		for _, ticker := range m.tickers {
-			ticker.Stop()
+		// Global controllers go first so nothing adds groups while they're stopping. They keep
+		// what they set up, such as classification rules, along with the groups.
+		m.global.stop(m.KeepOnExit)
+
+		m.mu.Lock()
+		groups := append([]*Group{}, m.groups...)
+		m.mu.Unlock()
+
+		var stopping sync.WaitGroup
+
+		for _, group := range groups {
+			stopping.Add(1)
+
+			go func(group *Group) {
+				defer stopping.Done()
+				group.stop(m.KeepOnExit)
+			}(group)
 		}
 
-		close(done)
-		m.wg.Wait()
+		stopping.Wait()
 		os.Exit(0)
 	}()
 }
@@ -106,49 +138,40 @@ type controller interface {
 	ReconcileDelete()
 }
 
+// releaser is implemented by controllers that can stop without tearing down what they set
+// up, for when the manager keeps shaping in place on exit.
+type releaser interface {
+	Release()
+}
+
 // controllerInfo stores information about the controllers prior to being started.
 type controllerInfo struct {
 	name           string
 	tickerDuration time.Duration
+	watches        []datastore.Key
 	controller     controller
 }
 
-// AddController adds a controller for start up.
+// AddController adds a controller that isn't tied to any interface for start up.
 func (m *Manager) AddController(name string, c controller, t time.Duration) {
-	m.controllers = append(m.controllers, controllerInfo{name: name, controller: c, tickerDuration: t})
-}
-
-func (m *Manager) checkReconciliationWithError(name string, f func() error) {
-	if err := f(); err != nil {
-		log := m.Log.Desugar().WithOptions(zap.AddCallerSkip(1)).Sugar().With("controller", name)
-		log.Error(err)
-	}
-}
-
-// startController starts reconciliation of a controller.
-func (m *Manager) startController(name string, ctrller controller, t time.Duration) {
-	m.tickers = append(m.tickers, m.newTicker(
-		name,
-		m.done,
-		m.wg,
-		t,
-		ctrller.Reconcile,
-		ctrller.ReconcileDelete,
-	))
-
-	m.checkReconciliationWithError(name, ctrller.Reconcile)
-	m.Log.Info("Started " + name + "controller")
+	m.global.AddController(name, c, t)
 }
 
 // Start starts all controllers.
 func (m *Manager) Start() error {
 	m.Log.Info("Starting controllers...")
 
-	for _, c := range m.controllers {
-		m.startController(c.name, c.controller, c.tickerDuration)
+	m.mu.Lock()
+	groups := append([]*Group{}, m.groups...)
+	m.mu.Unlock()
+
+	for _, group := range groups {
+		group.start()
 	}
 
-	m.setupCloseHandler(m.done)
+	m.global.start()
+
+	m.setupCloseHandler()
 	runtime.Goexit()
 
 	return nil
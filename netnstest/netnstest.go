@@ -0,0 +1,85 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+netnstest is a package of helpers for tests that create devices, running them in a scratch
+network namespace so they can't disturb the host's.
+*/
+package netnstest
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+const (
+	// RootName and PeerName are the names of the ends of the veth pair standing in for the
+	// root device.
+	RootName = "sqmtest0"
+	PeerName = "sqmtest1"
+)
+
+// EnterScratchNamespace locks the test to its thread and moves the thread to a new network
+// namespace, skipping the test without the privileges to do so.
+func EnterScratchNamespace(t *testing.T) {
+	t.Helper()
+
+	runtime.LockOSThread()
+
+	origin, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		t.Skipf("cannot get the current network namespace: %v", err)
+	}
+
+	scratch, err := netns.New()
+	if err != nil {
+		origin.Close()
+		runtime.UnlockOSThread()
+		t.Skipf("cannot create a network namespace, which needs CAP_SYS_ADMIN: %v", err)
+	}
+
+	t.Cleanup(func() {
+		if err := netns.Set(origin); err != nil {
+			t.Fatalf("cannot return to the original network namespace: %v", err)
+		}
+
+		scratch.Close()
+		origin.Close()
+		runtime.UnlockOSThread()
+	})
+}
+
+// AddVeth creates the root device as one end of a veth pair, brings both ends up and returns
+// the root device.
+func AddVeth(t *testing.T) netlink.Link {
+	t.Helper()
+
+	veth := &netlink.Veth{LinkAttrs: netlink.NewLinkAttrs(), PeerName: PeerName} //nolint:exhaustruct
+	veth.Name = RootName
+
+	if err := netlink.LinkAdd(veth); err != nil {
+		t.Fatalf("cannot add veth: %v", err)
+	}
+
+	for _, name := range []string{RootName, PeerName} {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			t.Fatalf("cannot find %s: %v", name, err)
+		}
+
+		if err := netlink.LinkSetUp(link); err != nil {
+			t.Fatalf("cannot bring up %s: %v", name, err)
+		}
+	}
+
+	root, err := netlink.LinkByName(RootName)
+	if err != nil {
+		t.Fatalf("cannot find %s: %v", RootName, err)
+	}
+
+	return root
+}
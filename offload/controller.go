@@ -0,0 +1,148 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+offload is a package for detecting traffic that bypasses shaping, such as forwarded
+connections handed to an nftables flowtable, which skip the qdiscs on the way in.
+*/
+package offload
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/randomvariable/sqm/datastore"
+	"go.uber.org/zap"
+)
+
+// WarningName is the name of the warning set while a bypass is active.
+const WarningName = "flowtable offload"
+
+// Controller contains all local information required for reconciliation.
+type Controller struct {
+	// data is the shared datastore
+	data *datastore.Data
+	// log is the logger
+	log *zap.SugaredLogger
+	// unhealthy stops the interface being reported healthy while a bypass is active
+	unhealthy bool
+}
+
+// NewOffloadController returns an instantiated controller.
+func NewOffloadController(unhealthy bool, data *datastore.Data, log *zap.SugaredLogger) *Controller {
+	return &Controller{
+		data:      data,
+		log:       log.Named("Offload Controller"),
+		unhealthy: unhealthy,
+	}
+}
+
+// Reconcile defines the reconciliation loop.
+func (c *Controller) Reconcile() error {
+	rootDevice, err := c.data.RootDevice()
+	if err != nil {
+		return fmt.Errorf("error getting root device: %w", err)
+	}
+
+	flowtables, err := Flowtables(rootDevice.Attrs().Name)
+	if err != nil {
+		return err
+	}
+
+	warning := datastore.Warning{Message: "", Unhealthy: false}
+
+	if len(flowtables) > 0 {
+		warning = datastore.Warning{
+			Message: fmt.Sprintf("forwarded traffic offloaded by flowtable %s bypasses shaping",
+				strings.Join(flowtables, ", ")),
+			Unhealthy: c.unhealthy,
+		}
+	}
+
+	if c.data.SetWarning(WarningName, warning) {
+		if warning.Message != "" {
+			c.log.Warnw("Flowtable offload bypasses shaping on the root device", "Flowtables", flowtables)
+		} else {
+			c.log.Info("No flowtable offload on the root device")
+		}
+	}
+
+	return nil
+}
+
+// Flowtables returns the flowtables, as family/table/name, that offload connections through
+// the named device. Flowtables no rule offloads connections to are left out.
+func Flowtables(device string) ([]string, error) {
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to nftables: %w", err)
+	}
+
+	tables, err := conn.ListTables()
+	if err != nil {
+		return nil, fmt.Errorf("cannot list nftables tables: %w", err)
+	}
+
+	found := []string{}
+
+	for _, table := range tables {
+		flowtables, err := conn.ListFlowtables(table)
+		if err != nil {
+			return nil, fmt.Errorf("cannot list flowtables of table %s: %w", table.Name, err)
+		}
+
+		for _, flowtable := range flowtables {
+			if flowtable.Use == 0 || !contains(flowtable.Devices, device) {
+				continue
+			}
+
+			name := fmt.Sprintf("%s/%s/%s", familyName(table.Family), table.Name, flowtable.Name)
+			if flowtable.Flags&nftables.FlowtableFlagsHWOffload != 0 {
+				name += " (hardware offload)"
+			}
+
+			found = append(found, name)
+		}
+	}
+
+	sort.Strings(found)
+
+	return found, nil
+}
+
+func contains(devices []string, device string) bool {
+	for _, d := range devices {
+		if d == device {
+			return true
+		}
+	}
+
+	return false
+}
+
+// familyName returns the name nft uses for a table family.
+func familyName(family nftables.TableFamily) string {
+	switch family {
+	case nftables.TableFamilyINet:
+		return "inet"
+	case nftables.TableFamilyIPv4:
+		return "ip"
+	case nftables.TableFamilyIPv6:
+		return "ip6"
+	case nftables.TableFamilyNetdev:
+		return "netdev"
+	case nftables.TableFamilyBridge:
+		return "bridge"
+	case nftables.TableFamilyARP:
+		return "arp"
+	default:
+		return fmt.Sprintf("family%d", family)
+	}
+}
+
+// ReconcileDelete defines what happens on shutdown.
+func (c *Controller) ReconcileDelete() {
+	c.log.Info("Offload controller shut down")
+}
@@ -0,0 +1,81 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+ownership is a package for recognising the tc objects sqm creates, so that it leaves
+those of other tc users, such as firewalls, docker or tc-bpf programs, alone.
+
+Qdiscs sqm creates have a handle major in a reserved range, filter actions carry a cookie
+and links carry an alias.
+*/
+package ownership
+
+import (
+	"bytes"
+	"errors"
+
+	tc "github.com/florianl/go-tc"
+	"github.com/florianl/go-tc/core"
+)
+
+var ErrConflict = errors.New("tc object belongs to something other than sqm")
+
+const (
+	// HandleMin is the lowest qdisc handle major sqm uses. The range sits below the
+	// 0x8000 and up the kernel allocates automatically.
+	HandleMin = uint32(0x5300)
+	// HandleMax is the highest qdisc handle major sqm uses.
+	HandleMax = uint32(0x53ff)
+	// EgressHandle is the handle major of the root device's CAKE qdisc.
+	EgressHandle = uint32(0x5312)
+	// IngressHandle is the handle major of the IFB device's CAKE qdisc.
+	IngressHandle = uint32(0x5313)
+	// EgressClassHandle and IngressClassHandle are the first handle majors of the CAKE qdiscs
+	// under each class of a hierarchical shaper, with room for ClassHandles of them.
+	EgressClassHandle  = uint32(0x5320)
+	IngressClassHandle = uint32(0x5360)
+	ClassHandles       = 0x40
+
+	// legacyEgressHandle and legacyIngressHandle were used by earlier releases.
+	legacyEgressHandle  = uint32(0x8012)
+	legacyIngressHandle = uint32(0x8013)
+)
+
+// Cookie marks filter actions sqm creates.
+func Cookie() []byte {
+	return []byte("sqm")
+}
+
+// OwnsHandle returns whether a qdisc handle is one sqm creates.
+func OwnsHandle(handle uint32) bool {
+	major, _ := core.SplitHandle(handle)
+
+	if major == legacyEgressHandle || major == legacyIngressHandle {
+		return true
+	}
+
+	return major >= HandleMin && major <= HandleMax
+}
+
+// IsDefaultHandle returns whether a qdisc handle is the kernel's, as used for the default
+// qdisc of a device. Those can be replaced without taking anything from anyone.
+func IsDefaultHandle(handle uint32) bool {
+	major, _ := core.SplitHandle(handle)
+
+	return major == 0
+}
+
+// HasCookie returns whether any of the actions carries sqm's cookie.
+func HasCookie(actions *[]*tc.Action) bool {
+	if actions == nil {
+		return false
+	}
+
+	for _, action := range *actions {
+		if action != nil && action.Cookie != nil && bytes.Equal(*action.Cookie, Cookie()) {
+			return true
+		}
+	}
+
+	return false
+}
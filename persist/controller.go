@@ -0,0 +1,104 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package persist
+
+import (
+	"time"
+
+	"github.com/randomvariable/sqm/datastore"
+	"github.com/randomvariable/sqm/ratesource"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultStateDir is where the state of each interface is saved if not configured.
+	DefaultStateDir = "/var/lib/sqm"
+	// DefaultMaxAge is the oldest state that will be used on startup if not configured.
+	DefaultMaxAge = 24 * time.Hour
+
+	// refreshInterval is how often the timestamp is refreshed while rates are unchanged.
+	refreshInterval = 10 * time.Minute
+)
+
+// Controller saves the rates in effect whenever they come from a live rate source.
+type Controller struct {
+	// path is the state file
+	path string
+	// data is the shared datastore
+	data *datastore.Data
+	// log is the logger
+	log *zap.SugaredLogger
+	// saved is the last state written
+	saved State
+	// now returns the current time
+	now func() time.Time
+}
+
+// NewPersistController returns an instantiated controller.
+func NewPersistController(path string, data *datastore.Data, log *zap.SugaredLogger) *Controller {
+	return &Controller{
+		path:  path,
+		data:  data,
+		log:   log.Named("Persist Controller").With("StateFile", path),
+		saved: State{}, //nolint:exhaustruct
+		now:   time.Now,
+	}
+}
+
+// Reconcile defines the reconciliation loop.
+func (c *Controller) Reconcile() error {
+	state, ok := c.current()
+	if !ok {
+		return nil
+	}
+
+	unchanged := state.IngressRate == c.saved.IngressRate &&
+		state.EgressRate == c.saved.EgressRate &&
+		state.IngressSource == c.saved.IngressSource &&
+		state.EgressSource == c.saved.EgressSource
+	if unchanged && state.Timestamp.Sub(c.saved.Timestamp) < refreshInterval {
+		return nil
+	}
+
+	if err := Save(c.path, state); err != nil {
+		return err
+	}
+
+	c.saved = state
+
+	return nil
+}
+
+// current returns the state to save, and false if the rates in effect didn't come from a
+// live rate source.
+func (c *Controller) current() (State, bool) {
+	snapshot := c.data.Snapshot()
+	state := State{
+		IngressRate:   snapshot.IngressRate,
+		EgressRate:    snapshot.EgressRate,
+		IngressSource: snapshot.IngressSource,
+		EgressSource:  snapshot.EgressSource,
+		Timestamp:     c.now(),
+	}
+
+	return state, isLive(state.IngressSource, state.IngressRate) && isLive(state.EgressSource, state.EgressRate)
+}
+
+func isLive(source string, rate int64) bool {
+	return rate > 0 &&
+		source != "" &&
+		source != ratesource.FallbackSourceName &&
+		source != ratesource.ProvisionalSourceName
+}
+
+// ReconcileDelete defines what happens on shutdown.
+func (c *Controller) ReconcileDelete() {
+	if state, ok := c.current(); ok {
+		if err := Save(c.path, state); err != nil {
+			c.log.Errorw("Cannot save state", "error", err)
+		}
+	}
+
+	c.log.Info("Persist controller shut down")
+}
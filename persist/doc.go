@@ -0,0 +1,9 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+persist saves the last known good rates to a state file so they can be used as
+provisional rates when sqm restarts, rather than leaving the line unshaped until a
+rate source answers.
+*/
+package persist
@@ -0,0 +1,94 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package persist
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var ErrStateTooOld = errors.New("state file is too old")
+
+const (
+	stateDirMode  = 0o755
+	stateFileMode = 0o644
+)
+
+// State is the content of the state file.
+type State struct {
+	IngressRate   int64     `json:"ingressRate"`
+	EgressRate    int64     `json:"egressRate"`
+	IngressSource string    `json:"ingressSource"`
+	EgressSource  string    `json:"egressSource"`
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+// Load reads the state file, returning ErrStateTooOld if it was written more than maxAge ago.
+// A maxAge of zero accepts state of any age.
+func Load(path string, maxAge time.Duration, now time.Time) (State, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return State{}, fmt.Errorf("cannot read state file: %w", err)
+	}
+
+	var state State
+	if err := json.Unmarshal(raw, &state); err != nil {
+		return State{}, fmt.Errorf("cannot parse state file %s: %w", path, err)
+	}
+
+	if age := now.Sub(state.Timestamp); maxAge > 0 && age > maxAge {
+		return State{}, fmt.Errorf("%w: written %s ago", ErrStateTooOld, age.Round(time.Second))
+	}
+
+	return state, nil
+}
+
+// Save atomically writes the state file, creating its directory if needed.
+func Save(path string, state State) error {
+	return SaveJSON(path, state)
+}
+
+// SaveJSON atomically writes a value as JSON to a file under the state directory, creating the
+// directory if needed.
+func SaveJSON(path string, value interface{}) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, stateDirMode); err != nil {
+		return fmt.Errorf("cannot create state directory: %w", err)
+	}
+
+	raw, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return fmt.Errorf("cannot encode state: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("cannot create temporary state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+
+		return fmt.Errorf("cannot write temporary state file: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("cannot close temporary state file: %w", err)
+	}
+
+	if err := os.Chmod(tmp.Name(), stateFileMode); err != nil {
+		return fmt.Errorf("cannot set state file permissions: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("cannot replace state file: %w", err)
+	}
+
+	return nil
+}
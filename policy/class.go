@@ -0,0 +1,144 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+policy is a package for sorting traffic into named classes, such as voice or bulk, without
+knowing DSCP. Each class is marked with a DSCP value CAKE sorts into a tin of its own in the
+root device's diffserv mode, and the traffic each class matches is counted.
+*/
+package policy
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/randomvariable/sqm/classify"
+	"github.com/randomvariable/sqm/shaper"
+)
+
+var ErrInvalidPolicy = errors.New("invalid policy")
+
+// Class is a kind of traffic, from highest to lowest priority.
+type Class string
+
+const (
+	Voice      Class = "voice"
+	Video      Class = "video"
+	BestEffort Class = "best-effort"
+	Bulk       Class = "bulk"
+)
+
+// Classes is every class, from highest to lowest priority.
+func Classes() []Class {
+	return []Class{Voice, Video, BestEffort, Bulk}
+}
+
+// ParseClass returns the class with the given name.
+func ParseClass(name string) (Class, error) {
+	for _, class := range Classes() {
+		if Class(name) == class {
+			return class, nil
+		}
+	}
+
+	return "", fmt.Errorf("%w: unknown class %q", ErrInvalidPolicy, name)
+}
+
+// codepoint returns the DSCP value conventionally used for the class.
+func (c Class) codepoint() uint8 {
+	switch c {
+	case Voice:
+		return 46 //nolint:gomnd // EF
+	case Video:
+		return 34 //nolint:gomnd // AF41
+	case Bulk:
+		return 8 //nolint:gomnd // CS1
+	default:
+		return 0
+	}
+}
+
+// DSCP returns the value traffic of the class is marked with in a diffserv mode. Voice is put
+// in the highest priority tin and video in the one below, bulk in the lowest and best effort
+// where unmarked traffic goes, using the class's usual value where CAKE sorts it there. A class
+// that would share best effort's tin, such as video in diffserv3, is an error.
+func (c Class) DSCP(mode shaper.DiffServMode) (uint8, error) {
+	tins, err := mode.Tins()
+	if err != nil {
+		return 0, err //nolint:wrapcheck
+	}
+
+	bestEffort, err := mode.TinIndex(0)
+	if err != nil {
+		return 0, err //nolint:wrapcheck
+	}
+
+	tin, distinct := bestEffort, true
+
+	switch c {
+	case Voice:
+		tin = len(tins) - 1
+		distinct = tin > bestEffort
+	case Video:
+		tin = len(tins) - 2 //nolint:gomnd
+		distinct = tin > bestEffort
+	case Bulk:
+		tin = 0
+		distinct = tin < bestEffort
+	case BestEffort:
+	}
+
+	if !distinct {
+		return 0, fmt.Errorf("%w: diffserv mode %s has no tin for %s traffic apart from best effort",
+			ErrInvalidPolicy, mode, c)
+	}
+
+	return mode.Codepoint(tin, c.codepoint()) //nolint:wrapcheck
+}
+
+// Policy sorts the traffic it matches into a class.
+type Policy struct {
+	Name  string
+	Class Class
+	Match classify.Match
+}
+
+// Validate checks every policy, that their names are unique, and that each class has a tin of
+// its own in the root device's diffserv mode.
+func Validate(policies []Policy, mode shaper.DiffServMode) error {
+	names := map[string]bool{}
+
+	for _, policy := range policies {
+		if names[policy.Name] {
+			return fmt.Errorf("%w: more than one policy is named %s", ErrInvalidPolicy, policy.Name)
+		}
+
+		names[policy.Name] = true
+
+		if policy.Match.OutputInterface != "" {
+			return fmt.Errorf("%w: policy %s matches an output interface, but applies to its own", ErrInvalidPolicy,
+				policy.Name)
+		}
+
+		dscp, err := policy.Class.DSCP(mode)
+		if err != nil {
+			return fmt.Errorf("policy %s: %w", policy.Name, err)
+		}
+
+		if err := policy.rule(dscp).Validate(); err != nil {
+			return fmt.Errorf("policy %s: %w", policy.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// rule returns the classification rule marking the policy's traffic with a DSCP value.
+func (p Policy) rule(dscp uint8) classify.Rule {
+	return classify.Rule{
+		Name:   p.Name,
+		Hook:   classify.Postrouting,
+		Match:  p.Match,
+		Action: classify.Action{DSCP: &dscp, Mark: nil},
+	}
+}
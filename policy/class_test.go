@@ -0,0 +1,84 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package policy
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/randomvariable/sqm/classify"
+	"github.com/randomvariable/sqm/shaper"
+)
+
+func TestClassDSCP(t *testing.T) {
+	tests := []struct {
+		mode    shaper.DiffServMode
+		class   Class
+		want    uint8
+		wantTin string
+		wantErr error
+	}{
+		{mode: shaper.DiffServ3, class: Voice, want: 46, wantTin: "Voice", wantErr: nil},
+		{mode: shaper.DiffServ3, class: Video, want: 0, wantTin: "", wantErr: ErrInvalidPolicy},
+		{mode: shaper.DiffServ3, class: BestEffort, want: 0, wantTin: "Best Effort", wantErr: nil},
+		{mode: shaper.DiffServ3, class: Bulk, want: 8, wantTin: "Bulk", wantErr: nil},
+		{mode: shaper.DiffServ4, class: Voice, want: 46, wantTin: "Voice", wantErr: nil},
+		{mode: shaper.DiffServ4, class: Video, want: 34, wantTin: "Video", wantErr: nil},
+		{mode: shaper.DiffServ4, class: BestEffort, want: 0, wantTin: "Best Effort", wantErr: nil},
+		{mode: shaper.DiffServ4, class: Bulk, want: 8, wantTin: "Bulk", wantErr: nil},
+		{mode: shaper.DiffServ8, class: Voice, want: 48, wantTin: "Tin 7", wantErr: nil},
+		{mode: shaper.DiffServ8, class: Video, want: 32, wantTin: "Tin 6", wantErr: nil},
+		{mode: shaper.DiffServ8, class: BestEffort, want: 0, wantTin: "Tin 2", wantErr: nil},
+		{mode: shaper.DiffServ8, class: Bulk, want: 8, wantTin: "Tin 0", wantErr: nil},
+		{mode: shaper.Precedence, class: Voice, want: 56, wantTin: "Tin 7", wantErr: nil},
+		{mode: shaper.Precedence, class: Video, want: 48, wantTin: "Tin 6", wantErr: nil},
+		{mode: shaper.Precedence, class: BestEffort, want: 0, wantTin: "Tin 0", wantErr: nil},
+		{mode: shaper.Precedence, class: Bulk, want: 0, wantTin: "", wantErr: ErrInvalidPolicy},
+		{mode: shaper.BestEffort, class: Voice, want: 0, wantTin: "", wantErr: ErrInvalidPolicy},
+		{mode: shaper.BestEffort, class: BestEffort, want: 0, wantTin: "Best Effort", wantErr: nil},
+		{mode: shaper.BestEffort, class: Bulk, want: 0, wantTin: "", wantErr: ErrInvalidPolicy},
+	}
+
+	for _, tt := range tests {
+		dscp, err := tt.class.DSCP(tt.mode)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s in %s: DSCP() error = %v, want %v", tt.class, tt.mode, err, tt.wantErr)
+
+			continue
+		}
+
+		if err != nil {
+			continue
+		}
+
+		if dscp != tt.want {
+			t.Errorf("%s in %s: DSCP() = %d, want %d", tt.class, tt.mode, dscp, tt.want)
+		}
+
+		if tin, _ := tt.mode.Tin(dscp); tin != tt.wantTin {
+			t.Errorf("%s in %s: DSCP() is sorted into %q, want %q", tt.class, tt.mode, tin, tt.wantTin)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	match := classify.Match{Protocols: []uint8{17}} //nolint:exhaustruct
+	policies := []Policy{
+		{Name: "calls", Class: Voice, Match: match},
+		{Name: "streams", Class: Video, Match: match},
+	}
+
+	if err := Validate(policies, shaper.DiffServ4); err != nil {
+		t.Errorf("Validate() in diffserv4 error = %v, want nil", err)
+	}
+
+	if err := Validate(policies, shaper.DiffServ3); !errors.Is(err, ErrInvalidPolicy) {
+		t.Errorf("Validate() in diffserv3 error = %v, want %v", err, ErrInvalidPolicy)
+	}
+
+	duplicate := []Policy{{Name: "calls", Class: Voice, Match: match}, {Name: "calls", Class: Bulk, Match: match}}
+	if err := Validate(duplicate, shaper.DiffServ4); !errors.Is(err, ErrInvalidPolicy) {
+		t.Errorf("Validate() with duplicate names error = %v, want %v", err, ErrInvalidPolicy)
+	}
+}
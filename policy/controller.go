@@ -0,0 +1,271 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package policy
+
+import (
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/randomvariable/sqm/classify"
+	"github.com/randomvariable/sqm/datastore"
+	"github.com/randomvariable/sqm/firewall"
+	"github.com/randomvariable/sqm/shaper"
+	"go.uber.org/zap"
+)
+
+// priority runs policies after classification rules, so policies win, and before the DSCP
+// store, so their marking is stored.
+const priority = -145
+
+// Chain returns the base chain jumping to each device's policies.
+func Chain() *nftables.Chain {
+	return &nftables.Chain{ //nolint:exhaustruct
+		Name:     "policy",
+		Table:    firewall.Table(),
+		Hooknum:  nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityRef(priority),
+		Type:     nftables.ChainTypeFilter,
+	}
+}
+
+// Controller contains all local information required for reconciliation.
+type Controller struct {
+	// device is the root device name
+	device string
+	// policies are tried in order, the first match winning
+	policies []Policy
+	// egress is the tin layout of the root device
+	egress shaper.DiffServMode
+	// ingress is the tin layout of the IFB device, empty if DSCP isn't restored there
+	ingress shaper.DiffServMode
+	// data is the shared datastore
+	data *datastore.Data
+	// log is the logger
+	log *zap.SugaredLogger
+}
+
+// NewPolicyController returns an instantiated controller. The policies should be valid.
+func NewPolicyController(device string, policies []Policy, egress shaper.DiffServMode,
+	ingress shaper.DiffServMode, data *datastore.Data, log *zap.SugaredLogger,
+) *Controller {
+	return &Controller{
+		device:   device,
+		policies: policies,
+		egress:   egress,
+		ingress:  ingress,
+		data:     data,
+		log:      log.Named("Policy Controller"),
+	}
+}
+
+// chain returns the chain holding the device's policy rules.
+func (c *Controller) chain() *nftables.Chain {
+	return firewall.Chain("policy-" + c.device)
+}
+
+// jumpTag marks the rule jumping to the device's chain.
+func (c *Controller) jumpTag() []byte {
+	return firewall.Tag("policy:" + c.device)
+}
+
+// Reconcile defines the reconciliation loop. The device's rules are replaced when they differ
+// from the policies, and otherwise their counters are read into the datastore.
+func (c *Controller) Reconcile() error {
+	if _, err := c.data.RootDevice(); err != nil {
+		return fmt.Errorf("error getting root device: %w", err)
+	}
+
+	counters, err := c.counters()
+	if err != nil {
+		return err
+	}
+
+	err = firewall.Update(func(conn *nftables.Conn) error {
+		jumps, err := firewall.Rules(conn, Chain())
+		if err != nil {
+			return err //nolint:wrapcheck
+		}
+
+		existing, err := firewall.Rules(conn, c.chain())
+		if err != nil {
+			return err //nolint:wrapcheck
+		}
+
+		desired, classes, err := c.desired()
+		if err != nil {
+			return err
+		}
+
+		if !firewall.SameTags(existing, desired) {
+			conn.AddChain(c.chain())
+			conn.FlushChain(c.chain())
+
+			for _, rule := range desired {
+				conn.AddRule(rule)
+			}
+
+			c.log.Infow("Updated policy rules", "Rules", len(desired))
+
+			existing = nil
+		}
+
+		for i, rule := range existing {
+			for _, e := range rule.Exprs {
+				if counter, ok := e.(*expr.Counter); ok {
+					counters[classes[i]].Packets += counter.Packets
+					counters[classes[i]].Bytes += counter.Bytes
+				}
+			}
+		}
+
+		if len(firewall.Tagged(jumps, c.jumpTag())) == 0 {
+			conn.AddChain(Chain())
+			conn.AddRule(c.jumpRule())
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+
+	result := []datastore.ClassCounter{}
+
+	for _, class := range Classes() {
+		if counter, ok := counters[class]; ok {
+			result = append(result, *counter)
+		}
+	}
+
+	c.data.SetClassCounters(result)
+
+	return nil
+}
+
+// counters returns an empty counter for each class with policies, naming the tins it's
+// sorted into.
+func (c *Controller) counters() (map[Class]*datastore.ClassCounter, error) {
+	counters := map[Class]*datastore.ClassCounter{}
+
+	for _, policy := range c.policies {
+		if _, ok := counters[policy.Class]; ok {
+			continue
+		}
+
+		counter := &datastore.ClassCounter{Class: string(policy.Class)} //nolint:exhaustruct
+
+		dscp, err := policy.Class.DSCP(c.egress)
+		if err != nil {
+			return nil, err
+		}
+
+		if counter.EgressTin, err = c.egress.Tin(dscp); err != nil {
+			return nil, err //nolint:wrapcheck
+		}
+
+		if c.ingress != "" {
+			if counter.IngressTin, err = c.ingress.Tin(dscp); err != nil {
+				return nil, err //nolint:wrapcheck
+			}
+		}
+
+		counters[policy.Class] = counter
+	}
+
+	return counters, nil
+}
+
+// desired returns the device's nftables rules and the class of each. Every rule counts the
+// traffic it matches and returns, so the first matching policy wins.
+func (c *Controller) desired() ([]*nftables.Rule, []Class, error) {
+	desired := []*nftables.Rule{}
+	classes := []Class{}
+
+	for _, policy := range c.policies {
+		dscp, err := policy.Class.DSCP(c.egress)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		compiled, err := policy.rule(dscp).Compile()
+		if err != nil {
+			return nil, nil, err //nolint:wrapcheck
+		}
+
+		tag := firewall.Tag("policy:" + c.device + ":" + policy.Name + ":" + classify.Hash(compiled))
+
+		for _, exprs := range compiled {
+			desired = append(desired, &nftables.Rule{ //nolint:exhaustruct
+				Table: firewall.Table(),
+				Chain: c.chain(),
+				Exprs: append(exprs,
+					&expr.Counter{Bytes: 0, Packets: 0},
+					&expr.Verdict{Kind: expr.VerdictReturn, Chain: ""},
+				),
+				UserData: tag,
+			})
+			classes = append(classes, policy.Class)
+		}
+	}
+
+	return desired, classes, nil
+}
+
+// jumpRule returns the rule sending packets leaving the root device to its chain.
+func (c *Controller) jumpRule() *nftables.Rule {
+	return &nftables.Rule{ //nolint:exhaustruct
+		Table: firewall.Table(),
+		Chain: Chain(),
+		Exprs: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyOIFNAME, SourceRegister: false, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: firewall.IfName(c.device)},
+			&expr.Verdict{Kind: expr.VerdictJump, Chain: c.chain().Name},
+		},
+		UserData: c.jumpTag(),
+	}
+}
+
+// Release defines what happens on shutdown when shaping is to be left in place.
+func (c *Controller) Release() {
+	c.log.Info("Leaving policy rules in place")
+}
+
+// ReconcileDelete defines what happens on shutdown.
+func (c *Controller) ReconcileDelete() {
+	err := firewall.Remove(func(conn *nftables.Conn) error {
+		jumps, err := firewall.Rules(conn, Chain())
+		if err != nil {
+			return err //nolint:wrapcheck
+		}
+
+		owned := firewall.Tagged(jumps, c.jumpTag())
+		for _, rule := range owned {
+			if err := conn.DelRule(rule); err != nil {
+				return fmt.Errorf("cannot delete rule: %w", err)
+			}
+		}
+
+		if len(owned) > 0 && len(owned) == len(jumps) {
+			conn.DelChain(Chain())
+		}
+
+		exists, err := firewall.HasChain(conn, c.chain())
+		if err != nil || !exists {
+			return err //nolint:wrapcheck
+		}
+
+		conn.FlushChain(c.chain())
+		conn.DelChain(c.chain())
+
+		return nil
+	})
+	if err != nil {
+		c.log.Errorw("Cannot delete policy rules", "error", err)
+
+		return
+	}
+
+	c.log.Info("Deleted policy rules")
+}
@@ -0,0 +1,97 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+preflight is a package for checking the kernel and privileges sqm needs are available,
+so a missing module or capability is reported up front with a hint on fixing it, rather
+than as a stream of netlink errors.
+*/
+package preflight
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrChecksFailed = errors.New("preflight checks failed")
+
+// Result is the outcome of a check.
+type Result string
+
+const (
+	Pass Result = "pass"
+	Fail Result = "fail"
+	// Skip means the check couldn't be run, which doesn't stop sqm working
+	Skip Result = "skip"
+)
+
+// Check is the outcome of a single check.
+type Check struct {
+	Name   string `json:"name"`
+	Result Result `json:"result"`
+	Detail string `json:"detail,omitempty"`
+	Hint   string `json:"hint,omitempty"`
+}
+
+// Report is the outcome of every check.
+type Report struct {
+	Checks []Check `json:"checks"`
+}
+
+// Run runs every check. If a network namespace can't be created for the functional test,
+// currentNamespace sets up the test devices in the current one instead of skipping it.
+func Run(currentNamespace bool) Report {
+	report := Report{Checks: []Check{}}
+	report.Checks = append(report.Checks, checkCapabilities())
+	report.Checks = append(report.Checks, checkModules()...)
+	report.Checks = append(report.Checks, checkNamespace(currentNamespace)...)
+
+	return report
+}
+
+// Err returns ErrChecksFailed naming the failed checks, or nil if none failed.
+func (r Report) Err() error {
+	failed := []string{}
+
+	for _, check := range r.Checks {
+		if check.Result == Fail {
+			failed = append(failed, check.Name)
+		}
+	}
+
+	if len(failed) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %q", ErrChecksFailed, failed)
+}
+
+// Print writes a human readable report.
+func (r Report) Print(out io.Writer) {
+	for _, check := range r.Checks {
+		fmt.Fprintf(out, "%-4s  %s", check.Result, check.Name)
+
+		if check.Detail != "" {
+			fmt.Fprintf(out, ": %s", check.Detail)
+		}
+
+		fmt.Fprintln(out)
+
+		if check.Hint != "" && check.Result != Pass {
+			fmt.Fprintf(out, "      %s\n", check.Hint)
+		}
+	}
+}
+
+func passed(name string, detail string) Check {
+	return Check{Name: name, Result: Pass, Detail: detail, Hint: ""}
+}
+
+func failed(name string, err error, hint string) Check {
+	return Check{Name: name, Result: Fail, Detail: err.Error(), Hint: hint}
+}
+
+func skipped(name string, detail string, hint string) Check {
+	return Check{Name: name, Result: Skip, Detail: detail, Hint: hint}
+}
@@ -0,0 +1,374 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package preflight
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"syscall"
+
+	tc "github.com/florianl/go-tc"
+	"github.com/florianl/go-tc/core"
+	"github.com/randomvariable/sqm/links"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+var ErrLinkExists = errors.New("link already exists")
+
+const (
+	testRoot = "sqmcheck0"
+	testIFB  = "sqmcheck1"
+	testRate = uint64(125000)
+	// testAlias marks the test devices as sqm's, so those left by an interrupted check are
+	// recognised and removed.
+	testAlias    = links.OwnerAliasPrefix + "check"
+	namespaceTip = "Creating a network namespace needs CAP_SYS_ADMIN, and testing in the current one " +
+		"CAP_NET_ADMIN, so run sqm check as root to test the kernel features"
+)
+
+// step is one operation of the functional test.
+type step struct {
+	name   string
+	module string
+	// needs is the step this one relies on
+	needs string
+	// fallback is what sqm does if the step fails, if it can do without it
+	fallback string
+	run      func(handle *netlink.Handle, tcnl *tc.Tc) error
+}
+
+// checkNamespace sets up an IFB device, a CAKE qdisc, ingress and clsact qdiscs and mirred
+// filters in a throwaway network namespace, which goes away once the check is done. Without
+// the privileges for a namespace, the test devices are set up in the current one instead and
+// deleted afterwards if currentNamespace is set, and the steps are skipped otherwise.
+func checkNamespace(currentNamespace bool) []Check {
+	steps := []step{
+		{name: "create IFB device", module: "ifb", needs: "", fallback: "", run: createIFBs},
+		{name: "create CAKE qdisc", module: "sch_cake", needs: "create IFB device", fallback: "", run: createCake},
+		{
+			name: "create ingress qdisc", module: "sch_ingress", needs: "create IFB device", fallback: "",
+			run: createIngress,
+		},
+		{
+			name: "add mirred redirect filter", module: "act_mirred", needs: "create ingress qdisc", fallback: "",
+			run: addRedirect,
+		},
+		{
+			name: "create clsact qdisc", module: "sch_ingress", needs: "create IFB device",
+			fallback: "sqm falls back to an ingress qdisc", run: createClsact,
+		},
+		{
+			name: "add matchall redirect filter", module: "cls_matchall", needs: "create clsact qdisc",
+			fallback: fallbackU32, run: addMatchall,
+		},
+	}
+
+	namespace, err := newNamespace()
+	if err != nil && currentNamespace {
+		return checkCurrentNamespace(steps, err)
+	}
+
+	if err != nil {
+		return skipSteps(steps, err)
+	}
+	defer namespace.Close()
+
+	handle, err := netlink.NewHandleAt(namespace)
+	if err != nil {
+		return []Check{skipped("network namespace", err.Error(), "")}
+	}
+	defer handle.Delete()
+
+	tcnl, err := tc.Open(&tc.Config{NetNS: int(namespace), Logger: nil})
+	if err != nil {
+		return []Check{skipped("network namespace", err.Error(), "")}
+	}
+	defer tcnl.Close()
+
+	return runSteps(steps, handle, tcnl)
+}
+
+// checkCurrentNamespace runs the steps on test devices in the current network namespace, as
+// long as the process has CAP_NET_ADMIN. Otherwise the functional test fails, as nothing shows
+// the kernel can do what sqm needs.
+func checkCurrentNamespace(steps []step, namespaceErr error) []Check {
+	const name = "network namespace"
+
+	caps, err := effectiveCapabilities()
+	if err != nil || caps&(1<<capNetAdmin) == 0 {
+		return []Check{failed("functional test", namespaceErr, namespaceTip)}
+	}
+
+	handle, err := netlink.NewHandle()
+	if err != nil {
+		return []Check{failed("functional test", err, "")}
+	}
+	defer handle.Delete()
+
+	tcnl, err := tc.Open(&tc.Config{NetNS: 0, Logger: nil})
+	if err != nil {
+		return []Check{failed("functional test", err, "")}
+	}
+	defer tcnl.Close()
+
+	checks := []Check{skipped(name, namespaceErr.Error()+", testing with "+testRoot+" and "+testIFB+
+		" in the current one", "")}
+
+	if err := deleteTestLinks(handle); err != nil {
+		return append(checks, failed("functional test", err,
+			"Rename or delete the link, which sqm check uses for its test devices"))
+	}
+
+	defer func() {
+		_ = deleteTestLinks(handle)
+	}()
+
+	return append(checks, runSteps(steps, handle, tcnl)...)
+}
+
+// skipSteps skips every step, as only sqm check sets up test devices in the current network
+// namespace rather than touch it while the daemon starts.
+func skipSteps(steps []step, namespaceErr error) []Check {
+	checks := []Check{skipped("network namespace", namespaceErr.Error(),
+		"Run sqm check to test the kernel features in the current network namespace")}
+
+	for _, s := range steps {
+		checks = append(checks, skipped(s.name, "needs a network namespace", ""))
+	}
+
+	return checks
+}
+
+// deleteTestLinks deletes test devices left by an earlier check, returning ErrLinkExists if a
+// link with a test device's name isn't one.
+func deleteTestLinks(handle *netlink.Handle) error {
+	for _, name := range []string{testRoot, testIFB} {
+		link, err := handle.LinkByName(name)
+		if err != nil {
+			continue
+		}
+
+		if link.Attrs().Alias != testAlias {
+			return fmt.Errorf("%w: %s", ErrLinkExists, name)
+		}
+
+		if err := handle.LinkDel(link); err != nil {
+			return fmt.Errorf("cannot delete test device: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// runSteps runs each step in order, skipping those relying on one that failed.
+func runSteps(steps []step, handle *netlink.Handle, tcnl *tc.Tc) []Check {
+	checks := make([]Check, 0, len(steps))
+	broken := map[string]bool{}
+
+	for _, s := range steps {
+		// A step isn't meaningful once one it relies on has failed.
+		if broken[s.needs] {
+			checks = append(checks, skipped(s.name, "needs "+s.needs, ""))
+			broken[s.name] = true
+
+			continue
+		}
+
+		if err := s.run(handle, tcnl); err != nil {
+			if s.fallback != "" {
+				checks = append(checks, skipped(s.name, err.Error()+", "+s.fallback, ""))
+			} else {
+				checks = append(checks, failed(s.name, err, stepHint(s.module, err)))
+			}
+
+			broken[s.name] = true
+
+			continue
+		}
+
+		checks = append(checks, passed(s.name, ""))
+	}
+
+	return checks
+}
+
+// newNamespace creates a network namespace without moving the process into it.
+func newNamespace() (netns.NsHandle, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	original, err := netns.Get()
+	if err != nil {
+		return netns.None(), fmt.Errorf("cannot get network namespace: %w", err)
+	}
+	defer original.Close()
+
+	namespace, err := netns.New()
+	if err != nil {
+		return netns.None(), fmt.Errorf("cannot create network namespace: %w", err)
+	}
+
+	if err := netns.Set(original); err != nil {
+		namespace.Close()
+
+		return netns.None(), fmt.Errorf("cannot return to network namespace: %w", err)
+	}
+
+	return namespace, nil
+}
+
+// stepHint suggests a fix for a failed step.
+func stepHint(module string, err error) string {
+	if errors.Is(err, syscall.EPERM) {
+		return capabilityHint
+	}
+
+	return fmt.Sprintf("Check modprobe %s works, and that the kernel was built with it", module)
+}
+
+func createIFBs(handle *netlink.Handle, _ *tc.Tc) error {
+	for _, name := range []string{testRoot, testIFB} {
+		link := &netlink.GenericLink{LinkAttrs: netlink.NewLinkAttrs(), LinkType: "ifb"}
+		link.LinkAttrs.Name = name
+
+		if err := handle.LinkAdd(link); err != nil {
+			return fmt.Errorf("cannot add IFB device: %w", err)
+		}
+
+		if err := handle.LinkSetAlias(link, testAlias); err != nil {
+			return fmt.Errorf("cannot set alias of IFB device: %w", err)
+		}
+
+		if err := handle.LinkSetUp(link); err != nil {
+			return fmt.Errorf("cannot bring up IFB device: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func createCake(handle *netlink.Handle, tcnl *tc.Tc) error {
+	link, err := handle.LinkByName(testIFB)
+	if err != nil {
+		return fmt.Errorf("cannot find IFB device: %w", err)
+	}
+
+	rate := testRate
+
+	if err := tcnl.Qdisc().Add(&tc.Object{
+		Msg: tc.Msg{
+			Family:  unix.AF_UNSPEC,
+			Ifindex: uint32(link.Attrs().Index),
+			Handle:  core.BuildHandle(1, 0),
+			Parent:  tc.HandleRoot,
+			Info:    0,
+		},
+		Attribute: tc.Attribute{ //nolint:exhaustruct
+			Kind: "cake",
+			Cake: &tc.Cake{BaseRate: &rate}, //nolint:exhaustruct
+		},
+	}); err != nil {
+		return fmt.Errorf("cannot add CAKE qdisc: %w", err)
+	}
+
+	return nil
+}
+
+func createIngress(handle *netlink.Handle, _ *tc.Tc) error {
+	link, err := handle.LinkByName(testRoot)
+	if err != nil {
+		return fmt.Errorf("cannot find test device: %w", err)
+	}
+
+	if err := handle.QdiscAdd(&netlink.Ingress{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0), //nolint:gomnd
+			Parent:    netlink.HANDLE_INGRESS,
+			Refcnt:    0,
+		},
+	}); err != nil {
+		return fmt.Errorf("cannot add ingress qdisc: %w", err)
+	}
+
+	return nil
+}
+
+func addRedirect(handle *netlink.Handle, _ *tc.Tc) error {
+	root, err := handle.LinkByName(testRoot)
+	if err != nil {
+		return fmt.Errorf("cannot find test device: %w", err)
+	}
+
+	ifb, err := handle.LinkByName(testIFB)
+	if err != nil {
+		return fmt.Errorf("cannot find IFB device: %w", err)
+	}
+
+	if err := handle.FilterAdd(&netlink.U32{ //nolint:exhaustruct
+		FilterAttrs: netlink.FilterAttrs{ //nolint:exhaustruct
+			LinkIndex: root.Attrs().Index,
+			Parent:    netlink.MakeHandle(0xffff, 0), //nolint:gomnd
+			Priority:  1,
+			Protocol:  unix.ETH_P_ALL,
+		},
+		Actions: []netlink.Action{netlink.NewMirredAction(ifb.Attrs().Index)},
+	}); err != nil {
+		return fmt.Errorf("cannot add mirred filter: %w", err)
+	}
+
+	return nil
+}
+
+// createClsact adds a clsact qdisc to the IFB device, as the test root device has the
+// ingress qdisc and a device can't have both.
+func createClsact(handle *netlink.Handle, _ *tc.Tc) error {
+	link, err := handle.LinkByName(testIFB)
+	if err != nil {
+		return fmt.Errorf("cannot find IFB device: %w", err)
+	}
+
+	if err := handle.QdiscAdd(&netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0), //nolint:gomnd
+			Parent:    netlink.HANDLE_CLSACT,
+			Refcnt:    0,
+		},
+		QdiscType: "clsact",
+	}); err != nil {
+		return fmt.Errorf("cannot add clsact qdisc: %w", err)
+	}
+
+	return nil
+}
+
+func addMatchall(handle *netlink.Handle, _ *tc.Tc) error {
+	ifb, err := handle.LinkByName(testIFB)
+	if err != nil {
+		return fmt.Errorf("cannot find IFB device: %w", err)
+	}
+
+	root, err := handle.LinkByName(testRoot)
+	if err != nil {
+		return fmt.Errorf("cannot find test device: %w", err)
+	}
+
+	if err := handle.FilterAdd(&netlink.MatchAll{ //nolint:exhaustruct
+		FilterAttrs: netlink.FilterAttrs{ //nolint:exhaustruct
+			LinkIndex: ifb.Attrs().Index,
+			Parent:    netlink.HANDLE_MIN_INGRESS,
+			Priority:  1,
+			Protocol:  unix.ETH_P_ALL,
+		},
+		Actions: []netlink.Action{netlink.NewMirredAction(root.Attrs().Index)},
+	}); err != nil {
+		return fmt.Errorf("cannot add matchall filter: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,156 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package preflight
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	ErrMissingCapability = errors.New("missing capability")
+	ErrMissingModule     = errors.New("kernel module not found")
+)
+
+const (
+	// capNetAdmin is the bit of CAP_NET_ADMIN in capability sets.
+	capNetAdmin    = 12
+	fallbackU32    = "sqm falls back to a u32 redirect filter"
+	capabilityHint = "Run sqm as root, or give it CAP_NET_ADMIN, " +
+		"e.g. with AmbientCapabilities=CAP_NET_ADMIN in its systemd unit"
+)
+
+// module is a kernel module sqm relies on.
+type module struct {
+	name    string
+	feature string
+	// fallback is what sqm does without the module, if it can do without it
+	fallback string
+}
+
+var modules = []module{ //nolint:gochecknoglobals
+	{name: "ifb", feature: "IFB devices", fallback: ""},
+	{name: "sch_cake", feature: "the CAKE qdisc", fallback: ""},
+	{name: "sch_ingress", feature: "the ingress and clsact qdiscs", fallback: ""},
+	{name: "cls_u32", feature: "the u32 classifier", fallback: ""},
+	{name: "cls_matchall", feature: "the matchall classifier", fallback: fallbackU32},
+	{name: "act_mirred", feature: "the mirred action", fallback: ""},
+	{name: "act_ctinfo", feature: "the ctinfo action", fallback: "only needed to restore DSCP"},
+	{name: "act_gact", feature: "the gact action", fallback: "only needed for ingress exclusions"},
+	{name: "act_skbedit", feature: "the skbedit action", fallback: "only needed for egress exclusions"},
+	{name: "sch_htb", feature: "the HTB qdisc", fallback: "only needed for hierarchical shaping"},
+	{name: "cls_flower", feature: "the flower classifier", fallback: "only needed for classes matching VLANs"},
+}
+
+// checkCapabilities checks the process has CAP_NET_ADMIN.
+func checkCapabilities() Check {
+	const name = "CAP_NET_ADMIN"
+
+	caps, err := effectiveCapabilities()
+	if err != nil {
+		return skipped(name, err.Error(), "")
+	}
+
+	if caps&(1<<capNetAdmin) == 0 {
+		return failed(name, ErrMissingCapability, capabilityHint)
+	}
+
+	return passed(name, "")
+}
+
+// effectiveCapabilities reads the effective capability set of the process.
+func effectiveCapabilities() (uint64, error) {
+	file, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0, fmt.Errorf("cannot read process status: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "CapEff:") {
+			value := strings.TrimSpace(strings.TrimPrefix(line, "CapEff:"))
+
+			caps, err := strconv.ParseUint(value, 16, 64)
+			if err != nil {
+				return 0, fmt.Errorf("cannot parse capabilities: %w", err)
+			}
+
+			return caps, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no effective capabilities in process status: %w", scanner.Err())
+}
+
+// checkModules checks each kernel module sqm relies on is loaded, built in or available to load.
+func checkModules() []Check {
+	checks := []Check{}
+
+	var uname unix.Utsname
+	if err := unix.Uname(&uname); err != nil {
+		return append(checks, skipped("kernel modules", err.Error(), ""))
+	}
+
+	dir := filepath.Join("/lib/modules", unix.ByteSliceToString(uname.Release[:]))
+	available, err := availableModules(dir)
+
+	for _, mod := range modules {
+		name := "module " + mod.name
+
+		if _, statErr := os.Stat(filepath.Join("/sys/module", mod.name)); statErr == nil {
+			checks = append(checks, passed(name, "loaded"))
+
+			continue
+		}
+
+		switch {
+		case err != nil:
+			checks = append(checks, skipped(name, "not loaded, and "+err.Error(), ""))
+		case available[mod.name]:
+			checks = append(checks, passed(name, "available"))
+		case mod.fallback != "":
+			checks = append(checks, skipped(name, "not available, "+mod.fallback, ""))
+		default:
+			checks = append(checks, failed(name, ErrMissingModule, fmt.Sprintf(
+				"%s needs %s. Install the package with the kernel's extra modules, such as "+
+					"kernel-modules-extra or linux-modules-extra, then run modprobe %s",
+				mod.name, mod.feature, mod.name)))
+		}
+	}
+
+	return checks
+}
+
+// availableModules lists the modules built in to the kernel or installed for it.
+func availableModules(dir string) (map[string]bool, error) {
+	available := map[string]bool{}
+
+	for _, list := range []string{"modules.builtin", "modules.dep"} {
+		file, err := os.Open(filepath.Join(dir, list))
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the module list: %w", err)
+		}
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			path, _, _ := strings.Cut(scanner.Text(), ":")
+			base := filepath.Base(path)
+			base, _, _ = strings.Cut(base, ".ko")
+			// Module files use - and _ interchangeably.
+			available[strings.ReplaceAll(base, "-", "_")] = true
+		}
+
+		file.Close()
+	}
+
+	return available, nil
+}
@@ -0,0 +1,251 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package ratesource
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/randomvariable/sqm/datastore"
+	"go.uber.org/zap"
+)
+
+var ErrNoUsableSource = errors.New("no usable rate source")
+
+// Input is a source along with how it should be used.
+type Input struct {
+	// Name identifies the source in logs and status
+	Name string
+	// Source is where rates are read from
+	Source Source
+	// Priority is used by the Priority strategy, lower is preferred
+	Priority int
+	// Interval is the minimum time between reads, zero reads on every reconciliation
+	Interval time.Duration
+	// Directions limits which rates are taken from this source, empty means both
+	Directions []Direction
+}
+
+func (i Input) serves(direction Direction) bool {
+	if len(i.Directions) == 0 {
+		return true
+	}
+
+	for _, d := range i.Directions {
+		if d == direction {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sourceState tracks the most recent reads of a source.
+type sourceState struct {
+	// input is the source configuration
+	input Input
+	// reading is the last valid reading
+	reading Reading
+	// lastAttempt is when the source was last read
+	lastAttempt time.Time
+	// lastSuccess is when the source last returned a valid reading
+	lastSuccess time.Time
+	// lastErr is the error from the last read, if any
+	lastErr error
+}
+
+// due returns whether the source should be read again.
+func (s *sourceState) due(now time.Time) bool {
+	return s.lastAttempt.IsZero() || now.Sub(s.lastAttempt) >= s.input.Interval
+}
+
+// fresh returns whether the last valid reading is still usable.
+func (s *sourceState) fresh(now time.Time, staleAfter time.Duration) bool {
+	return !s.lastSuccess.IsZero() && now.Sub(s.lastSuccess) <= staleAfter
+}
+
+// Controller reads from one or more sources and stores the combined, validated rates.
+type Controller struct {
+	// sources are the sources in configuration order
+	sources []*sourceState
+	// options configures how sources are combined
+	options Options
+	// data is the shared datastore
+	data *datastore.Data
+	// log is the logger
+	log *zap.SugaredLogger
+	// now returns the current time
+	now func() time.Time
+	// provisional are the rates used ahead of the fallback until a source is usable for their
+	// direction
+	provisional map[Direction]int64
+	// provisionalUntil is when the provisional rates expire
+	provisionalUntil time.Time
+}
+
+// NewRateController returns an instantiated controller for the given sources.
+func NewRateController(inputs []Input, options Options, data *datastore.Data, log *zap.SugaredLogger) *Controller {
+	if options.StaleAfter <= 0 {
+		options.StaleAfter = DefaultStaleAfter
+	}
+
+	if options.Strategy == "" {
+		options.Strategy = FirstHealthy
+	}
+
+	sources := make([]*sourceState, 0, len(inputs))
+	for _, input := range inputs {
+		sources = append(sources, &sourceState{input: input}) //nolint:exhaustruct
+	}
+
+	return &Controller{
+		sources: sources,
+		options: options,
+		data:    data,
+		log:     log.Named("Rate Reader").With("Strategy", options.Strategy),
+		now:     time.Now,
+
+		provisional:      map[Direction]int64{},
+		provisionalUntil: time.Time{},
+	}
+}
+
+// SetProvisional sets rates to use until a source is usable for their direction or the given
+// time passes, such as the last known rates from before a restart. A zero time never expires.
+func (c *Controller) SetProvisional(reading Reading, until time.Time) {
+	c.provisional = map[Direction]int64{Ingress: reading.Ingress, Egress: reading.Egress}
+	c.provisionalUntil = until
+}
+
+// Reconcile defines the reconciliation loop.
+func (c *Controller) Reconcile() error {
+	now := c.now()
+
+	for _, source := range c.sources {
+		if source.due(now) {
+			c.read(source, now)
+		}
+	}
+
+	c.publishStatus(now)
+
+	ingressErr := c.apply(Ingress, now)
+	egressErr := c.apply(Egress, now)
+
+	if ingressErr != nil {
+		return ingressErr
+	}
+
+	return egressErr
+}
+
+// read reads a source and records the outcome.
+func (c *Controller) read(source *sourceState, now time.Time) {
+	source.lastAttempt = now
+
+	reading, err := source.input.Source.Read()
+	if err == nil {
+		err = validateServed(source.input, reading)
+	}
+
+	if err != nil {
+		if source.lastErr == nil {
+			c.log.Errorw("Cannot read rates", "source", source.input.Name, "error", err)
+		}
+
+		source.lastErr = err
+
+		return
+	}
+
+	if source.lastErr != nil {
+		c.log.Infow("Rate source recovered", "source", source.input.Name)
+	}
+
+	source.reading = reading
+	source.lastSuccess = now
+	source.lastErr = nil
+}
+
+// validateServed validates only the directions a source is used for.
+func validateServed(input Input, reading Reading) error {
+	for _, direction := range []Direction{Ingress, Egress} {
+		if !input.serves(direction) {
+			continue
+		}
+
+		if err := ValidateRate(reading.Rate(direction)); err != nil {
+			return fmt.Errorf("%s: %w", direction, err)
+		}
+	}
+
+	return nil
+}
+
+// apply chooses and stores the rate for a direction.
+func (c *Controller) apply(direction Direction, now time.Time) error {
+	rate, name, ok := c.options.choose(direction, c.sources, now)
+	provisional, hasProvisional := c.provisional[direction]
+
+	switch {
+	case ok:
+		// A provisional rate is only a stop gap until the first live reading for its direction.
+		delete(c.provisional, direction)
+	case hasProvisional && (c.provisionalUntil.IsZero() || now.Before(c.provisionalUntil)):
+		rate, name = provisional, ProvisionalSourceName
+	case c.options.Fallback != nil:
+		rate, name = c.options.Fallback.Rate(direction), FallbackSourceName
+	default:
+		return fmt.Errorf("%w for %s", ErrNoUsableSource, direction)
+	}
+
+	var rateUpdated, sourceUpdated bool
+
+	if direction == Ingress {
+		rateUpdated = c.data.SetIngressRate(rate)
+		sourceUpdated = c.data.SetIngressSource(name)
+	} else {
+		rateUpdated = c.data.SetEgressRate(rate)
+		sourceUpdated = c.data.SetEgressSource(name)
+	}
+
+	if sourceUpdated {
+		c.log.Infow("Rate source in effect changed", "direction", direction, "source", name, "rate", rate)
+	} else if rateUpdated {
+		c.log.Infow("Read rates updated", "direction", direction, "source", name, "rate", rate)
+	}
+
+	return nil
+}
+
+// publishStatus records the health of every source in the datastore.
+func (c *Controller) publishStatus(now time.Time) {
+	statuses := make([]datastore.RateSourceStatus, 0, len(c.sources))
+
+	for _, source := range c.sources {
+		status := datastore.RateSourceStatus{
+			Name:        source.input.Name,
+			Healthy:     source.lastErr == nil && source.fresh(now, c.options.StaleAfter),
+			Ingress:     source.reading.Ingress,
+			Egress:      source.reading.Egress,
+			LastSuccess: source.lastSuccess,
+			LastError:   "",
+		}
+
+		if source.lastErr != nil {
+			status.LastError = source.lastErr.Error()
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	c.data.SetRateSources(statuses)
+}
+
+// ReconcileDelete defines what happens on shutdown.
+func (c *Controller) ReconcileDelete() {
+	// Nothing to do
+	c.log.Info("Rate reader shut down")
+}
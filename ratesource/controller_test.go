@@ -0,0 +1,54 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package ratesource
+
+import (
+	"testing"
+	"time"
+
+	"github.com/randomvariable/sqm/datastore"
+	"go.uber.org/zap"
+)
+
+// fixedSource always reads the same rates.
+type fixedSource struct {
+	reading Reading
+}
+
+func (s fixedSource) Read() (Reading, error) {
+	return s.reading, nil
+}
+
+func TestProvisionalRatesPerDirection(t *testing.T) {
+	t.Parallel()
+
+	data := datastore.NewDataStore()
+	inputs := []Input{{
+		Name:       "downstream only",
+		Source:     fixedSource{reading: Reading{Ingress: 80000, Egress: 0}},
+		Priority:   0,
+		Interval:   0,
+		Directions: []Direction{Ingress},
+	}}
+	options := Options{Strategy: FirstHealthy, StaleAfter: time.Minute, Fallback: &Reading{Ingress: 1000, Egress: 500}}
+
+	ctrl := NewRateController(inputs, options, data, zap.NewNop().Sugar())
+	ctrl.SetProvisional(Reading{Ingress: 60000, Egress: 20000}, time.Time{})
+
+	for round := 0; round < 2; round++ {
+		if err := ctrl.Reconcile(); err != nil {
+			t.Fatalf("Reconcile() error = %v", err)
+		}
+
+		if data.IngressRate() != 80000 || data.IngressSource() != "downstream only" {
+			t.Errorf("round %d: ingress = %d from %q, want the live reading", round, data.IngressRate(),
+				data.IngressSource())
+		}
+
+		if data.EgressRate() != 20000 || data.EgressSource() != ProvisionalSourceName {
+			t.Errorf("round %d: egress = %d from %q, want the provisional rate", round, data.EgressRate(),
+				data.EgressSource())
+		}
+	}
+}
@@ -0,0 +1,9 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+ratesource defines the common interface for anything that can report the line rates
+of a modem, and a controller that validates those rates before storing them in the
+shared datastore.
+*/
+package ratesource
@@ -0,0 +1,71 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package ratesource
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrInvalidRate = errors.New("invalid rate")
+
+const (
+	// MaxRate is the highest rate in kbps that will be accepted from a source (100Gbps).
+	MaxRate = int64(100_000_000)
+)
+
+// Reading is a pair of line rates in kbps as reported by a source.
+type Reading struct {
+	// Ingress is the downstream rate in kbps
+	Ingress int64
+	// Egress is the upstream rate in kbps
+	Egress int64
+}
+
+// Source is anything that can report the current line rates.
+type Source interface {
+	// Read returns the current line rates in kbps.
+	Read() (Reading, error)
+}
+
+// Direction is either ingress or egress.
+type Direction string
+
+const (
+	Ingress Direction = "ingress"
+	Egress  Direction = "egress"
+)
+
+// Rate returns the rate for the given direction.
+func (r Reading) Rate(direction Direction) int64 {
+	if direction == Ingress {
+		return r.Ingress
+	}
+
+	return r.Egress
+}
+
+// Validate checks a reading is within sensible bounds.
+func Validate(reading Reading) error {
+	for _, direction := range []Direction{Ingress, Egress} {
+		if err := ValidateRate(reading.Rate(direction)); err != nil {
+			return fmt.Errorf("%s: %w", direction, err)
+		}
+	}
+
+	return nil
+}
+
+// ValidateRate checks a single rate is within sensible bounds.
+func ValidateRate(rate int64) error {
+	if rate <= 0 {
+		return fmt.Errorf("%w: %d kbps is not positive", ErrInvalidRate, rate)
+	}
+
+	if rate > MaxRate {
+		return fmt.Errorf("%w: %d kbps exceeds maximum of %d kbps", ErrInvalidRate, rate, MaxRate)
+	}
+
+	return nil
+}
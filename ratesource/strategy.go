@@ -0,0 +1,99 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package ratesource
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+var ErrUnknownStrategy = errors.New("unknown combination strategy")
+
+// Strategy is how rates from several sources are combined.
+type Strategy string
+
+const (
+	// FirstHealthy uses the first source, in configuration order, whose last read succeeded.
+	FirstHealthy Strategy = "first-healthy"
+	// Min uses the lowest rate of all sources that aren't stale.
+	Min Strategy = "min"
+	// Max uses the highest rate of all sources that aren't stale.
+	Max Strategy = "max"
+	// Priority uses the source with the lowest priority value that isn't stale, so a
+	// preferred source survives transient failures until it goes stale.
+	Priority Strategy = "priority"
+
+	// DefaultStaleAfter is how long a reading is usable for if not configured.
+	DefaultStaleAfter = time.Minute
+	// FallbackSourceName is recorded as the source in effect when fallback rates are used.
+	FallbackSourceName = "fallback"
+	// ProvisionalSourceName is recorded as the source in effect when provisional rates are used.
+	ProvisionalSourceName = "persisted"
+)
+
+// ParseStrategy returns the strategy with the given name, defaulting to FirstHealthy.
+func ParseStrategy(name string) (Strategy, error) {
+	switch strategy := Strategy(name); strategy {
+	case "":
+		return FirstHealthy, nil
+	case FirstHealthy, Min, Max, Priority:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("%w: %q", ErrUnknownStrategy, name)
+	}
+}
+
+// Options configures how a controller combines its sources.
+type Options struct {
+	// Strategy is the combination strategy
+	Strategy Strategy
+	// StaleAfter is how long since its last successful read a source is still usable
+	StaleAfter time.Duration
+	// Fallback is used for any direction where every source is stale, may be nil
+	Fallback *Reading
+}
+
+// choose picks the rate for a direction from the given sources, returning the rate,
+// the name of the source it came from and whether any source could be used.
+func (o Options) choose(direction Direction, sources []*sourceState, now time.Time) (int64, string, bool) {
+	candidates := []*sourceState{}
+
+	for _, source := range sources {
+		if !source.input.serves(direction) || !source.fresh(now, o.StaleAfter) {
+			continue
+		}
+
+		if o.Strategy == FirstHealthy && source.lastErr != nil {
+			continue
+		}
+
+		candidates = append(candidates, source)
+	}
+
+	if len(candidates) == 0 {
+		return 0, "", false
+	}
+
+	switch o.Strategy {
+	case Priority:
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return candidates[i].input.Priority < candidates[j].input.Priority
+		})
+	case Min:
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return candidates[i].reading.Rate(direction) < candidates[j].reading.Rate(direction)
+		})
+	case Max:
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return candidates[i].reading.Rate(direction) > candidates[j].reading.Rate(direction)
+		})
+	case FirstHealthy:
+	}
+
+	chosen := candidates[0]
+
+	return chosen.reading.Rate(direction), chosen.input.Name, true
+}
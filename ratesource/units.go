@@ -0,0 +1,56 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package ratesource
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+var ErrUnknownUnit = errors.New("unknown unit")
+
+// Unit is the unit a source reports rates in.
+type Unit string
+
+const (
+	// BitsPerSecond is bit/s.
+	BitsPerSecond Unit = "bps"
+	// KilobitsPerSecond is kbit/s, the unit used internally.
+	KilobitsPerSecond Unit = "kbps"
+	// MegabitsPerSecond is Mbit/s.
+	MegabitsPerSecond Unit = "mbps"
+	// GigabitsPerSecond is Gbit/s.
+	GigabitsPerSecond Unit = "gbps"
+)
+
+// ParseUnit returns the unit for the given name, ignoring case.
+func ParseUnit(name string) (Unit, error) {
+	unit := Unit(strings.ToLower(name))
+	if _, ok := unitFactors()[unit]; !ok {
+		return "", fmt.Errorf("%w: %q", ErrUnknownUnit, name)
+	}
+
+	return unit, nil
+}
+
+// ToKbps converts a value in the given unit to kbps.
+func ToKbps(value float64, unit Unit) (int64, error) {
+	factor, ok := unitFactors()[unit]
+	if !ok {
+		return 0, fmt.Errorf("%w: %q", ErrUnknownUnit, unit)
+	}
+
+	return int64(math.Round(value * factor)), nil
+}
+
+func unitFactors() map[Unit]float64 {
+	return map[Unit]float64{
+		BitsPerSecond:     0.001,
+		KilobitsPerSecond: 1,
+		MegabitsPerSecond: 1_000,
+		GigabitsPerSecond: 1_000_000,
+	}
+}
@@ -0,0 +1,430 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package redirector
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	tc "github.com/florianl/go-tc"
+	"github.com/florianl/go-tc/core"
+	"github.com/randomvariable/sqm/classify"
+	"github.com/randomvariable/sqm/datastore"
+	"github.com/randomvariable/sqm/ownership"
+	"github.com/randomvariable/sqm/tcutil"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+var ErrNoEgressHook = errors.New("egress exclusions need a clsact qdisc")
+
+const (
+	// IngressExclusionPriority and EgressExclusionPriority are the first of the priorities
+	// exclusion filters use on each hook, one for each of all protocols, IPv4 and IPv6, as tc
+	// doesn't mix protocols within a priority. Ingress ones are ahead of the redirect filter.
+	// The hooks of a clsact qdisc share u32 hash tables, showing each other's filters at the
+	// same priority, so they differ.
+	IngressExclusionPriority = 5
+	EgressExclusionPriority  = 1
+)
+
+// exclusionProtocols are the protocols of exclusion filters.
+var exclusionProtocols = []uint32{ //nolint:gochecknoglobals
+	tcutil.ProtocolAll, tcutil.ProtocolIPv4, tcutil.ProtocolIPv6,
+}
+
+// exclusionPriority returns the priority of exclusion filters for a protocol.
+func exclusionPriority(protocol uint32, egress bool) uint32 {
+	if egress {
+		return EgressExclusionPriority + tcutil.ProtocolOffset(protocol)
+	}
+
+	return IngressExclusionPriority + tcutil.ProtocolOffset(protocol)
+}
+
+// Exclusion is traffic that bypasses shaping. Every set field must match, and lists match
+// any of their entries.
+type Exclusion struct {
+	Name string
+	// Prefixes match the remote end of the traffic: the source on ingress and the
+	// destination on egress
+	Prefixes []*net.IPNet
+	// Protocols are layer 4 protocol numbers
+	Protocols []uint8
+	// Mark matches the firewall mark, which only egress traffic has, as ingress filters run
+	// before netfilter
+	Mark *classify.Mark
+}
+
+// Exclusions are the traffic to exclude in each direction.
+type Exclusions struct {
+	// Ingress traffic is passed before the redirect to the IFB device
+	Ingress []Exclusion
+	// Egress traffic can't skip the root device's CAKE qdisc, so is put in its highest
+	// priority tin
+	Egress []Exclusion
+	// EgressPriority is the skb priority naming that tin, as CAKE's handle and tin number, or
+	// naming a hierarchical shaper's HTB qdisc, which sends it straight out
+	EgressPriority uint32
+}
+
+// exclusionFilter is a filter sqm adds for an exclusion, without its device or parent.
+type exclusionFilter struct {
+	protocol uint32
+	keys     []tc.U32Key
+	mark     *tc.U32Mark
+}
+
+// filters returns the u32 filters matching the exclusion, as an IPv4 and an IPv6 filter for
+// each combination of prefix and protocol, or a filter matching the mark alone.
+func (e Exclusion) filters(egress bool) []exclusionFilter {
+	var mark *tc.U32Mark
+	if e.Mark != nil {
+		mark = &tc.U32Mark{Val: e.Mark.Value, Mask: e.Mark.Mask, Success: 0}
+	}
+
+	if len(e.Prefixes) == 0 && len(e.Protocols) == 0 {
+		return []exclusionFilter{{protocol: tcutil.ProtocolAll, keys: []tc.U32Key{matchAll()}, mark: mark}}
+	}
+
+	filters := []exclusionFilter{}
+
+	for _, protocol := range []uint32{tcutil.ProtocolIPv4, tcutil.ProtocolIPv6} {
+		prefixes := [][]tc.U32Key{nil}
+
+		if len(e.Prefixes) > 0 {
+			prefixes = nil
+
+			for _, prefix := range e.Prefixes {
+				// Exclusions match the remote address, the destination on egress and the source
+				// on ingress.
+				if tcutil.PrefixProtocol(prefix) == protocol {
+					prefixes = append(prefixes, tcutil.PrefixKeys(prefix, !egress))
+				}
+			}
+		}
+
+		protocols := [][]tc.U32Key{nil}
+
+		if len(e.Protocols) > 0 {
+			protocols = nil
+
+			for _, l4 := range e.Protocols {
+				if (l4 == unix.IPPROTO_ICMP && protocol == tcutil.ProtocolIPv6) ||
+					(l4 == unix.IPPROTO_ICMPV6 && protocol == tcutil.ProtocolIPv4) {
+					continue
+				}
+
+				protocols = append(protocols, []tc.U32Key{protocolKey(protocol, l4)})
+			}
+		}
+
+		for _, prefixKeys := range prefixes {
+			for _, protocolKeys := range protocols {
+				keys := append(append([]tc.U32Key{}, prefixKeys...), protocolKeys...)
+				if len(keys) == 0 {
+					keys = []tc.U32Key{matchAll()}
+				}
+
+				filters = append(filters, exclusionFilter{protocol: protocol, keys: keys, mark: mark})
+			}
+		}
+	}
+
+	return filters
+}
+
+// matchAll returns a key matching every packet.
+func matchAll() tc.U32Key {
+	return tc.U32Key{Mask: 0, Val: 0, Off: 0, OffMask: 0}
+}
+
+// u32Key matches the masked bytes of the network header at offset, which is 4 byte aligned.
+// The kernel keeps the mask and value in network byte order.
+func u32Key(offset uint32, mask []byte, value []byte) tc.U32Key {
+	return tc.U32Key{
+		Mask:    nl.NativeEndian().Uint32(mask),
+		Val:     nl.NativeEndian().Uint32(value),
+		Off:     offset,
+		OffMask: 0,
+	}
+}
+
+// protocolKey matches the layer 4 protocol in an IPv4 or IPv6 header.
+func protocolKey(protocol uint32, l4 uint8) tc.U32Key {
+	if protocol == tcutil.ProtocolIPv4 {
+		return u32Key(8, []byte{0, 0xff, 0, 0}, []byte{0, l4, 0, 0}) //nolint:gomnd
+	}
+
+	return u32Key(4, []byte{0, 0, 0xff, 0}, []byte{0, 0, l4, 0}) //nolint:gomnd
+}
+
+// object returns the filter with its action, passing the traffic on ingress or setting its
+// priority on egress.
+func (f exclusionFilter) object(ifindex int, parent uint32, skbPriority *uint32) *tc.Object {
+	cookie := ownership.Cookie()
+	action := &tc.Action{ //nolint:exhaustruct
+		Kind:   "gact",
+		Cookie: &cookie,
+		Gact: &tc.Gact{ //nolint:exhaustruct
+			Parms: &tc.GactParms{Action: uint32(netlink.TC_ACT_OK)}, //nolint:exhaustruct
+		},
+	}
+
+	if skbPriority != nil {
+		action = &tc.Action{ //nolint:exhaustruct
+			Kind:   "skbedit",
+			Cookie: &cookie,
+			SkbEdit: &tc.SkbEdit{ //nolint:exhaustruct
+				Parms:    &tc.SkbEditParms{Action: uint32(netlink.TC_ACT_OK)}, //nolint:exhaustruct
+				Priority: skbPriority,
+			},
+		}
+	}
+
+	classID := core.BuildHandle(1, 1)
+
+	return &tc.Object{
+		Msg: tc.Msg{
+			Family:  unix.AF_UNSPEC,
+			Ifindex: uint32(ifindex),
+			Handle:  0,
+			Parent:  parent,
+			Info:    exclusionPriority(f.protocol, skbPriority != nil)<<16 | f.protocol, //nolint:gomnd
+		},
+		Attribute: tc.Attribute{ //nolint:exhaustruct
+			Kind: "u32",
+			U32: &tc.U32{ //nolint:exhaustruct
+				ClassID: &classID,
+				Sel: &tc.U32Sel{ //nolint:exhaustruct
+					Flags: u32Terminal,
+					NKeys: uint8(len(f.keys)),
+					Keys:  f.keys,
+				},
+				Mark:    f.mark,
+				Actions: &[]*tc.Action{action},
+			},
+		},
+	}
+}
+
+// signature describes what an exclusion filter matches and does, for comparing sqm's filters
+// with those wanted.
+func signature(filter *tc.Object) string {
+	parts := []string{fmt.Sprintf("%s/%x", filter.Kind, filter.Info)}
+
+	if filter.U32 != nil {
+		if filter.U32.Sel != nil {
+			for _, key := range filter.U32.Sel.Keys {
+				parts = append(parts, fmt.Sprintf("%08x/%08x@%d", key.Val, key.Mask, key.Off))
+			}
+		}
+
+		if filter.U32.Mark != nil {
+			parts = append(parts, fmt.Sprintf("mark %x/%x", filter.U32.Mark.Val, filter.U32.Mark.Mask))
+		}
+	}
+
+	if acts := actions(filter); acts != nil {
+		for _, action := range *acts {
+			switch {
+			case action.Gact != nil && action.Gact.Parms != nil:
+				parts = append(parts, fmt.Sprintf("gact %d", action.Gact.Parms.Action))
+			case action.SkbEdit != nil && action.SkbEdit.Priority != nil:
+				parts = append(parts, fmt.Sprintf("skbedit priority %x", *action.SkbEdit.Priority))
+			default:
+				parts = append(parts, action.Kind)
+			}
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// signatures returns the sorted signatures of filters.
+func signatures(filters []*tc.Object) []string {
+	result := make([]string, 0, len(filters))
+	for _, filter := range filters {
+		result = append(result, signature(filter))
+	}
+
+	sort.Strings(result)
+
+	return result
+}
+
+// ExclusionWarningName is the name of the warning set while exclusions can't be applied.
+const ExclusionWarningName = "exclusions"
+
+// reconcileExclusions applies the exclusions of both directions, recording a warning rather
+// than failing, as shaping works without them.
+func (c *Controller) reconcileExclusions(rootDevice netlink.Link, qdisc netlink.Qdisc) error {
+	err := c.reconcileHookExclusions(rootDevice, filterParent(qdisc), c.exclusions.Ingress, nil)
+
+	if err == nil && qdisc.Type() == string(ModeClsact) {
+		priority := c.exclusions.EgressPriority
+		err = c.reconcileHookExclusions(rootDevice, EgressParent, c.exclusions.Egress, &priority)
+	} else if err == nil && len(c.exclusions.Egress) > 0 {
+		err = ErrNoEgressHook
+	}
+
+	if errors.Is(err, ownership.ErrConflict) {
+		return err
+	}
+
+	warning := datastore.Warning{Message: "", Unhealthy: false}
+	if err != nil {
+		warning.Message = "traffic isn't excluded from shaping: " + err.Error()
+	}
+
+	if c.data.SetWarning(ExclusionWarningName, warning) && err != nil {
+		c.log.Warnw("Cannot exclude traffic from shaping", "error", err)
+	}
+
+	return nil
+}
+
+// reconcileHookExclusions makes sqm's filters at the exclusion priorities of a hook match the
+// exclusions, replacing them all if they don't. Anything else at those priorities is reported
+// as a conflict.
+func (c *Controller) reconcileHookExclusions(rootDevice netlink.Link, parent uint32, exclusions []Exclusion,
+	skbPriority *uint32,
+) error {
+	direction := "ingress"
+	if skbPriority != nil {
+		direction = "egress"
+	}
+
+	owned, err := c.exclusionFilters(rootDevice, parent, direction)
+	if err != nil {
+		return err
+	}
+
+	desired := []*tc.Object{}
+
+	for _, exclusion := range exclusions {
+		for _, filter := range exclusion.filters(skbPriority != nil) {
+			desired = append(desired, filter.object(rootDevice.Attrs().Index, parent, skbPriority))
+		}
+	}
+
+	if strings.Join(signatures(owned), "\n") == strings.Join(signatures(desired), "\n") {
+		return nil
+	}
+
+	c.deleteExclusions(rootDevice, parent, owned, false)
+
+	for _, filter := range desired {
+		if err := c.tcnl.Filter().Add(filter); err != nil {
+			return fmt.Errorf("error adding %s exclusion filter: %w", direction, err)
+		}
+	}
+
+	c.log.Infow("Updated exclusion filters", "Direction", direction, "Filters", len(desired))
+
+	return nil
+}
+
+// exclusionFilters returns sqm's filters at the exclusion priorities of a hook, failing with a
+// conflict if anything else is there.
+func (c *Controller) exclusionFilters(rootDevice netlink.Link, parent uint32, direction string) ([]*tc.Object,
+	error,
+) {
+	filters, err := c.filters(rootDevice, parent)
+	if err != nil {
+		return nil, err
+	}
+
+	object := direction + " exclusion filters on " + rootDevice.Attrs().Name
+
+	owned, foreign := exclusionsAt(filters, parent == EgressParent)
+	if foreign != nil {
+		description := fmt.Sprintf("%s filter at priority %d is not sqm's", foreign.Kind, priority(foreign))
+		if c.data.SetConflict(object, description) {
+			c.log.Errorw("Not adding exclusion filters alongside a filter owned by something else",
+				"Kind", foreign.Kind, "Priority", priority(foreign))
+		}
+
+		return nil, fmt.Errorf("%w: %s", ownership.ErrConflict, description)
+	}
+
+	c.data.SetConflict(object, "")
+
+	return owned, nil
+}
+
+// exclusionsAt returns sqm's filters at the exclusion priorities, and any other filter there.
+func exclusionsAt(filters []tc.Object, egress bool) ([]*tc.Object, *tc.Object) {
+	owned := []*tc.Object{}
+
+	var foreign *tc.Object
+
+	for i := range filters {
+		filter := &filters[i]
+
+		switch {
+		case !isExclusionPriority(priority(filter), egress) || isStructural(filter):
+		case hasCookie(filter):
+			owned = append(owned, filter)
+		default:
+			foreign = filter
+		}
+	}
+
+	return owned, foreign
+}
+
+// isExclusionPriority returns whether exclusion filters of a direction use a priority.
+func isExclusionPriority(prio uint32, egress bool) bool {
+	for _, protocol := range exclusionProtocols {
+		if prio == exclusionPriority(protocol, egress) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// deleteExclusions deletes every priority sqm's exclusion filters are at, which also removes
+// the hash tables u32 created for them. Filters sharing a priority with others are deleted one
+// by one.
+func (c *Controller) deleteExclusions(rootDevice netlink.Link, parent uint32, owned []*tc.Object, shared bool) {
+	deleted := map[uint32]bool{}
+
+	for _, filter := range owned {
+		if shared {
+			if err := c.tcnl.Filter().Delete(filter); err != nil {
+				c.log.Errorw("Error deleting exclusion filter", "error", err)
+			}
+
+			continue
+		}
+
+		if deleted[filter.Info] {
+			continue
+		}
+
+		deleted[filter.Info] = true
+
+		err := c.tcnl.Filter().Delete(&tc.Object{
+			Msg: tc.Msg{
+				Family:  unix.AF_UNSPEC,
+				Ifindex: uint32(rootDevice.Attrs().Index),
+				Handle:  0,
+				Parent:  parent,
+				Info:    filter.Info,
+			},
+			Attribute: tc.Attribute{ //nolint:exhaustruct
+				Kind: filter.Kind,
+			},
+		})
+		if err != nil {
+			c.log.Errorw("Error deleting exclusion filters", "error", err)
+		}
+	}
+}
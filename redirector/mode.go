@@ -0,0 +1,58 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package redirector
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+var ErrUnknownMode = errors.New("unknown redirect mode")
+
+// Mode is how the redirect to the IFB device is attached to the root device.
+type Mode string
+
+const (
+	// ModeClsact uses a clsact qdisc and a matchall filter. The clsact qdisc's egress hook is
+	// also free for other filters without adding a qdisc.
+	ModeClsact Mode = "clsact"
+	// ModeIngress uses an ingress qdisc and a u32 filter, for kernels without clsact or matchall
+	ModeIngress Mode = "ingress"
+)
+
+const (
+	// IngressParent is the parent of filters on a clsact qdisc's ingress hook
+	IngressParent = uint32(netlink.HANDLE_MIN_INGRESS)
+	// EgressParent is the parent of filters on a clsact qdisc's egress hook
+	EgressParent = uint32(netlink.HANDLE_MIN_EGRESS)
+)
+
+// ParseMode returns the mode with the given name, defaulting to ModeClsact.
+func ParseMode(name string) (Mode, error) {
+	switch Mode(name) {
+	case "", ModeClsact:
+		return ModeClsact, nil
+	case ModeIngress:
+		return ModeIngress, nil
+	default:
+		return "", fmt.Errorf("%w: %q", ErrUnknownMode, name)
+	}
+}
+
+// filterKind returns the classifier of the mode's redirect filter.
+func (m Mode) filterKind() string {
+	if m == ModeClsact {
+		return "matchall"
+	}
+
+	return "u32"
+}
+
+// unsupported returns whether an error is the kernel lacking a qdisc or classifier.
+func unsupported(err error) bool {
+	return errors.Is(err, unix.ENOENT) || errors.Is(err, unix.EOPNOTSUPP)
+}
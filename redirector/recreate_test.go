@@ -0,0 +1,214 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package redirector
+
+import (
+	"testing"
+
+	"github.com/randomvariable/sqm/datastore"
+	"github.com/randomvariable/sqm/links"
+	"github.com/randomvariable/sqm/netnstest"
+	"github.com/randomvariable/sqm/ownership"
+	"github.com/randomvariable/sqm/shaper"
+	"github.com/vishvananda/netlink"
+	"go.uber.org/zap"
+)
+
+const (
+	// settleRounds is how many times every controller is reconciled for the pipeline to settle.
+	// Recreating the root device takes a few, as each controller catches up with the last.
+	settleRounds = 5
+)
+
+type reconciler interface {
+	Reconcile() error
+	ReconcileDelete()
+}
+
+// canCake returns whether the kernel can create CAKE qdiscs.
+func canCake(t *testing.T, link netlink.Link) bool {
+	t.Helper()
+
+	qdisc := &netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{ //nolint:exhaustruct
+			LinkIndex: link.Attrs().Index,
+			Parent:    netlink.HANDLE_ROOT,
+			Handle:    netlink.MakeHandle(1, 0),
+		},
+		QdiscType: "cake",
+	}
+
+	if err := netlink.QdiscAdd(qdisc); err != nil {
+		t.Logf("kernel can't create CAKE qdiscs, so shaping isn't checked: %v", err)
+
+		return false
+	}
+
+	if err := netlink.QdiscDel(qdisc); err != nil {
+		t.Fatalf("cannot delete CAKE qdisc: %v", err)
+	}
+
+	return true
+}
+
+// settle reconciles every controller in pipeline order until none of them fails.
+func settle(t *testing.T, controllers []reconciler) {
+	t.Helper()
+
+	var err error
+
+	for round := 0; round < settleRounds; round++ {
+		err = nil
+
+		for _, ctrl := range controllers {
+			if reconcileErr := ctrl.Reconcile(); reconcileErr != nil {
+				err = reconcileErr
+			}
+		}
+
+		if err == nil {
+			return
+		}
+	}
+
+	t.Fatalf("pipeline didn't settle: %v", err)
+}
+
+// hasQdisc returns whether a device has a qdisc of a kind with the given handle major.
+func hasQdisc(t *testing.T, link netlink.Link, kind string, major uint32) bool {
+	t.Helper()
+
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		t.Fatalf("cannot list qdiscs of %s: %v", link.Attrs().Name, err)
+	}
+
+	for _, qdisc := range qdiscs {
+		if qdisc.Type() == kind && qdisc.Attrs().Handle == netlink.MakeHandle(uint16(major), 0) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkPipeline checks the root device is redirected to the IFB device, and both are shaped if
+// cake is set, and returns the two devices.
+func checkPipeline(t *testing.T, redirect *Controller, cake bool) (netlink.Link, netlink.Link) {
+	t.Helper()
+
+	root, err := netlink.LinkByName(netnstest.RootName)
+	if err != nil {
+		t.Fatalf("cannot find root device: %v", err)
+	}
+
+	ifb, err := netlink.LinkByName(links.IFBName(netnstest.RootName))
+	if err != nil {
+		t.Fatalf("cannot find IFB device: %v", err)
+	}
+
+	if ifb.Attrs().Alias != links.IFBAlias(netnstest.RootName) {
+		t.Errorf("IFB device alias = %q, want %q", ifb.Attrs().Alias, links.IFBAlias(netnstest.RootName))
+	}
+
+	if cake && !hasQdisc(t, root, "cake", ownership.EgressHandle) {
+		t.Errorf("root device has no CAKE qdisc with handle %x:", ownership.EgressHandle)
+	}
+
+	if cake && !hasQdisc(t, ifb, "cake", ownership.IngressHandle) {
+		t.Errorf("IFB device has no CAKE qdisc with handle %x:", ownership.IngressHandle)
+	}
+
+	qdisc, ok := redirect.findRootQdisc()
+	if !ok {
+		t.Fatal("root device has no ingress or clsact qdisc")
+	}
+
+	filters, err := redirect.filters(root, filterParent(qdisc))
+	if err != nil {
+		t.Fatalf("cannot list redirect filters: %v", err)
+	}
+
+	redirected := false
+
+	for i := range filters {
+		if hasCookie(&filters[i]) && redirectsTo(&filters[i], ifb.Attrs().Index) {
+			redirected = true
+		}
+	}
+
+	if !redirected {
+		t.Errorf("no filter on root device ifindex %d redirects to IFB device ifindex %d", root.Attrs().Index,
+			ifb.Attrs().Index)
+	}
+
+	return root, ifb
+}
+
+func TestRootDeviceRecreated(t *testing.T) {
+	netnstest.EnterScratchNamespace(t)
+	cake := canCake(t, netnstest.AddVeth(t))
+
+	data := datastore.NewDataStore()
+	data.SetIngressRate(50000)
+	data.SetEgressRate(10000)
+
+	log := zap.NewNop().Sugar()
+
+	egressShaper, err := shaper.NewShaperController(false, shaper.DefaultProfile(), nil, data, log)
+	if err != nil {
+		t.Fatalf("cannot create root device shaper: %v", err)
+	}
+
+	ingressShaper, err := shaper.NewShaperController(true, shaper.DefaultProfile(), nil, data, log)
+	if err != nil {
+		t.Fatalf("cannot create IFB device shaper: %v", err)
+	}
+
+	redirect, err := NewRedirectorController(ModeClsact, Exclusions{}, data, log) //nolint:exhaustruct
+	if err != nil {
+		t.Fatalf("cannot create redirector: %v", err)
+	}
+
+	controllers := []reconciler{
+		links.NewDeviceController(netnstest.RootName, data, false, log),
+		links.NewDeviceController(links.IFBName(netnstest.RootName), data, true, log),
+	}
+
+	// Without CAKE the shapers can never settle, but the redirect doesn't depend on them.
+	if cake {
+		controllers = append(controllers, egressShaper, ingressShaper)
+	} else {
+		egressShaper.Close()
+		ingressShaper.Close()
+	}
+
+	controllers = append(controllers, redirect)
+
+	t.Cleanup(func() {
+		for i := len(controllers) - 1; i >= 0; i-- {
+			controllers[i].ReconcileDelete()
+		}
+	})
+
+	settle(t, controllers)
+	oldRoot, oldIfb := checkPipeline(t, redirect, cake)
+
+	if err := netlink.LinkDel(oldRoot); err != nil {
+		t.Fatalf("cannot delete root device: %v", err)
+	}
+
+	netnstest.AddVeth(t)
+	settle(t, controllers)
+	newRoot, newIfb := checkPipeline(t, redirect, cake)
+
+	if newRoot.Attrs().Index == oldRoot.Attrs().Index {
+		t.Fatalf("recreated root device kept ifindex %d", oldRoot.Attrs().Index)
+	}
+
+	if newIfb.Attrs().Index == oldIfb.Attrs().Index {
+		t.Errorf("IFB device ifindex %d wasn't replaced after the root device was recreated",
+			oldIfb.Attrs().Index)
+	}
+}
@@ -5,12 +5,16 @@ package redirector
 
 import (
 	"fmt"
-	"syscall"
 
+	tc "github.com/florianl/go-tc"
 	"github.com/florianl/go-tc/core"
 	"github.com/randomvariable/sqm/datastore"
+	"github.com/randomvariable/sqm/links"
+	"github.com/randomvariable/sqm/ownership"
+	"github.com/randomvariable/sqm/tcutil"
 	"github.com/vishvananda/netlink"
 	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
 )
 
 // Controller contains all local information required for reconciliation.
@@ -19,20 +23,47 @@ type Controller struct {
 	data *datastore.Data
 	// log is the logger
 	log *zap.SugaredLogger
+	// tcnl is the socket connection to rtnetlink
+	tcnl *tc.Tc
+	// mode is how the redirect is attached, falling back to ModeIngress if the kernel lacks
+	// clsact or matchall
+	mode Mode
+	// exclusions is the traffic that bypasses shaping
+	exclusions Exclusions
+	// sharedIngress is set once an ingress qdisc with other filters on it has been kept in
+	// place of a clsact qdisc
+	sharedIngress bool
 }
 
 const (
 	DefaultPriority = 10
 	rootHandleBase  = uint16(0xffff)
 	rootHandleSub   = uint16(0)
+	// u32Terminal is TC_U32_TERMINAL, ending classification at a match
+	u32Terminal = 1
 )
 
 // NewRedirectorController returns an instantiated controller.
-func NewRedirectorController(data *datastore.Data, log *zap.SugaredLogger) *Controller {
+func NewRedirectorController(mode Mode, exclusions Exclusions, data *datastore.Data,
+	log *zap.SugaredLogger,
+) (*Controller, error) {
+	tcnl, err := tc.Open(&tc.Config{
+		NetNS:  0,
+		Logger: nil,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open netlink socket: %w", err)
+	}
+
 	return &Controller{
 		data: data,
 		log:  log.Named("Redirector Controller"),
-	}
+		tcnl: tcnl,
+		mode: mode,
+
+		exclusions:    exclusions,
+		sharedIngress: false,
+	}, nil
 }
 
 // Reconcile defines the reconciliation loop.
@@ -42,25 +73,65 @@ func (c *Controller) Reconcile() error {
 		return fmt.Errorf("error getting root device: %w", err)
 	}
 
-	c.log = c.log.With("RootDevice", rootDev.Attrs().Name)
 	redirectDevice, err := c.data.IfbDevice()
 	if err != nil {
 		return fmt.Errorf("error getting root device: %w", err)
 	}
 
-	c.log = c.log.With("IFBDevice", redirectDevice.Attrs().Name)
+	for _, dev := range []netlink.Link{rootDev, redirectDevice} {
+		if err := links.Current(dev); err != nil {
+			return err //nolint:wrapcheck
+		}
+	}
 
 	qdisc, err := c.reconcileRootQdisc()
 	if err != nil {
 		return err
 	}
 
-	return c.reconcileRedirect(qdisc.Attrs().Handle)
+	if err := c.reconcileRedirect(filterParent(qdisc)); err != nil {
+		return err
+	}
+
+	return c.reconcileExclusions(rootDev, qdisc)
+}
+
+// fallBack switches to ModeIngress once the kernel has turned down part of ModeClsact.
+func (c *Controller) fallBack(feature string, replacement string, err error) {
+	c.log.Warnw("Kernel doesn't support "+feature+", falling back to "+replacement, "error", err)
+	c.mode = ModeIngress
+}
+
+// filterParent returns the parent for filters on the root device's ingress hook, which for a
+// clsact qdisc is its ingress hook rather than the qdisc itself.
+func filterParent(qdisc netlink.Qdisc) uint32 {
+	if qdisc.Type() == string(ModeClsact) {
+		return IngressParent
+	}
+
+	return qdisc.Attrs().Handle
+}
+
+// filters returns the filters with the given parent on the root device.
+func (c *Controller) filters(rootDevice netlink.Link, parent uint32) ([]tc.Object, error) {
+	filters, err := c.tcnl.Filter().Get(&tc.Msg{
+		Family:  unix.AF_UNSPEC,
+		Ifindex: uint32(rootDevice.Attrs().Index),
+		Handle:  0,
+		Parent:  parent,
+		Info:    0,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error getting filters for root device: %w", err)
+	}
+
+	return filters, nil
 }
 
 // reconcileRedirect sets up the tc filter using the mirred action to redirect ingress traffic from
-// the root device to the IFB device so it can be shaped.
-func (c *Controller) reconcileRedirect(qdiscHandle uint32) error {
+// the root device to the IFB device so it can be shaped. Only filters carrying sqm's cookie are
+// changed. Anything else at sqm's priority is reported as a conflict.
+func (c *Controller) reconcileRedirect(parent uint32) error {
 	rootDevice, err := c.data.RootDevice()
 	if err != nil {
 		return fmt.Errorf("error getting root device: %w", err)
@@ -71,55 +142,198 @@ func (c *Controller) reconcileRedirect(qdiscHandle uint32) error {
 		return fmt.Errorf("error getting ifb device: %w", err)
 	}
 
-	filters, err := netlink.FilterList(rootDevice, netlink.HANDLE_INGRESS)
+	filters, err := c.filters(rootDevice, parent)
 	if err != nil {
-		return fmt.Errorf("error getting filters for root device: %w", err)
+		return err
 	}
 
-	for _, filter := range filters {
-		if filter.Type() == "u32" {
-			return nil
+	log := c.log.With("RootDevice", rootDevice.Attrs().Name, "IFBDevice", ifbDevice.Attrs().Name)
+	object := "redirect filter on " + rootDevice.Attrs().Name
+	found := false
+
+	for i := range filters {
+		filter := &filters[i]
+		if priority(filter) != DefaultPriority || isStructural(filter) {
+			continue
+		}
+
+		if !c.owns(filter, rootDevice, ifbDevice) {
+			description := fmt.Sprintf("%s filter at priority %d is not sqm's", filter.Kind, DefaultPriority)
+			if c.data.SetConflict(object, description) {
+				log.Errorw("Not adding redirect filter alongside a filter owned by something else",
+					"Kind", filter.Kind, "Priority", DefaultPriority)
+			}
+
+			return fmt.Errorf("%w: %s", ownership.ErrConflict, description)
+		}
+
+		reason := mismatch(filter, c.mode.filterKind(), ifbDevice.Attrs().Index)
+		if reason == "" && found {
+			reason = "duplicate"
 		}
+
+		if reason == "" {
+			found = true
+
+			continue
+		}
+
+		// Wrong, stale such as pointing at an IFB device that's been replaced, a duplicate, or
+		// from a release that didn't set a cookie. It's replaced below.
+		if err := c.tcnl.Filter().Delete(filter); err != nil {
+			return fmt.Errorf("error deleting stale redirect filter: %w", err)
+		}
+
+		log.Warnw("Repairing redirect filter", "Reason", reason)
 	}
 
-	if err := netlink.FilterAdd(&netlink.U32{
-		ClassId: core.BuildHandle(1, 1),
-		Link:    0,
-		FilterAttrs: netlink.FilterAttrs{
-			Parent:    qdiscHandle,
-			Protocol:  syscall.ETH_P_ALL,
-			Priority:  DefaultPriority,
-			LinkIndex: rootDevice.Attrs().Index,
-			Handle:    0,
-		},
-		Sel:        nil,
-		Divisor:    0,
-		Hash:       0,
-		RedirIndex: 0,
-		Actions: []netlink.Action{
-			&netlink.MirredAction{
-				MirredAction: netlink.TCA_EGRESS_REDIR,
-				Ifindex:      ifbDevice.Attrs().Index,
-				ActionAttrs: netlink.ActionAttrs{
-					Action:  netlink.TC_ACT_STOLEN,
-					Index:   0,
-					Capab:   0,
-					Refcnt:  0,
-					Bindcnt: 0,
-				},
-			},
-		},
-	}); err != nil {
+	c.data.SetConflict(object, "")
+
+	if found {
+		return nil
+	}
+
+	err = c.tcnl.Filter().Add(c.redirectFilter(rootDevice, ifbDevice, parent))
+	if err != nil && unsupported(err) && c.mode == ModeClsact {
+		c.fallBack("the matchall classifier", "a u32 filter", err)
+
+		err = c.tcnl.Filter().Add(c.redirectFilter(rootDevice, ifbDevice, parent))
+	}
+
+	if err != nil {
 		return fmt.Errorf("error adding redirect filter: %w", err)
 	}
 
-	c.log.Info("Added redirect filter")
+	log.Infow("Added redirect filter", "Kind", c.mode.filterKind())
 
 	return nil
 }
 
-// findRootQdisc attempts to find the root qdisc to which the redirection will be
-// set up upon.
+// redirectFilter returns a filter matching everything and redirecting it to the IFB device,
+// using the mode's classifier.
+func (c *Controller) redirectFilter(rootDevice netlink.Link, ifbDevice netlink.Link, parent uint32) *tc.Object {
+	cookie := ownership.Cookie()
+	actions := &[]*tc.Action{{ //nolint:exhaustruct
+		Kind:   "mirred",
+		Cookie: &cookie,
+		Mirred: &tc.Mirred{ //nolint:exhaustruct
+			Parms: &tc.MirredParam{ //nolint:exhaustruct
+				Action:  uint32(netlink.TC_ACT_STOLEN),
+				Eaction: uint32(netlink.TCA_EGRESS_REDIR),
+				IfIndex: uint32(ifbDevice.Attrs().Index),
+			},
+		},
+	}}
+
+	filter := &tc.Object{
+		Msg: tc.Msg{
+			Family:  unix.AF_UNSPEC,
+			Ifindex: uint32(rootDevice.Attrs().Index),
+			Handle:  0,
+			Parent:  parent,
+			Info:    uint32(DefaultPriority)<<16 | tcutil.ProtocolAll, //nolint:gomnd
+		},
+		Attribute: tc.Attribute{ //nolint:exhaustruct
+			Kind: c.mode.filterKind(),
+		},
+	}
+
+	if c.mode == ModeClsact {
+		filter.Matchall = &tc.Matchall{Actions: actions} //nolint:exhaustruct
+
+		return filter
+	}
+
+	classID := core.BuildHandle(1, 1)
+	filter.U32 = &tc.U32{ //nolint:exhaustruct
+		ClassID: &classID,
+		Sel: &tc.U32Sel{ //nolint:exhaustruct
+			Flags: u32Terminal,
+			NKeys: 1,
+			Keys:  []tc.U32Key{{Mask: 0, Val: 0, Off: 0, OffMask: 0}},
+		},
+		Actions: actions,
+	}
+
+	return filter
+}
+
+// owns returns whether sqm created the filter: it carries sqm's cookie, or it's a u32 filter
+// redirecting everything to the root device's IFB device, as set up by releases before cookies
+// were used.
+func (c *Controller) owns(filter *tc.Object, rootDevice netlink.Link, ifbDevice netlink.Link) bool {
+	if hasCookie(filter) {
+		return true
+	}
+
+	if ifbDevice == nil || ifbDevice.Attrs().Alias != links.IFBAlias(rootDevice.Attrs().Name) {
+		return false
+	}
+
+	return filter.Kind == "u32" && isCatchAll(filter) && redirectsTo(filter, ifbDevice.Attrs().Index)
+}
+
+// isCatchAll returns whether a u32 filter matches every packet.
+func isCatchAll(filter *tc.Object) bool {
+	if filter.U32 == nil || filter.U32.Sel == nil {
+		return false
+	}
+
+	for _, key := range filter.U32.Sel.Keys {
+		if key.Mask != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// priority returns the priority of a filter.
+func priority(filter *tc.Object) uint32 {
+	return filter.Info >> 16 //nolint:gomnd
+}
+
+// isStructural returns whether the filter is the entry for a whole priority, or the hash table
+// u32 creates for its filters, rather than a filter that classifies anything.
+func isStructural(filter *tc.Object) bool {
+	return filter.Handle == 0 || (filter.Kind == "u32" && filter.U32 != nil && filter.U32.Divisor != nil)
+}
+
+// actions returns the actions of a filter.
+func actions(filter *tc.Object) *[]*tc.Action {
+	switch {
+	case filter.U32 != nil:
+		return filter.U32.Actions
+	case filter.Matchall != nil:
+		return filter.Matchall.Actions
+	default:
+		return nil
+	}
+}
+
+// hasCookie returns whether the filter carries sqm's cookie.
+func hasCookie(filter *tc.Object) bool {
+	return ownership.HasCookie(actions(filter))
+}
+
+// redirectsTo returns whether the filter redirects to the given ifindex.
+func redirectsTo(filter *tc.Object, ifindex int) bool {
+	acts := actions(filter)
+	if acts == nil {
+		return false
+	}
+
+	for _, action := range *acts {
+		if action.Mirred != nil && action.Mirred.Parms != nil && action.Mirred.Parms.IfIndex == uint32(ifindex) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// findRootQdisc attempts to find the ingress or clsact qdisc to which the redirection will
+// be set up upon.
 func (c *Controller) findRootQdisc() (netlink.Qdisc, bool) {
 	var rootQDisc netlink.Qdisc
 
@@ -148,7 +362,8 @@ func (c *Controller) findRootQdisc() (netlink.Qdisc, bool) {
 	return rootQDisc, true
 }
 
-// reconcileRootQdisc ensures there's a root qdisc handle for redirection.
+// reconcileRootQdisc ensures there's a root qdisc handle for redirection. An existing ingress
+// or clsact qdisc is shared with any other filters on it.
 func (c *Controller) reconcileRootQdisc() (netlink.Qdisc, error) {
 	qdisc, ok := c.findRootQdisc()
 	if !ok {
@@ -159,34 +374,172 @@ func (c *Controller) reconcileRootQdisc() (netlink.Qdisc, error) {
 		return c.reconcileRootQdisc()
 	}
 
-	return qdisc, nil
+	if c.mode != ModeClsact || qdisc.Type() != string(ModeIngress) {
+		return qdisc, nil
+	}
+
+	migrated, err := c.migrateIngress(qdisc)
+	if err != nil || !migrated {
+		return qdisc, err
+	}
+
+	return c.reconcileRootQdisc()
+}
+
+// migrateIngress deletes an ingress qdisc so it can be replaced by a clsact qdisc, as long as
+// only sqm's filters are on it, such as when upgrading from a release that used one. The two
+// can't be on a device at once, so an ingress qdisc with other filters on it is kept.
+func (c *Controller) migrateIngress(qdisc netlink.Qdisc) (bool, error) {
+	if c.sharedIngress {
+		return false, nil
+	}
+
+	rootDevice, err := c.data.RootDevice()
+	if err != nil {
+		return false, fmt.Errorf("error getting root device: %w", err)
+	}
+
+	ifbDevice, err := c.data.IfbDevice()
+	if err != nil {
+		return false, fmt.Errorf("error getting ifb device: %w", err)
+	}
+
+	filters, err := c.filters(rootDevice, qdisc.Attrs().Handle)
+	if err != nil {
+		return false, err
+	}
+
+	for i := range filters {
+		filter := &filters[i]
+		if !isStructural(filter) && !c.owns(filter, rootDevice, ifbDevice) {
+			c.log.Infow("Keeping ingress qdisc shared with other filters rather than using clsact")
+
+			c.sharedIngress = true
+
+			return false, nil
+		}
+	}
+
+	if err := netlink.QdiscDel(qdisc); err != nil {
+		return false, fmt.Errorf("error deleting ingress qdisc: %w", err)
+	}
+
+	c.log.Infow("Replacing ingress qdisc with clsact")
+
+	return true, nil
 }
 
-// createRootHandle creates a root qdisc handle.
+// createRootHandle creates the mode's root qdisc handle.
 func (c *Controller) createRootHandle() error {
 	rootDevice, err := c.data.RootDevice()
 	if err != nil {
 		return fmt.Errorf("error getting root device: %w", err)
 	}
 
-	if err := netlink.QdiscReplace(&netlink.Ingress{
-		QdiscAttrs: netlink.QdiscAttrs{
-			LinkIndex: rootDevice.Attrs().Index,
-			Handle:    netlink.MakeHandle(rootHandleBase, rootHandleSub),
-			Parent:    netlink.HANDLE_INGRESS,
-			Refcnt:    uint32(1),
-		},
-	}); err != nil {
+	attrs := netlink.QdiscAttrs{
+		LinkIndex: rootDevice.Attrs().Index,
+		Handle:    netlink.MakeHandle(rootHandleBase, rootHandleSub),
+		Parent:    netlink.HANDLE_INGRESS,
+		Refcnt:    uint32(1),
+	}
+
+	if c.mode == ModeClsact {
+		err := netlink.QdiscReplace(&netlink.GenericQdisc{QdiscAttrs: attrs, QdiscType: string(ModeClsact)})
+		if err == nil {
+			c.log.Infow("Created root handle", "Kind", ModeClsact)
+
+			return nil
+		}
+
+		if !unsupported(err) {
+			return fmt.Errorf("error creating root handle: %w", err)
+		}
+
+		c.fallBack("the clsact qdisc", "an ingress qdisc and u32 filter", err)
+	}
+
+	if err := netlink.QdiscReplace(&netlink.Ingress{QdiscAttrs: attrs}); err != nil {
 		return fmt.Errorf("error creating root handle: %w", err)
 	}
 
-	c.log.Infow("Created root handle")
+	c.log.Infow("Created root handle", "Kind", ModeIngress)
 
 	return nil
 }
 
-// ReconcileDelete defines what happens on shutdown.
+// deleteFilters deletes sqm's filters. Unless other filters share sqm's priority, the whole
+// priority is deleted, which also removes the hash table u32 created for the filters.
+func (c *Controller) deleteFilters(rootDevice netlink.Link, parent uint32, filters []*tc.Object, shared bool) {
+	if len(filters) == 0 {
+		return
+	}
+
+	if !shared {
+		filters = []*tc.Object{{
+			Msg: tc.Msg{
+				Family:  unix.AF_UNSPEC,
+				Ifindex: uint32(rootDevice.Attrs().Index),
+				Handle:  0,
+				Parent:  parent,
+				Info:    uint32(DefaultPriority)<<16 | tcutil.ProtocolAll, //nolint:gomnd
+			},
+			Attribute: tc.Attribute{ //nolint:exhaustruct
+				Kind: filters[0].Kind,
+			},
+		}}
+	}
+
+	for _, filter := range filters {
+		if err := c.tcnl.Filter().Delete(filter); err != nil {
+			c.log.Errorw("Error deleting redirect filter", "error", err)
+		}
+	}
+}
+
+// otherFilters counts the filters on a clsact qdisc's egress hook, which go with the qdisc.
+func (c *Controller) otherFilters(rootDevice netlink.Link, qdisc netlink.Qdisc) int {
+	if qdisc.Type() != string(ModeClsact) {
+		return 0
+	}
+
+	filters, err := c.filters(rootDevice, EgressParent)
+	if err != nil {
+		c.log.Errorw("Cannot list egress filters", "error", err)
+
+		// Err on the side of leaving the qdisc in place.
+		return 1
+	}
+
+	count := 0
+
+	for i := range filters {
+		if !isStructural(&filters[i]) {
+			count++
+		}
+	}
+
+	return count
+}
+
+// Release defines what happens on shutdown when shaping is to be left in place.
+func (c *Controller) Release() {
+	if err := c.tcnl.Close(); err != nil {
+		c.log.Errorw("Cannot close netlink socket", "error", err)
+	}
+
+	c.log.Info("Leaving redirection in place")
+}
+
+// ReconcileDelete defines what happens on shutdown. sqm's filters are deleted, including the
+// redirect from releases before cookies were used, and the ingress or clsact qdisc too once
+// nothing else has filters on it.
 func (c *Controller) ReconcileDelete() {
+	defer func() {
+		if err := c.tcnl.Close(); err != nil {
+			c.log.Errorw("Cannot close netlink socket", "error", err)
+		}
+	}()
+
 	qdisc, ok := c.findRootQdisc()
 	if !ok {
 		c.log.Info("Couldn't find root handle. Skipping")
@@ -194,6 +547,67 @@ func (c *Controller) ReconcileDelete() {
 		return
 	}
 
+	rootDevice, err := c.data.RootDevice()
+	if err != nil {
+		return
+	}
+
+	// Without an IFB device, only filters carrying the cookie are recognised as sqm's.
+	ifbDevice, err := c.data.IfbDevice()
+	if err != nil {
+		ifbDevice = nil
+	}
+
+	parent := filterParent(qdisc)
+
+	for _, hook := range []uint32{parent, EgressParent} {
+		if hook == EgressParent && qdisc.Type() != string(ModeClsact) {
+			continue
+		}
+
+		filters, err := c.filters(rootDevice, hook)
+		if err != nil {
+			c.log.Errorw("Cannot list filters", "error", err)
+
+			continue
+		}
+
+		owned, foreign := exclusionsAt(filters, hook == EgressParent)
+		c.deleteExclusions(rootDevice, hook, owned, foreign != nil)
+	}
+
+	filters, err := c.filters(rootDevice, parent)
+	if err != nil {
+		c.log.Errorw("Cannot list filters", "error", err)
+
+		return
+	}
+
+	remaining := c.otherFilters(rootDevice, qdisc)
+	ours := []*tc.Object{}
+	shared := false
+
+	for i := range filters {
+		filter := &filters[i]
+
+		switch {
+		case isStructural(filter):
+		case c.owns(filter, rootDevice, ifbDevice):
+			ours = append(ours, filter)
+		default:
+			remaining++
+			shared = shared || priority(filter) == DefaultPriority
+		}
+	}
+
+	c.deleteFilters(rootDevice, parent, ours, shared)
+
+	if remaining > 0 {
+		c.log.Infow("Leaving "+qdisc.Type()+" qdisc in place for other filters", "Filters", remaining)
+
+		return
+	}
+
 	if err := netlink.QdiscDel(qdisc); err != nil {
 		c.log.Errorf("Error deleting root qdisc for redirection: %v", err)
 	}
@@ -0,0 +1,103 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package redirector
+
+import (
+	"testing"
+
+	tc "github.com/florianl/go-tc"
+	"github.com/randomvariable/sqm/datastore"
+	"github.com/randomvariable/sqm/links"
+	"github.com/randomvariable/sqm/netnstest"
+	"github.com/vishvananda/netlink"
+	"go.uber.org/zap"
+)
+
+// addLegacyRedirect sets up redirection to an IFB device with the given alias as releases
+// before cookies did, with an ingress qdisc and a u32 filter matching the given keys.
+func addLegacyRedirect(t *testing.T, alias string, keys []tc.U32Key) *Controller {
+	t.Helper()
+
+	root := netnstest.AddVeth(t)
+
+	ifb := &netlink.GenericLink{LinkAttrs: netlink.NewLinkAttrs(), LinkType: "ifb"}
+	ifb.Name = links.IFBName(netnstest.RootName)
+
+	if err := netlink.LinkAdd(ifb); err != nil {
+		t.Skipf("kernel can't create IFB devices: %v", err)
+	}
+
+	ifbDevice, err := netlink.LinkByName(ifb.Name)
+	if err != nil {
+		t.Fatalf("cannot find IFB device: %v", err)
+	}
+
+	if err := netlink.LinkSetAlias(ifbDevice, alias); err != nil {
+		t.Fatalf("cannot set alias of IFB device: %v", err)
+	}
+
+	ifbDevice.Attrs().Alias = alias
+
+	data := datastore.NewDataStore()
+	data.SetRootDevice(root)
+	data.SetIfbDevice(ifbDevice)
+
+	redirect, err := NewRedirectorController(ModeIngress, Exclusions{}, data, zap.NewNop().Sugar()) //nolint:exhaustruct
+	if err != nil {
+		t.Fatalf("cannot create redirector: %v", err)
+	}
+
+	if err := redirect.createRootHandle(); err != nil {
+		t.Fatalf("cannot create ingress qdisc: %v", err)
+	}
+
+	qdisc, ok := redirect.findRootQdisc()
+	if !ok {
+		t.Fatal("ingress qdisc wasn't created")
+	}
+
+	filter := redirect.redirectFilter(root, ifbDevice, filterParent(qdisc))
+	(*filter.U32.Actions)[0].Cookie = nil
+	filter.U32.Sel.Keys = keys
+	filter.U32.Sel.NKeys = uint8(len(keys))
+
+	if err := redirect.tcnl.Filter().Add(filter); err != nil {
+		t.Skipf("kernel can't add u32 filters with mirred actions: %v", err)
+	}
+
+	return redirect
+}
+
+func TestReconcileDeleteLegacyRedirect(t *testing.T) {
+	matchAll := []tc.U32Key{{Mask: 0, Val: 0, Off: 0, OffMask: 0}}
+	// One address rather than everything, which sqm never redirected.
+	oneAddress := []tc.U32Key{{Mask: 0xffffffff, Val: 0x0100000a, Off: 16, OffMask: 0}}
+
+	tests := []struct {
+		name        string
+		alias       string
+		keys        []tc.U32Key
+		wantDeleted bool
+	}{
+		{name: "sqm's IFB device", alias: links.IFBAlias(netnstest.RootName), keys: matchAll, wantDeleted: true},
+		{name: "unaliased IFB device", alias: "", keys: matchAll, wantDeleted: false},
+		{name: "another root device's IFB device", alias: links.IFBAlias("eth9"), keys: matchAll, wantDeleted: false},
+		{name: "not a catch-all", alias: links.IFBAlias(netnstest.RootName), keys: oneAddress, wantDeleted: false},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			netnstest.EnterScratchNamespace(t)
+
+			redirect := addLegacyRedirect(t, tt.alias, tt.keys)
+			redirect.ReconcileDelete()
+
+			_, found := redirect.findRootQdisc()
+			if deleted := !found; deleted != tt.wantDeleted {
+				t.Errorf("ingress qdisc deleted = %t, want %t", deleted, tt.wantDeleted)
+			}
+		})
+	}
+}
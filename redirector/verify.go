@@ -0,0 +1,81 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package redirector
+
+import (
+	"fmt"
+
+	tc "github.com/florianl/go-tc"
+	"github.com/randomvariable/sqm/tcutil"
+	"github.com/vishvananda/netlink"
+)
+
+// skipSoftware is TCA_CLS_FLAGS_SKIP_SW.
+const skipSoftware = 2
+
+// mismatch compares a redirect filter with the one sqm would add, returning what's wrong with
+// it, or an empty string if it's as wanted.
+func mismatch(filter *tc.Object, kind string, ifindex int) string {
+	if !hasCookie(filter) {
+		return "no sqm cookie"
+	}
+
+	if filter.Kind != kind {
+		return fmt.Sprintf("is a %s filter rather than %s", filter.Kind, kind)
+	}
+
+	if protocol := filter.Info & 0xffff; protocol != tcutil.ProtocolAll { //nolint:gomnd
+		return fmt.Sprintf("matches protocol %#04x rather than all", protocol)
+	}
+
+	if reason := selectorMismatch(filter); reason != "" {
+		return reason
+	}
+
+	acts := actions(filter)
+	if acts == nil || len(*acts) != 1 {
+		return "doesn't have exactly one action"
+	}
+
+	action := (*acts)[0]
+	if action.Kind != "mirred" || action.Mirred == nil || action.Mirred.Parms == nil {
+		return fmt.Sprintf("has a %s action rather than mirred", action.Kind)
+	}
+
+	parms := action.Mirred.Parms
+
+	switch {
+	case parms.Eaction != uint32(netlink.TCA_EGRESS_REDIR):
+		return fmt.Sprintf("mirred action %d isn't an egress redirect", parms.Eaction)
+	case parms.Action != uint32(netlink.TC_ACT_STOLEN):
+		return fmt.Sprintf("verdict %d isn't stolen", parms.Action)
+	case parms.IfIndex != uint32(ifindex):
+		return fmt.Sprintf("redirects to ifindex %d rather than %d", parms.IfIndex, ifindex)
+	}
+
+	return ""
+}
+
+// selectorMismatch checks a filter matches every packet in software.
+func selectorMismatch(filter *tc.Object) string {
+	if filter.Kind == "matchall" {
+		if filter.Matchall != nil && filter.Matchall.Flags != nil && *filter.Matchall.Flags&skipSoftware != 0 {
+			return "is only offloaded to hardware"
+		}
+
+		return ""
+	}
+
+	if filter.U32 == nil || filter.U32.Sel == nil {
+		return "has no u32 selector"
+	}
+
+	for _, key := range filter.U32.Sel.Keys {
+		if key.Mask != 0 {
+			return "doesn't match every packet"
+		}
+	}
+
+	return ""
+}
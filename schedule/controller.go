@@ -0,0 +1,111 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package schedule
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/randomvariable/sqm/datastore"
+	"go.uber.org/zap"
+)
+
+// AdjustmentName is the name the schedule in effect is recorded under in the datastore.
+const AdjustmentName = "schedule"
+
+// Schedule changes how both directions are shaped during a window.
+type Schedule struct {
+	Name    string
+	Window  Window
+	Ingress datastore.Adjustment
+	Egress  datastore.Adjustment
+}
+
+// Validate checks schedule names are unique and their adjustments make sense.
+func Validate(schedules []Schedule) error {
+	names := map[string]bool{}
+
+	for _, schedule := range schedules {
+		if schedule.Name == "" {
+			return fmt.Errorf("%w: schedules need a name", ErrInvalidSchedule)
+		}
+
+		if names[schedule.Name] {
+			return fmt.Errorf("%w: more than one schedule is named %q", ErrInvalidSchedule, schedule.Name)
+		}
+
+		names[schedule.Name] = true
+
+		for _, adjustment := range []datastore.Adjustment{schedule.Ingress, schedule.Egress} {
+			if adjustment.Multiplier < 0 || adjustment.Cap < 0 {
+				return fmt.Errorf("%w: schedule %q has a negative multiplier or cap", ErrInvalidSchedule, schedule.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Controller records the adjustments of the first schedule whose window contains the current
+// time, if any.
+type Controller struct {
+	// schedules are tried in order
+	schedules []Schedule
+	// data is the shared datastore
+	data *datastore.Data
+	// log is the logger
+	log *zap.SugaredLogger
+	// now returns the current time
+	now func() time.Time
+}
+
+// NewScheduleController returns an instantiated controller.
+func NewScheduleController(schedules []Schedule, data *datastore.Data, log *zap.SugaredLogger) *Controller {
+	return &Controller{
+		schedules: schedules,
+		data:      data,
+		log:       log.Named("Schedule Controller"),
+		now:       time.Now,
+	}
+}
+
+// Active returns the schedule in effect at a time, or nil if none is.
+func (c *Controller) Active(now time.Time) *Schedule {
+	for i := range c.schedules {
+		if c.schedules[i].Window.Contains(now) {
+			return &c.schedules[i]
+		}
+	}
+
+	return nil
+}
+
+// Reconcile defines the reconciliation loop.
+func (c *Controller) Reconcile() error {
+	var adjustments datastore.Adjustments
+
+	active := c.Active(c.now())
+	if active != nil {
+		adjustments = datastore.Adjustments{Reason: active.Name, Ingress: active.Ingress, Egress: active.Egress}
+	}
+
+	if !c.data.SetAdjustments(AdjustmentName, adjustments) {
+		return nil
+	}
+
+	if active != nil {
+		c.log.Infow("Schedule in effect", "Schedule", active.Name, "IngressRate", c.data.ShapedIngressRate(),
+			"EgressRate", c.data.ShapedEgressRate())
+	} else {
+		c.log.Infow("No schedule in effect", "IngressRate", c.data.ShapedIngressRate(),
+			"EgressRate", c.data.ShapedEgressRate())
+	}
+
+	return nil
+}
+
+// ReconcileDelete defines what happens on shutdown.
+func (c *Controller) ReconcileDelete() {
+	c.log.Info("Schedule controller shut down")
+}
@@ -0,0 +1,204 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/randomvariable/sqm/datastore"
+	"go.uber.org/zap"
+)
+
+const (
+	lineIngress = 50000
+	lineEgress  = 10000
+)
+
+// at returns a local time in the week starting on Monday 19 October 2026.
+func at(day time.Weekday, hour, minute int) time.Time {
+	monday := time.Date(2026, time.October, 19, 0, 0, 0, 0, time.Local)
+
+	return monday.AddDate(0, 0, (int(day)+6)%7).Add(time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute)
+}
+
+// window returns a window, failing the test if it doesn't parse.
+func window(t *testing.T, days, start, end string) Window {
+	t.Helper()
+
+	parsedDays, err := ParseDays(days)
+	if err != nil {
+		t.Fatalf("ParseDays(%q) error = %v", days, err)
+	}
+
+	parsedStart, err := ParseTime(start)
+	if err != nil {
+		t.Fatalf("ParseTime(%q) error = %v", start, err)
+	}
+
+	parsedEnd, err := ParseTime(end)
+	if err != nil {
+		t.Fatalf("ParseTime(%q) error = %v", end, err)
+	}
+
+	return Window{Days: parsedDays, Start: parsedStart, End: parsedEnd}
+}
+
+func TestControllerReconcile(t *testing.T) {
+	t.Parallel()
+
+	schedules := []Schedule{
+		{
+			Name:    "office hours",
+			Window:  window(t, "mon-fri", "09:00", "17:30"),
+			Ingress: datastore.Adjustment{}, //nolint:exhaustruct
+			Egress:  datastore.Adjustment{Multiplier: 0.5, Cap: 0, Profile: "calls"},
+		},
+		{
+			Name:    "friday night",
+			Window:  window(t, "fri", "22:00", "02:00"),
+			Ingress: datastore.Adjustment{Multiplier: 0, Cap: 40000, Profile: ""},
+			Egress:  datastore.Adjustment{}, //nolint:exhaustruct
+		},
+		{
+			Name:    "overnight",
+			Window:  window(t, "*", "23:00", "06:00"),
+			Ingress: datastore.Adjustment{Multiplier: 0, Cap: 20000, Profile: ""},
+			Egress:  datastore.Adjustment{Multiplier: 0, Cap: 2000, Profile: ""},
+		},
+	}
+
+	// The steps run in order against one controller, so each checks the adjustments of the
+	// previous step were replaced or cleared.
+	steps := []struct {
+		name          string
+		now           time.Time
+		wantSchedule  string
+		wantIngress   int64
+		wantEgress    int64
+		wantProfile   string
+		wantReconcile bool
+	}{
+		{"before office hours", at(time.Monday, 8, 59), "", lineIngress, lineEgress, "", false},
+		{"office hours start", at(time.Monday, 9, 0), "office hours", lineIngress, 5000, "calls", true},
+		{"during office hours", at(time.Monday, 17, 29), "office hours", lineIngress, 5000, "calls", false},
+		{"office hours end", at(time.Monday, 17, 30), "", lineIngress, lineEgress, "", true},
+		{"overnight start", at(time.Monday, 23, 0), "overnight", 20000, 2000, "", true},
+		{"overnight past midnight", at(time.Tuesday, 5, 59), "overnight", 20000, 2000, "", false},
+		{"overnight end", at(time.Tuesday, 6, 0), "", lineIngress, lineEgress, "", true},
+		{"friday office hours", at(time.Friday, 12, 0), "office hours", lineIngress, 5000, "calls", true},
+		{"friday night before overnight", at(time.Friday, 22, 30), "friday night", 40000, lineEgress, "", true},
+		{"first match wins", at(time.Friday, 23, 30), "friday night", 40000, lineEgress, "", false},
+		{"friday night into saturday", at(time.Saturday, 1, 59), "friday night", 40000, lineEgress, "", false},
+		{"friday night ends", at(time.Saturday, 2, 0), "overnight", 20000, 2000, "", true},
+		{"no office hours at the weekend", at(time.Saturday, 12, 0), "", lineIngress, lineEgress, "", true},
+		{"saturday night into sunday", at(time.Sunday, 1, 0), "overnight", 20000, 2000, "", true},
+		{"overnight ends on sunday", at(time.Sunday, 6, 0), "", lineIngress, lineEgress, "", true},
+	}
+
+	data := datastore.NewDataStore()
+	data.SetIngressRate(lineIngress)
+	data.SetEgressRate(lineEgress)
+
+	ctrl := NewScheduleController(schedules, data, zap.NewNop().Sugar())
+
+	for _, step := range steps {
+		now := step.now
+		ctrl.now = func() time.Time { return now }
+		generation := data.Generation(datastore.KeyAdjustments)
+
+		if err := ctrl.Reconcile(); err != nil {
+			t.Fatalf("%s: Reconcile() error = %v", step.name, err)
+		}
+
+		if reconciled := data.Generation(datastore.KeyAdjustments) != generation; reconciled != step.wantReconcile {
+			t.Errorf("%s: adjustments changed = %t, want %t", step.name, reconciled, step.wantReconcile)
+		}
+
+		if got := data.Adjustments()[AdjustmentName].Reason; got != step.wantSchedule {
+			t.Errorf("%s: schedule in effect = %q, want %q", step.name, got, step.wantSchedule)
+		}
+
+		if got := data.ShapedIngressRate(); got != step.wantIngress {
+			t.Errorf("%s: ShapedIngressRate() = %d, want %d", step.name, got, step.wantIngress)
+		}
+
+		if got := data.ShapedEgressRate(); got != step.wantEgress {
+			t.Errorf("%s: ShapedEgressRate() = %d, want %d", step.name, got, step.wantEgress)
+		}
+
+		if got := data.EgressProfile(); got != step.wantProfile {
+			t.Errorf("%s: EgressProfile() = %q, want %q", step.name, got, step.wantProfile)
+		}
+
+		if got := data.IngressProfile(); got != "" {
+			t.Errorf("%s: IngressProfile() = %q, want none", step.name, got)
+		}
+	}
+}
+
+func TestWindowContainsAllDay(t *testing.T) {
+	t.Parallel()
+
+	allDay := window(t, "sat,sun", "00:00", "00:00")
+
+	tests := []struct {
+		now  time.Time
+		want bool
+	}{
+		{at(time.Friday, 23, 59), false},
+		{at(time.Saturday, 0, 0), true},
+		{at(time.Sunday, 23, 59), true},
+		{at(time.Monday, 0, 0), false},
+	}
+
+	for _, tt := range tests {
+		if got := allDay.Contains(tt.now); got != tt.want {
+			t.Errorf("Contains(%s) = %t, want %t", tt.now.Format("Mon 15:04"), got, tt.want)
+		}
+	}
+}
+
+func TestParseDays(t *testing.T) {
+	t.Parallel()
+
+	weekdays := Days(0)
+	for day := time.Monday; day <= time.Friday; day++ {
+		weekdays |= 1 << day
+	}
+
+	weekend := Days(1<<time.Saturday | 1<<time.Sunday)
+
+	tests := []struct {
+		text    string
+		want    Days
+		wantErr bool
+	}{
+		{"", EveryDay, false},
+		{"*", EveryDay, false},
+		{"mon-fri", weekdays, false},
+		{"Monday-Friday", weekdays, false},
+		{"1-5", weekdays, false},
+		{"sat,sun", weekend, false},
+		{"6-7", weekend, false},
+		{"sat-sun", weekend, false},
+		{"0", 1 << time.Sunday, false},
+		{"fri-mon", 0, true},
+		{"8", 0, true},
+		{"someday", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseDays(tt.text)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseDays(%q) error = %v, want error %t", tt.text, err, tt.wantErr)
+
+			continue
+		}
+
+		if got != tt.want {
+			t.Errorf("ParseDays(%q) = %07b, want %07b", tt.text, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+schedule is a package for changing how an interface is shaped during recurring windows of the
+week, such as capping uploads during office hours, by adjusting the rates the rate sources
+report before the shaper uses them.
+*/
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidSchedule = errors.New("invalid schedule")
+
+const daysPerWeek = 7
+
+// dayNames are the names of the days of the week, as cron numbers them from Sunday.
+var dayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"} //nolint:gochecknoglobals
+
+// Days is a set of days of the week, with bit n set for time.Weekday n.
+type Days uint8
+
+// EveryDay is every day of the week.
+const EveryDay = Days(1<<daysPerWeek - 1)
+
+// Has returns whether the set includes a day.
+func (d Days) Has(day time.Weekday) bool {
+	return d&(1<<day) != 0
+}
+
+// ParseDays parses the day of week field of a crontab, such as mon-fri, sat,sun, 1-5 or *. Both
+// 0 and 7 are Sunday, and an empty field is every day.
+func ParseDays(text string) (Days, error) {
+	if text == "" || text == "*" {
+		return EveryDay, nil
+	}
+
+	days := Days(0)
+
+	for _, part := range strings.Split(text, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+
+		start, err := parseDay(first)
+		if err != nil {
+			return 0, err
+		}
+
+		end := start
+
+		if isRange {
+			if end, err = parseDay(last); err != nil {
+				return 0, err
+			}
+
+			// A range ending on Sunday as 0, such as fri-sun, wraps to the end of the week.
+			if end < start && end == 0 {
+				end = daysPerWeek
+			}
+
+			if end < start {
+				return 0, fmt.Errorf("%w: day range %q runs backwards", ErrInvalidSchedule, part)
+			}
+		}
+
+		for day := start; day <= end; day++ {
+			days |= 1 << (day % daysPerWeek)
+		}
+	}
+
+	return days, nil
+}
+
+// parseDay parses a day name or number.
+func parseDay(text string) (int, error) {
+	text = strings.ToLower(strings.TrimSpace(text))
+
+	for day, name := range dayNames {
+		if strings.HasPrefix(text, name) {
+			return day, nil
+		}
+	}
+
+	day, err := strconv.Atoi(text)
+	if err != nil || day < 0 || day > daysPerWeek {
+		return 0, fmt.Errorf("%w: unknown day %q", ErrInvalidSchedule, text)
+	}
+
+	return day, nil
+}
+
+// ParseTime parses a time of day as HH:MM, returning the time since midnight. 24:00 is the end
+// of the day.
+func ParseTime(text string) (time.Duration, error) {
+	hoursText, minutesText, ok := strings.Cut(text, ":")
+
+	hours, hoursErr := strconv.Atoi(hoursText)
+	minutes, minutesErr := strconv.Atoi(minutesText)
+
+	if !ok || hoursErr != nil || minutesErr != nil || hours < 0 || minutes < 0 || minutes > 59 ||
+		hours > 24 || (hours == 24 && minutes > 0) {
+		return 0, fmt.Errorf("%w: time %q isn't HH:MM", ErrInvalidSchedule, text)
+	}
+
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute, nil
+}
+
+// Window is a recurring period of the week in local time. A window ending before it starts runs
+// past midnight, into the day after each of its days, and one ending as it starts lasts all day.
+type Window struct {
+	Days  Days
+	Start time.Duration
+	End   time.Duration
+}
+
+// Contains returns whether a time is within the window.
+func (w Window) Contains(now time.Time) bool {
+	offset := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute +
+		time.Duration(now.Second())*time.Second
+	day := now.Weekday()
+
+	switch {
+	case w.Start == w.End:
+		return w.Days.Has(day)
+	case w.Start < w.End:
+		return w.Days.Has(day) && offset >= w.Start && offset < w.End
+	case offset >= w.Start:
+		return w.Days.Has(day)
+	case offset < w.End:
+		return w.Days.Has((day + daysPerWeek - 1) % daysPerWeek)
+	default:
+		return false
+	}
+}
@@ -0,0 +1,584 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package shaper
+
+import (
+	"fmt"
+	"math"
+	"net"
+
+	tc "github.com/florianl/go-tc"
+	"github.com/florianl/go-tc/core"
+	"github.com/randomvariable/sqm/classify"
+	"github.com/randomvariable/sqm/ownership"
+	"github.com/randomvariable/sqm/tcutil"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// rootClassMinor is the minor of the HTB class holding the whole line rate, and
+	// defaultClassMinor that of the class for traffic no configured class matches. The
+	// configured classes follow, in order.
+	rootClassMinor    = uint32(1)
+	defaultClassMinor = uint32(2)
+	// htbMTU is the most a class can always send in one go, and the least it's given when
+	// sharing spare rate
+	htbMTU = 1600
+	// maxQuantum is the most the kernel lets a class send when sharing spare rate
+	maxQuantum = 200000
+	// rateToQuantum is how many times a class's rate in bytes/s is larger than its quantum
+	rateToQuantum = 10
+	// ticksPerSecond is the rate of the kernel's packet scheduler clock, which ticks every 64ns
+	ticksPerSecond = 15625000
+	// linkLayerEthernet and linkLayerATM are TC_LINKLAYER_ETHERNET and TC_LINKLAYER_ATM
+	linkLayerEthernet = 1
+	linkLayerATM      = 2
+	// ethTypeVLAN is ETH_P_8021Q, as flower matches it
+	ethTypeVLAN = 0x8100
+	// prioritiesPerClass is the number of filter priorities each class takes, one for each
+	// protocol, as tc doesn't mix protocols within a priority
+	prioritiesPerClass = 4
+	u32Terminal        = 1
+)
+
+// Class is a class of a hierarchical shaper, guaranteed a share of the line rate and limited
+// to another. Traffic matching any of its prefixes, VLANs or marks is sorted into it.
+type Class struct {
+	Name string
+	// Rate is the fraction of the line rate the class is guaranteed
+	Rate float64
+	// Ceil is the largest fraction of the line rate the class may use
+	Ceil float64
+	// Prefixes match the local end of the traffic: the source on egress and the destination
+	// on ingress
+	Prefixes []*net.IPNet
+	// VLANs are the IDs of tagged traffic on the device
+	VLANs []uint16
+	// Marks match the firewall mark, which only egress traffic has, as the redirect to the IFB
+	// device happens before netfilter
+	Marks []classify.Mark
+}
+
+// validateClasses checks the classes leave part of the line rate for unmatched traffic.
+func (p Profile) validateClasses() error {
+	if len(p.Classes) >= ownership.ClassHandles {
+		return fmt.Errorf("%w: at most %d classes are supported", ErrInvalidProfile, ownership.ClassHandles-1)
+	}
+
+	names := map[string]bool{}
+	guaranteed := 0.0
+
+	for _, class := range p.Classes {
+		switch {
+		case class.Name == "":
+			return fmt.Errorf("%w: classes need a name", ErrInvalidProfile)
+		case names[class.Name]:
+			return fmt.Errorf("%w: more than one class is named %q", ErrInvalidProfile, class.Name)
+		case class.Rate <= 0 || class.Rate > class.Ceil || class.Ceil > 1:
+			return fmt.Errorf("%w: class %q needs 0 < rate <= ceil <= 1, not rate %g and ceil %g", ErrInvalidProfile,
+				class.Name, class.Rate, class.Ceil)
+		case len(class.Prefixes) == 0 && len(class.VLANs) == 0 && len(class.Marks) == 0:
+			return fmt.Errorf("%w: class %q matches no traffic", ErrInvalidProfile, class.Name)
+		}
+
+		for _, vlan := range class.VLANs {
+			if vlan == 0 || vlan > 4094 { //nolint:gomnd
+				return fmt.Errorf("%w: class %q has invalid VLAN ID %d", ErrInvalidProfile, class.Name, vlan)
+			}
+		}
+
+		names[class.Name] = true
+		guaranteed += class.Rate
+	}
+
+	if guaranteed >= 1 {
+		return fmt.Errorf("%w: classes are guaranteed %g of the line rate, leaving none for other traffic",
+			ErrInvalidProfile, guaranteed)
+	}
+
+	return nil
+}
+
+// validateIngressClasses checks the classes of an IFB device's profile only match what
+// ingress traffic carries.
+func (p Profile) validateIngressClasses() error {
+	for _, class := range p.Classes {
+		if len(class.Marks) > 0 {
+			return fmt.Errorf("%w: class %q matches marks, which ingress traffic doesn't have yet",
+				ErrInvalidProfile, class.Name)
+		}
+	}
+
+	return nil
+}
+
+// leaf is a class traffic is sorted into, with its rates in bytes/s.
+type leaf struct {
+	minor uint32
+	name  string
+	rate  uint64
+	ceil  uint64
+}
+
+// leaves returns the default class, which is guaranteed what the configured classes aren't
+// and may use the whole line rate, followed by the configured classes.
+func (p Profile) leaves(total uint64) []leaf {
+	leaves := []leaf{{minor: defaultClassMinor, name: "default", rate: 0, ceil: total}}
+	guaranteed := 0.0
+
+	for i, class := range p.Classes {
+		leaves = append(leaves, leaf{
+			minor: defaultClassMinor + 1 + uint32(i),
+			name:  class.Name,
+			rate:  share(total, class.Rate),
+			ceil:  share(total, class.Ceil),
+		})
+		guaranteed += class.Rate
+	}
+
+	leaves[0].rate = share(total, 1-guaranteed)
+
+	return leaves
+}
+
+// share returns a fraction of a rate, which HTB needs to be at least one.
+func share(total uint64, fraction float64) uint64 {
+	if rate := uint64(float64(total) * fraction); rate > 0 {
+		return rate
+	}
+
+	return 1
+}
+
+// rateSpec returns the HTB rate with the profile's overhead. HTB only compensates for ATM
+// framing, so the CAKE qdisc under each class also limits it to its ceiling.
+func (p Profile) rateSpec(rate uint64) tc.RateSpec {
+	linkLayer := uint8(linkLayerEthernet)
+	if p.ATM == ATM {
+		linkLayer = linkLayerATM
+	}
+
+	if rate > math.MaxUint32 {
+		rate = math.MaxUint32
+	}
+
+	return tc.RateSpec{
+		CellLog:   0,
+		Linklayer: linkLayer,
+		Overhead:  uint16(p.Overhead),
+		CellAlign: 0,
+		Mpu:       uint16(p.MPU),
+		Rate:      uint32(rate),
+	}
+}
+
+// buffer returns the scheduler ticks taken to send a millisecond of traffic and a packet.
+func buffer(rate uint64) uint32 {
+	ticks := (rate/1000 + htbMTU) * ticksPerSecond / rate //nolint:gomnd
+	if ticks > math.MaxUint32 {
+		return math.MaxUint32
+	}
+
+	return uint32(ticks)
+}
+
+// quantum returns how much a class sends at a time when sharing spare rate, in proportion to
+// its rate.
+func quantum(rate uint64) uint32 {
+	switch quantum := rate / rateToQuantum; {
+	case quantum < htbMTU:
+		return htbMTU
+	case quantum > maxQuantum:
+		return maxQuantum
+	default:
+		return uint32(quantum)
+	}
+}
+
+// htb returns the HTB class options for a rate and ceiling in bytes/s.
+func (p Profile) htb(rate uint64, ceil uint64) *tc.Htb {
+	htb := &tc.Htb{ //nolint:exhaustruct
+		Parms: &tc.HtbOpt{
+			Rate:    p.rateSpec(rate),
+			Ceil:    p.rateSpec(ceil),
+			Buffer:  buffer(rate),
+			Cbuffer: buffer(ceil),
+			Quantum: quantum(rate),
+			Level:   0,
+			Prio:    0,
+		},
+	}
+
+	if rate > math.MaxUint32 {
+		htb.Rate64 = &rate
+	}
+
+	if ceil > math.MaxUint32 {
+		htb.Ceil64 = &ceil
+	}
+
+	return htb
+}
+
+// htbMatches returns whether an existing HTB class has the desired rates.
+func htbMatches(existing *tc.Htb, desired *tc.Htb) bool {
+	if existing == nil || existing.Parms == nil {
+		return false
+	}
+
+	have, want := *existing.Parms, *desired.Parms
+	have.Level, have.Prio = want.Level, want.Prio
+
+	return have == want && value64(existing.Rate64) == value64(desired.Rate64) &&
+		value64(existing.Ceil64) == value64(desired.Ceil64)
+}
+
+func value64(value *uint64) uint64 {
+	if value == nil {
+		return 0
+	}
+
+	return *value
+}
+
+// classHandle returns the handle of the CAKE qdisc under the class with the given minor.
+func (c *Controller) classHandle(minor uint32) uint32 {
+	if c.ifbDevice {
+		return core.BuildHandle(ownership.IngressClassHandle+minor-defaultClassMinor, 0)
+	}
+
+	return core.BuildHandle(ownership.EgressClassHandle+minor-defaultClassMinor, 0)
+}
+
+// reconcileHierarchy makes the root qdisc an HTB qdisc with a class for unmatched traffic and
+// each configured class, each with a CAKE qdisc under it, at the current line rate.
+func (c *Controller) reconcileHierarchy(device netlink.Link, existing *tc.Object) error {
+	ifindex := uint32(device.Attrs().Index)
+
+	if existing != nil && existing.Kind != "htb" {
+		if err := c.deleteRoot(existing); err != nil {
+			return err
+		}
+
+		existing = nil
+	}
+
+	handle := core.BuildHandle(c.baseHandle(), 0)
+
+	if existing == nil {
+		if err := c.tcnl.Qdisc().Add(&tc.Object{
+			Msg: tc.Msg{
+				Family:  unix.AF_UNSPEC,
+				Ifindex: ifindex,
+				Handle:  handle,
+				Parent:  tc.HandleRoot,
+				Info:    0,
+			},
+			Attribute: tc.Attribute{ //nolint:exhaustruct
+				Kind: "htb",
+				Htb: &tc.Htb{ //nolint:exhaustruct
+					Init: &tc.HtbGlob{
+						Version:      3, //nolint:gomnd
+						Rate2Quantum: rateToQuantum,
+						Defcls:       defaultClassMinor,
+						Debug:        0,
+						DirectPkts:   0,
+					},
+				},
+			},
+		}); err != nil {
+			return fmt.Errorf("could not add HTB qdisc to device: %w", err)
+		}
+
+		c.filtered = false
+	} else if !c.adopted {
+		handle = existing.Handle
+		c.log.Infow("Adopted existing htb qdisc", "Handle", fmt.Sprintf("%x:", handle>>16)) //nolint:gomnd
+	}
+
+	c.adopted = true
+
+	updated, err := c.reconcileClasses(ifindex, handle, uint64(c.rate()*bitrateMultiplier))
+	if err != nil {
+		return err
+	}
+
+	if !c.filtered {
+		if err := c.replaceClassFilters(ifindex, handle); err != nil {
+			return err
+		}
+
+		c.filtered = true
+	}
+
+	stale, err := c.deleteStaleClasses(ifindex, handle)
+	if err != nil {
+		return err
+	}
+
+	c.reapply = false
+
+	if updated || stale {
+		c.log.Infow("Rebuilt htb classes", "Rate", c.rate())
+	}
+
+	return nil
+}
+
+// classes returns the HTB classes of the qdisc with the given handle by class ID.
+func (c *Controller) classes(ifindex uint32, handle uint32) (map[uint32]*tc.Object, error) {
+	classes, err := c.tcnl.Class().Get(&tc.Msg{Family: unix.AF_UNSPEC, Ifindex: ifindex, Handle: 0, Parent: 0, Info: 0})
+	if err != nil {
+		return nil, fmt.Errorf("could not list classes: %w", err)
+	}
+
+	major, _ := core.SplitHandle(handle)
+	result := map[uint32]*tc.Object{}
+
+	for i := range classes {
+		if classMajor, _ := core.SplitHandle(classes[i].Handle); classes[i].Kind == "htb" && classMajor == major {
+			result[classes[i].Handle] = &classes[i]
+		}
+	}
+
+	return result, nil
+}
+
+// reconcileClasses makes the classes and their CAKE qdiscs match the line rate in bytes/s,
+// returning whether anything changed.
+func (c *Controller) reconcileClasses(ifindex uint32, handle uint32, total uint64) (bool, error) {
+	existing, err := c.classes(ifindex, handle)
+	if err != nil {
+		return false, err
+	}
+
+	qdiscs, err := c.tcnl.Qdisc().Get()
+	if err != nil {
+		return false, fmt.Errorf("could not list qdiscs: %w", err)
+	}
+
+	children := map[uint32]*tc.Object{}
+
+	for i := range qdiscs {
+		if qdiscs[i].Ifindex == ifindex {
+			children[qdiscs[i].Parent] = &qdiscs[i]
+		}
+	}
+
+	major, _ := core.SplitHandle(handle)
+	root := core.BuildHandle(major, rootClassMinor)
+	updated := false
+
+	replace := func(parent uint32, classID uint32, htb *tc.Htb) error {
+		if current, ok := existing[classID]; ok && htbMatches(current.Htb, htb) {
+			return nil
+		}
+
+		updated = true
+
+		return c.tcnl.Class().Replace(&tc.Object{ //nolint:wrapcheck
+			Msg: tc.Msg{
+				Family:  unix.AF_UNSPEC,
+				Ifindex: ifindex,
+				Handle:  classID,
+				Parent:  parent,
+				Info:    0,
+			},
+			Attribute: tc.Attribute{ //nolint:exhaustruct
+				Kind: "htb",
+				Htb:  htb,
+			},
+		})
+	}
+
+	if err := replace(handle, root, c.profile.htb(total, total)); err != nil {
+		return false, fmt.Errorf("could not set root class: %w", err)
+	}
+
+	for _, leaf := range c.profile.leaves(total) {
+		classID := core.BuildHandle(major, leaf.minor)
+
+		if err := replace(root, classID, c.profile.htb(leaf.rate, leaf.ceil)); err != nil {
+			return false, fmt.Errorf("could not set class %s: %w", leaf.name, err)
+		}
+
+		cake, err := c.profile.cake(leaf.ceil)
+		if err != nil {
+			return false, err
+		}
+
+		if child := children[classID]; child != nil && child.Kind == "cake" && cakeMatches(child.Cake, cake) && !c.reapply {
+			continue
+		}
+
+		updated = true
+
+		if err := c.tcnl.Qdisc().Replace(&tc.Object{
+			Msg: tc.Msg{
+				Family:  unix.AF_UNSPEC,
+				Ifindex: ifindex,
+				Handle:  c.classHandle(leaf.minor),
+				Parent:  classID,
+				Info:    0,
+			},
+			Attribute: tc.Attribute{ //nolint:exhaustruct
+				Kind: "cake",
+				Cake: cake,
+			},
+		}); err != nil {
+			return false, fmt.Errorf("could not assign qdisc to class %s: %w", leaf.name, err)
+		}
+	}
+
+	return updated, nil
+}
+
+// deleteStaleClasses deletes the classes left by an earlier run with more classes configured,
+// once the filters sorting traffic into them are gone.
+func (c *Controller) deleteStaleClasses(ifindex uint32, handle uint32) (bool, error) {
+	existing, err := c.classes(ifindex, handle)
+	if err != nil {
+		return false, err
+	}
+
+	deleted := false
+
+	for classID, class := range existing {
+		if _, minor := core.SplitHandle(classID); minor <= defaultClassMinor+uint32(len(c.profile.Classes)) {
+			continue
+		}
+
+		if err := c.tcnl.Class().Delete(class); err != nil {
+			return deleted, fmt.Errorf("could not delete stale class: %w", err)
+		}
+
+		deleted = true
+	}
+
+	return deleted, nil
+}
+
+// replaceClassFilters replaces the filters on the HTB qdisc with those sorting traffic into the
+// configured classes. Everything on sqm's own qdisc is sqm's.
+func (c *Controller) replaceClassFilters(ifindex uint32, handle uint32) error {
+	filters, err := c.tcnl.Filter().Get(&tc.Msg{
+		Family:  unix.AF_UNSPEC,
+		Ifindex: ifindex,
+		Handle:  0,
+		Parent:  handle,
+		Info:    0,
+	})
+	if err != nil {
+		return fmt.Errorf("could not list class filters: %w", err)
+	}
+
+	deleted := map[uint32]bool{}
+
+	for _, filter := range filters {
+		if deleted[filter.Info] {
+			continue
+		}
+
+		deleted[filter.Info] = true
+
+		if err := c.tcnl.Filter().Delete(&tc.Object{
+			Msg: tc.Msg{
+				Family:  unix.AF_UNSPEC,
+				Ifindex: ifindex,
+				Handle:  0,
+				Parent:  handle,
+				Info:    filter.Info,
+			},
+			Attribute: tc.Attribute{ //nolint:exhaustruct
+				Kind: filter.Kind,
+			},
+		}); err != nil {
+			return fmt.Errorf("could not delete class filters: %w", err)
+		}
+	}
+
+	desired := c.profile.classFilters(ifindex, handle, !c.ifbDevice)
+
+	for _, filter := range desired {
+		if err := c.tcnl.Filter().Add(filter); err != nil {
+			return fmt.Errorf("could not add class filter: %w", err)
+		}
+	}
+
+	c.log.Infow("Added class filters", "Filters", len(desired))
+
+	return nil
+}
+
+// classFilters returns the filters on the HTB qdisc with the given handle sorting traffic into
+// each configured class.
+func (p Profile) classFilters(ifindex uint32, parent uint32, egress bool) []*tc.Object {
+	filters := []*tc.Object{}
+	major, _ := core.SplitHandle(parent)
+
+	for i, class := range p.Classes {
+		classID := core.BuildHandle(major, defaultClassMinor+1+uint32(i))
+		filter := func(protocol uint32, attribute tc.Attribute) *tc.Object {
+			priority := 1 + uint32(i)*prioritiesPerClass + tcutil.ProtocolOffset(protocol)
+
+			return &tc.Object{
+				Msg: tc.Msg{
+					Family:  unix.AF_UNSPEC,
+					Ifindex: ifindex,
+					Handle:  0,
+					Parent:  parent,
+					Info:    priority<<16 | protocol, //nolint:gomnd
+				},
+				Attribute: attribute,
+			}
+		}
+
+		// Classes match the local address, the source on egress and the destination on ingress.
+		for _, prefix := range class.Prefixes {
+			keys := tcutil.PrefixKeys(prefix, egress)
+			if len(keys) == 0 {
+				keys = []tc.U32Key{{Mask: 0, Val: 0, Off: 0, OffMask: 0}}
+			}
+
+			filters = append(filters, filter(tcutil.PrefixProtocol(prefix), u32(classID, keys, nil)))
+		}
+
+		for _, mark := range class.Marks {
+			keys := []tc.U32Key{{Mask: 0, Val: 0, Off: 0, OffMask: 0}}
+			filters = append(filters, filter(tcutil.ProtocolAll, u32(classID, keys,
+				&tc.U32Mark{Val: mark.Value, Mask: mark.Mask, Success: 0})))
+		}
+
+		for _, vlan := range class.VLANs {
+			classID, ethType, vlan := classID, uint16(ethTypeVLAN), vlan
+			filters = append(filters, filter(tcutil.ProtocolVLAN, tc.Attribute{ //nolint:exhaustruct
+				Kind: "flower",
+				Flower: &tc.Flower{ //nolint:exhaustruct
+					ClassID:    &classID,
+					KeyEthType: &ethType,
+					KeyVlanID:  &vlan,
+				},
+			}))
+		}
+	}
+
+	return filters
+}
+
+// u32 returns a u32 filter sorting traffic matching the keys and mark into a class.
+func u32(classID uint32, keys []tc.U32Key, mark *tc.U32Mark) tc.Attribute {
+	return tc.Attribute{ //nolint:exhaustruct
+		Kind: "u32",
+		U32: &tc.U32{ //nolint:exhaustruct
+			ClassID: &classID,
+			Sel: &tc.U32Sel{ //nolint:exhaustruct
+				Flags: u32Terminal,
+				NKeys: uint8(len(keys)),
+				Keys:  keys,
+			},
+			Mark: mark,
+		},
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package shaper
+
+import (
+	"errors"
+	"math"
+	"net"
+	"reflect"
+	"testing"
+
+	tc "github.com/florianl/go-tc"
+	"github.com/florianl/go-tc/core"
+	"github.com/randomvariable/sqm/classify"
+	"github.com/randomvariable/sqm/ownership"
+	"github.com/randomvariable/sqm/tcutil"
+)
+
+// prefixes parses prefixes, failing the test if any doesn't parse.
+func prefixes(t *testing.T, cidrs ...string) []*net.IPNet {
+	t.Helper()
+
+	parsed := []*net.IPNet{}
+
+	for _, cidr := range cidrs {
+		_, prefix, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatalf("cannot parse %q: %v", cidr, err)
+		}
+
+		parsed = append(parsed, prefix)
+	}
+
+	return parsed
+}
+
+func TestShare(t *testing.T) {
+	tests := []struct {
+		name     string
+		total    uint64
+		fraction float64
+		want     uint64
+	}{
+		{name: "fraction", total: 1000, fraction: 0.3, want: 300},
+		{name: "whole", total: 1000, fraction: 1, want: 1000},
+		{name: "nothing", total: 1000, fraction: 0, want: 1},
+		{name: "no rate", total: 0, fraction: 0.5, want: 1},
+	}
+
+	for _, tt := range tests {
+		if got := share(tt.total, tt.fraction); got != tt.want {
+			t.Errorf("%s: share(%d, %g) = %d, want %d", tt.name, tt.total, tt.fraction, got, tt.want)
+		}
+	}
+}
+
+func TestBuffer(t *testing.T) {
+	tests := []struct {
+		rate uint64
+		want uint32
+	}{
+		// A millisecond at 1Mbit/s is 125 bytes, so 1725 bytes take 13.8ms, or 215625 ticks.
+		{rate: 125000, want: 215625},
+		{rate: 12500000, want: 17625},
+		{rate: 1, want: math.MaxUint32},
+	}
+
+	for _, tt := range tests {
+		if got := buffer(tt.rate); got != tt.want {
+			t.Errorf("buffer(%d) = %d, want %d", tt.rate, got, tt.want)
+		}
+	}
+}
+
+func TestQuantum(t *testing.T) {
+	tests := []struct {
+		rate uint64
+		want uint32
+	}{
+		{rate: 10000, want: htbMTU},
+		{rate: 100000, want: 10000},
+		{rate: 10000000, want: maxQuantum},
+	}
+
+	for _, tt := range tests {
+		if got := quantum(tt.rate); got != tt.want {
+			t.Errorf("quantum(%d) = %d, want %d", tt.rate, got, tt.want)
+		}
+	}
+}
+
+func TestLeaves(t *testing.T) {
+	profile := DefaultProfile()
+	profile.Classes = []Class{
+		{Name: "guest", Rate: 0.2, Ceil: 0.5, Prefixes: nil, VLANs: []uint16{20}, Marks: nil},
+		{Name: "work", Rate: 0.3, Ceil: 1, Prefixes: nil, VLANs: []uint16{30}, Marks: nil},
+	}
+
+	want := []leaf{
+		{minor: defaultClassMinor, name: "default", rate: 500, ceil: 1000},
+		{minor: defaultClassMinor + 1, name: "guest", rate: 200, ceil: 500},
+		{minor: defaultClassMinor + 2, name: "work", rate: 300, ceil: 1000},
+	}
+
+	if got := profile.leaves(1000); !reflect.DeepEqual(got, want) {
+		t.Errorf("leaves() = %+v, want %+v", got, want)
+	}
+}
+
+// filterSummary is what a class filter matches and where it sorts traffic.
+type filterSummary struct {
+	priority uint32
+	protocol uint32
+	kind     string
+	classID  uint32
+	keys     []tc.U32Key
+	mark     *tc.U32Mark
+	vlan     uint16
+}
+
+func summarise(t *testing.T, filter *tc.Object) filterSummary {
+	t.Helper()
+
+	summary := filterSummary{
+		priority: filter.Info >> 16,
+		protocol: filter.Info & 0xffff,
+		kind:     filter.Kind,
+		classID:  0,
+		keys:     nil,
+		mark:     nil,
+		vlan:     0,
+	}
+
+	switch filter.Kind {
+	case "u32":
+		summary.classID, summary.keys, summary.mark = *filter.U32.ClassID, filter.U32.Sel.Keys, filter.U32.Mark
+
+		if int(filter.U32.Sel.NKeys) != len(filter.U32.Sel.Keys) {
+			t.Errorf("u32 filter has NKeys %d but %d keys", filter.U32.Sel.NKeys, len(filter.U32.Sel.Keys))
+		}
+	case "flower":
+		summary.classID, summary.vlan = *filter.Flower.ClassID, *filter.Flower.KeyVlanID
+	}
+
+	return summary
+}
+
+func TestClassFilters(t *testing.T) {
+	const ifindex = 7
+
+	profile := DefaultProfile()
+	profile.Classes = []Class{
+		{
+			Name:     "guest",
+			Rate:     0.1,
+			Ceil:     0.2,
+			Prefixes: prefixes(t, "10.0.0.0/8", "::ffff:192.168.0.0/112", "2001:db8::/32"),
+			VLANs:    []uint16{20},
+			Marks:    []classify.Mark{{Value: 0x100, Mask: 0xf00}},
+		},
+		{Name: "everything", Rate: 0.1, Ceil: 1, Prefixes: prefixes(t, "0.0.0.0/0"), VLANs: nil, Marks: nil},
+	}
+
+	parent := core.BuildHandle(ownership.EgressHandle, 0)
+	guest := core.BuildHandle(ownership.EgressHandle, defaultClassMinor+1)
+	everything := core.BuildHandle(ownership.EgressHandle, defaultClassMinor+2)
+	matchAll := []tc.U32Key{{Mask: 0, Val: 0, Off: 0, OffMask: 0}}
+
+	want := []filterSummary{
+		{
+			priority: 2, protocol: tcutil.ProtocolIPv4, kind: "u32", classID: guest,
+			keys: tcutil.PrefixKeys(prefixes(t, "10.0.0.0/8")[0], true), mark: nil, vlan: 0,
+		},
+		{
+			priority: 2, protocol: tcutil.ProtocolIPv4, kind: "u32", classID: guest,
+			keys: tcutil.PrefixKeys(prefixes(t, "192.168.0.0/16")[0], true), mark: nil, vlan: 0,
+		},
+		{
+			priority: 3, protocol: tcutil.ProtocolIPv6, kind: "u32", classID: guest,
+			keys: tcutil.PrefixKeys(prefixes(t, "2001:db8::/32")[0], true), mark: nil, vlan: 0,
+		},
+		{
+			priority: 1, protocol: tcutil.ProtocolAll, kind: "u32", classID: guest, keys: matchAll,
+			mark: &tc.U32Mark{Val: 0x100, Mask: 0xf00, Success: 0}, vlan: 0,
+		},
+		{priority: 4, protocol: tcutil.ProtocolVLAN, kind: "flower", classID: guest, keys: nil, mark: nil, vlan: 20},
+		{
+			priority: 6, protocol: tcutil.ProtocolIPv4, kind: "u32", classID: everything, keys: matchAll,
+			mark: nil, vlan: 0,
+		},
+	}
+
+	filters := profile.classFilters(ifindex, parent, true)
+	if len(filters) != len(want) {
+		t.Fatalf("classFilters() returned %d filters, want %d", len(filters), len(want))
+	}
+
+	for i, filter := range filters {
+		if filter.Ifindex != ifindex || filter.Parent != parent {
+			t.Errorf("filter %d is on ifindex %d parent %x, want %d and %x", i, filter.Ifindex, filter.Parent,
+				ifindex, parent)
+		}
+
+		if got := summarise(t, filter); !reflect.DeepEqual(got, want[i]) {
+			t.Errorf("filter %d = %+v, want %+v", i, got, want[i])
+		}
+	}
+}
+
+func TestValidateIngressClasses(t *testing.T) {
+	profile := DefaultProfile()
+	profile.Classes = []Class{
+		{Name: "guest", Rate: 0.1, Ceil: 0.2, Prefixes: prefixes(t, "2001:db8:20::/64"), VLANs: nil, Marks: nil},
+	}
+
+	if err := profile.validateIngressClasses(); err != nil {
+		t.Errorf("validateIngressClasses() error = %v, want nil", err)
+	}
+
+	profile.Classes[0].Marks = []classify.Mark{{Value: 0x100, Mask: 0xf00}}
+
+	if err := profile.validateIngressClasses(); !errors.Is(err, ErrInvalidProfile) {
+		t.Errorf("validateIngressClasses() error = %v, want %v", err, ErrInvalidProfile)
+	}
+}
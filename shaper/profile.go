@@ -0,0 +1,286 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package shaper
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"sort"
+	"strings"
+
+	tc "github.com/florianl/go-tc"
+)
+
+var ErrInvalidProfile = errors.New("invalid shaper profile")
+
+// DiffServMode is the CAKE tin layout.
+type DiffServMode string
+
+const (
+	DiffServ3  DiffServMode = "diffserv3"
+	DiffServ4  DiffServMode = "diffserv4"
+	DiffServ8  DiffServMode = "diffserv8"
+	BestEffort DiffServMode = "besteffort"
+	Precedence DiffServMode = "precedence"
+)
+
+// kernelValue returns the CAKE_DIFFSERV_* value for the mode.
+func (m DiffServMode) kernelValue() (uint32, error) {
+	switch m {
+	case DiffServ3:
+		return 0, nil
+	case DiffServ4:
+		return 1, nil
+	case DiffServ8:
+		return 2, nil //nolint:gomnd
+	case BestEffort:
+		return 3, nil //nolint:gomnd
+	case Precedence:
+		return 4, nil //nolint:gomnd
+	default:
+		return 0, fmt.Errorf("%w: unknown diffserv mode %q", ErrInvalidProfile, m)
+	}
+}
+
+// ATMMode is the CAKE link layer compensation.
+type ATMMode string
+
+const (
+	ATMNone ATMMode = "none"
+	ATM     ATMMode = "atm"
+	PTM     ATMMode = "ptm"
+)
+
+// kernelValue returns the CAKE_ATM_* value for the mode.
+func (m ATMMode) kernelValue() (uint32, error) {
+	switch m {
+	case ATMNone:
+		return 0, nil
+	case ATM:
+		return 1, nil
+	case PTM:
+		return 2, nil //nolint:gomnd
+	default:
+		return 0, fmt.Errorf("%w: unknown ATM mode %q", ErrInvalidProfile, m)
+	}
+}
+
+// Profile holds the CAKE settings for one direction.
+type Profile struct {
+	// DiffServ is the tin layout
+	DiffServ DiffServMode
+	// Overhead is the per packet overhead in bytes
+	Overhead uint32
+	// ATM is the link layer compensation
+	ATM ATMMode
+	// MPU is the minimum packet size in bytes, zero for none
+	MPU uint32
+	// NAT makes CAKE look up the pre-NAT addresses for flow isolation
+	NAT bool
+	// AckFilter drops redundant TCP ACKs
+	AckFilter bool
+	// SplitGSO splits GSO super packets
+	SplitGSO bool
+	// Wash clears DSCP markings after tin selection
+	Wash bool
+	// FwMark selects tins from the firewall mark rather than DSCP, when its mask is set
+	FwMark FwMark
+	// Classes, if any, put an HTB qdisc at the root with a CAKE qdisc under each class
+	Classes []Class
+}
+
+// FwMark selects tins from the firewall mark. CAKE shifts the masked bits down, and a result of
+// n picks the nth tin, lowest priority first. Zero, or more than there are tins, falls back to
+// DSCP.
+type FwMark struct {
+	// Mask is the firewall mark bits CAKE reads, zero to ignore the mark
+	Mask uint32
+	// Tins names the tin each mark value is meant to select, checked against the diffserv mode
+	Tins map[uint32]string
+}
+
+// DefaultProfile returns the settings for a VDSL line with PPPoE.
+func DefaultProfile() Profile {
+	return Profile{
+		DiffServ:  DiffServ3,
+		Overhead:  averageOverhead,
+		ATM:       PTM,
+		MPU:       0,
+		NAT:       true,
+		AckFilter: true,
+		SplitGSO:  true,
+		Wash:      false,
+		FwMark:    FwMark{Mask: 0, Tins: nil},
+		Classes:   nil,
+	}
+}
+
+// Validate checks the profile can be turned into a CAKE configuration.
+func (p Profile) Validate() error {
+	if _, err := p.cake(0); err != nil {
+		return err
+	}
+
+	if err := p.validateFwMark(); err != nil {
+		return err
+	}
+
+	return p.validateClasses()
+}
+
+// validateFwMark checks every mapped firewall mark selects the tin it's meant to.
+func (p Profile) validateFwMark() error {
+	if len(p.FwMark.Tins) > 0 && p.FwMark.Mask == 0 {
+		return fmt.Errorf("%w: firewall marks are mapped to tins without a fwmark mask", ErrInvalidProfile)
+	}
+
+	tins, err := p.DiffServ.Tins()
+	if err != nil {
+		return err
+	}
+
+	marks := make([]uint32, 0, len(p.FwMark.Tins))
+	for mark := range p.FwMark.Tins {
+		marks = append(marks, mark)
+	}
+
+	sort.Slice(marks, func(i, j int) bool { return marks[i] < marks[j] })
+
+	for _, mark := range marks {
+		tin := p.FwMark.Tins[mark]
+
+		if mark&^p.FwMark.Mask != 0 {
+			return fmt.Errorf("%w: firewall mark %#x has bits outside the fwmark mask %#x", ErrInvalidProfile, mark,
+				p.FwMark.Mask)
+		}
+
+		want := -1
+
+		for i, name := range tins {
+			if name == tin {
+				want = i
+			}
+		}
+
+		if want < 0 {
+			return fmt.Errorf("%w: %s has no tin %q, only %s", ErrInvalidProfile, p.DiffServ, tin,
+				strings.Join(tins, ", "))
+		}
+
+		if p.FwMark.tin(p.FwMark.Mark(want)) != want+1 {
+			return fmt.Errorf("%w: fwmark mask %#x is too narrow to select tin %q", ErrInvalidProfile, p.FwMark.Mask, tin)
+		}
+
+		if p.FwMark.tin(mark) != want+1 {
+			return fmt.Errorf("%w: firewall mark %#x doesn't select tin %q in %s, %#x does", ErrInvalidProfile, mark, tin,
+				p.DiffServ, p.FwMark.Mark(want))
+		}
+	}
+
+	return nil
+}
+
+// tin returns the tin number, counting from one, CAKE reads from a firewall mark.
+func (f FwMark) tin(mark uint32) int {
+	return int((mark & f.Mask) >> bits.TrailingZeros32(f.Mask))
+}
+
+// Mark returns the firewall mark selecting the tin at index, lowest priority first.
+func (f FwMark) Mark(index int) uint32 {
+	return (uint32(index+1) << bits.TrailingZeros32(f.Mask)) & f.Mask
+}
+
+// CheckMTU checks the size settings make sense for a link with the given MTU.
+func (p Profile) CheckMTU(mtu int) error {
+	if mtu <= 0 {
+		return nil
+	}
+
+	if p.Overhead >= uint32(mtu) {
+		return fmt.Errorf("%w: overhead %d is not smaller than the MTU %d", ErrInvalidProfile, p.Overhead, mtu)
+	}
+
+	if p.MPU > uint32(mtu)+p.Overhead {
+		return fmt.Errorf("%w: MPU %d is larger than the largest packet of %d bytes", ErrInvalidProfile,
+			p.MPU, uint32(mtu)+p.Overhead)
+	}
+
+	return nil
+}
+
+// cake returns the CAKE configuration for the profile at the given base rate in bytes/s.
+func (p Profile) cake(baseRate uint64) (*tc.Cake, error) {
+	diffServ, err := p.DiffServ.kernelValue()
+	if err != nil {
+		return nil, err
+	}
+
+	atm, err := p.ATM.kernelValue()
+	if err != nil {
+		return nil, err
+	}
+
+	overhead := p.Overhead
+	mpu := p.MPU
+	fwMark := p.FwMark.Mask
+
+	cake := &tc.Cake{ //nolint:exhaustruct
+		BaseRate:     &baseRate,
+		DiffServMode: &diffServ,
+		Nat:          kernelBool(p.NAT),
+		AckFilter:    kernelBool(p.AckFilter),
+		SplitGso:     kernelBool(p.SplitGSO),
+		Wash:         kernelBool(p.Wash),
+		// Always set, so removing the mask stops tins being picked by the firewall mark.
+		FwMark:   &fwMark,
+		Overhead: &overhead,
+		Atm:      &atm,
+		// Always set, as the kernel keeps the previous MPU when it's left out.
+		Mpu: &mpu,
+	}
+
+	return cake, nil
+}
+
+// cakeMatches returns whether an existing CAKE qdisc already has every setting of the desired
+// configuration, so it can be left alone.
+func cakeMatches(existing *tc.Cake, desired *tc.Cake) bool {
+	if existing == nil {
+		return false
+	}
+
+	if desired.BaseRate != nil && (existing.BaseRate == nil || *existing.BaseRate != *desired.BaseRate) {
+		return false
+	}
+
+	pairs := [][2]*uint32{
+		{existing.DiffServMode, desired.DiffServMode},
+		{existing.Atm, desired.Atm},
+		{existing.Overhead, desired.Overhead},
+		{existing.Mpu, desired.Mpu},
+		{existing.Nat, desired.Nat},
+		{existing.Wash, desired.Wash},
+		{existing.AckFilter, desired.AckFilter},
+		{existing.SplitGso, desired.SplitGso},
+		{existing.FwMark, desired.FwMark},
+	}
+
+	for _, pair := range pairs {
+		if pair[1] != nil && (pair[0] == nil || *pair[0] != *pair[1]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func kernelBool(value bool) *uint32 {
+	result := uint32(0)
+	if value {
+		result = 1
+	}
+
+	return &result
+}
@@ -6,39 +6,87 @@ package shaper
 import (
 	"errors"
 	"fmt"
+	"reflect"
 
 	tc "github.com/florianl/go-tc"
 	"github.com/florianl/go-tc/core"
 	"github.com/randomvariable/sqm/datastore"
+	"github.com/randomvariable/sqm/links"
+	"github.com/randomvariable/sqm/ownership"
 	"github.com/vishvananda/netlink"
 	"go.uber.org/zap"
 	"golang.org/x/sys/unix"
 )
 
-var ErrSNMPNotReady = errors.New("SNMP data not ready")
+var ErrRateNotReady = errors.New("no rate available yet")
+
+const (
+	// EgressMTUWarningName and IngressMTUWarningName are the names of the warnings set while the
+	// shaper settings of each direction don't suit the device MTU.
+	EgressMTUWarningName  = "egress MTU"
+	IngressMTUWarningName = "ingress MTU"
+)
 
 // Controller holds all local information.
 type Controller struct {
 	// ifbDevice defines whether this is the IFB device or not
 	ifbDevice bool
+	// profile holds the CAKE settings in effect
+	profile Profile
+	// base is the configured profile, used unless an adjustment selects one of profiles
+	base Profile
+	// profiles are the alternative profiles by name
+	profiles map[string]Profile
 	// data is the shared datastore
 	data *datastore.Data
 	// log is the logger
 	log *zap.SugaredLogger
 	// tcnl is the socket connection to rtnetlink
 	tcnl *tc.Tc
+	// mtu is the device MTU the profile was last checked against
+	mtu int
+	// reapply is set once the device MTU has changed, until the CAKE qdiscs are reconfigured
+	reapply bool
+	// adopted is set once the qdisc has been adopted or replaced
+	adopted bool
+	// filtered is set once the class filters of a hierarchical shaper have been added
+	filtered bool
 }
 
 const (
-	averageOverhead      = uint32(68)
-	defaultIngressHandle = uint32(0x8013)
-	defaultEgressHandle  = uint32(0x8012)
-	bitrateMultiplier    = 125
+	averageOverhead   = uint32(68)
+	bitrateMultiplier = 125
 )
 
-// NewShaperController returns an instantiated controller.
-func NewShaperController(ifbDevice bool, data *datastore.Data, log *zap.SugaredLogger) (*Controller, error) {
+// NewShaperController returns an instantiated controller, with alternative profiles that
+// adjustments such as schedules can select by name.
+func NewShaperController(ifbDevice bool, profile Profile, profiles map[string]Profile, data *datastore.Data,
+	log *zap.SugaredLogger,
+) (*Controller, error) {
 	newLog := log.Named("Shaper controller").With("IsIfbDevice", ifbDevice)
+
+	validate := func(p Profile) error {
+		if err := p.Validate(); err != nil {
+			return err
+		}
+
+		if ifbDevice {
+			return p.validateIngressClasses()
+		}
+
+		return nil
+	}
+
+	if err := validate(profile); err != nil {
+		return nil, err
+	}
+
+	for name, alternative := range profiles {
+		if err := validate(alternative); err != nil {
+			return nil, fmt.Errorf("profile %s: %w", name, err)
+		}
+	}
+
 	tcnl, err := tc.Open(&tc.Config{
 		NetNS:  0,
 		Logger: nil,
@@ -51,9 +99,16 @@ func NewShaperController(ifbDevice bool, data *datastore.Data, log *zap.SugaredL
 
 	ctrl := &Controller{
 		ifbDevice: ifbDevice,
+		profile:   profile,
+		base:      profile,
+		profiles:  profiles,
 		data:      data,
 		log:       newLog,
 		tcnl:      tcnl,
+		mtu:       0,
+		reapply:   false,
+		adopted:   false,
+		filtered:  false,
 	}
 
 	return ctrl, nil
@@ -68,22 +123,124 @@ func (c *Controller) device() (netlink.Link, error) {
 	return c.data.RootDevice() //nolint:wrapcheck
 }
 
-// rate returns the appropriate ingress or egress rate.
+// rate returns the appropriate ingress or egress rate, after any adjustments.
 func (c *Controller) rate() int64 {
 	if c.ifbDevice {
-		return c.data.IngressRate()
+		return c.data.ShapedIngressRate()
 	}
 
-	return c.data.EgressRate()
+	return c.data.ShapedEgressRate()
 }
 
-// baseHandle is an arbitrary base handle value depending on ingress or egress.
+// selectProfile puts the profile an adjustment selects, or the configured one, in effect.
+func (c *Controller) selectProfile() {
+	name := c.data.EgressProfile()
+	if c.ifbDevice {
+		name = c.data.IngressProfile()
+	}
+
+	profile, ok := c.profiles[name]
+	if !ok {
+		profile, name = c.base, ""
+	}
+
+	if reflect.DeepEqual(profile, c.profile) {
+		return
+	}
+
+	c.log.Infow("Shaper profile changed", "Profile", name)
+	c.profile = profile
+	// The new profile may have other classes, and sizes to check against the MTU.
+	c.filtered = false
+	c.mtu = 0
+}
+
+// mtuWarning is the name of the warning set while the profile doesn't suit the device MTU.
+func (c *Controller) mtuWarning() string {
+	if c.ifbDevice {
+		return IngressMTUWarningName
+	}
+
+	return EgressMTUWarningName
+}
+
+// checkMTU warns while the size settings of the profile don't suit the device MTU.
+func (c *Controller) checkMTU(device netlink.Link) {
+	warning := datastore.Warning{Message: "", Unhealthy: false}
+
+	if err := c.profile.CheckMTU(device.Attrs().MTU); err != nil {
+		warning = datastore.Warning{
+			Message:   fmt.Sprintf("shaper settings don't suit the MTU of %s: %v", device.Attrs().Name, err),
+			Unhealthy: true,
+		}
+	}
+
+	if !c.data.SetWarning(c.mtuWarning(), warning) {
+		return
+	}
+
+	if warning.Message != "" {
+		c.log.Warnw("Shaper settings don't suit the device MTU", "MTU", device.Attrs().MTU, "error", warning.Message)
+	} else {
+		c.log.Infow("Shaper settings suit the device MTU", "MTU", device.Attrs().MTU)
+	}
+}
+
+// baseHandle is the handle major from sqm's reserved range depending on ingress or egress.
 func (c *Controller) baseHandle() uint32 {
 	if c.ifbDevice {
-		return defaultIngressHandle
+		return ownership.IngressHandle
+	}
+
+	return ownership.EgressHandle
+}
+
+// rootQdisc returns the root qdisc of the device, or nil if there isn't one.
+func (c *Controller) rootQdisc(device netlink.Link) (*tc.Object, error) {
+	qdiscs, err := c.tcnl.Qdisc().Get()
+	if err != nil {
+		return nil, fmt.Errorf("could not list qdiscs: %w", err)
+	}
+
+	for i := range qdiscs {
+		if qdiscs[i].Ifindex == uint32(device.Attrs().Index) && qdiscs[i].Parent == tc.HandleRoot {
+			return &qdiscs[i], nil
+		}
 	}
 
-	return defaultEgressHandle
+	return nil, nil //nolint:nilnil
+}
+
+// checkOwnership reports a conflict if the device's root qdisc belongs to something else,
+// rather than replacing it. The kernel's default qdisc is fair game. The existing root qdisc
+// is returned if sqm owns it.
+func (c *Controller) checkOwnership(device netlink.Link) (*tc.Object, error) {
+	object := "root qdisc on " + device.Attrs().Name
+
+	existing, err := c.rootQdisc(device)
+	if err != nil {
+		return nil, err
+	}
+
+	if existing != nil && !ownership.IsDefaultHandle(existing.Handle) && !ownership.OwnsHandle(existing.Handle) {
+		major, minor := core.SplitHandle(existing.Handle)
+		description := fmt.Sprintf("%s qdisc %x:%x is not sqm's", existing.Kind, major, minor)
+
+		if c.data.SetConflict(object, description) {
+			c.log.Errorw("Not replacing root qdisc owned by something else", "Kind", existing.Kind,
+				"Handle", fmt.Sprintf("%x:%x", major, minor))
+		}
+
+		return nil, fmt.Errorf("%w: %s", ownership.ErrConflict, description)
+	}
+
+	c.data.SetConflict(object, "")
+
+	if existing == nil || !ownership.OwnsHandle(existing.Handle) {
+		return nil, nil //nolint:nilnil
+	}
+
+	return existing, nil
 }
 
 // Reconcile defines the reconciliation loop.
@@ -93,36 +250,79 @@ func (c *Controller) Reconcile() error {
 		return fmt.Errorf("could not get device: %w", err)
 	}
 
+	if err := links.Current(device); err != nil {
+		return err //nolint:wrapcheck
+	}
+
+	c.selectProfile()
+
+	if mtu := device.Attrs().MTU; mtu != c.mtu {
+		// CAKE sizes its queues from the device MTU when configured, so a qdisc set up before
+		// the MTU changed is reconfigured even if its settings match.
+		c.reapply = c.mtu != 0
+		c.mtu = mtu
+		c.checkMTU(device)
+	}
+
+	existing, err := c.checkOwnership(device)
+	if err != nil {
+		return err
+	}
+
 	if c.rate() == 0 {
-		c.log.Warn("SNMP data not ready")
+		c.log.Warn("No rate available yet")
+
+		return ErrRateNotReady
+	}
+
+	if len(c.profile.Classes) > 0 {
+		return c.reconcileHierarchy(device, existing)
+	}
 
-		return ErrSNMPNotReady
+	// A hierarchical shaper left by an earlier run can't be changed into a CAKE qdisc in place.
+	if existing != nil && existing.Kind != "cake" {
+		if err := c.deleteRoot(existing); err != nil {
+			return err
+		}
+
+		existing = nil
+	}
+
+	cake, err := c.profile.cake(uint64(c.rate() * bitrateMultiplier))
+	if err != nil {
+		return err
 	}
 
-	baserate := uint64(c.rate() * bitrateMultiplier)
-	kernelYes := uint32(1)
-	diffservMode := uint32(0)
-	overhead := averageOverhead
-	cakeAtmPtm := uint32(2) //nolint:gomnd
+	handle := core.BuildHandle(c.baseHandle(), 0)
+
+	// Adopt a CAKE qdisc left by an earlier run, keeping its handle, and leave it untouched if
+	// it's already as wanted, so restarts and upgrades don't disturb traffic.
+	if existing != nil && existing.Kind == "cake" {
+		if cakeMatches(existing.Cake, cake) && !c.reapply {
+			if !c.adopted {
+				c.log.Infow("Adopted existing cake qdisc", "Handle", fmt.Sprintf("%x:", existing.Handle>>16)) //nolint:gomnd
+				c.adopted = true
+			}
+
+			return nil
+		}
+
+		handle = existing.Handle
+	}
+
+	c.adopted = true
+
 	qdisc := tc.Object{
 		Msg: tc.Msg{
 			Family:  unix.AF_UNSPEC,
 			Ifindex: uint32(device.Attrs().Index),
-			Handle:  core.BuildHandle(c.baseHandle(), 0),
+			Handle:  handle,
 			Parent:  tc.HandleRoot,
 			Info:    0,
 		},
 		Attribute: tc.Attribute{ //nolint:exhaustruct
 			Kind: "cake",
-			Cake: &tc.Cake{ //nolint:exhaustruct
-				BaseRate:     &baserate,
-				DiffServMode: &diffservMode,
-				Nat:          &kernelYes,
-				AckFilter:    &kernelYes,
-				SplitGso:     &kernelYes,
-				Overhead:     &overhead,
-				Atm:          &cakeAtmPtm,
-			},
+			Cake: cake,
 		},
 	}
 
@@ -133,19 +333,72 @@ func (c *Controller) Reconcile() error {
 	}
 
 	c.log.Info("Rebuilt cake qdisc")
+	c.reapply = false
 
 	return nil
 }
 
-// ReconcileDelete defines what happens on shutdown.
+// Close closes the netlink socket without touching the device, for a controller that was
+// never started.
+func (c *Controller) Close() {
+	if err := c.tcnl.Close(); err != nil {
+		c.log.Errorw("Cannot close netlink socket", "error", err)
+	}
+}
+
+// Release defines what happens on shutdown when shaping is to be left in place.
+func (c *Controller) Release() {
+	c.Close()
+	c.log.Info("Leaving shaper in place")
+}
+
+// ReconcileDelete defines what happens on shutdown. Only a root qdisc sqm created is deleted,
+// returning the device to its default qdisc.
 func (c *Controller) ReconcileDelete() {
-	// Not yet implemented
-	c.log.Info("Shaper deletion not yet implemented")
+	defer c.Close()
+
+	device, err := c.device()
+	if err != nil {
+		return
+	}
+
+	qdisc, err := c.rootQdisc(device)
+	if err != nil {
+		c.log.Errorw("Cannot find root qdisc", "error", err)
+
+		return
+	}
+
+	if qdisc == nil || !ownership.OwnsHandle(qdisc.Handle) {
+		c.log.Info("No root qdisc of sqm's to tear down")
+
+		return
+	}
+
+	if err := c.deleteRoot(qdisc); err != nil {
+		c.log.Errorw("Cannot delete root qdisc", "error", err)
+
+		return
+	}
+
+	c.log.Info("Torn down shaper")
 }
 
-//nolint:godox
-// TODO @randomvariable: Set up these DSCP marks?
-// iptables -A PREROUTING -i vtun+ -p tcp -j MARK --set-xmark 0x2/0xff
-// iptables -A PREROUTING -i ppp0 -m dscp ! --dscp 0x00 -j DSCP --set-dscp 0x00
-// iptables -A OUTPUT -p udp -m multiport --ports 123,53 -j DSCP --set-dscp 0x24
-// iptables -A POSTROUTING -o ppp0 -m mark --mark 0x0/0xff -g QOS_MARK_ppp0
+// deleteRoot deletes a root qdisc of sqm's, along with any classes and qdiscs under it. The
+// qdisc's own options are sent back, as go-tc won't send a request without them.
+func (c *Controller) deleteRoot(qdisc *tc.Object) error {
+	if err := c.tcnl.Qdisc().Delete(&tc.Object{
+		Msg: tc.Msg{
+			Family:  unix.AF_UNSPEC,
+			Ifindex: qdisc.Ifindex,
+			Handle:  qdisc.Handle,
+			Parent:  tc.HandleRoot,
+			Info:    0,
+		},
+		Attribute: qdisc.Attribute,
+	}); err != nil {
+		return fmt.Errorf("could not delete %s root qdisc: %w", qdisc.Kind, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,122 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package shaper
+
+import "fmt"
+
+// tinLayout is the tins of a diffserv mode, lowest priority first as tc shows them, and the
+// tin each DSCP value is sorted into, as in CAKE's tables.
+type tinLayout struct {
+	names []string
+	dscp  [64]uint8
+}
+
+//nolint:gochecknoglobals,gomnd
+var tinLayouts = map[DiffServMode]tinLayout{
+	BestEffort: {names: []string{"Best Effort"}, dscp: [64]uint8{}},
+	DiffServ3: {
+		names: []string{"Bulk", "Best Effort", "Voice"},
+		dscp: [64]uint8{
+			1, 0, 1, 1, 2, 1, 1, 1,
+			0, 1, 1, 1, 1, 1, 1, 1,
+			1, 1, 1, 1, 1, 1, 1, 1,
+			1, 1, 1, 1, 1, 1, 1, 1,
+			1, 1, 1, 1, 1, 1, 1, 1,
+			1, 1, 1, 1, 2, 1, 2, 1,
+			2, 1, 1, 1, 1, 1, 1, 1,
+			2, 1, 1, 1, 1, 1, 1, 1,
+		},
+	},
+	DiffServ4: {
+		names: []string{"Bulk", "Best Effort", "Video", "Voice"},
+		dscp: [64]uint8{
+			1, 0, 1, 1, 3, 1, 1, 1,
+			0, 1, 1, 1, 1, 1, 1, 1,
+			2, 1, 2, 1, 2, 1, 2, 1,
+			2, 1, 2, 1, 2, 1, 2, 1,
+			3, 1, 2, 1, 2, 1, 2, 1,
+			3, 1, 1, 1, 3, 1, 3, 1,
+			3, 1, 1, 1, 1, 1, 1, 1,
+			3, 1, 1, 1, 1, 1, 1, 1,
+		},
+	},
+	DiffServ8: {
+		names: []string{"Tin 0", "Tin 1", "Tin 2", "Tin 3", "Tin 4", "Tin 5", "Tin 6", "Tin 7"},
+		dscp: [64]uint8{
+			2, 0, 1, 2, 4, 2, 2, 2,
+			0, 2, 1, 2, 1, 2, 1, 2,
+			5, 2, 4, 2, 4, 2, 4, 2,
+			3, 2, 3, 2, 3, 2, 3, 2,
+			6, 2, 3, 2, 3, 2, 3, 2,
+			6, 2, 2, 2, 6, 2, 6, 2,
+			7, 2, 2, 2, 2, 2, 2, 2,
+			7, 2, 2, 2, 2, 2, 2, 2,
+		},
+	},
+	Precedence: {
+		names: []string{"Tin 0", "Tin 1", "Tin 2", "Tin 3", "Tin 4", "Tin 5", "Tin 6", "Tin 7"},
+		dscp: [64]uint8{
+			0, 0, 0, 0, 0, 0, 0, 0,
+			1, 1, 1, 1, 1, 1, 1, 1,
+			2, 2, 2, 2, 2, 2, 2, 2,
+			3, 3, 3, 3, 3, 3, 3, 3,
+			4, 4, 4, 4, 4, 4, 4, 4,
+			5, 5, 5, 5, 5, 5, 5, 5,
+			6, 6, 6, 6, 6, 6, 6, 6,
+			7, 7, 7, 7, 7, 7, 7, 7,
+		},
+	},
+}
+
+// Tins returns the names of the mode's tins, lowest priority first.
+func (m DiffServMode) Tins() ([]string, error) {
+	layout, ok := tinLayouts[m]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown diffserv mode %q", ErrInvalidProfile, m)
+	}
+
+	return append([]string{}, layout.names...), nil
+}
+
+// Tin returns the name of the tin CAKE sorts packets with the given DSCP into.
+func (m DiffServMode) Tin(dscp uint8) (string, error) {
+	index, err := m.TinIndex(dscp)
+	if err != nil {
+		return "", err
+	}
+
+	return tinLayouts[m].names[index], nil
+}
+
+// TinIndex returns the number of the tin CAKE sorts packets with the given DSCP into, counting
+// from the lowest priority tin.
+func (m DiffServMode) TinIndex(dscp uint8) (int, error) {
+	layout, ok := tinLayouts[m]
+	if !ok {
+		return 0, fmt.Errorf("%w: unknown diffserv mode %q", ErrInvalidProfile, m)
+	}
+
+	return int(layout.dscp[dscp&0x3f]), nil //nolint:gomnd
+}
+
+// Codepoint returns a DSCP value CAKE sorts into the numbered tin: the preferred one if it's
+// sorted there, and otherwise the lowest that is.
+func (m DiffServMode) Codepoint(tin int, preferred uint8) (uint8, error) {
+	layout, ok := tinLayouts[m]
+	if !ok {
+		return 0, fmt.Errorf("%w: unknown diffserv mode %q", ErrInvalidProfile, m)
+	}
+
+	if int(layout.dscp[preferred&0x3f]) == tin { //nolint:gomnd
+		return preferred, nil
+	}
+
+	for dscp, sortedInto := range layout.dscp {
+		if int(sortedInto) == tin {
+			return uint8(dscp), nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w: diffserv mode %s has no tin %d", ErrInvalidProfile, m, tin)
+}
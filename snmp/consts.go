@@ -3,7 +3,17 @@
 
 package snmp
 
+import "time"
+
 const (
+	// DefaultCommunity is the SNMP community read from.
+	DefaultCommunity = "public"
+	// DefaultTimeout is how long to wait for an answer before retrying.
+	DefaultTimeout = 2 * time.Second
+
+	port    = 161
+	retries = 3
+
 	// ZyxelSNMPIngressOID is the OID used by Zyxel modems for the ingress rate.
 	ZyxelSNMPIngressOID = "1.3.6.1.2.1.10.97.1.1.2.1.10.1"
 	// ZyxelSNMPEgressOID is the OID used by Zyxel modems for the egress rate.
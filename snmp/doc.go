@@ -1,6 +1,6 @@
 // Copyright 2022 Naadir Jeewa. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
-// snmp defines a controller that can read two values via SNMP that returns the bandwidth.
+// snmp defines a rate source that can read two values via SNMP that returns the bandwidth.
 // Typically for use with VDSL/ADSL modems where the bitrate may change.
 package snmp
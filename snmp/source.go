@@ -0,0 +1,64 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package snmp
+
+import (
+	"fmt"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/randomvariable/sqm/ratesource"
+)
+
+// Source reads the line rates from a modem via SNMP.
+type Source struct {
+	// ingressOID is the SNMP OID for reading the ingress rate in kbps
+	ingressOID string
+	// ingressOID is the SNMP OID for reading the egress rate in kbps
+	egressOID string
+	// host is the SNMP host to read from
+	host string
+	// client is this source's own SNMP session, so sources for different interfaces can be
+	// read at the same time
+	client *gosnmp.GoSNMP
+}
+
+// NewSNMPSource returns an instantiated SNMP rate source.
+func NewSNMPSource(ingressOID, egressOID, host string) Source {
+	return Source{
+		ingressOID: ingressOID,
+		egressOID:  egressOID,
+		host:       host,
+		client: &gosnmp.GoSNMP{ //nolint:exhaustruct
+			Target:             host,
+			Port:               port,
+			Transport:          "udp",
+			Community:          DefaultCommunity,
+			Version:            gosnmp.Version2c,
+			Timeout:            DefaultTimeout,
+			Retries:            retries,
+			ExponentialTimeout: true,
+			MaxOids:            gosnmp.MaxOids,
+		},
+	}
+}
+
+// Read returns the current line rates.
+func (s Source) Read() (ratesource.Reading, error) {
+	if err := s.client.Connect(); err != nil {
+		return ratesource.Reading{}, fmt.Errorf("cannot connect to SNMP host %s: %w", s.host, err)
+	}
+	defer s.client.Conn.Close()
+
+	oids := []string{s.ingressOID, s.egressOID}
+
+	result, err := s.client.Get(oids)
+	if err != nil {
+		return ratesource.Reading{}, fmt.Errorf("cannot read SNMP: %w", err)
+	}
+
+	return ratesource.Reading{
+		Ingress: gosnmp.ToBigInt(result.Variables[0].Value).Int64(),
+		Egress:  gosnmp.ToBigInt(result.Variables[1].Value).Int64(),
+	}, nil
+}
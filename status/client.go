@@ -0,0 +1,54 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+var ErrUnexpectedStatus = errors.New("unexpected HTTP status")
+
+const clientTimeout = 5 * time.Second
+
+// Fetch retrieves the status report from a running daemon.
+func Fetch(socketPath string) (Report, error) {
+	client := &http.Client{ //nolint:exhaustruct
+		Timeout: clientTimeout,
+		Transport: &http.Transport{ //nolint:exhaustruct
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+
+				return dialer.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://sqm"+statusPath, nil)
+	if err != nil {
+		return Report{}, fmt.Errorf("cannot build status request: %w", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return Report{}, fmt.Errorf("cannot reach sqm at %s: %w", socketPath, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return Report{}, fmt.Errorf("%w: %s", ErrUnexpectedStatus, resp.Status)
+	}
+
+	var report Report
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return Report{}, fmt.Errorf("cannot decode status: %w", err)
+	}
+
+	return report, nil
+}
@@ -0,0 +1,8 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+status exposes the state of a running sqm daemon over a unix socket, and provides
+the client used by the sqm status command.
+*/
+package status
@@ -0,0 +1,108 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package status
+
+import (
+	"sort"
+
+	"github.com/randomvariable/sqm/datastore"
+)
+
+// DataStores lists the datastore of each managed interface by name.
+type DataStores interface {
+	DataStores() map[string]*datastore.Data
+}
+
+// Report is the status of a running daemon.
+type Report struct {
+	Interfaces []InterfaceReport `json:"interfaces"`
+}
+
+// InterfaceReport is the status of a single managed interface.
+type InterfaceReport struct {
+	Name              string                           `json:"name"`
+	Healthy           bool                             `json:"healthy"`
+	RootDevice        string                           `json:"rootDevice,omitempty"`
+	IfbDevice         string                           `json:"ifbDevice,omitempty"`
+	IngressRate       int64                            `json:"ingressRate"`
+	EgressRate        int64                            `json:"egressRate"`
+	ShapedIngressRate int64                            `json:"shapedIngressRate"`
+	ShapedEgressRate  int64                            `json:"shapedEgressRate"`
+	IngressSource     string                           `json:"ingressSource,omitempty"`
+	EgressSource      string                           `json:"egressSource,omitempty"`
+	RateSources       []datastore.RateSourceStatus     `json:"rateSources"`
+	Adjustments       map[string]datastore.Adjustments `json:"adjustments,omitempty"`
+	Usage             *datastore.Usage                 `json:"usage,omitempty"`
+	Conflicts         map[string]string                `json:"conflicts,omitempty"`
+	Warnings          map[string]datastore.Warning     `json:"warnings,omitempty"`
+	Classes           []datastore.ClassCounter         `json:"classes,omitempty"`
+}
+
+// NewReport builds a report from every interface's datastore.
+func NewReport(stores DataStores) Report {
+	report := Report{Interfaces: []InterfaceReport{}}
+
+	for name, data := range stores.DataStores() {
+		report.Interfaces = append(report.Interfaces, newInterfaceReport(name, data))
+	}
+
+	sort.Slice(report.Interfaces, func(i, j int) bool {
+		return report.Interfaces[i].Name < report.Interfaces[j].Name
+	})
+
+	return report
+}
+
+// newInterfaceReport builds the report for one interface.
+func newInterfaceReport(name string, data *datastore.Data) InterfaceReport {
+	snapshot := data.Snapshot()
+	report := InterfaceReport{
+		Name:              name,
+		Healthy:           healthy(snapshot),
+		RootDevice:        "",
+		IfbDevice:         "",
+		IngressRate:       snapshot.IngressRate,
+		EgressRate:        snapshot.EgressRate,
+		ShapedIngressRate: snapshot.ShapedIngressRate,
+		ShapedEgressRate:  snapshot.ShapedEgressRate,
+		IngressSource:     snapshot.IngressSource,
+		EgressSource:      snapshot.EgressSource,
+		RateSources:       snapshot.RateSources,
+		Adjustments:       snapshot.Adjustments,
+		Usage:             snapshot.Usage,
+		Conflicts:         snapshot.Conflicts,
+		Warnings:          snapshot.Warnings,
+		Classes:           snapshot.ClassCounters,
+	}
+
+	if snapshot.RootDevice != nil {
+		report.RootDevice = snapshot.RootDevice.Attrs().Name
+	}
+
+	if snapshot.IfbDevice != nil {
+		report.IfbDevice = snapshot.IfbDevice.Attrs().Name
+	}
+
+	return report
+}
+
+// healthy returns whether the interface is being shaped as intended: its devices are set up,
+// rates are known, and nothing is in conflict or marked unhealthy.
+func healthy(snapshot datastore.Snapshot) bool {
+	if snapshot.RootDevice == nil || snapshot.IfbDevice == nil {
+		return false
+	}
+
+	if snapshot.IngressRate == 0 || snapshot.EgressRate == 0 || len(snapshot.Conflicts) > 0 {
+		return false
+	}
+
+	for _, warning := range snapshot.Warnings {
+		if warning.Unhealthy {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,109 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package status
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultSocketPath is where the status socket is created if not configured.
+	DefaultSocketPath = "/run/sqm/sqm.sock"
+
+	statusPath        = "/status"
+	socketDirMode     = 0o755
+	readHeaderTimeout = 5 * time.Second
+)
+
+// Controller serves status reports on a unix socket.
+type Controller struct {
+	// socketPath is the unix socket to listen on
+	socketPath string
+	// stores lists the datastore of each interface
+	stores DataStores
+	// log is the logger
+	log *zap.SugaredLogger
+	// server is the running HTTP server, nil until started
+	server *http.Server
+}
+
+// NewStatusController returns an instantiated controller.
+func NewStatusController(socketPath string, stores DataStores, log *zap.SugaredLogger) *Controller {
+	return &Controller{
+		socketPath: socketPath,
+		stores:     stores,
+		log:        log.Named("Status Controller").With("Socket", socketPath),
+		server:     nil,
+	}
+}
+
+// Reconcile defines the reconciliation loop.
+func (c *Controller) Reconcile() error {
+	if c.server != nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.socketPath), socketDirMode); err != nil {
+		return fmt.Errorf("cannot create status socket directory: %w", err)
+	}
+
+	// A previous instance may have left its socket behind.
+	if err := os.Remove(c.socketPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("cannot remove stale status socket: %w", err)
+	}
+
+	listener, err := net.Listen("unix", c.socketPath)
+	if err != nil {
+		return fmt.Errorf("cannot listen on status socket: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(statusPath, c.serveStatus)
+
+	c.server = &http.Server{Handler: mux, ReadHeaderTimeout: readHeaderTimeout} //nolint:exhaustruct
+
+	go func(server *http.Server) {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			c.log.Errorw("Status server stopped", "error", err)
+		}
+	}(c.server)
+
+	c.log.Info("Serving status")
+
+	return nil
+}
+
+func (c *Controller) serveStatus(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(NewReport(c.stores)); err != nil {
+		c.log.Errorw("Cannot write status", "error", err)
+	}
+}
+
+// ReconcileDelete defines what happens on shutdown.
+func (c *Controller) ReconcileDelete() {
+	if c.server == nil {
+		return
+	}
+
+	if err := c.server.Close(); err != nil {
+		c.log.Errorw("Cannot close status server", "error", err)
+	}
+
+	if err := os.Remove(c.socketPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		c.log.Errorw("Cannot remove status socket", "error", err)
+	}
+
+	c.log.Info("Status server shut down")
+}
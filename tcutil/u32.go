@@ -0,0 +1,103 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+tcutil is a package for building the u32 filter keys sqm matches addresses with, shared by
+the redirector's exclusions and the shaper's classes.
+*/
+package tcutil
+
+import (
+	"net"
+
+	tc "github.com/florianl/go-tc"
+	"github.com/vishvananda/netlink/nl"
+)
+
+const (
+	// ProtocolAll, ProtocolIPv4, ProtocolIPv6 and ProtocolVLAN are ETH_P_ALL, ETH_P_IP,
+	// ETH_P_IPV6 and ETH_P_8021Q in network byte order, as filters carry them
+	ProtocolAll  = 0x0300
+	ProtocolIPv4 = 0x0008
+	ProtocolIPv6 = 0xdd86
+	ProtocolVLAN = 0x0081
+	// ipv4Source and ipv4Destination are the offsets of the addresses in an IPv4 header, and
+	// ipv6Source and ipv6Destination those in an IPv6 header
+	ipv4Source      = 12
+	ipv4Destination = 16
+	ipv6Source      = 8
+	ipv6Destination = 24
+)
+
+// ProtocolOffset returns the offset of a protocol's filters from the first of the priorities
+// a set of filters takes, as tc doesn't mix protocols within a priority.
+func ProtocolOffset(protocol uint32) uint32 {
+	switch protocol {
+	case ProtocolIPv4:
+		return 1
+	case ProtocolIPv6:
+		return 2 //nolint:gomnd
+	case ProtocolVLAN:
+		return 3 //nolint:gomnd
+	default:
+		return 0
+	}
+}
+
+// Normalise returns a prefix with a 4 byte address and mask if it only covers IPv4 addresses,
+// including IPv4-mapped IPv6 prefixes such as ::ffff:10.0.0.0/104, and 16 bytes otherwise.
+func Normalise(prefix *net.IPNet) *net.IPNet {
+	ones, _ := prefix.Mask.Size()
+	mapped := len(prefix.Mask) == net.IPv6len && ones >= 8*(net.IPv6len-net.IPv4len)
+
+	if ip := prefix.IP.To4(); ip != nil && (len(prefix.Mask) == net.IPv4len || mapped) {
+		mask := prefix.Mask[len(prefix.Mask)-net.IPv4len:]
+
+		return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+	}
+
+	return &net.IPNet{IP: prefix.IP.To16().Mask(prefix.Mask), Mask: prefix.Mask}
+}
+
+// PrefixProtocol returns the protocol of a prefix's addresses.
+func PrefixProtocol(prefix *net.IPNet) uint32 {
+	if len(Normalise(prefix).IP) == net.IPv4len {
+		return ProtocolIPv4
+	}
+
+	return ProtocolIPv6
+}
+
+// PrefixKeys matches the source or destination address of an IPv4 or IPv6 header against a
+// prefix, returning no keys for a prefix covering every address. The kernel keeps the mask and
+// value in network byte order.
+func PrefixKeys(prefix *net.IPNet, source bool) []tc.U32Key {
+	prefix = Normalise(prefix)
+
+	offset := uint32(ipv6Destination)
+	if source {
+		offset = ipv6Source
+	}
+
+	if len(prefix.IP) == net.IPv4len {
+		offset = ipv4Destination
+		if source {
+			offset = ipv4Source
+		}
+	}
+
+	keys := []tc.U32Key{}
+
+	for i := 0; i < len(prefix.Mask); i += 4 {
+		if prefix.Mask[i]|prefix.Mask[i+1]|prefix.Mask[i+2]|prefix.Mask[i+3] != 0 {
+			keys = append(keys, tc.U32Key{
+				Mask:    nl.NativeEndian().Uint32(prefix.Mask[i : i+4]),
+				Val:     nl.NativeEndian().Uint32(prefix.IP[i : i+4]),
+				Off:     offset + uint32(i),
+				OffMask: 0,
+			})
+		}
+	}
+
+	return keys
+}
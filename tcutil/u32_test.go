@@ -0,0 +1,127 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package tcutil
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	tc "github.com/florianl/go-tc"
+	"github.com/vishvananda/netlink/nl"
+)
+
+func key(offset uint32, mask []byte, value []byte) tc.U32Key {
+	return tc.U32Key{
+		Mask:    nl.NativeEndian().Uint32(mask),
+		Val:     nl.NativeEndian().Uint32(value),
+		Off:     offset,
+		OffMask: 0,
+	}
+}
+
+func TestPrefixKeys(t *testing.T) {
+	ones := []byte{0xff, 0xff, 0xff, 0xff}
+
+	tests := []struct {
+		prefix       string
+		source       bool
+		wantProtocol uint32
+		wantKeys     []tc.U32Key
+	}{
+		{
+			prefix:       "10.1.2.3/8",
+			source:       true,
+			wantProtocol: ProtocolIPv4,
+			wantKeys:     []tc.U32Key{key(12, []byte{0xff, 0, 0, 0}, []byte{10, 0, 0, 0})},
+		},
+		{
+			prefix:       "192.168.1.5/32",
+			source:       false,
+			wantProtocol: ProtocolIPv4,
+			wantKeys:     []tc.U32Key{key(16, ones, []byte{192, 168, 1, 5})},
+		},
+		{
+			prefix:       "::ffff:10.0.0.0/104",
+			source:       true,
+			wantProtocol: ProtocolIPv4,
+			wantKeys:     []tc.U32Key{key(12, []byte{0xff, 0, 0, 0}, []byte{10, 0, 0, 0})},
+		},
+		{
+			prefix:       "::ffff:192.168.1.5/128",
+			source:       false,
+			wantProtocol: ProtocolIPv4,
+			wantKeys:     []tc.U32Key{key(16, ones, []byte{192, 168, 1, 5})},
+		},
+		{
+			prefix:       "0.0.0.0/0",
+			source:       true,
+			wantProtocol: ProtocolIPv4,
+			wantKeys:     []tc.U32Key{},
+		},
+		{
+			prefix:       "2001:db8::/32",
+			source:       true,
+			wantProtocol: ProtocolIPv6,
+			wantKeys:     []tc.U32Key{key(8, ones, []byte{0x20, 0x01, 0x0d, 0xb8})},
+		},
+		{
+			prefix:       "2001:db8:1:2::/56",
+			source:       false,
+			wantProtocol: ProtocolIPv6,
+			wantKeys: []tc.U32Key{
+				key(24, ones, []byte{0x20, 0x01, 0x0d, 0xb8}),
+				key(28, []byte{0xff, 0xff, 0xff, 0}, []byte{0, 1, 0, 0}),
+			},
+		},
+		{
+			prefix:       "::/0",
+			source:       false,
+			wantProtocol: ProtocolIPv6,
+			wantKeys:     []tc.U32Key{},
+		},
+		{
+			// Wider than the IPv4-mapped range, so it also covers IPv6 addresses.
+			prefix:       "::ffff:0:0/80",
+			source:       true,
+			wantProtocol: ProtocolIPv6,
+			wantKeys: []tc.U32Key{
+				key(8, ones, []byte{0, 0, 0, 0}),
+				key(12, ones, []byte{0, 0, 0, 0}),
+				key(16, []byte{0xff, 0xff, 0, 0}, []byte{0, 0, 0, 0}),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.prefix, func(t *testing.T) {
+			_, prefix, err := net.ParseCIDR(tt.prefix)
+			if err != nil {
+				t.Fatalf("cannot parse prefix: %v", err)
+			}
+
+			if protocol := PrefixProtocol(prefix); protocol != tt.wantProtocol {
+				t.Errorf("PrefixProtocol() = %#x, want %#x", protocol, tt.wantProtocol)
+			}
+
+			if keys := PrefixKeys(prefix, tt.source); !reflect.DeepEqual(keys, tt.wantKeys) {
+				t.Errorf("PrefixKeys() = %+v, want %+v", keys, tt.wantKeys)
+			}
+		})
+	}
+}
+
+func TestProtocolOffset(t *testing.T) {
+	seen := map[uint32]bool{}
+
+	for _, protocol := range []uint32{ProtocolAll, ProtocolIPv4, ProtocolIPv6, ProtocolVLAN} {
+		offset := ProtocolOffset(protocol)
+		if seen[offset] {
+			t.Errorf("ProtocolOffset(%#x) = %d, shared with another protocol", protocol, offset)
+		}
+
+		seen[offset] = true
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package tr064
+
+import (
+	"crypto/md5" //nolint:gosec // MD5 is mandated by TR-064 digest authentication
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var ErrUnsupportedChallenge = errors.New("unsupported authentication challenge")
+
+// client is a HTTP client that answers digest or basic authentication challenges.
+type client struct {
+	// http is the underlying HTTP client
+	http *http.Client
+	// username is the TR-064 user, may be empty
+	username string
+	// password is the TR-064 password
+	password string
+	// nonce is the last digest nonce answered
+	nonce string
+	// nonceCount is how many times nonce has been answered
+	nonceCount uint32
+}
+
+func newClient(username, password string) *client {
+	return &client{
+		http:       &http.Client{Timeout: requestTimeout}, //nolint:exhaustruct
+		username:   username,
+		password:   password,
+		nonce:      "",
+		nonceCount: 0,
+	}
+}
+
+// do performs a request, and if challenged, performs it again with credentials.
+// newRequest is called once per attempt so the body can be replayed.
+func (c *client) do(newRequest func() (*http.Request, error)) (*http.Response, error) {
+	req, err := newRequest()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request to %s failed: %w", req.URL, err)
+	}
+
+	if resp.StatusCode != http.StatusUnauthorized || c.username == "" {
+		return resp, nil
+	}
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+
+	req, err = newRequest()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.authorize(req, challenge); err != nil {
+		return nil, err
+	}
+
+	resp, err = c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("authenticated request to %s failed: %w", req.URL, err)
+	}
+
+	return resp, nil
+}
+
+// authorize adds an Authorization header answering the given challenge.
+func (c *client) authorize(req *http.Request, challenge string) error {
+	scheme, params, _ := strings.Cut(challenge, " ")
+
+	switch strings.ToLower(scheme) {
+	case "basic":
+		req.SetBasicAuth(c.username, c.password)
+
+		return nil
+	case "digest":
+		return c.authorizeDigest(req, parseChallenge(params))
+	default:
+		return fmt.Errorf("%w: %q", ErrUnsupportedChallenge, scheme)
+	}
+}
+
+// authorizeDigest implements RFC 2617 digest authentication with MD5 and qop=auth.
+func (c *client) authorizeDigest(req *http.Request, params map[string]string) error {
+	if algorithm, ok := params["algorithm"]; ok && !strings.EqualFold(algorithm, "MD5") {
+		return fmt.Errorf("%w: digest algorithm %q", ErrUnsupportedChallenge, algorithm)
+	}
+
+	realm := params["realm"]
+	nonce := params["nonce"]
+	uri := req.URL.RequestURI()
+	ha1 := md5Hex(c.username + ":" + realm + ":" + c.password)
+	ha2 := md5Hex(req.Method + ":" + uri)
+
+	fields := []string{
+		fmt.Sprintf("username=%q", c.username),
+		fmt.Sprintf("realm=%q", realm),
+		fmt.Sprintf("nonce=%q", nonce),
+		fmt.Sprintf("uri=%q", uri),
+		"algorithm=MD5",
+	}
+
+	if qopSupportsAuth(params["qop"]) {
+		// The count restarts for each new nonce, as RFC 7616 has it.
+		if nonce != c.nonce {
+			c.nonce = nonce
+			c.nonceCount = 0
+		}
+
+		c.nonceCount++
+		nc := fmt.Sprintf("%08x", c.nonceCount)
+
+		cnonce, err := newCnonce()
+		if err != nil {
+			return err
+		}
+
+		response := md5Hex(strings.Join([]string{ha1, nonce, nc, cnonce, "auth", ha2}, ":"))
+		fields = append(fields, "qop=auth", "nc="+nc, fmt.Sprintf("cnonce=%q", cnonce), fmt.Sprintf("response=%q", response))
+	} else {
+		fields = append(fields, fmt.Sprintf("response=%q", md5Hex(ha1+":"+nonce+":"+ha2)))
+	}
+
+	if opaque, ok := params["opaque"]; ok {
+		fields = append(fields, fmt.Sprintf("opaque=%q", opaque))
+	}
+
+	req.Header.Set("Authorization", "Digest "+strings.Join(fields, ", "))
+
+	return nil
+}
+
+// parseChallenge splits the parameters of a WWW-Authenticate header.
+func parseChallenge(params string) map[string]string {
+	result := map[string]string{}
+
+	for _, part := range splitChallenge(params) {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+
+		result[strings.ToLower(key)] = strings.Trim(value, `"`)
+	}
+
+	return result
+}
+
+// splitChallenge splits on commas that are not inside quotes.
+func splitChallenge(params string) []string {
+	parts := []string{}
+	quoted := false
+	start := 0
+
+	for i, r := range params {
+		switch r {
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				parts = append(parts, params[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	return append(parts, params[start:])
+}
+
+func qopSupportsAuth(qop string) bool {
+	for _, option := range strings.Split(qop, ",") {
+		if strings.TrimSpace(option) == "auth" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func newCnonce() (string, error) {
+	buf := make([]byte, 8) //nolint:gomnd
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("cannot generate client nonce: %w", err)
+	}
+
+	return hex.EncodeToString(buf), nil
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s)) //nolint:gosec
+
+	return hex.EncodeToString(sum[:])
+}
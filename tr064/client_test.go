@@ -0,0 +1,191 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package tr064
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const (
+	testUsername = "admin"
+	testPassword = "secret"
+	testRealm    = "F!Box SOAP-Auth"
+	testNonce    = "6F3C2B9E1A0D4E5F"
+)
+
+// digestHandler answers requests without valid digest credentials with a challenge, and
+// passes the rest to next.
+func digestHandler(t *testing.T, qop string, next http.Handler) http.Handler {
+	t.Helper()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheme, params, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		if scheme != "Digest" {
+			challenge := `Digest realm="` + testRealm + `", nonce="` + testNonce + `", algorithm=MD5`
+			if qop != "" {
+				challenge += `, qop="` + qop + `"`
+			}
+
+			w.Header().Set("WWW-Authenticate", challenge)
+			w.WriteHeader(http.StatusUnauthorized)
+
+			return
+		}
+
+		fields := parseChallenge(params)
+		ha1 := md5Hex(testUsername + ":" + testRealm + ":" + testPassword)
+		ha2 := md5Hex(r.Method + ":" + r.URL.RequestURI())
+
+		want := md5Hex(ha1 + ":" + testNonce + ":" + ha2)
+		if qop != "" {
+			if fields["qop"] != "auth" || fields["nc"] == "" || fields["cnonce"] == "" {
+				t.Errorf("digest fields = %v, want qop=auth with nc and cnonce", fields)
+			}
+
+			want = md5Hex(strings.Join([]string{ha1, testNonce, fields["nc"], fields["cnonce"], "auth", ha2}, ":"))
+		}
+
+		if fields["username"] != testUsername || fields["uri"] != r.URL.RequestURI() || fields["response"] != want {
+			t.Errorf("digest fields = %v, want username %q, uri %q and response %q", fields, testUsername,
+				r.URL.RequestURI(), want)
+			w.WriteHeader(http.StatusUnauthorized)
+
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func TestDigestAuthentication(t *testing.T) {
+	t.Parallel()
+
+	for _, qop := range []string{"", "auth", "auth,auth-int"} {
+		qop := qop
+
+		t.Run("qop="+qop, func(t *testing.T) {
+			t.Parallel()
+
+			ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+			server := httptest.NewServer(digestHandler(t, qop, ok))
+			defer server.Close()
+
+			resp, err := newClient(testUsername, testPassword).do(func() (*http.Request, error) {
+				return http.NewRequestWithContext(context.Background(), http.MethodGet, server.URL+"/upnp/control/wancommonifconfig1?x=1", nil)
+			})
+			if err != nil {
+				t.Fatalf("do() error = %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("do() status = %s, want 200 OK", resp.Status)
+			}
+		})
+	}
+}
+
+func TestDigestNonceCount(t *testing.T) {
+	t.Parallel()
+
+	// Each challenge has the next nonce, and the server records the nc of each answer.
+	nonces := []string{"first", "first", "second", "first"}
+	counts := []string{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheme, params, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		if scheme != "Digest" {
+			nonce := nonces[0]
+			nonces = nonces[1:]
+
+			w.Header().Set("WWW-Authenticate", `Digest realm="`+testRealm+`", nonce="`+nonce+`", qop="auth"`)
+			w.WriteHeader(http.StatusUnauthorized)
+
+			return
+		}
+
+		fields := parseChallenge(params)
+		counts = append(counts, fields["nonce"]+"/"+fields["nc"])
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	c := newClient(testUsername, testPassword)
+
+	for i := 0; i < 4; i++ {
+		resp, err := c.do(func() (*http.Request, error) {
+			return http.NewRequestWithContext(context.Background(), http.MethodGet, server.URL, nil)
+		})
+		if err != nil {
+			t.Fatalf("do() error = %v", err)
+		}
+
+		resp.Body.Close()
+	}
+
+	want := []string{"first/00000001", "first/00000002", "second/00000001", "first/00000001"}
+	if strings.Join(counts, " ") != strings.Join(want, " ") {
+		t.Errorf("nonce counts = %v, want %v", counts, want)
+	}
+}
+
+func TestDigestAuthenticationWithoutCredentials(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(digestHandler(t, "auth", http.NotFoundHandler()))
+	defer server.Close()
+
+	resp, err := newClient("", "").do(func() (*http.Request, error) {
+		return http.NewRequestWithContext(context.Background(), http.MethodGet, server.URL, nil)
+	})
+	if err != nil {
+		t.Fatalf("do() error = %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("do() status = %s, want the challenge passed through", resp.Status)
+	}
+}
+
+func TestUnsupportedChallenge(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("WWW-Authenticate", `Digest realm="x", nonce="y", algorithm=SHA-256`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	_, err := newClient(testUsername, testPassword).do(func() (*http.Request, error) {
+		return http.NewRequestWithContext(context.Background(), http.MethodGet, server.URL, nil)
+	})
+	if !errors.Is(err, ErrUnsupportedChallenge) {
+		t.Errorf("do() error = %v, want %v", err, ErrUnsupportedChallenge)
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	t.Parallel()
+
+	got := parseChallenge(`realm="a, b", nonce="n", qop="auth,auth-int", algorithm=MD5`)
+	want := map[string]string{"realm": "a, b", "nonce": "n", "qop": "auth,auth-int", "algorithm": "MD5"}
+
+	if len(got) != len(want) {
+		t.Fatalf("parseChallenge() = %v, want %v", got, want)
+	}
+
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("parseChallenge()[%q] = %q, want %q", key, got[key], value)
+		}
+	}
+}
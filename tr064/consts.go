@@ -0,0 +1,32 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package tr064
+
+import "time"
+
+// WANCommonInterfaceConfigServices are the service types searched for, in order of preference.
+var WANCommonInterfaceConfigServices = []string{ //nolint:gochecknoglobals
+	TR064WANCommonInterfaceConfigService,
+	IGDWANCommonInterfaceConfigService,
+}
+
+const (
+	// TR064WANCommonInterfaceConfigService is the TR-064 service type that reports link
+	// properties, as listed by a Fritz!Box in tr64desc.xml.
+	TR064WANCommonInterfaceConfigService = "urn:dslforum-org:service:WANCommonInterfaceConfig:1"
+	// IGDWANCommonInterfaceConfigService is the UPnP IGD service type that reports link properties.
+	IGDWANCommonInterfaceConfigService = "urn:schemas-upnp-org:service:WANCommonInterfaceConfig:1"
+	// GetCommonLinkPropertiesAction is the SOAP action that returns the layer 1 rates.
+	GetCommonLinkPropertiesAction = "GetCommonLinkProperties"
+	// FritzBoxDescriptionURL is the usual location of the TR-064 description on a Fritz!Box.
+	FritzBoxDescriptionURL = "http://fritz.box:49000/tr64desc.xml"
+
+	upstreamRateArgument   = "NewLayer1UpstreamMaxBitRate"
+	downstreamRateArgument = "NewLayer1DownstreamMaxBitRate"
+
+	ssdpAddress        = "239.255.255.250:1900"
+	ssdpMaxWaitSeconds = 2
+	discoveryTimeout   = 3 * time.Second
+	requestTimeout     = 5 * time.Second
+)
@@ -0,0 +1,107 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package tr064
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var ErrServiceNotFound = errors.New("service not found in device description")
+
+// deviceDescription is the subset of a UPnP device description needed to find a service.
+type deviceDescription struct {
+	URLBase string `xml:"URLBase"`
+	Device  device `xml:"device"`
+}
+
+type device struct {
+	Services []service `xml:"serviceList>service"`
+	Devices  []device  `xml:"deviceList>device"`
+}
+
+type service struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+// findService searches a device and its embedded devices for a service type.
+func (d device) findService(serviceType string) (service, bool) {
+	for _, svc := range d.Services {
+		if svc.ServiceType == serviceType {
+			return svc, true
+		}
+	}
+
+	for _, child := range d.Devices {
+		if svc, ok := child.findService(serviceType); ok {
+			return svc, true
+		}
+	}
+
+	return service{}, false
+}
+
+// resolveControlURL fetches a device description and returns the absolute control URL of the
+// first of the given service types it lists, along with that service type.
+func (c *client) resolveControlURL(descriptionURL string, serviceTypes ...string) (string, string, error) {
+	resp, err := c.do(func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, descriptionURL, nil)
+		if err != nil {
+			return nil, fmt.Errorf("invalid description URL: %w", err)
+		}
+
+		return req, nil
+	})
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("%w: fetching %s returned %s", ErrUnexpectedStatus, descriptionURL, resp.Status)
+	}
+
+	var desc deviceDescription
+	if err := xml.NewDecoder(resp.Body).Decode(&desc); err != nil {
+		return "", "", fmt.Errorf("cannot parse device description: %w", err)
+	}
+
+	var (
+		svc   service
+		found bool
+	)
+
+	for _, serviceType := range serviceTypes {
+		if svc, found = desc.Device.findService(serviceType); found {
+			break
+		}
+	}
+
+	if !found {
+		return "", "", fmt.Errorf("%w: %s", ErrServiceNotFound, strings.Join(serviceTypes, " or "))
+	}
+
+	base := descriptionURL
+	if desc.URLBase != "" {
+		base = desc.URLBase
+	}
+
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid base URL %q: %w", base, err)
+	}
+
+	controlURL, err := baseURL.Parse(svc.ControlURL)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid control URL %q: %w", svc.ControlURL, err)
+	}
+
+	return controlURL.String(), svc.ServiceType, nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package tr064
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+var ErrNoDeviceFound = errors.New("no device answered SSDP discovery")
+
+// Discover sends an SSDP M-SEARCH for each WANCommonInterfaceConfig service type, TR-064 first,
+// and returns the description URL of the first device that answers.
+func Discover(timeout time.Duration) (string, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return "", fmt.Errorf("cannot open socket for SSDP discovery: %w", err)
+	}
+	defer conn.Close()
+
+	dest, err := net.ResolveUDPAddr("udp4", ssdpAddress)
+	if err != nil {
+		return "", fmt.Errorf("cannot resolve SSDP address: %w", err)
+	}
+
+	for _, serviceType := range WANCommonInterfaceConfigServices {
+		search := fmt.Sprintf("M-SEARCH * HTTP/1.1\r\n"+
+			"HOST: %s\r\n"+
+			"MAN: \"ssdp:discover\"\r\n"+
+			"MX: %d\r\n"+
+			"ST: %s\r\n\r\n", ssdpAddress, ssdpMaxWaitSeconds, serviceType)
+
+		if _, err := conn.WriteTo([]byte(search), dest); err != nil {
+			return "", fmt.Errorf("cannot send SSDP search: %w", err)
+		}
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return "", fmt.Errorf("cannot set SSDP read deadline: %w", err)
+	}
+
+	buf := make([]byte, 2048) //nolint:gomnd
+
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return "", ErrNoDeviceFound
+			}
+
+			return "", fmt.Errorf("error reading SSDP response: %w", err)
+		}
+
+		if location := parseSearchResponse(buf[:n]); location != "" {
+			return location, nil
+		}
+	}
+}
+
+// parseSearchResponse returns the LOCATION header of an SSDP response, if any.
+func parseSearchResponse(payload []byte) string {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(payload)), nil)
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return ""
+	}
+
+	return resp.Header.Get("Location")
+}
@@ -0,0 +1,7 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// tr064 defines a rate source that reads the layer 1 line rates of a consumer router
+// via the TR-064 or UPnP IGD WANCommonInterfaceConfig service, as exposed by Fritz!Box and
+// many ISP supplied CPEs.
+package tr064
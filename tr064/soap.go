@@ -0,0 +1,102 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package tr064
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+var (
+	ErrUnexpectedStatus = errors.New("unexpected HTTP status")
+	ErrSOAPFault        = errors.New("SOAP fault")
+)
+
+const soapEnvelope = `<?xml version="1.0" encoding="utf-8"?>` +
+	`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" ` +
+	`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+	`<s:Body><u:%[1]s xmlns:u="%[2]s"></u:%[1]s></s:Body></s:Envelope>`
+
+// call invokes an argument-less SOAP action and returns the output arguments by name.
+func (c *client) call(controlURL, serviceType, action string) (map[string]string, error) {
+	body := fmt.Sprintf(soapEnvelope, action, serviceType)
+
+	resp, err := c.do(func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, controlURL, strings.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("invalid control URL: %w", err)
+		}
+
+		req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+		req.Header.Set("SOAPAction", fmt.Sprintf("%q", serviceType+"#"+action))
+
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	payload, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read SOAP response: %w", err)
+	}
+
+	values, err := parseSOAPResponse(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if fault, ok := values["faultstring"]; ok {
+		return nil, fmt.Errorf("%w calling %s: %s %s", ErrSOAPFault, action, fault, values["errorDescription"])
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: calling %s returned %s", ErrUnexpectedStatus, action, resp.Status)
+	}
+
+	return values, nil
+}
+
+// parseSOAPResponse collects the text of every leaf element in the SOAP body, keyed by local name.
+func parseSOAPResponse(payload []byte) (map[string]string, error) {
+	values := map[string]string{}
+	decoder := xml.NewDecoder(bytes.NewReader(payload))
+
+	var (
+		current string
+		text    strings.Builder
+	)
+
+	for {
+		token, err := decoder.Token()
+		if errors.Is(err, io.EOF) {
+			return values, nil
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse SOAP response: %w", err)
+		}
+
+		switch elem := token.(type) {
+		case xml.StartElement:
+			current = elem.Name.Local
+			text.Reset()
+		case xml.CharData:
+			text.Write(elem)
+		case xml.EndElement:
+			if current == elem.Name.Local {
+				values[current] = strings.TrimSpace(text.String())
+			}
+
+			current = ""
+		}
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package tr064
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/randomvariable/sqm/ratesource"
+)
+
+var ErrMissingArgument = errors.New("missing output argument")
+
+// Source reads the line rates from a TR-064 or UPnP IGD device.
+type Source struct {
+	// descriptionURL is the device description location. If empty, SSDP discovery is used.
+	descriptionURL string
+	// client is the HTTP client used for all requests
+	client *client
+	// controlURL is the resolved WANCommonInterfaceConfig control URL, cached between reads
+	controlURL string
+	// serviceType is the service type the control URL was resolved for
+	serviceType string
+}
+
+// NewTR064Source returns an instantiated TR-064 rate source. The username and password
+// are only used when the device issues an authentication challenge.
+func NewTR064Source(descriptionURL, username, password string) *Source {
+	return &Source{
+		descriptionURL: descriptionURL,
+		client:         newClient(username, password),
+		controlURL:     "",
+		serviceType:    "",
+	}
+}
+
+// Read returns the current line rates.
+func (s *Source) Read() (ratesource.Reading, error) {
+	if err := s.ensureControlURL(); err != nil {
+		return ratesource.Reading{}, err
+	}
+
+	values, err := s.client.call(s.controlURL, s.serviceType, GetCommonLinkPropertiesAction)
+	if err != nil {
+		// The device may have rebooted onto a different address, so resolve again next time.
+		s.controlURL = ""
+
+		return ratesource.Reading{}, err
+	}
+
+	ingress, err := rateArgument(values, downstreamRateArgument)
+	if err != nil {
+		return ratesource.Reading{}, err
+	}
+
+	egress, err := rateArgument(values, upstreamRateArgument)
+	if err != nil {
+		return ratesource.Reading{}, err
+	}
+
+	return ratesource.Reading{Ingress: ingress, Egress: egress}, nil
+}
+
+// ensureControlURL discovers the device if needed and resolves the control URL.
+func (s *Source) ensureControlURL() error {
+	if s.controlURL != "" {
+		return nil
+	}
+
+	descriptionURL := s.descriptionURL
+	if descriptionURL == "" {
+		location, err := Discover(discoveryTimeout)
+		if err != nil {
+			return err
+		}
+
+		descriptionURL = location
+	}
+
+	controlURL, serviceType, err := s.client.resolveControlURL(descriptionURL, WANCommonInterfaceConfigServices...)
+	if err != nil {
+		return err
+	}
+
+	s.controlURL = controlURL
+	s.serviceType = serviceType
+
+	return nil
+}
+
+// rateArgument converts an output argument in bit/s to kbps.
+func rateArgument(values map[string]string, name string) (int64, error) {
+	raw, ok := values[name]
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", ErrMissingArgument, name)
+	}
+
+	bps, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse %s value %q: %w", name, raw, err)
+	}
+
+	return ratesource.ToKbps(bps, ratesource.BitsPerSecond) //nolint:wrapcheck
+}
@@ -0,0 +1,220 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package tr064
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// descriptionTemplate is a device description in the shape of a Fritz!Box tr64desc.xml, with
+// the WANCommonInterfaceConfig service types filled in.
+const descriptionTemplate = `<?xml version="1.0"?>
+<root xmlns="urn:dslforum-org:device-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <device>
+    <deviceType>urn:dslforum-org:device:InternetGatewayDevice:1</deviceType>
+    <serviceList>
+      <service>
+        <serviceType>urn:dslforum-org:service:DeviceInfo:1</serviceType>
+        <controlURL>/upnp/control/deviceinfo</controlURL>
+      </service>
+    </serviceList>
+    <deviceList>
+      <device>
+        <deviceType>urn:dslforum-org:device:WANDevice:1</deviceType>
+        <serviceList>%s</serviceList>
+      </device>
+    </deviceList>
+  </device>
+</root>`
+
+const serviceTemplate = `
+          <service>
+            <serviceType>%s</serviceType>
+            <controlURL>%s</controlURL>
+          </service>`
+
+const linkPropertiesResponse = `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"
+    s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+  <s:Body>
+    <u:GetCommonLinkPropertiesResponse xmlns:u="%s">
+      <NewWANAccessType>DSL</NewWANAccessType>
+      <NewLayer1UpstreamMaxBitRate>40000000</NewLayer1UpstreamMaxBitRate>
+      <NewLayer1DownstreamMaxBitRate>250000000</NewLayer1DownstreamMaxBitRate>
+      <NewPhysicalLinkStatus>Up</NewPhysicalLinkStatus>
+    </u:GetCommonLinkPropertiesResponse>
+  </s:Body>
+</s:Envelope>`
+
+const faultResponse = `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/">
+  <s:Body>
+    <s:Fault>
+      <faultcode>s:Client</faultcode>
+      <faultstring>UPnPError</faultstring>
+      <detail>
+        <UPnPError xmlns="urn:dslforum-org:control-1-0">
+          <errorCode>401</errorCode>
+          <errorDescription>Invalid Action</errorDescription>
+        </UPnPError>
+      </detail>
+    </s:Fault>
+  </s:Body>
+</s:Envelope>`
+
+// description returns a device description listing the given service types, each with its
+// own control URL.
+func description(serviceTypes ...string) string {
+	services := ""
+
+	for i, serviceType := range serviceTypes {
+		services += fmt.Sprintf(serviceTemplate, serviceType, fmt.Sprintf("/upnp/control/wan%d", i))
+	}
+
+	return fmt.Sprintf(descriptionTemplate, services)
+}
+
+func TestParseSOAPResponse(t *testing.T) {
+	t.Parallel()
+
+	values, err := parseSOAPResponse([]byte(fmt.Sprintf(linkPropertiesResponse, TR064WANCommonInterfaceConfigService)))
+	if err != nil {
+		t.Fatalf("parseSOAPResponse() error = %v", err)
+	}
+
+	for name, want := range map[string]string{
+		upstreamRateArgument:    "40000000",
+		downstreamRateArgument:  "250000000",
+		"NewPhysicalLinkStatus": "Up",
+	} {
+		if values[name] != want {
+			t.Errorf("parseSOAPResponse()[%q] = %q, want %q", name, values[name], want)
+		}
+	}
+
+	values, err = parseSOAPResponse([]byte(faultResponse))
+	if err != nil {
+		t.Fatalf("parseSOAPResponse() of a fault error = %v", err)
+	}
+
+	if values["faultstring"] != "UPnPError" || values["errorDescription"] != "Invalid Action" {
+		t.Errorf("parseSOAPResponse() of a fault = %v, want the fault string and description", values)
+	}
+
+	if _, err := parseSOAPResponse([]byte("<s:Envelope><s:Body>")); err == nil {
+		t.Error("parseSOAPResponse() of a truncated body succeeded, want an error")
+	}
+}
+
+func TestResolveControlURL(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name            string
+		description     string
+		wantPath        string
+		wantServiceType string
+		wantErr         error
+	}{
+		{
+			name:            "TR-064",
+			description:     description(TR064WANCommonInterfaceConfigService),
+			wantPath:        "/upnp/control/wan0",
+			wantServiceType: TR064WANCommonInterfaceConfigService,
+			wantErr:         nil,
+		},
+		{
+			name:            "UPnP IGD",
+			description:     description(IGDWANCommonInterfaceConfigService),
+			wantPath:        "/upnp/control/wan0",
+			wantServiceType: IGDWANCommonInterfaceConfigService,
+			wantErr:         nil,
+		},
+		{
+			name:            "TR-064 preferred",
+			description:     description(IGDWANCommonInterfaceConfigService, TR064WANCommonInterfaceConfigService),
+			wantPath:        "/upnp/control/wan1",
+			wantServiceType: TR064WANCommonInterfaceConfigService,
+			wantErr:         nil,
+		},
+		{
+			name:            "not listed",
+			description:     description("urn:dslforum-org:service:WANPPPConnection:1"),
+			wantPath:        "",
+			wantServiceType: "",
+			wantErr:         ErrServiceNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, tt.description) //nolint:errcheck
+			}))
+			defer server.Close()
+
+			controlURL, serviceType, err := newClient("", "").resolveControlURL(server.URL+"/tr64desc.xml",
+				WANCommonInterfaceConfigServices...)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("resolveControlURL() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr != nil {
+				return
+			}
+
+			if controlURL != server.URL+tt.wantPath || serviceType != tt.wantServiceType {
+				t.Errorf("resolveControlURL() = %q, %q, want %q, %q", controlURL, serviceType,
+					server.URL+tt.wantPath, tt.wantServiceType)
+			}
+		})
+	}
+}
+
+func TestSourceRead(t *testing.T) {
+	t.Parallel()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tr64desc.xml", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, description(TR064WANCommonInterfaceConfigService)) //nolint:errcheck
+	})
+	mux.Handle("/upnp/control/wan0", digestHandler(t, "auth", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			wantAction := fmt.Sprintf("%q", TR064WANCommonInterfaceConfigService+"#"+GetCommonLinkPropertiesAction)
+			if action := r.Header.Get("SOAPAction"); action != wantAction {
+				t.Errorf("SOAPAction = %s, want %s", action, wantAction)
+			}
+
+			body, _ := io.ReadAll(r.Body)
+			if !strings.Contains(string(body), `<u:GetCommonLinkProperties xmlns:u="`+
+				TR064WANCommonInterfaceConfigService+`">`) {
+				t.Errorf("request body = %s, want a GetCommonLinkProperties call", body)
+			}
+
+			fmt.Fprintf(w, linkPropertiesResponse, TR064WANCommonInterfaceConfigService)
+		})))
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	reading, err := NewTR064Source(server.URL+"/tr64desc.xml", testUsername, testPassword).Read()
+	if err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+
+	if reading.Ingress != 250000 || reading.Egress != 40000 {
+		t.Errorf("Read() = %+v, want 250000 kbps ingress and 40000 kbps egress", reading)
+	}
+}
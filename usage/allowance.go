@@ -0,0 +1,118 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package usage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/randomvariable/sqm/datastore"
+)
+
+var ErrInvalidAllowance = errors.New("invalid data cap")
+
+const (
+	// maxResetDay is the last day of the longest month.
+	maxResetDay = 31
+	// bytesPerGigabyte is a decimal gigabyte, as data plans are billed.
+	bytesPerGigabyte = 1e9
+)
+
+// Threshold steps down the shaping once the usage in a billing period reaches it.
+type Threshold struct {
+	Bytes   uint64
+	Ingress datastore.Adjustment
+	Egress  datastore.Adjustment
+}
+
+// Allowance is the billing period and the thresholds within it.
+type Allowance struct {
+	// ResetDay is the day of the month each billing period starts on
+	ResetDay int
+	// Thresholds are in increasing order of bytes
+	Thresholds []Threshold
+}
+
+// Validate checks the reset day is a day of the month and the thresholds increase.
+func (a Allowance) Validate() error {
+	if a.ResetDay < 1 || a.ResetDay > maxResetDay {
+		return fmt.Errorf("%w: reset day %d isn't a day of the month", ErrInvalidAllowance, a.ResetDay)
+	}
+
+	previous := uint64(0)
+
+	for _, threshold := range a.Thresholds {
+		if threshold.Bytes <= previous {
+			return fmt.Errorf("%w: thresholds must be above zero and increase", ErrInvalidAllowance)
+		}
+
+		for _, adjustment := range []datastore.Adjustment{threshold.Ingress, threshold.Egress} {
+			if adjustment.Multiplier < 0 || adjustment.Cap < 0 {
+				return fmt.Errorf("%w: threshold %s has a negative multiplier or cap", ErrInvalidAllowance,
+					FormatGigabytes(threshold.Bytes))
+			}
+		}
+
+		previous = threshold.Bytes
+	}
+
+	return nil
+}
+
+// crossed returns the highest threshold the usage has reached, or nil if none.
+func (a Allowance) crossed(used uint64) *Threshold {
+	var highest *Threshold
+
+	for i := range a.Thresholds {
+		if used >= a.Thresholds[i].Bytes {
+			highest = &a.Thresholds[i]
+		}
+	}
+
+	return highest
+}
+
+// PeriodStart returns when the billing period containing a time started: midnight local time on
+// the reset day, or on the last day of months too short to have it.
+func PeriodStart(now time.Time, resetDay int) time.Time {
+	start := resetIn(now.Year(), now.Month(), resetDay, now.Location())
+	if now.Before(start) {
+		start = resetIn(now.Year(), now.Month()-1, resetDay, now.Location())
+	}
+
+	return start
+}
+
+// resetIn returns the start of the billing period in a month.
+func resetIn(year int, month time.Month, resetDay int, location *time.Location) time.Time {
+	if lastDay := time.Date(year, month+1, 0, 0, 0, 0, 0, location).Day(); resetDay > lastDay {
+		resetDay = lastDay
+	}
+
+	return time.Date(year, month, resetDay, 0, 0, 0, 0, location)
+}
+
+// FormatGigabytes describes a number of bytes in gigabytes.
+func FormatGigabytes(bytes uint64) string {
+	return fmt.Sprintf("%.2f GB", float64(bytes)/bytesPerGigabyte)
+}
+
+// Load reads the usage saved by a previous run.
+func Load(path string) (datastore.Usage, error) {
+	var usage datastore.Usage
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return usage, fmt.Errorf("cannot read usage file: %w", err)
+	}
+
+	if err := json.Unmarshal(raw, &usage); err != nil {
+		return usage, fmt.Errorf("cannot parse usage file %s: %w", path, err)
+	}
+
+	return usage, nil
+}
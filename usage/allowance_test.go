@@ -0,0 +1,86 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package usage
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/randomvariable/sqm/datastore"
+)
+
+// day returns midnight local time on a date.
+func day(year int, month time.Month, date int) time.Time {
+	return time.Date(year, month, date, 0, 0, 0, 0, time.Local)
+}
+
+func TestPeriodStart(t *testing.T) {
+	tests := []struct {
+		name     string
+		now      time.Time
+		resetDay int
+		want     time.Time
+	}{
+		{name: "first of the month", now: day(2026, time.October, 19).Add(12 * time.Hour), resetDay: 1,
+			want: day(2026, time.October, 1)},
+		{name: "before the reset day", now: day(2026, time.October, 19), resetDay: 20,
+			want: day(2026, time.September, 20)},
+		{name: "on the reset day", now: day(2026, time.October, 20), resetDay: 20,
+			want: day(2026, time.October, 20)},
+		{name: "just before the reset", now: day(2026, time.October, 20).Add(-time.Second), resetDay: 20,
+			want: day(2026, time.September, 20)},
+		{name: "across new year", now: day(2026, time.January, 10), resetDay: 15,
+			want: day(2025, time.December, 15)},
+		{name: "short month", now: day(2026, time.February, 28).Add(12 * time.Hour), resetDay: 31,
+			want: day(2026, time.February, 28)},
+		{name: "before a short month's reset", now: day(2026, time.February, 27), resetDay: 31,
+			want: day(2026, time.January, 31)},
+		{name: "after a short month", now: day(2026, time.March, 1), resetDay: 31,
+			want: day(2026, time.February, 28)},
+		{name: "leap year", now: day(2024, time.March, 1), resetDay: 30,
+			want: day(2024, time.February, 29)},
+		{name: "thirty day month", now: day(2026, time.April, 30), resetDay: 31,
+			want: day(2026, time.April, 30)},
+	}
+
+	for _, tt := range tests {
+		if got := PeriodStart(tt.now, tt.resetDay); !got.Equal(tt.want) {
+			t.Errorf("%s: PeriodStart(%s, %d) = %s, want %s", tt.name, tt.now, tt.resetDay, got, tt.want)
+		}
+	}
+}
+
+func TestAllowanceValidate(t *testing.T) {
+	adjustment := datastore.Adjustment{Multiplier: 0.5, Cap: 0, Profile: ""}
+
+	tests := []struct {
+		name      string
+		allowance Allowance
+		wantErr   error
+	}{
+		{name: "valid", wantErr: nil, allowance: Allowance{ResetDay: 31, Thresholds: []Threshold{
+			{Bytes: 1, Ingress: adjustment, Egress: adjustment},
+			{Bytes: 2, Ingress: adjustment, Egress: adjustment},
+		}}},
+		{name: "day zero", wantErr: ErrInvalidAllowance, allowance: Allowance{ResetDay: 0, Thresholds: nil}},
+		{name: "day 32", wantErr: ErrInvalidAllowance, allowance: Allowance{ResetDay: 32, Thresholds: nil}},
+		{name: "zero threshold", wantErr: ErrInvalidAllowance, allowance: Allowance{ResetDay: 1, Thresholds: []Threshold{
+			{Bytes: 0, Ingress: adjustment, Egress: adjustment},
+		}}},
+		{name: "decreasing", wantErr: ErrInvalidAllowance, allowance: Allowance{ResetDay: 1, Thresholds: []Threshold{
+			{Bytes: 2, Ingress: adjustment, Egress: adjustment},
+			{Bytes: 1, Ingress: adjustment, Egress: adjustment},
+		}}},
+		{name: "negative cap", wantErr: ErrInvalidAllowance, allowance: Allowance{ResetDay: 1, Thresholds: []Threshold{
+			{Bytes: 1, Ingress: datastore.Adjustment{Multiplier: 0, Cap: -1, Profile: ""}, Egress: adjustment},
+		}}},
+	}
+
+	for _, tt := range tests {
+		if err := tt.allowance.Validate(); !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: Validate() error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package usage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"time"
+
+	"github.com/randomvariable/sqm/datastore"
+	"github.com/randomvariable/sqm/persist"
+	"github.com/vishvananda/netlink"
+	"go.uber.org/zap"
+)
+
+var ErrNoStatistics = errors.New("device has no statistics")
+
+const (
+	// AdjustmentName is the name the step down in effect is recorded under in the datastore.
+	AdjustmentName = "data cap"
+	// WarningName is the name of the warning set once a threshold is crossed.
+	WarningName = "data cap"
+
+	// saveInterval is how often the usage is saved while it changes.
+	saveInterval = time.Minute
+)
+
+// counter follows a device's transmitted bytes between readings.
+type counter struct {
+	index int
+	bytes uint64
+	known bool
+}
+
+// advance returns the bytes sent since the last reading. The first reading only sets the
+// baseline, and a recreated device, such as a PPP link that reconnected, counts from zero.
+func (c *counter) advance(index int, bytes uint64) uint64 {
+	delta := uint64(0)
+
+	switch {
+	case !c.known:
+	case index != c.index || bytes < c.bytes:
+		delta = bytes
+	default:
+		delta = bytes - c.bytes
+	}
+
+	c.index, c.bytes, c.known = index, bytes, true
+
+	return delta
+}
+
+// Controller counts the bytes through the root and IFB devices over each billing period, and
+// steps down the shaping as the usage crosses thresholds.
+type Controller struct {
+	// path is the usage file, empty to not save it
+	path string
+	// allowance is the billing period and thresholds
+	allowance Allowance
+	// data is the shared datastore
+	data *datastore.Data
+	// log is the logger
+	log *zap.SugaredLogger
+	// usage is the usage in the current billing period
+	usage datastore.Usage
+	// ingress and egress follow the IFB and root device counters
+	ingress counter
+	egress  counter
+	// restored is set once the usage file has been read
+	restored bool
+	// saved is when the usage was last saved
+	saved time.Time
+	// now returns the current time
+	now func() time.Time
+}
+
+// NewUsageController returns an instantiated controller.
+func NewUsageController(path string, allowance Allowance, data *datastore.Data,
+	log *zap.SugaredLogger,
+) *Controller {
+	return &Controller{
+		path:      path,
+		allowance: allowance,
+		data:      data,
+		log:       log.Named("Usage Controller").With("UsageFile", path),
+		usage:     datastore.Usage{}, //nolint:exhaustruct
+		ingress:   counter{index: 0, bytes: 0, known: false},
+		egress:    counter{index: 0, bytes: 0, known: false},
+		restored:  false,
+		saved:     time.Time{},
+		now:       time.Now,
+	}
+}
+
+// Reconcile defines the reconciliation loop.
+func (c *Controller) Reconcile() error {
+	if !c.restored {
+		c.restore()
+		c.restored = true
+	}
+
+	rootDevice, err := c.data.RootDevice()
+	if err != nil {
+		return fmt.Errorf("error getting root device: %w", err)
+	}
+
+	ifbDevice, err := c.data.IfbDevice()
+	if err != nil {
+		return fmt.Errorf("error getting IFB device: %w", err)
+	}
+
+	egressIndex, egressBytes, err := transmitted(rootDevice.Attrs().Name)
+	if err != nil {
+		return err
+	}
+
+	ingressIndex, ingressBytes, err := transmitted(ifbDevice.Attrs().Name)
+	if err != nil {
+		return err
+	}
+
+	now := c.now()
+	if c.account(now, ingressIndex, ingressBytes, egressIndex, egressBytes) {
+		c.saved = time.Time{}
+	}
+
+	if !c.data.SetUsage(c.usage) || now.Sub(c.saved) < saveInterval {
+		return nil
+	}
+
+	if err := c.save(); err != nil {
+		return err
+	}
+
+	c.saved = now
+
+	return nil
+}
+
+// account adds what the devices sent since the last readings to the usage of the billing
+// period containing now, starting a new period once it has begun, and steps the shaping. It
+// returns whether the threshold crossed changed.
+func (c *Controller) account(now time.Time, ingressIndex int, ingressBytes uint64, egressIndex int,
+	egressBytes uint64,
+) bool {
+	if start := PeriodStart(now, c.allowance.ResetDay); !start.Equal(c.usage.PeriodStart) {
+		if !c.usage.PeriodStart.IsZero() {
+			c.log.Infow("Billing period started", "PeriodStart", start,
+				"PreviousUsage", FormatGigabytes(c.usage.Total()))
+		}
+
+		c.usage = datastore.Usage{PeriodStart: start, IngressBytes: 0, EgressBytes: 0, Threshold: 0}
+	}
+
+	c.usage.IngressBytes += c.ingress.advance(ingressIndex, ingressBytes)
+	c.usage.EgressBytes += c.egress.advance(egressIndex, egressBytes)
+
+	return c.step()
+}
+
+// step records the adjustments and warning of the highest threshold crossed, returning whether
+// that changed.
+func (c *Controller) step() bool {
+	threshold := c.allowance.crossed(c.usage.Total())
+
+	adjustments := datastore.Adjustments{Reason: "", Ingress: datastore.Adjustment{}, Egress: datastore.Adjustment{}}
+	warning := datastore.Warning{Message: "", Unhealthy: false}
+	c.usage.Threshold = 0
+
+	if threshold != nil {
+		c.usage.Threshold = threshold.Bytes
+		adjustments = datastore.Adjustments{
+			Reason:  FormatGigabytes(threshold.Bytes) + " used",
+			Ingress: threshold.Ingress,
+			Egress:  threshold.Egress,
+		}
+		warning = datastore.Warning{
+			Message: fmt.Sprintf("over %s used since %s, shaping is stepped down",
+				FormatGigabytes(threshold.Bytes), c.usage.PeriodStart.Format("2 January")),
+			Unhealthy: false,
+		}
+	}
+
+	c.data.SetWarning(WarningName, warning)
+
+	if !c.data.SetAdjustments(AdjustmentName, adjustments) {
+		return false
+	}
+
+	if threshold != nil {
+		c.log.Warnw("Data cap threshold crossed, stepping down shaping", "Usage", FormatGigabytes(c.usage.Total()),
+			"Threshold", FormatGigabytes(threshold.Bytes), "IngressRate", c.data.ShapedIngressRate(),
+			"EgressRate", c.data.ShapedEgressRate())
+	} else {
+		c.log.Infow("Below every data cap threshold", "Usage", FormatGigabytes(c.usage.Total()),
+			"IngressRate", c.data.ShapedIngressRate(), "EgressRate", c.data.ShapedEgressRate())
+	}
+
+	return true
+}
+
+// transmitted returns the ifindex and transmitted bytes of a device.
+func transmitted(name string) (int, uint64, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return 0, 0, fmt.Errorf("cannot find %s: %w", name, err)
+	}
+
+	stats := link.Attrs().Statistics
+	if stats == nil {
+		return 0, 0, fmt.Errorf("%w: %s", ErrNoStatistics, name)
+	}
+
+	return link.Attrs().Index, stats.TxBytes, nil
+}
+
+// restore reads the usage saved by a previous run, if any.
+func (c *Controller) restore() {
+	if c.path == "" {
+		return
+	}
+
+	usage, err := Load(c.path)
+
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		c.log.Warnw("Cannot restore data usage, counting from zero", "error", err)
+	default:
+		c.usage = usage
+		c.log.Infow("Restored data usage", "PeriodStart", usage.PeriodStart, "Usage", FormatGigabytes(usage.Total()))
+	}
+}
+
+// save writes the usage, if there's a usage file.
+func (c *Controller) save() error {
+	if c.path == "" {
+		return nil
+	}
+
+	if err := persist.SaveJSON(c.path, c.usage); err != nil {
+		return fmt.Errorf("cannot save data usage: %w", err)
+	}
+
+	return nil
+}
+
+// ReconcileDelete defines what happens on shutdown.
+func (c *Controller) ReconcileDelete() {
+	if c.restored {
+		if err := c.save(); err != nil {
+			c.log.Errorw("Cannot save data usage", "error", err)
+		}
+	}
+
+	c.log.Info("Usage controller shut down")
+}
@@ -0,0 +1,143 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package usage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/randomvariable/sqm/datastore"
+	"go.uber.org/zap"
+)
+
+const (
+	lineIngress = 50000
+	lineEgress  = 10000
+)
+
+func TestCounterAdvance(t *testing.T) {
+	steps := []struct {
+		name  string
+		index int
+		bytes uint64
+		want  uint64
+	}{
+		{name: "baseline", index: 1, bytes: 1000, want: 0},
+		{name: "sent", index: 1, bytes: 1500, want: 500},
+		{name: "idle", index: 1, bytes: 1500, want: 0},
+		{name: "counter reset", index: 1, bytes: 200, want: 200},
+		{name: "device recreated", index: 2, bytes: 300, want: 300},
+		{name: "sent on new device", index: 2, bytes: 400, want: 100},
+	}
+
+	var c counter
+
+	for _, step := range steps {
+		if got := c.advance(step.index, step.bytes); got != step.want {
+			t.Errorf("%s: advance(%d, %d) = %d, want %d", step.name, step.index, step.bytes, got, step.want)
+		}
+	}
+}
+
+func TestControllerAccount(t *testing.T) {
+	allowance := Allowance{
+		ResetDay: 1,
+		Thresholds: []Threshold{
+			{
+				Bytes:   1000,
+				Ingress: datastore.Adjustment{Multiplier: 0.5, Cap: 0, Profile: ""},
+				Egress:  datastore.Adjustment{Multiplier: 0, Cap: 0, Profile: ""},
+			},
+			{
+				Bytes:   2000,
+				Ingress: datastore.Adjustment{Multiplier: 0, Cap: 1000, Profile: ""},
+				Egress:  datastore.Adjustment{Multiplier: 0.5, Cap: 0, Profile: ""},
+			},
+		},
+	}
+
+	steps := []struct {
+		name         string
+		now          time.Time
+		ingressIndex int
+		ingressBytes uint64
+		egressIndex  int
+		egressBytes  uint64
+		wantChanged  bool
+		wantUsage    datastore.Usage
+		wantIngress  int64
+		wantEgress   int64
+	}{
+		{
+			name: "baseline", now: day(2026, time.October, 19), ingressIndex: 5, ingressBytes: 10000, egressIndex: 4,
+			egressBytes: 20000, wantChanged: false,
+			wantUsage: datastore.Usage{
+				PeriodStart: day(2026, time.October, 1), IngressBytes: 0, EgressBytes: 0, Threshold: 0,
+			},
+			wantIngress: lineIngress, wantEgress: lineEgress,
+		},
+		{
+			name: "first threshold", now: day(2026, time.October, 20), ingressIndex: 5, ingressBytes: 10600,
+			egressIndex: 4, egressBytes: 20500, wantChanged: true,
+			wantUsage: datastore.Usage{
+				PeriodStart: day(2026, time.October, 1), IngressBytes: 600, EgressBytes: 500, Threshold: 1000,
+			},
+			wantIngress: lineIngress / 2, wantEgress: lineEgress,
+		},
+		{
+			name: "counter reset", now: day(2026, time.October, 21), ingressIndex: 5, ingressBytes: 100,
+			egressIndex: 4, egressBytes: 20500, wantChanged: false,
+			wantUsage: datastore.Usage{
+				PeriodStart: day(2026, time.October, 1), IngressBytes: 700, EgressBytes: 500, Threshold: 1000,
+			},
+			wantIngress: lineIngress / 2, wantEgress: lineEgress,
+		},
+		{
+			name: "second threshold on a new device", now: day(2026, time.October, 22), ingressIndex: 6,
+			ingressBytes: 900, egressIndex: 4, egressBytes: 20500, wantChanged: true,
+			wantUsage: datastore.Usage{
+				PeriodStart: day(2026, time.October, 1), IngressBytes: 1600, EgressBytes: 500, Threshold: 2000,
+			},
+			wantIngress: 1000, wantEgress: lineEgress / 2,
+		},
+		{
+			name: "new billing period", now: day(2026, time.November, 1), ingressIndex: 6, ingressBytes: 950,
+			egressIndex: 4, egressBytes: 20600, wantChanged: true,
+			wantUsage: datastore.Usage{
+				PeriodStart: day(2026, time.November, 1), IngressBytes: 50, EgressBytes: 100, Threshold: 0,
+			},
+			wantIngress: lineIngress, wantEgress: lineEgress,
+		},
+	}
+
+	data := datastore.NewDataStore()
+	data.SetIngressRate(lineIngress)
+	data.SetEgressRate(lineEgress)
+
+	ctrl := NewUsageController("", allowance, data, zap.NewNop().Sugar())
+
+	for _, step := range steps {
+		changed := ctrl.account(step.now, step.ingressIndex, step.ingressBytes, step.egressIndex, step.egressBytes)
+		if changed != step.wantChanged {
+			t.Errorf("%s: account() = %t, want %t", step.name, changed, step.wantChanged)
+		}
+
+		if ctrl.usage != step.wantUsage {
+			t.Errorf("%s: usage = %+v, want %+v", step.name, ctrl.usage, step.wantUsage)
+		}
+
+		if rate := data.ShapedIngressRate(); rate != step.wantIngress {
+			t.Errorf("%s: ShapedIngressRate() = %d, want %d", step.name, rate, step.wantIngress)
+		}
+
+		if rate := data.ShapedEgressRate(); rate != step.wantEgress {
+			t.Errorf("%s: ShapedEgressRate() = %d, want %d", step.name, rate, step.wantEgress)
+		}
+
+		_, warned := data.Warnings()[WarningName]
+		if want := step.wantUsage.Threshold != 0; warned != want {
+			t.Errorf("%s: data cap warning set = %t, want %t", step.name, warned, want)
+		}
+	}
+}
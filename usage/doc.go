@@ -0,0 +1,8 @@
+// Copyright 2022 Naadir Jeewa. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+usage accounts for the data an interface uses over a monthly billing period, for links paid
+for by the gigabyte, and steps down the shaping as the usage passes configured thresholds.
+*/
+package usage